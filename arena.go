@@ -0,0 +1,128 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// ----------------------------------------------------------------------------
+
+const arenaChunkSize = 256
+
+// nodeArena allocates the most common ast nodes created by the builder in
+// chunks (see Config.ArenaMode). A chunk is one object for GC, and it's freed
+// with the package (after WriteFile, when the package isn't referenced any
+// more). Like internal.Stack.New, a node is never reused.
+type nodeArena struct {
+	idents []ast.Ident
+	sels   []ast.SelectorExpr
+	calls  []ast.CallExpr
+	stmts  []ast.ExprStmt
+	exprs  []ast.Expr
+}
+
+func (p *nodeArena) newIdent(name string) *ast.Ident {
+	if len(p.idents) == 0 {
+		p.idents = make([]ast.Ident, arenaChunkSize)
+	}
+	ret := &p.idents[0]
+	p.idents = p.idents[1:]
+	ret.Name = name
+	return ret
+}
+
+func (p *nodeArena) newSelectorExpr(x ast.Expr, sel *ast.Ident) *ast.SelectorExpr {
+	if len(p.sels) == 0 {
+		p.sels = make([]ast.SelectorExpr, arenaChunkSize)
+	}
+	ret := &p.sels[0]
+	p.sels = p.sels[1:]
+	ret.X, ret.Sel = x, sel
+	return ret
+}
+
+func (p *nodeArena) newCallExpr(fn ast.Expr, args []ast.Expr, ellipsis token.Pos) *ast.CallExpr {
+	if len(p.calls) == 0 {
+		p.calls = make([]ast.CallExpr, arenaChunkSize)
+	}
+	ret := &p.calls[0]
+	p.calls = p.calls[1:]
+	ret.Fun, ret.Args, ret.Ellipsis = fn, args, ellipsis
+	return ret
+}
+
+func (p *nodeArena) newExprStmt(x ast.Expr) *ast.ExprStmt {
+	if len(p.stmts) == 0 {
+		p.stmts = make([]ast.ExprStmt, arenaChunkSize)
+	}
+	ret := &p.stmts[0]
+	p.stmts = p.stmts[1:]
+	ret.X = x
+	return ret
+}
+
+// newExprs allocates a slice of n exprs, whose capacity is n so that appending
+// to it doesn't overwrite exprs allocated after it.
+func (p *nodeArena) newExprs(n int) []ast.Expr {
+	if n > arenaChunkSize/4 {
+		return make([]ast.Expr, n)
+	}
+	if len(p.exprs) < n {
+		p.exprs = make([]ast.Expr, arenaChunkSize)
+	}
+	ret := p.exprs[:n:n]
+	p.exprs = p.exprs[n:]
+	return ret
+}
+
+// ----------------------------------------------------------------------------
+
+func (p *Package) newIdent(name string) *ast.Ident {
+	if p.arena != nil {
+		return p.arena.newIdent(name)
+	}
+	return &ast.Ident{Name: name}
+}
+
+func (p *Package) newSelectorExpr(x ast.Expr, sel *ast.Ident) *ast.SelectorExpr {
+	if p.arena != nil {
+		return p.arena.newSelectorExpr(x, sel)
+	}
+	return &ast.SelectorExpr{X: x, Sel: sel}
+}
+
+func (p *Package) newCallExpr(fn ast.Expr, args []ast.Expr, ellipsis token.Pos) *ast.CallExpr {
+	if p.arena != nil {
+		return p.arena.newCallExpr(fn, args, ellipsis)
+	}
+	return &ast.CallExpr{Fun: fn, Args: args, Ellipsis: ellipsis}
+}
+
+func (p *Package) newExprStmt(x ast.Expr) *ast.ExprStmt {
+	if p.arena != nil {
+		return p.arena.newExprStmt(x)
+	}
+	return &ast.ExprStmt{X: x}
+}
+
+func (p *Package) newExprs(n int) []ast.Expr {
+	if p.arena != nil {
+		return p.arena.newExprs(n)
+	}
+	return make([]ast.Expr, n)
+}
+
+// ----------------------------------------------------------------------------
@@ -51,6 +51,30 @@ func ident(name string) *ast.Ident {
 	return &ast.Ident{Name: name}
 }
 
+// universeIdents are shared idents of names in the universe scope (such as
+// types int and string, function len), which must not be modified.
+var universeIdents = func() map[string]*ast.Ident {
+	names := types.Universe.Names()
+	ret := make(map[string]*ast.Ident, len(names))
+	for _, name := range names {
+		ret[name] = ident(name)
+	}
+	for _, id := range []*ast.Ident{
+		identTrue, identFalse, identNil, identAppend, identLen, identCap, identNew, identMake, identIota} {
+		ret[id.Name] = id
+	}
+	return ret
+}()
+
+// universeIdent returns the shared ident of `name` if it's in the universe
+// scope, otherwise a new ident.
+func universeIdent(name string) *ast.Ident {
+	if id, ok := universeIdents[name]; ok {
+		return id
+	}
+	return ident(name)
+}
+
 func boolean(v bool) *ast.Ident {
 	if v {
 		return identTrue
@@ -172,7 +196,7 @@ func toBasicType(pkg *Package, t *types.Basic) ast.Expr {
 	if (t.Info() & types.IsUntyped) != 0 {
 		panic("unexpected: untyped type")
 	}
-	return &ast.Ident{Name: t.Name()}
+	return universeIdent(t.Name())
 }
 
 func isUntyped(pkg *Package, typ types.Type) bool {
@@ -254,27 +278,24 @@ func toInterface(pkg *Package, t *types.Interface) ast.Expr {
 // -----------------------------------------------------------------------------
 // expression
 
+// newElem allocates an Elem by the stack of `pkg` (if not nil).
+func newElem(pkg *Package, val ast.Expr, typ types.Type, cval constant.Value, src ast.Node) *internal.Elem {
+	if pkg == nil {
+		return &internal.Elem{Val: val, Type: typ, CVal: cval, Src: src}
+	}
+	return pkg.cb.stk.New(val, typ, cval, src)
+}
+
 func toExpr(pkg *Package, val interface{}, src ast.Node) *internal.Elem {
 	if val == nil {
-		return &internal.Elem{
-			Val:  identNil,
-			Type: types.Typ[types.UntypedNil],
-			Src:  src,
-		}
+		return newElem(pkg, identNil, types.Typ[types.UntypedNil], nil, src)
 	}
 	switch v := val.(type) {
 	case *ast.BasicLit:
-		return &internal.Elem{
-			Val:  v,
-			Type: types.Typ[toBasicKind(v.Kind)],
-			CVal: constant.MakeFromLiteral(v.Value, v.Kind, 0),
-			Src:  src,
-		}
+		return newElem(pkg, v, types.Typ[toBasicKind(v.Kind)], constant.MakeFromLiteral(v.Value, v.Kind, 0), src)
 	case *types.TypeName:
 		if typ := v.Type(); isType(typ) {
-			return &internal.Elem{
-				Val: toType(pkg, typ), Type: NewTypeType(typ), Src: src,
-			}
+			return newElem(pkg, toType(pkg, typ), NewTypeType(typ), nil, src)
 		} else { // builtin
 			return toObject(pkg, v, src)
 		}
@@ -286,63 +307,59 @@ func toExpr(pkg *Package, val interface{}, src ast.Node) *internal.Elem {
 	case types.Object:
 		if v == iotaObj {
 			v := pkg.cb.iotav
-			return &internal.Elem{
-				Val:  identIota,
-				Type: types.Typ[types.UntypedInt],
-				CVal: constant.MakeInt64(int64(v)),
-				Src:  src,
-			}
+			return newElem(pkg, identIota, types.Typ[types.UntypedInt], constant.MakeInt64(int64(v)), src)
 		}
 		return toObject(pkg, v, src)
 	case *Element:
 		return v
 	case int:
-		return &internal.Elem{
-			Val:  &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(v)},
-			Type: types.Typ[types.UntypedInt],
-			CVal: constant.MakeInt64(int64(v)),
-			Src:  src,
+		if (v == 0 || v == 1) && (pkg == nil || pkg.srcs == nil) { // see recordSrc
+			return newElem(pkg, basicLitInts[v], types.Typ[types.UntypedInt], cvalInts[v], src)
 		}
+		return newElem(pkg,
+			&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(v)},
+			types.Typ[types.UntypedInt], constant.MakeInt64(int64(v)), src)
 	case string:
-		return &internal.Elem{
-			Val:  &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(v)},
-			Type: types.Typ[types.UntypedString],
-			CVal: constant.MakeString(v),
-			Src:  src,
+		if v == "" && (pkg == nil || pkg.srcs == nil) {
+			return newElem(pkg, basicLitEmptyStr, types.Typ[types.UntypedString], cvalEmptyStr, src)
 		}
+		return newElem(pkg,
+			&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(v)},
+			types.Typ[types.UntypedString], constant.MakeString(v), src)
 	case bool:
-		return &internal.Elem{
-			Val:  boolean(v),
-			Type: types.Typ[types.UntypedBool],
-			CVal: constant.MakeBool(v),
-			Src:  src,
-		}
+		return newElem(pkg, boolean(v), types.Typ[types.UntypedBool], constant.MakeBool(v), src)
 	case rune:
-		return &internal.Elem{
-			Val:  &ast.BasicLit{Kind: token.CHAR, Value: strconv.QuoteRune(v)},
-			Type: types.Typ[types.UntypedRune],
-			CVal: constant.MakeInt64(int64(v)),
-			Src:  src,
-		}
+		return newElem(pkg,
+			&ast.BasicLit{Kind: token.CHAR, Value: strconv.QuoteRune(v)},
+			types.Typ[types.UntypedRune], constant.MakeInt64(int64(v)), src)
 	case float64:
 		val := strconv.FormatFloat(v, 'g', -1, 64)
 		if !strings.ContainsAny(val, ".e") {
 			val += ".0"
 		}
-		return &internal.Elem{
-			Val:  &ast.BasicLit{Kind: token.FLOAT, Value: val},
-			Type: types.Typ[types.UntypedFloat],
-			CVal: constant.MakeFloat64(v),
-			Src:  src,
-		}
+		return newElem(pkg,
+			&ast.BasicLit{Kind: token.FLOAT, Value: val},
+			types.Typ[types.UntypedFloat], constant.MakeFloat64(v), src)
+	}
+	if pkg == nil {
+		panic("unexpected: unsupport value type")
 	}
-	panic("unexpected: unsupport value type")
+	return reflectVal(pkg, val, src)
 }
 
 var (
 	iotaObj = types.Universe.Lookup("iota")
 )
 
+// shared literals (and their constant values) of common values, which must
+// not be modified.
+var (
+	basicLitInts     = [...]*ast.BasicLit{{Kind: token.INT, Value: "0"}, {Kind: token.INT, Value: "1"}}
+	basicLitEmptyStr = &ast.BasicLit{Kind: token.STRING, Value: `""`}
+	cvalInts         = [...]constant.Value{constant.MakeInt64(0), constant.MakeInt64(1)}
+	cvalEmptyStr     = constant.MakeString("")
+)
+
 func toBasicKind(tok token.Token) types.BasicKind {
 	return tok2BasicKinds[tok]
 }
@@ -362,17 +379,33 @@ func toObject(pkg *Package, v types.Object, src ast.Node) *internal.Elem {
 	if cv, ok := v.(*types.Const); ok {
 		cval = cv.Val()
 	}
-	return &internal.Elem{
-		Val: toObjectExpr(pkg, v), Type: realType(v.Type()), CVal: cval, Src: src,
-	}
+	return newElem(pkg, toObjectExpr(pkg, v), realType(v.Type()), cval, src)
 }
 
 func toObjectExpr(pkg *Package, v types.Object) ast.Expr {
 	atPkg, name := v.Pkg(), v.Name()
-	if atPkg == nil || atPkg == pkg.Types { // at universe or at this package
-		return ident(name)
+	if atPkg == nil { // at universe
+		return universeIdent(name)
+	}
+	if atPkg == pkg.Types { // at this package
+		pkg.cb.recordInitDep(v)
+		x := pkg.newIdent(name)
+		var fn *types.Func
+		switch o := v.(type) {
+		case *types.Func:
+			fn = o
+		case *Func:
+			fn = o.Func
+		}
+		if fn != nil {
+			if pkg.funcRefs == nil {
+				pkg.funcRefs = make(map[*types.Func][]*ast.Ident)
+			}
+			pkg.funcRefs[fn] = append(pkg.funcRefs[fn], x)
+		}
+		return x
 	}
-	if atPkg == pkg.builtin { // at builtin package
+	if atPkg == pkg.builtin || atPkg == pkg.sharedBuiltin { // at builtin package
 		if strings.HasPrefix(name, goxPrefix) {
 			opName := name[len(goxPrefix):]
 			if op, ok := nameToOps[opName]; ok {
@@ -384,16 +417,13 @@ func toObjectExpr(pkg *Package, v types.Object) ast.Expr {
 				}
 			}
 		}
-		return ident(name)
+		return universeIdent(name)
 	}
 	importPkg := pkg.Import(atPkg.Path())
 	importPkg.EnsureImported()
-	x := ident(atPkg.Name())
-	importPkg.nameRefs = append(importPkg.nameRefs, x)
-	return &ast.SelectorExpr{
-		X:   x,
-		Sel: ident(v.Name()),
-	}
+	x := pkg.newIdent(atPkg.Name())
+	pkg.file.refPkg(importPkg, x)
+	return pkg.newSelectorExpr(x, pkg.newIdent(v.Name()))
 }
 
 type operator struct {
@@ -613,57 +643,57 @@ retry:
 		if fex, ok := CheckFuncEx(t); ok {
 			switch ft := fex.(type) {
 			case *TyOverloadFunc:
-				backup := backupArgs(args)
-				for _, o := range ft.Funcs {
-					if ret, err = matchFuncCall(pkg, toObject(pkg, o, fn.Src), args, flags); err == nil {
-						if ret.CVal == nil && isUntyped(pkg, ret.Type) {
-							ret.CVal = builtinCall(fn, args)
-						}
-						return
-					}
-					restoreArgs(args, backup)
+				targs := cloneArgs(args)
+				err = matchOverload(pkg, ft, len(ft.Funcs), args, targs, flags, func(i int) (err error) {
+					ret, err = matchFuncCall(pkg, toObject(pkg, ft.Funcs[i], fn.Src), targs, flags)
+					return
+				})
+				if err == nil && ret.CVal == nil && isUntyped(pkg, ret.Type) {
+					ret.CVal = builtinCall(fn, args)
 				}
 				return
 			case *TyOverloadMethod:
-				backup := backupArgs(args)
-				for _, o := range ft.Methods {
+				targs := cloneArgs(args)
+				err = matchOverload(pkg, ft, len(ft.Methods), args, targs, flags, func(i int) (err error) {
+					o := ft.Methods[i]
 					mfn := *fn
-					mfn.Val.(*ast.SelectorExpr).Sel = ident(o.Name())
+					sel := *mfn.Val.(*ast.SelectorExpr)
+					sel.Sel = ident(o.Name())
+					mfn.Val = &sel
 					if (flags & instrFlagOpFunc) != 0 { // from callOpFunc
 						mfn.Type = o.Type()
 					} else {
 						mfn.Type = methodTypeOf(o.Type())
 					}
-					if ret, err = matchFuncCall(pkg, &mfn, args, flags); err == nil {
+					if ret, err = matchFuncCall(pkg, &mfn, targs, flags); err == nil {
 						fn.Val, fn.Type = mfn.Val, mfn.Type
-						return
 					}
-					restoreArgs(args, backup)
-				}
+					return
+				})
 				return
 			case *TyTemplateRecvMethod:
 				if mth, ok := fn.Val.(*ast.SelectorExpr); ok {
 					if recv := denoteRecv(mth); recv != nil {
-						backup := backupArgs(args)
+						targs := make([]*internal.Elem, len(args)+1)
+						copy(targs[1:], cloneArgs(args))
 						for i := 0; i < 2; i++ {
+							if i > 0 {
+								assignArgs(targs[1:], args)
+							}
 							tfn := toObject(pkg, ft.Func, nil)
-							targs := make([]*internal.Elem, len(args)+1)
 							targ0 := *recv
 							if i == 1 {
 								targ0.Val = &ast.UnaryExpr{Op: token.AND, X: targ0.Val}
 								targ0.Type = types.NewPointer(targ0.Type)
 							}
 							targs[0] = &targ0
-							for j, arg := range args {
-								targs[j+1] = arg
-							}
 							if ret, err = matchFuncCall(pkg, tfn, targs, flags); err == nil {
+								assignArgs(args, targs[1:])
 								return
 							}
 							if isPointer(targ0.Type) {
 								break
 							}
-							restoreArgs(args, backup)
 						}
 					}
 				}
@@ -700,31 +730,36 @@ retry:
 	tyRet := toRetType(sig.Results(), it)
 	if cval != nil { // untyped bigint/bigrat
 		if ret, ok := untypeBig(pkg, cval, tyRet); ok {
-			pkg.file.removedExprs = true
+			switch fn.Val.(type) {
+			case *ast.BinaryExpr, *ast.UnaryExpr: // operands aren't filled yet
+			default:
+				pkg.unrefPkgs(fn.Val)
+			}
+			for _, arg := range args {
+				pkg.unrefPkgs(arg.Val)
+			}
 			return ret, nil
 		}
 	}
 	switch t := fn.Val.(type) {
 	case *ast.BinaryExpr:
-		t.X, t.Y = checkParenExpr(args[0].Val), checkParenExpr(args[1].Val)
-		return &internal.Elem{Val: t, Type: tyRet, CVal: cval}, nil
+		expr := &ast.BinaryExpr{
+			X: checkParenExpr(args[0].Val), OpPos: t.OpPos, Op: t.Op, Y: checkParenExpr(args[1].Val)}
+		return newElem(pkg, expr, tyRet, cval, nil), nil
 	case *ast.UnaryExpr:
-		t.X = args[0].Val
-		return &internal.Elem{Val: t, Type: tyRet, CVal: cval}, nil
+		expr := &ast.UnaryExpr{OpPos: t.OpPos, Op: t.Op, X: args[0].Val}
+		return newElem(pkg, expr, tyRet, cval, nil), nil
 	}
 	var valArgs []ast.Expr
 	var recv = getParam1st(sig)
 	if n := len(args); n > recv { // for method, args[0] is already in fn.Val
-		valArgs = make([]ast.Expr, n-recv)
+		valArgs = pkg.newExprs(n - recv)
 		for i := recv; i < n; i++ {
 			valArgs[i-recv] = args[i].Val
 		}
 	}
-	return &internal.Elem{
-		Type: tyRet, CVal: cval,
-		Val: &ast.CallExpr{
-			Fun: fn.Val, Args: valArgs, Ellipsis: token.Pos(flags & InstrFlagEllipsis)},
-	}, nil
+	call := pkg.newCallExpr(fn.Val, valArgs, token.Pos(flags&InstrFlagEllipsis))
+	return newElem(pkg, call, tyRet, cval, nil), nil
 }
 
 func matchTypeCast(pkg *Package, typ types.Type, fn *internal.Elem, args []*internal.Elem, flags InstrFlags) (ret *internal.Elem, err error) {
@@ -881,22 +916,104 @@ func checkParenExpr(x ast.Expr) ast.Expr {
 	return x
 }
 
-type backupElem struct {
-	typ types.Type
-	val ast.Expr
+// maxOverloadArgs is the max number of arguments of an overloaded call whose
+// matched candidate is memoized.
+const maxOverloadArgs = 4
+
+// overloadKey is key of a memoized candidate of an overload: the overload and
+// types of arguments of a call.
+type overloadKey struct {
+	set   TyFuncEx
+	flags InstrFlags
+	n     int
+	args  [maxOverloadArgs]types.Type
+}
+
+// matchOverload tries to match `n` candidates of the overload `set` in order
+// by `match`, which matches a candidate against `targs` (copies of `args`,
+// see cloneArgs). It stops at the first matched candidate and adopts `targs`.
+//
+// A frontend often emits the same shape of an overloaded call many times, so
+// the matched candidate is memoized by types of the arguments and tried
+// first. Calls with constant arguments aren't memoized, because matching of
+// an untyped constant depends on its value, too. Neither are calls with
+// arguments of unbound types: an earlier candidate rejecting them may match
+// once they are bound, so a memoized candidate is only valid while the types
+// of arguments stay the same.
+func matchOverload(
+	pkg *Package, set TyFuncEx, n int, args, targs []*internal.Elem, flags InstrFlags,
+	match func(i int) error) (err error) {
+	key, memo := overloadKeyOf(set, args, flags)
+	if memo {
+		if i, ok := pkg.overloads[key]; ok {
+			if err = match(i); err == nil {
+				assignArgs(args, targs)
+				return
+			}
+			assignArgs(targs, args)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			assignArgs(targs, args)
+		}
+		if err = match(i); err == nil {
+			assignArgs(args, targs)
+			if memo {
+				if pkg.overloads == nil {
+					pkg.overloads = make(map[overloadKey]int)
+				}
+				pkg.overloads[key] = i
+			}
+			return
+		}
+	}
+	return
 }
 
-func backupArgs(args []*internal.Elem) []backupElem {
-	backup := make([]backupElem, len(args))
+func overloadKeyOf(set TyFuncEx, args []*internal.Elem, flags InstrFlags) (key overloadKey, ok bool) {
+	if len(args) > maxOverloadArgs {
+		return
+	}
 	for i, arg := range args {
-		backup[i].typ, backup[i].val = arg.Type, arg.Val
+		if arg.CVal != nil || arg.Type == nil || isUnboundArg(arg.Type) {
+			return
+		}
+		key.args[i] = arg.Type
 	}
-	return backup
+	key.set, key.flags, key.n = set, flags, len(args)
+	return key, true
 }
 
-func restoreArgs(args []*internal.Elem, backup []backupElem) {
+// isUnboundArg checks if `t` is a type of an argument which isn't bound yet.
+func isUnboundArg(t types.Type) bool {
+	switch t := t.(type) {
+	case *unboundType:
+		return t.tBound == nil
+	case *unboundMapElemType:
+		return true
+	}
+	return isUnboundParam(t)
+}
+
+// cloneArgs returns shallow copies of `args`, so that a candidate of an
+// overload can be matched against them without touching `args` (matchType
+// converts untyped arguments in place). The copies are reused by candidates
+// in turn, and adopted by assignArgs(args, copies) when one matches.
+func cloneArgs(args []*internal.Elem) []*internal.Elem {
+	elems := make([]internal.Elem, len(args))
+	ret := make([]*internal.Elem, len(args))
 	for i, arg := range args {
-		arg.Type, arg.Val = backup[i].typ, backup[i].val
+		elems[i] = *arg
+		ret[i] = &elems[i]
+	}
+	return ret
+}
+
+// assignArgs copies elements of `src` to `dst`.
+func assignArgs(dst, src []*internal.Elem) {
+	for i, arg := range dst {
+		*arg = *src[i]
 	}
 }
 
@@ -963,9 +1080,11 @@ func matchFuncType(
 	n := len(args)
 	if len(args) == 1 && checkTuple(&t, args[0].Type) {
 		n = t.Len()
+		elems := make([]internal.Elem, n)
 		args = make([]*internal.Elem, n)
 		for i := 0; i < n; i++ {
-			args[i] = &internal.Elem{Type: t.At(i).Type()}
+			elems[i].Type = t.At(i).Type()
+			args[i] = &elems[i]
 		}
 	} else if (flags&instrFlagApproxType) != 0 && n > 0 {
 		if typ, ok := args[0].Type.(*types.Named); ok {
@@ -975,14 +1094,9 @@ func matchFuncType(
 			}
 		}
 	}
-	var at interface{}
+	var at interface{} = fn // see matchAt
 	if fn == nil {
 		at = "closure argument" // fn = nil means it is a closure
-	} else {
-		at = func() string {
-			src, _ := pkg.cb.loadExpr(fn.Src)
-			return "argument to " + src
-		}
 	}
 	if sig.Variadic() {
 		if (flags & InstrFlagEllipsis) == 0 {
@@ -1110,7 +1224,9 @@ func checkAssignType(pkg *Package, varRef types.Type, val *internal.Elem) {
 			panic(err)
 		}
 	} else if varRef == nil { // underscore
-		// do nothing
+		if val.Type == types.Typ[types.UntypedNil] {
+			pkg.cb.panicCodeError(getSrcPos(val.Src), "use of untyped nil in assignment")
+		}
 		if t, ok := val.Type.(*inferFuncType); ok {
 			t.Instance()
 		}
@@ -1145,6 +1261,18 @@ type MatchError struct {
 	fstmt bool
 }
 
+// matchAt returns At of a MatchError. Arguments of a call are matched with the
+// function as `at`, so that no closure is allocated for calls that match.
+func matchAt(pkg *Package, at interface{}) interface{} {
+	if fn, ok := at.(*internal.Elem); ok {
+		return func() string {
+			src, _ := pkg.cb.loadExpr(fn.Src)
+			return "argument to " + src
+		}
+	}
+	return at
+}
+
 func strval(at interface{}) string {
 	switch v := at.(type) {
 	case string:
@@ -1269,7 +1397,7 @@ func matchType(pkg *Package, arg *internal.Elem, param types.Type, at interface{
 		return nil
 	}
 	return &MatchError{
-		Src: arg.Src, Arg: arg.Type, Param: param, At: at, fstmt: arg.Val == nil,
+		Src: arg.Src, Arg: arg.Type, Param: param, At: matchAt(pkg, at), fstmt: arg.Val == nil,
 		Fset: pkg.cb.fset, intr: pkg.cb.interp,
 	}
 }
@@ -1280,17 +1408,58 @@ func boundElementType(pkg *Package, elts []*internal.Elem, base, max, step int)
 	var tBound types.Type
 	for i := base; i < max; i += step {
 		e := elts[i]
-		if tBound == e.Type {
-			// nothing to do
-		} else if tBound == nil || AssignableTo(pkg, tBound, e.Type) {
+		if tBound == nil {
 			tBound = e.Type
-		} else if !AssignableTo(pkg, e.Type, tBound) {
+		} else if tBound = commonType(pkg, tBound, e.Type); tBound == nil {
 			return TyEmptyInterface
 		}
 	}
+	if tBound == types.Typ[types.UntypedNil] { // all elements are nil
+		return TyEmptyInterface
+	}
 	return tBound
 }
 
+// commonType returns the type that values of types `a` and `b` are both
+// converted to, or nil if there isn't one. Untyped numeric values are
+// converted to the kind that appears later in the list: integer, rune,
+// floating-point, complex (like `'a' + 1` is an untyped rune).
+func commonType(pkg *Package, a, b types.Type) types.Type {
+	if types.Identical(a, b) {
+		return a
+	}
+	if ba, ok := a.(*types.Basic); ok && isUntypedNumeric(ba) {
+		if bb, ok := b.(*types.Basic); ok && isUntypedNumeric(bb) {
+			if ba.Kind() < bb.Kind() { // UntypedInt < UntypedRune < UntypedFloat < UntypedComplex
+				return b
+			}
+			return a
+		}
+	}
+	if AssignableTo(pkg, a, b) {
+		return b
+	}
+	if AssignableTo(pkg, b, a) {
+		return a
+	}
+	return nil
+}
+
+func isUntypedNumeric(t *types.Basic) bool {
+	return t.Info()&types.IsUntyped != 0 && t.Info()&types.IsNumeric != 0
+}
+
+// isUntypedNumericOf checks if `a` and `b` are untyped numeric types and `a`
+// appears later than `b` in the list: integer, rune, floating-point, complex.
+func isUntypedNumericOf(a, b types.Type) bool {
+	if ta, ok := a.(*types.Basic); ok && isUntypedNumeric(ta) {
+		if tb, ok := b.(*types.Basic); ok && isUntypedNumeric(tb) {
+			return ta.Kind() > tb.Kind()
+		}
+	}
+	return false
+}
+
 func constantToBigInt(v constant.Value) (*big.Int, bool) {
 	if v.Kind() == constant.Int {
 		return new(big.Int).SetString(v.String(), 10)
@@ -27,9 +27,41 @@ import (
 	"golang.org/x/tools/go/types/typeutil"
 )
 
+// builtinKey is the configuration a builtin package created by
+// newBuiltinDefault depends on (prefix of operators is always goxPrefix).
+type builtinKey struct {
+	bigInt, bigRat *types.Named
+}
+
+// newBuiltinDefault returns the builtin package for the configuration of
+// `conf`. Objects of the package (operators and builtin functions) are
+// created once by the Context and shared by packages of the Context, but
+// each package gets its own scope of them, so that objects inserted into the
+// builtin package of a package aren't visible to others. Only builtin methods
+// of types (see initBuiltinTIs) depend on `pkg`.
 func newBuiltinDefault(pkg *Package, conf *Config) *types.Package {
+	key := builtinKey{conf.UntypedBigInt, conf.UntypedBigRat}
+	ctx := pkg.ctx
+	ctx.mu.Lock()
+	shared, ok := ctx.builtins[key]
+	if !ok {
+		shared = types.NewPackage("", "")
+		initBuiltinOps(shared, conf)
+		initBuiltinAssignOps(shared)
+		initBuiltinFuncs(shared)
+		if ctx.builtins == nil {
+			ctx.builtins = make(map[builtinKey]*types.Package)
+		}
+		ctx.builtins[key] = shared
+	}
+	ctx.mu.Unlock()
 	builtin := types.NewPackage("", "")
-	InitBuiltin(pkg, builtin, conf)
+	scope, from := builtin.Scope(), shared.Scope()
+	for _, name := range from.Names() {
+		scope.Insert(from.Lookup(name))
+	}
+	pkg.sharedBuiltin = shared
+	initBuiltinTIs(pkg)
 	return builtin
 }
 
@@ -631,12 +663,15 @@ retry:
 			ret = &Element{Val: &ast.UnaryExpr{Op: token.ARROW, X: args[0].Val}, Type: typ}
 			return
 		}
-		panic("TODO: <-ch is a send only chan")
+		s, pos := pkg.cb.loadExpr(args[0].Src)
+		pkg.cb.panicCodeErrorf(pos, "invalid operation: cannot receive from send-only channel %s (type %v)", s, args[0].Type)
 	case *types.Named:
 		t0 = pkg.cb.getUnderlying(t)
 		goto retry
 	}
-	panic("TODO: <-ch not a chan type")
+	s, pos := pkg.cb.loadExpr(args[0].Src)
+	pkg.cb.panicCodeErrorf(pos, "invalid operation: cannot receive from non-channel %s (type %v)", s, args[0].Type)
+	return
 }
 
 type addrInstr struct {
@@ -1436,6 +1471,18 @@ func initBuiltinTIs(pkg *Package) {
 }
 
 func (p *CodeBuilder) getBuiltinTI(typ types.Type) *builtinTI {
+	if bti, ok := p.btiCache[typ]; ok {
+		return bti
+	}
+	bti := p.lookupBuiltinTI(typ)
+	if p.btiCache == nil {
+		p.btiCache = make(map[types.Type]*builtinTI)
+	}
+	p.btiCache[typ] = bti
+	return bti
+}
+
+func (p *CodeBuilder) lookupBuiltinTI(typ types.Type) *builtinTI {
 	switch t := typ.(type) {
 	case *types.Basic:
 		typ = types.Default(typ)
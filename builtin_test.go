@@ -15,6 +15,7 @@ package gox
 
 import (
 	"bytes"
+	"errors"
 	"go/ast"
 	"go/constant"
 	"go/token"
@@ -259,6 +260,77 @@ func TestComparableTo2(t *testing.T) {
 	if !ComparableTo(pkg, av, at) {
 		t.Fatalf("Failed: ComparableTo %v => %v returns %v\n", av, at, false)
 	}
+	reasons := []struct {
+		v, t types.Type
+		msg  string
+	}{
+		{tySlice, tySlice, "slice can only be compared to nil"},
+		{f1, bar2, "mismatched types foo.f1 and foo.bar2"},
+		{types.Typ[types.Int], bar2, "int does not implement foo.bar2 (missing method Bar)"},
+		{types.Typ[types.String], types.Typ[types.Int], "mismatched types string and int"},
+	}
+	for _, a := range reasons {
+		err := CheckComparable(pkg, &Element{Type: a.v}, &Element{Type: a.t})
+		if err == nil || err.Error() != a.msg {
+			t.Fatalf("Failed: CheckComparable %v => %v returns %v\n", a.v, a.t, err)
+		}
+	}
+}
+
+func TestCheckImplements(t *testing.T) {
+	pkg := NewPackage("foo", "foo", gblConf)
+	sigGet := types.NewSignatureType(nil, nil, nil, nil, types.NewTuple(types.NewVar(token.NoPos, nil, "", types.Typ[types.Int])), false)
+	getter := pkg.NewType("getter").InitType(pkg, types.NewInterfaceType([]*types.Func{
+		types.NewFunc(token.NoPos, pkg.Types, "Get", sigGet)}, nil).Complete())
+	newType := func(name string, ptrRecv bool, sig *types.Signature) *types.Named {
+		typ := pkg.NewType(name).InitType(pkg, types.NewStruct(nil, nil))
+		if sig != nil {
+			var recvType types.Type = typ
+			if ptrRecv {
+				recvType = types.NewPointer(typ)
+			}
+			recv := types.NewVar(token.NoPos, pkg.Types, "p", recvType)
+			sig = types.NewSignatureType(recv, nil, nil, sig.Params(), sig.Results(), false)
+			typ.AddMethod(types.NewFunc(token.NoPos, pkg.Types, "Get", sig))
+		}
+		return typ
+	}
+	a := newType("a", false, sigGet)
+	b := newType("b", true, sigGet)
+	c := newType("c", false, types.NewSignatureType(nil, nil, nil, nil, nil, false))
+	d := newType("d", false, nil)
+	cases := []struct {
+		v, t types.Type
+		kind MismatchKind
+		msg  string
+	}{
+		{a, getter, -1, ""},
+		{types.NewPointer(b), getter, -1, ""},
+		{b, getter, MismatchPointerRecv, "foo.b does not implement foo.getter (method Get has pointer receiver)"},
+		{c, getter, MismatchWrongMethod,
+			"foo.c does not implement foo.getter (wrong type for method Get: have func(), want func() int)"},
+		{d, getter, MismatchMissingMethod, "foo.d does not implement foo.getter (missing method Get)"},
+		{a, d, MismatchType, "cannot use type foo.a as type foo.d"},
+	}
+	for _, c := range cases {
+		ret := CheckImplements(pkg, c.v, c.t)
+		if c.kind < 0 {
+			if ret != nil {
+				t.Fatal("CheckImplements:", ret)
+			}
+		} else if ret == nil || ret.Kind != c.kind || ret.Error() != c.msg {
+			t.Fatal("CheckImplements:", c.v, c.t, ret)
+		}
+	}
+	if ret := CheckAssignable(pkg, c, getter, nil); ret == nil || ret.Kind != MismatchWrongMethod || ret.Have == nil {
+		t.Fatal("CheckAssignable:", ret)
+	}
+	if ret := CheckAssignable(pkg, types.Typ[types.UntypedInt], getter, nil); ret == nil || ret.Kind != MismatchType {
+		t.Fatal("CheckAssignable:", ret)
+	}
+	if ret := CheckAssignable(pkg, a, getter, nil); ret != nil {
+		t.Fatal("CheckAssignable:", ret)
+	}
 }
 
 func TestAssignableTo(t *testing.T) {
@@ -354,6 +426,24 @@ func TestInternalStack(t *testing.T) {
 	}
 }
 
+func BenchmarkStackNew(b *testing.B) {
+	var stk internal.Stack
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		stk.Push(stk.New(identNil, types.Typ[types.UntypedNil], nil, nil))
+		stk.Pop()
+	}
+}
+
+func BenchmarkStackNewHeap(b *testing.B) {
+	var stk internal.Stack
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		stk.Push(&internal.Elem{Val: identNil, Type: types.Typ[types.UntypedNil]})
+		stk.Pop()
+	}
+}
+
 func TestCheckInterface(t *testing.T) {
 	var pkg = new(Package)
 	var cb = &pkg.cb
@@ -621,6 +711,38 @@ func TestVarDeclEnd(t *testing.T) {
 	decl.End(nil, nil)
 }
 
+func TestSortVarDeclsCopy(t *testing.T) {
+	pkg := NewPackage("", "main", nil)
+	a := pkg.NewVar(token.NoPos, types.Typ[types.Int], "a")
+	pkg.NewVar(token.NoPos, types.Typ[types.Int], "b")
+	a.InitStart(pkg).VarVal("b").EndInit(1)
+	decls := append([]ast.Decl(nil), pkg.file.decls...)
+	f := pkg.ASTFile()
+	if len(f.Decls) != 2 || f.Decls[0] != decls[1] {
+		t.Fatal("TestSortVarDeclsCopy: not sorted")
+	}
+	for i, decl := range pkg.file.decls {
+		if decl != decls[i] {
+			t.Fatal("TestSortVarDeclsCopy: decls of the file are changed")
+		}
+	}
+}
+
+func TestTypeObjectOfMain(t *testing.T) {
+	pkg := NewPackage("", "main", nil)
+	foo := pkg.NewType("foo").InitType(pkg, types.Typ[types.Int])
+	if o := pkg.typeObjectOf("main", "foo"); o == nil || o.Type() != foo {
+		t.Fatal("typeObjectOf:", o)
+	}
+	pkg = NewPackage("example.com/foo", "foo", nil)
+	defer func() {
+		if e := recover(); e == nil {
+			t.Fatal("typeObjectOf: no error?")
+		}
+	}()
+	pkg.typeObjectOf("main", "foo")
+}
+
 func TestCheckParenExpr(t *testing.T) {
 	x := checkParenExpr(&ast.CompositeLit{})
 	if _, ok := x.(*ast.ParenExpr); !ok {
@@ -1229,3 +1351,43 @@ func TestToTag(t *testing.T) {
 }
 
 // ----------------------------------------------------------------------------
+
+func TestOverloadMemoUnbound(t *testing.T) {
+	pkg := NewPackage("", "foo", nil)
+	set := &TyOverloadFunc{}
+	tyX := &unboundType{}
+	args := []*internal.Elem{{Val: ident("x"), Type: tyX}}
+	match := func(i int) error {
+		if i == 0 && tyX.tBound == nil { // the first candidate matches only if x is bound
+			return errors.New("unbound")
+		}
+		return nil
+	}
+	var matched []int
+	for i := 0; i < 2; i++ {
+		err := matchOverload(pkg, set, 2, args, cloneArgs(args), 0, func(i int) error {
+			if err := match(i); err != nil {
+				return err
+			}
+			matched = append(matched, i)
+			return nil
+		})
+		if err != nil {
+			t.Fatal("matchOverload:", err)
+		}
+		tyX.tBound = types.Typ[types.Int]
+	}
+	if len(matched) != 2 || matched[0] != 1 || matched[1] != 0 {
+		t.Fatal("matchOverload:", matched)
+	}
+}
+
+func TestBlocksUnlimited(t *testing.T) {
+	pkg := NewPackage("", "foo", nil)
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		If().Val(true).Then()
+	if cb.blocks != nil {
+		t.Fatal("TestBlocksUnlimited: blocks recorded -", cb.blocks)
+	}
+	cb.End().End()
+}
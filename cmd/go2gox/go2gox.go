@@ -0,0 +1,668 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// go2gox reads a Go file and prints a Go program that rebuilds it by gox
+// CodeBuilder calls. It is useful for learning the gox API and for migrating
+// handwritten code templates into gox-based generators.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: go2gox source.go\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		return
+	}
+	code, err := convert(flag.Arg(0))
+	if err != nil {
+		log.Panicln(err)
+	}
+	os.Stdout.Write(code)
+}
+
+// convert returns a Go program that rebuilds the Go file `filename`.
+func convert(filename string) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	pkg, err := conf.Check("", fset, []*ast.File{f}, info)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &gen{info: info, pkg: pkg}
+	p.file(f)
+	code, err := format.Source([]byte(p.String()))
+	if err != nil {
+		return nil, fmt.Errorf("%v\n%s", err, p.String())
+	}
+	return code, nil
+}
+
+// ----------------------------------------------------------------------------
+
+type gen struct {
+	strings.Builder
+	info *types.Info
+	pkg  *types.Package
+}
+
+func (p *gen) printf(format string, args ...interface{}) {
+	fmt.Fprintf(p, format, args...)
+}
+
+func (p *gen) file(f *ast.File) {
+	p.printf(`package main
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"os"
+
+	"github.com/goplus/gox"
+)
+
+var _ *ast.BasicLit
+
+func lookup(cb *gox.CodeBuilder, name string) types.Object {
+	_, o := cb.Scope().LookupParent(name, token.NoPos)
+	return o
+}
+
+func label(cb *gox.CodeBuilder, name string) *gox.Label {
+	l, _ := cb.LookupLabel(name)
+	return l
+}
+
+func main() {
+	pkg := gox.NewPackage("", %q, nil)
+	cb := pkg.CB()
+`, f.Name.Name)
+	for _, decl := range f.Decls { // declare types first, so they can refer to each other
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.TYPE {
+			for _, spec := range d.Specs {
+				name := spec.(*ast.TypeSpec).Name.Name
+				p.printf("type_%s := pkg.NewType(%q)\n", name, name)
+			}
+		}
+	}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.GenDecl:
+			p.genDecl(d)
+		case *ast.FuncDecl:
+			p.funcDecl(d)
+		}
+	}
+	p.printf("\tpkg.WriteTo(os.Stdout)\n}\n")
+}
+
+func (p *gen) genDecl(d *ast.GenDecl) {
+	switch d.Tok {
+	case token.TYPE:
+		for _, spec := range d.Specs {
+			name := spec.(*ast.TypeSpec).Name
+			named := p.info.Defs[name].(*types.TypeName).Type()
+			p.printf("type_%s.InitType(pkg, %s)\n", name.Name, p.typ(named.Underlying()))
+		}
+	case token.CONST:
+		for _, spec := range d.Specs {
+			for _, name := range spec.(*ast.ValueSpec).Names {
+				o := p.info.Defs[name].(*types.Const)
+				typ := "nil"
+				if t, ok := o.Type().(*types.Basic); !ok || t.Info()&types.IsUntyped == 0 {
+					typ = p.typ(o.Type())
+				}
+				p.printf("cb.NewConstStart(%s, %q).Val(%s).EndInit(1)\n", typ, name.Name, constVal(o.Val()))
+			}
+		}
+	case token.VAR:
+		for _, spec := range d.Specs {
+			p.valueSpec(spec.(*ast.ValueSpec))
+		}
+	}
+}
+
+func constVal(v constant.Value) string {
+	switch v.Kind() {
+	case constant.String:
+		return v.ExactString()
+	case constant.Bool:
+		return v.String()
+	case constant.Float: // eg. 3.14 isn't exact, which is a fraction 157/50
+		if f, _ := constant.Float64Val(v); !math.IsInf(f, 0) {
+			s := strconv.FormatFloat(f, 'g', -1, 64)
+			if !strings.ContainsAny(s, ".e") {
+				s += ".0"
+			}
+			return s
+		}
+	}
+	return v.ExactString()
+}
+
+func (p *gen) valueSpec(vs *ast.ValueSpec) {
+	names := make([]string, len(vs.Names))
+	for i, name := range vs.Names {
+		names[i] = strconv.Quote(name.Name)
+	}
+	typ := "nil"
+	if vs.Type != nil {
+		typ = p.typ(p.info.Types[vs.Type].Type)
+	}
+	if vs.Values == nil {
+		p.printf("cb.NewVar(%s, %s)\n", typ, strings.Join(names, ", "))
+		return
+	}
+	p.printf("cb.NewVarStart(%s, %s)", typ, strings.Join(names, ", "))
+	p.exprs(vs.Values)
+	p.printf(".EndInit(%d)\n", len(vs.Values))
+}
+
+func (p *gen) funcDecl(d *ast.FuncDecl) {
+	sig := p.info.Defs[d.Name].Type().(*types.Signature)
+	recv := "nil"
+	if r := sig.Recv(); r != nil {
+		recv = p.param(r)
+	}
+	p.printf("pkg.NewFunc(%s, %q, %s, %s, %v).BodyStart(pkg)\n",
+		recv, d.Name.Name, p.tuple(sig.Params()), p.tuple(sig.Results()), sig.Variadic())
+	p.stmts(d.Body.List)
+	p.printf("cb.End()\n")
+}
+
+// ----------------------------------------------------------------------------
+
+func (p *gen) param(v *types.Var) string {
+	return fmt.Sprintf("pkg.NewParam(token.NoPos, %q, %s)", v.Name(), p.typ(v.Type()))
+}
+
+func (p *gen) tuple(t *types.Tuple) string {
+	if t.Len() == 0 {
+		return "nil"
+	}
+	params := make([]string, t.Len())
+	for i := range params {
+		params[i] = p.param(t.At(i))
+	}
+	return "types.NewTuple(" + strings.Join(params, ", ") + ")"
+}
+
+var basicNames = map[types.BasicKind]string{
+	types.Bool: "Bool", types.Int: "Int", types.Int8: "Int8", types.Int16: "Int16", types.Int32: "Int32",
+	types.Int64: "Int64", types.Uint: "Uint", types.Uint8: "Uint8", types.Uint16: "Uint16",
+	types.Uint32: "Uint32", types.Uint64: "Uint64", types.Uintptr: "Uintptr", types.Float32: "Float32",
+	types.Float64: "Float64", types.Complex64: "Complex64", types.Complex128: "Complex128",
+	types.String: "String", types.UnsafePointer: "UnsafePointer",
+	types.UntypedBool: "UntypedBool", types.UntypedInt: "UntypedInt", types.UntypedRune: "UntypedRune",
+	types.UntypedFloat: "UntypedFloat", types.UntypedComplex: "UntypedComplex",
+	types.UntypedString: "UntypedString", types.UntypedNil: "UntypedNil",
+}
+
+func (p *gen) typ(typ types.Type) string {
+	switch t := typ.(type) {
+	case *types.Basic:
+		return "types.Typ[types." + basicNames[t.Kind()] + "]"
+	case *types.Named:
+		o := t.Obj()
+		switch o.Pkg() {
+		case nil:
+			return fmt.Sprintf("types.Universe.Lookup(%q).Type()", o.Name())
+		case p.pkg:
+			return fmt.Sprintf("pkg.Ref(%q).Type()", o.Name())
+		}
+		return fmt.Sprintf("pkg.Import(%q).Ref(%q).Type()", o.Pkg().Path(), o.Name())
+	case *types.Pointer:
+		return "types.NewPointer(" + p.typ(t.Elem()) + ")"
+	case *types.Slice:
+		return "types.NewSlice(" + p.typ(t.Elem()) + ")"
+	case *types.Array:
+		return fmt.Sprintf("types.NewArray(%s, %d)", p.typ(t.Elem()), t.Len())
+	case *types.Map:
+		return fmt.Sprintf("types.NewMap(%s, %s)", p.typ(t.Key()), p.typ(t.Elem()))
+	case *types.Chan:
+		dirs := [...]string{"types.SendRecv", "types.SendOnly", "types.RecvOnly"}
+		return fmt.Sprintf("types.NewChan(%s, %s)", dirs[t.Dir()], p.typ(t.Elem()))
+	case *types.Signature:
+		return fmt.Sprintf("types.NewSignatureType(nil, nil, nil, %s, %s, %v)",
+			p.tuple(t.Params()), p.tuple(t.Results()), t.Variadic())
+	case *types.Struct:
+		fields := make([]string, t.NumFields())
+		tags := make([]string, t.NumFields())
+		for i := range fields {
+			fld := t.Field(i)
+			fields[i] = fmt.Sprintf("types.NewField(token.NoPos, pkg.Types, %q, %s, %v)",
+				fld.Name(), p.typ(fld.Type()), fld.Embedded())
+			tags[i] = strconv.Quote(t.Tag(i))
+		}
+		return fmt.Sprintf("types.NewStruct([]*types.Var{%s}, []string{%s})",
+			strings.Join(fields, ", "), strings.Join(tags, ", "))
+	case *types.Interface:
+		if t.Empty() {
+			return "gox.TyEmptyInterface"
+		}
+		methods := make([]string, t.NumExplicitMethods())
+		for i := range methods {
+			m := t.ExplicitMethod(i)
+			methods[i] = fmt.Sprintf("types.NewFunc(token.NoPos, pkg.Types, %q, %s)", m.Name(), p.typ(m.Type()))
+		}
+		embeddeds := make([]string, t.NumEmbeddeds())
+		for i := range embeddeds {
+			embeddeds[i] = p.typ(t.EmbeddedType(i))
+		}
+		return fmt.Sprintf("types.NewInterfaceType([]*types.Func{%s}, []types.Type{%s}).Complete()",
+			strings.Join(methods, ", "), strings.Join(embeddeds, ", "))
+	}
+	return fmt.Sprintf("nil /* TODO: unsupported type %v */", typ)
+}
+
+// ----------------------------------------------------------------------------
+
+var tokens = func() map[token.Token]string {
+	ret := make(map[token.Token]string)
+	for tok := token.ADD; tok <= token.GEQ; tok++ {
+		ret[tok] = "token." + tokenNames[tok-token.ADD]
+	}
+	return ret
+}()
+
+// tokenNames are names of tokens from token.ADD to token.GEQ.
+var tokenNames = [...]string{
+	"ADD", "SUB", "MUL", "QUO", "REM", "AND", "OR", "XOR", "SHL", "SHR", "AND_NOT",
+	"ADD_ASSIGN", "SUB_ASSIGN", "MUL_ASSIGN", "QUO_ASSIGN", "REM_ASSIGN",
+	"AND_ASSIGN", "OR_ASSIGN", "XOR_ASSIGN", "SHL_ASSIGN", "SHR_ASSIGN", "AND_NOT_ASSIGN",
+	"LAND", "LOR", "ARROW", "INC", "DEC", "EQL", "LSS", "GTR", "ASSIGN", "NOT", "NEQ", "LEQ", "GEQ",
+}
+
+func (p *gen) exprs(exprs []ast.Expr) {
+	for _, e := range exprs {
+		p.expr(e, nil)
+	}
+}
+
+func (p *gen) expr(expr ast.Expr, expected types.Type) {
+	if tv, ok := p.info.Types[expr]; ok && tv.IsType() {
+		p.printf(".Typ(%s)", p.typ(tv.Type))
+		return
+	}
+	switch v := expr.(type) {
+	case *ast.Ident:
+		p.printf(".VarVal(%q)", v.Name)
+	case *ast.BasicLit:
+		p.printf(".Val(&ast.BasicLit{Kind: token.%v, Value: %q})", v.Kind, v.Value)
+	case *ast.ParenExpr:
+		p.expr(v.X, nil)
+	case *ast.SelectorExpr:
+		if x, ok := v.X.(*ast.Ident); ok {
+			if pn, ok := p.info.Uses[x].(*types.PkgName); ok {
+				p.printf(".Val(pkg.Import(%q).Ref(%q))", pn.Imported().Path(), v.Sel.Name)
+				return
+			}
+		}
+		p.expr(v.X, nil)
+		p.printf(".MemberVal(%q)", v.Sel.Name)
+	case *ast.StarExpr:
+		p.expr(v.X, nil)
+		p.printf(".Star()")
+	case *ast.UnaryExpr:
+		p.expr(v.X, nil)
+		p.printf(".UnaryOp(%s)", tokens[v.Op])
+	case *ast.BinaryExpr:
+		p.expr(v.X, nil)
+		p.expr(v.Y, nil)
+		p.printf(".BinaryOp(%s)", tokens[v.Op])
+	case *ast.CallExpr:
+		p.expr(v.Fun, nil)
+		p.exprs(v.Args)
+		if v.Ellipsis != token.NoPos {
+			p.printf(".Call(%d, true)", len(v.Args))
+		} else {
+			p.printf(".Call(%d)", len(v.Args))
+		}
+	case *ast.IndexExpr:
+		p.expr(v.X, nil)
+		p.expr(v.Index, nil)
+		p.printf(".Index(1, false)")
+	case *ast.SliceExpr:
+		p.expr(v.X, nil)
+		for _, e := range []ast.Expr{v.Low, v.High} {
+			if e == nil {
+				p.printf(".None()")
+			} else {
+				p.expr(e, nil)
+			}
+		}
+		if v.Slice3 {
+			p.expr(v.Max, nil)
+		}
+		p.printf(".Slice(%v)", v.Slice3)
+	case *ast.TypeAssertExpr:
+		p.expr(v.X, nil)
+		p.printf(".TypeAssert(%s, false)", p.typ(p.info.Types[v.Type].Type))
+	case *ast.CompositeLit:
+		p.compositeLit(v, expected)
+	case *ast.FuncLit:
+		sig := p.info.Types[v].Type.(*types.Signature)
+		p.printf(".NewClosure(%s, %s, %v).BodyStart(pkg)\n", p.tuple(sig.Params()), p.tuple(sig.Results()), sig.Variadic())
+		p.stmts(v.Body.List)
+		p.printf("cb.End()")
+	default:
+		p.printf(" /* TODO: unsupported %T */", expr)
+	}
+}
+
+func (p *gen) compositeLit(v *ast.CompositeLit, expected types.Type) {
+	typ := p.info.Types[v].Type
+	isPtr := false
+	if v.Type == nil && expected != nil {
+		if t, ok := expected.(*types.Pointer); ok {
+			isPtr = true
+			typ = t.Elem()
+		}
+	}
+	n := len(v.Elts)
+	keyVal := n > 0
+	if keyVal {
+		_, keyVal = v.Elts[0].(*ast.KeyValueExpr)
+	}
+	switch t := typ.Underlying().(type) {
+	case *types.Struct:
+		for i, elt := range v.Elts {
+			if kv, ok := elt.(*ast.KeyValueExpr); ok {
+				name := kv.Key.(*ast.Ident).Name
+				for idx := 0; idx < t.NumFields(); idx++ {
+					if t.Field(idx).Name() == name {
+						p.printf(".Val(%d)", idx)
+						p.expr(kv.Value, t.Field(idx).Type())
+					}
+				}
+			} else {
+				p.expr(elt, t.Field(i).Type())
+			}
+		}
+		if keyVal {
+			n <<= 1
+		}
+		p.printf(".StructLit(%s, %d, %v)", p.typ(typ), n, keyVal)
+	case *types.Map:
+		for _, elt := range v.Elts {
+			kv := elt.(*ast.KeyValueExpr)
+			p.expr(kv.Key, t.Key())
+			p.expr(kv.Value, t.Elem())
+		}
+		p.printf(".MapLit(%s, %d)", p.typ(typ), n<<1)
+	case *types.Slice:
+		p.elts(v.Elts, keyVal, t.Elem())
+		if keyVal {
+			p.printf(".SliceLit(%s, %d, true)", p.typ(typ), n<<1)
+		} else {
+			p.printf(".SliceLit(%s, %d)", p.typ(typ), n)
+		}
+	case *types.Array:
+		p.elts(v.Elts, keyVal, t.Elem())
+		if keyVal {
+			p.printf(".ArrayLit(%s, %d, true)", p.typ(typ), n<<1)
+		} else {
+			p.printf(".ArrayLit(%s, %d)", p.typ(typ), n)
+		}
+	}
+	if isPtr {
+		p.printf(".UnaryOp(token.AND)")
+	}
+}
+
+func (p *gen) elts(elts []ast.Expr, keyVal bool, elem types.Type) {
+	for _, elt := range elts {
+		if kv, ok := elt.(*ast.KeyValueExpr); ok && keyVal {
+			p.expr(kv.Key, nil)
+			p.expr(kv.Value, elem)
+		} else {
+			p.expr(elt, elem)
+		}
+	}
+}
+
+func (p *gen) ref(expr ast.Expr) {
+	switch v := expr.(type) {
+	case *ast.Ident:
+		if v.Name == "_" {
+			p.printf(".VarRef(nil)")
+		} else {
+			p.printf(".VarRef(lookup(cb, %q))", v.Name)
+		}
+	case *ast.ParenExpr:
+		p.ref(v.X)
+	case *ast.SelectorExpr:
+		if x, ok := v.X.(*ast.Ident); ok {
+			if pn, ok := p.info.Uses[x].(*types.PkgName); ok {
+				p.printf(".VarRef(pkg.Import(%q).Ref(%q))", pn.Imported().Path(), v.Sel.Name)
+				return
+			}
+		}
+		p.expr(v.X, nil)
+		p.printf(".MemberRef(%q)", v.Sel.Name)
+	case *ast.IndexExpr:
+		p.expr(v.X, nil)
+		p.expr(v.Index, nil)
+		p.printf(".IndexRef(1)")
+	case *ast.StarExpr:
+		p.expr(v.X, nil)
+		p.printf(".ElemRef()")
+	default:
+		p.printf(" /* TODO: unsupported %T */", expr)
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+func (p *gen) stmts(stmts []ast.Stmt) {
+	for _, stmt := range stmts {
+		p.stmt(stmt)
+	}
+}
+
+func (p *gen) stmt(stmt ast.Stmt) {
+	switch v := stmt.(type) {
+	case *ast.ExprStmt:
+		p.printf("cb")
+		p.expr(v.X, nil)
+		p.printf(".EndStmt()\n")
+	case *ast.AssignStmt:
+		p.printf("cb")
+		switch v.Tok {
+		case token.DEFINE:
+			names := make([]string, len(v.Lhs))
+			for i, lhs := range v.Lhs {
+				names[i] = strconv.Quote(lhs.(*ast.Ident).Name)
+			}
+			p.printf(".DefineVarStart(token.NoPos, %s)", strings.Join(names, ", "))
+			p.exprs(v.Rhs)
+			p.printf(".EndInit(%d)\n", len(v.Rhs))
+		case token.ASSIGN:
+			for _, lhs := range v.Lhs {
+				p.ref(lhs)
+			}
+			p.exprs(v.Rhs)
+			p.printf(".Assign(%d, %d)\n", len(v.Lhs), len(v.Rhs))
+		default:
+			p.ref(v.Lhs[0])
+			p.expr(v.Rhs[0], nil)
+			p.printf(".AssignOp(%s)\n", tokens[v.Tok])
+		}
+	case *ast.IncDecStmt:
+		p.printf("cb")
+		p.ref(v.X)
+		p.printf(".IncDec(%s)\n", tokens[v.Tok])
+	case *ast.DeclStmt:
+		if d, ok := v.Decl.(*ast.GenDecl); ok && d.Tok == token.VAR {
+			for _, spec := range d.Specs {
+				p.valueSpec(spec.(*ast.ValueSpec))
+			}
+		} else {
+			p.printf("// TODO: unsupported local declaration\n")
+		}
+	case *ast.ReturnStmt:
+		p.printf("cb")
+		p.exprs(v.Results)
+		p.printf(".Return(%d)\n", len(v.Results))
+	case *ast.BlockStmt:
+		p.printf("cb.Block()\n")
+		p.stmts(v.List)
+		p.printf("cb.End()\n")
+	case *ast.IfStmt:
+		p.printf("cb.If()\n")
+		if v.Init != nil {
+			p.stmt(v.Init)
+		}
+		p.printf("cb")
+		p.expr(v.Cond, nil)
+		p.printf(".Then()\n")
+		p.stmts(v.Body.List)
+		if v.Else != nil {
+			p.printf("cb.Else()\n")
+			if e, ok := v.Else.(*ast.BlockStmt); ok {
+				p.stmts(e.List)
+			} else {
+				p.stmt(v.Else)
+			}
+		}
+		p.printf("cb.End()\n")
+	case *ast.ForStmt:
+		p.printf("cb.For()\n")
+		if v.Init != nil {
+			p.stmt(v.Init)
+		}
+		if v.Cond == nil {
+			p.printf("cb.None()")
+		} else {
+			p.printf("cb")
+			p.expr(v.Cond, nil)
+		}
+		p.printf(".Then()\n")
+		p.stmts(v.Body.List)
+		if v.Post != nil {
+			p.printf("cb.Post()\n")
+			p.stmt(v.Post)
+		}
+		p.printf("cb.End()\n")
+	case *ast.RangeStmt:
+		if v.Tok == token.DEFINE {
+			var names []string
+			for _, e := range []ast.Expr{v.Key, v.Value} {
+				if e != nil {
+					names = append(names, strconv.Quote(e.(*ast.Ident).Name))
+				}
+			}
+			p.printf("cb.ForRange(%s)", strings.Join(names, ", "))
+		} else {
+			p.printf("cb.ForRange()")
+			for _, e := range []ast.Expr{v.Key, v.Value} {
+				if e != nil {
+					p.ref(e)
+				}
+			}
+		}
+		p.expr(v.X, nil)
+		p.printf(".RangeAssignThen(token.NoPos)\n")
+		p.stmts(v.Body.List)
+		p.printf("cb.End()\n")
+	case *ast.SwitchStmt:
+		p.printf("cb.Switch()\n")
+		if v.Init != nil {
+			p.stmt(v.Init)
+		}
+		if v.Tag == nil {
+			p.printf("cb.None()")
+		} else {
+			p.printf("cb")
+			p.expr(v.Tag, nil)
+		}
+		p.printf(".Then()\n")
+		for _, c := range v.Body.List {
+			clause := c.(*ast.CaseClause)
+			p.printf("cb")
+			p.exprs(clause.List)
+			p.printf(".Case(%d)\n", len(clause.List))
+			p.stmts(clause.Body)
+			p.printf("cb.End()\n")
+		}
+		p.printf("cb.End()\n")
+	case *ast.BranchStmt:
+		l := "nil"
+		if v.Label != nil {
+			l = fmt.Sprintf("label(cb, %q)", v.Label.Name)
+		}
+		switch v.Tok {
+		case token.BREAK:
+			p.printf("cb.Break(%s)\n", l)
+		case token.CONTINUE:
+			p.printf("cb.Continue(%s)\n", l)
+		case token.GOTO:
+			p.printf("cb.Goto(%s)\n", l)
+		case token.FALLTHROUGH:
+			p.printf("cb.Fallthrough()\n")
+		}
+	case *ast.LabeledStmt:
+		p.printf("cb.Label(cb.NewLabel(token.NoPos, %q))\n", v.Label.Name)
+		p.stmt(v.Stmt)
+	case *ast.DeferStmt:
+		p.printf("cb")
+		p.expr(v.Call, nil)
+		p.printf(".Defer()\n")
+	case *ast.GoStmt:
+		p.printf("cb")
+		p.expr(v.Call, nil)
+		p.printf(".Go()\n")
+	case *ast.SendStmt:
+		p.printf("cb")
+		p.expr(v.Chan, nil)
+		p.expr(v.Value, nil)
+		p.printf(".Send()\n")
+	case *ast.EmptyStmt:
+	default:
+		p.printf("// TODO: unsupported %T\n", stmt)
+	}
+}
+
+// ----------------------------------------------------------------------------
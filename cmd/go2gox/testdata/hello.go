@@ -0,0 +1,44 @@
+package main
+
+import "fmt"
+
+type Shape interface {
+	Area() float64
+}
+type Rect struct {
+	W float64
+	H float64
+}
+
+const Pi = 3.14
+
+var names = []string{"a", "b"}
+
+func (r *Rect) Area() float64 {
+	return r.W * r.H
+}
+func sum(n int) (ret int) {
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			continue
+		}
+		ret += i
+	}
+	return
+}
+func main() {
+	var s Shape = &Rect{W: 2, H: 3}
+	fmt.Println(s.Area(), Pi, sum(10))
+	for i, name := range names {
+		switch {
+		case i > 0:
+			fmt.Println(name + name)
+		default:
+			fmt.Println(name)
+		}
+	}
+	f := func(x int) int {
+		return x * 2
+	}
+	defer fmt.Println(f(21))
+}
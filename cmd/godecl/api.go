@@ -0,0 +1,141 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"go/token"
+	"go/types"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/gcexportdata"
+)
+
+// -----------------------------------------------------------------------------
+
+// writeExport writes gc export data of the package to file.
+func writeExport(file string, fset *token.FileSet, pkg *types.Package) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err = gcexportdata.Write(w, fset, pkg); err == nil {
+		err = w.Flush()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// -----------------------------------------------------------------------------
+
+// apiLines returns the exported API of the package in the format of
+// $GOROOT/api/go1.*.txt, sorted:
+//
+//	pkg path, const Name Type
+//	pkg path, const Name = Value
+//	pkg path, func Name(Params) Results
+//	pkg path, method (Recv) Name(Params) Results
+//	pkg path, type Name struct
+//	pkg path, type Name struct, Field Type
+//	pkg path, type Name interface { Methods }
+//	pkg path, var Name Type
+func apiLines(label string, pkg *types.Package) []string {
+	var lines []string
+	add := func(s string) {
+		lines = append(lines, "pkg "+label+", "+s)
+	}
+	qf := func(other *types.Package) string {
+		if other == pkg {
+			return ""
+		}
+		return other.Name()
+	}
+	typStr := func(t types.Type) string {
+		return types.TypeString(t, qf)
+	}
+	sigStr := func(sig *types.Signature) string {
+		return strings.TrimPrefix(types.TypeString(sig, qf), "func")
+	}
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		if !isPublic(name) {
+			continue
+		}
+		switch o := scope.Lookup(name).(type) {
+		case *types.Const:
+			add("const " + name + " " + strings.Replace(typStr(o.Type()), "untyped ", "ideal-", 1))
+			add("const " + name + " = " + o.Val().ExactString())
+		case *types.Var:
+			add("var " + name + " " + typStr(o.Type()))
+		case *types.Func:
+			add("func " + name + sigStr(o.Type().(*types.Signature)))
+		case *types.TypeName:
+			if o.IsAlias() {
+				add("type " + name + " = " + typStr(o.Type()))
+				continue
+			}
+			switch t := o.Type().Underlying().(type) {
+			case *types.Struct:
+				add("type " + name + " struct")
+				for i, n := 0, t.NumFields(); i < n; i++ {
+					if fld := t.Field(i); fld.Exported() {
+						if fld.Embedded() {
+							add("type " + name + " struct, embedded " + typStr(fld.Type()))
+						} else {
+							add("type " + name + " struct, " + fld.Name() + " " + typStr(fld.Type()))
+						}
+					}
+				}
+			case *types.Interface:
+				methods := make([]string, 0, t.NumMethods())
+				for i, n := 0, t.NumMethods(); i < n; i++ {
+					if m := t.Method(i); m.Exported() {
+						methods = append(methods, m.Name())
+						add("type " + name + " interface, " + m.Name() + sigStr(m.Type().(*types.Signature)))
+					} else {
+						methods = append(methods, "unexported methods")
+					}
+				}
+				add("type " + name + " interface { " + strings.Join(methods, ", ") + " }")
+			default:
+				add("type " + name + " " + typStr(t))
+			}
+			if _, ok := o.Type().Underlying().(*types.Interface); ok {
+				continue
+			}
+			mset := types.NewMethodSet(types.NewPointer(o.Type()))
+			for i, n := 0, mset.Len(); i < n; i++ {
+				sel := mset.At(i)
+				if m := sel.Obj(); m.Exported() && len(sel.Index()) == 1 { // skip promoted methods
+					sig := m.Type().(*types.Signature)
+					add("method (" + typStr(sig.Recv().Type()) + ") " + m.Name() + sigStr(sig))
+				}
+			}
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// writeAPI writes API lines to file.
+func writeAPI(file string, lines []string) error {
+	return os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0666)
+}
+
+// -----------------------------------------------------------------------------
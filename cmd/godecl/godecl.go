@@ -21,19 +21,34 @@ import (
 	"go/parser"
 	"go/token"
 	"go/types"
+	"io"
 	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"unicode"
 )
 
 var (
 	internal = flag.Bool("i", false, "print internal declarations")
+	methods  = flag.Bool("m", false, "print method sets of named types")
+	impls    = flag.Bool("impl", false, "print local interfaces implemented by named types")
+	filename = flag.String("filename", "<stdin>", "file name of the source read from stdin (used in positions)")
+	pkgPath  = flag.String("pkgpath", "", "import path of the package (used in export data and API summary)")
+	export   = flag.String("export", "", "write gc export data of the package to `file`")
+	api      = flag.String("api", "", "write API summary (like $GOROOT/api/go1.txt) of packages to `file`")
+	stub     = flag.String("stub", "", "write gox bindings of the package to `file`")
+	stubPkg  = flag.String("stubpkg", "", "package name of gox bindings (default: name of the package + \"gox\")")
+	exported = flag.Bool("exported-only", false, "print only exported declarations (overrides -i)")
+	nameExp  = flag.String("name", "", "print only declarations whose names match `regexp`")
+	kinds    = flag.String("kind", "", "print only declarations of these `kinds` (comma-separated: func,type,var,const)")
 )
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: godecl [-i] [source.go ...]\n")
+	fmt.Fprintf(os.Stderr, "Usage: godecl [-i] [-m] [-impl] [-filename name] [-pkgpath path] [-export file] [-api file] [-stub file] [-stubpkg name] [-exported-only] [-name regexp] [-kind kinds] [dir ... | dir/... | source.go ... | -]\n")
 	flag.PrintDefaults()
 }
 
@@ -59,55 +74,339 @@ func main() {
 	}
 	initGoEnv()
 
-	var files []*ast.File
-
-	// Parse the input string, []byte, or io.Reader,
-	// recording position information in fset.
-	// ParseFile returns an *ast.File, a syntax tree.
-	fset := token.NewFileSet()
-	if infile := flag.Arg(0); isDir(infile) {
-		pkgs, first := parser.ParseDir(fset, infile, func(fi fs.FileInfo) bool {
-			return !strings.HasSuffix(fi.Name(), "_test.go")
-		}, 0)
-		check(first)
-		for name, pkg := range pkgs {
-			if !strings.HasSuffix(name, "_test") {
-				for _, f := range pkg.Files {
-					files = append(files, f)
-				}
-				break
-			}
-		}
-	} else {
-		for i, n := 0, flag.NArg(); i < n; i++ {
-			f, err := parser.ParseFile(fset, flag.Arg(i), nil, 0)
-			check(err)
-			files = append(files, f)
-		}
+	srcs, err := expandArgs(flag.Args())
+	check(err)
+	if err = initFilter(); err != nil {
+		log.Fatalln(err)
+	}
+	if *export != "" && len(srcs) != 1 {
+		log.Fatalln("-export: only one package is allowed")
+	}
+	if *stub != "" && len(srcs) != 1 {
+		log.Fatalln("-stub: only one package is allowed")
+	}
+	if *pkgPath != "" && len(srcs) != 1 {
+		log.Fatalln("-pkgpath: only one package is allowed")
 	}
 
 	// A Config controls various options of the type checker.
 	// The defaults work fine except for one setting:
 	// we must specify how to deal with imports.
+	fset := token.NewFileSet()
 	imp := importer.ForCompiler(fset, "source", nil)
-	conf := types.Config{
+	conf := &types.Config{
 		Importer:                 imp,
 		IgnoreFuncBodies:         true,
 		DisableUnusedImportCheck: true,
 	}
 
-	// Type-check the package containing only file f.
-	// Check returns a *types.Package.
-	pkg, err := conf.Check("", fset, files, nil)
-	check(err)
+	failed := false
+	var apis []string
+	for i, src := range srcs {
+		if len(srcs) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Println("#", src.name)
+		}
+		pkg, err := src.load(fset, conf)
+		if err != nil { // continue with other packages
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		printDecls(os.Stdout, pkg)
+		if *export != "" {
+			if err = writeExport(*export, fset, pkg); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				failed = true
+			}
+		}
+		if *stub != "" {
+			name := *stubPkg
+			if name == "" {
+				name = pkg.Name() + "gox"
+			}
+			if err = writeStub(*stub, name, pkg); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				failed = true
+			}
+		}
+		if *api != "" {
+			label := pkg.Path()
+			if label == "" {
+				label = src.name
+			}
+			apis = append(apis, apiLines(label, pkg)...)
+		}
+	}
+	if *api != "" {
+		if err = writeAPI(*api, apis); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
 
+func printDecls(w io.Writer, pkg *types.Package) {
 	scope := pkg.Scope()
 	names := scope.Names()
+	var ifaces []*types.TypeName
+	if *impls {
+		for _, name := range names {
+			if o, ok := scope.Lookup(name).(*types.TypeName); ok && (*internal || isPublic(name)) {
+				if t, ok := o.Type().Underlying().(*types.Interface); ok && t.NumMethods() > 0 {
+					ifaces = append(ifaces, o)
+				}
+			}
+		}
+	}
+	qf := types.RelativeTo(pkg)
 	for _, name := range names {
-		if *internal || isPublic(name) {
-			fmt.Println(scope.Lookup(name))
+		if o := scope.Lookup(name); filter(o) {
+			fmt.Fprintln(w, types.ObjectString(o, qf))
+			if t, ok := o.(*types.TypeName); ok && !t.IsAlias() {
+				if *methods {
+					printMethodSet(w, t.Type(), qf)
+				}
+				printImpls(w, t, ifaces, qf)
+			}
+		}
+	}
+}
+
+var (
+	nameRE       *regexp.Regexp
+	kindsToPrint map[string]bool
+)
+
+func initFilter() (err error) {
+	if *nameExp != "" {
+		if nameRE, err = regexp.Compile(*nameExp); err != nil {
+			return
+		}
+	}
+	if *kinds != "" {
+		kindsToPrint = make(map[string]bool)
+		for _, kind := range strings.Split(*kinds, ",") {
+			switch kind = strings.TrimSpace(kind); kind {
+			case "func", "type", "var", "const":
+				kindsToPrint[kind] = true
+			default:
+				return fmt.Errorf("-kind: unknown kind %q", kind)
+			}
 		}
 	}
+	return
+}
+
+// filter reports whether the declaration is printed, according to -i,
+// -exported-only, -name and -kind.
+func filter(o types.Object) bool {
+	name := o.Name()
+	if (*exported || !*internal) && !isPublic(name) {
+		return false
+	}
+	if nameRE != nil && !nameRE.MatchString(name) {
+		return false
+	}
+	if kindsToPrint != nil {
+		var kind string
+		switch o.(type) {
+		case *types.Func:
+			kind = "func"
+		case *types.TypeName:
+			kind = "type"
+		case *types.Var:
+			kind = "var"
+		case *types.Const:
+			kind = "const"
+		}
+		return kindsToPrint[kind]
+	}
+	return true
+}
+
+// printMethodSet prints the method set of T, and methods of the method set of
+// *T which are not in the method set of T.
+func printMethodSet(w io.Writer, t types.Type, qf types.Qualifier) {
+	mset := types.NewMethodSet(t)
+	printSels := func(mset *types.MethodSet, skip *types.MethodSet) {
+		for i, n := 0, mset.Len(); i < n; i++ {
+			sel := mset.At(i)
+			m := sel.Obj()
+			if !*internal && !m.Exported() {
+				continue
+			}
+			if skip != nil && skip.Lookup(m.Pkg(), m.Name()) != nil {
+				continue
+			}
+			fmt.Fprintln(w, "\t"+types.SelectionString(sel, qf))
+		}
+	}
+	printSels(mset, nil)
+	if _, ok := t.Underlying().(*types.Interface); !ok {
+		printSels(types.NewMethodSet(types.NewPointer(t)), mset)
+	}
+}
+
+// printImpls prints interfaces of `ifaces` implemented by T or *T.
+func printImpls(w io.Writer, t *types.TypeName, ifaces []*types.TypeName, qf types.Qualifier) {
+	typ := t.Type()
+	if _, ok := typ.Underlying().(*types.Interface); ok {
+		return
+	}
+	for _, iface := range ifaces {
+		it := iface.Type().Underlying().(*types.Interface)
+		if types.Implements(typ, it) {
+			fmt.Fprintln(w, "\timplements", types.TypeString(iface.Type(), qf))
+		} else if ptr := types.NewPointer(typ); types.Implements(ptr, it) {
+			fmt.Fprintln(w, "\timplements", types.TypeString(iface.Type(), qf), "(by "+types.TypeString(ptr, qf)+")")
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// pkgSource represents source of a package: a directory, or a list of files.
+type pkgSource struct {
+	name  string
+	dir   string
+	files []string
+}
+
+// expandArgs groups command line arguments by package. An argument is a
+// directory, a pattern dir/... which matches dir and all its subdirectories
+// containing Go files, a Go file, or "-" which means a Go file read from stdin.
+// Consecutive files are of one package.
+func expandArgs(args []string) (srcs []pkgSource, err error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "..." || strings.HasSuffix(arg, "/...") {
+			root := strings.TrimSuffix(strings.TrimSuffix(arg, "..."), "/")
+			if root == "" {
+				root = "."
+			}
+			dirs, err := walkPkgDirs(root)
+			if err != nil {
+				return nil, err
+			}
+			for _, dir := range dirs {
+				srcs = append(srcs, pkgSource{name: dir, dir: dir})
+			}
+		} else if arg == "-" {
+			srcs = append(srcs, pkgSource{name: *filename, files: args[i : i+1]})
+		} else if isDir(arg) {
+			srcs = append(srcs, pkgSource{name: arg, dir: arg})
+		} else {
+			j := i + 1
+			for j < len(args) && strings.HasSuffix(args[j], ".go") {
+				j++
+			}
+			files := args[i:j]
+			srcs = append(srcs, pkgSource{name: strings.Join(files, " "), files: files})
+			i = j - 1
+		}
+	}
+	return
+}
+
+// walkPkgDirs returns root and all its subdirectories containing Go files,
+// skipping testdata and directories whose names begin with "." or "_" (like
+// the go command does).
+func walkPkgDirs(root string) (dirs []string, err error) {
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root {
+			if name := d.Name(); name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+				return filepath.SkipDir
+			}
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if name := e.Name(); !e.IsDir() && isGoFile(name) {
+				dirs = append(dirs, path)
+				break
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func isGoFile(name string) bool {
+	return strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go")
+}
+
+// load parses and type-checks the package.
+func (p *pkgSource) load(fset *token.FileSet, conf *types.Config) (*types.Package, error) {
+	var files []*ast.File
+
+	// Parse the input string, []byte, or io.Reader,
+	// recording position information in fset.
+	// ParseFile returns an *ast.File, a syntax tree.
+	if p.dir != "" {
+		pkgs, err := parser.ParseDir(fset, p.dir, func(fi fs.FileInfo) bool {
+			return isGoFile(fi.Name())
+		}, 0)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for name := range pkgs {
+			if !strings.HasSuffix(name, "_test") {
+				names = append(names, name)
+			}
+		}
+		switch len(names) {
+		case 0:
+			return nil, fmt.Errorf("%s: no Go package found", p.dir)
+		case 1:
+		default:
+			sort.Strings(names)
+			return nil, fmt.Errorf("%s: multiple packages %s", p.dir, strings.Join(names, ", "))
+		}
+		pkg := pkgs[names[0]]
+		fnames := make([]string, 0, len(pkg.Files))
+		for fname := range pkg.Files {
+			fnames = append(fnames, fname)
+		}
+		sort.Strings(fnames)
+		for _, fname := range fnames {
+			files = append(files, pkg.Files[fname])
+		}
+	} else {
+		for _, file := range p.files {
+			var src interface{}
+			if file == "-" {
+				b, err := io.ReadAll(os.Stdin)
+				if err != nil {
+					return nil, err
+				}
+				file, src = *filename, b
+			}
+			f, err := parser.ParseFile(fset, file, src, 0)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f)
+		}
+	}
+
+	// Type-check the package containing only these files.
+	// Check returns a *types.Package.
+	return conf.Check(*pkgPath, fset, files, nil)
 }
 
 func check(err error) {
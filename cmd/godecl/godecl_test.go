@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/gcexportdata"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func loadTest(t *testing.T, dir, path string) *types.Package {
+	t.Helper()
+	*pkgPath = path
+	defer func() { *pkgPath = "" }()
+	fset := token.NewFileSet()
+	conf := &types.Config{
+		Importer:                 importer.ForCompiler(fset, "source", nil),
+		IgnoreFuncBodies:         true,
+		DisableUnusedImportCheck: true,
+	}
+	src := &pkgSource{name: dir, dir: dir}
+	pkg, err := src.load(fset, conf)
+	if err != nil {
+		t.Fatal("load:", err)
+	}
+	return pkg
+}
+
+func checkGolden(t *testing.T, golden string, got []byte) {
+	t.Helper()
+	golden = filepath.Join("testdata", golden)
+	if *update {
+		if err := os.WriteFile(golden, got, 0666); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s mismatch:\n==> got:\n%s\n==> want:\n%s", golden, got, want)
+	}
+}
+
+func TestDecls(t *testing.T) {
+	*internal, *methods, *impls = true, true, true
+	defer func() { *internal, *methods, *impls = false, false, false }()
+	pkg := loadTest(t, "testdata/foo", "")
+	var buf bytes.Buffer
+	printDecls(&buf, pkg)
+	checkGolden(t, "foo.golden", buf.Bytes())
+}
+
+func TestAPI(t *testing.T) {
+	pkg := loadTest(t, "testdata/foo", "example.com/foo")
+	lines := apiLines(pkg.Path(), pkg)
+	checkGolden(t, "foo.api.golden", []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+func TestStub(t *testing.T) {
+	pkg := loadTest(t, "testdata/foo", "example.com/foo")
+	b, err := genStub("foogox", pkg)
+	if err != nil {
+		t.Fatal("genStub:", err)
+	}
+	checkGolden(t, "foo.stub.golden", b)
+}
+
+func TestExport(t *testing.T) {
+	fset := token.NewFileSet()
+	pkg := loadTest(t, "testdata/foo", "example.com/foo")
+	file := filepath.Join(t.TempDir(), "foo.a")
+	if err := writeExport(file, fset, pkg); err != nil {
+		t.Fatal("writeExport:", err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ret, err := gcexportdata.Read(f, fset, make(map[string]*types.Package), "example.com/foo")
+	if err != nil {
+		t.Fatal("gcexportdata.Read:", err)
+	}
+	if ret.Scope().Lookup("Point") == nil || ret.Scope().Lookup("scale") != nil {
+		t.Fatal("export data:", ret.Scope().Names())
+	}
+}
+
+func TestExpandArgs(t *testing.T) {
+	srcs, err := expandArgs([]string{"testdata/foo/...", "testdata/foo", "testdata/foo/foo.go", "testdata/foo/bar.go"})
+	if err != nil {
+		t.Fatal("expandArgs:", err)
+	}
+	want := []pkgSource{
+		{name: "testdata/foo", dir: "testdata/foo"},
+		{name: "testdata/foo", dir: "testdata/foo"},
+		{name: "testdata/foo/foo.go testdata/foo/bar.go", files: []string{"testdata/foo/foo.go", "testdata/foo/bar.go"}},
+	}
+	if !reflect.DeepEqual(srcs, want) {
+		t.Fatal("expandArgs:", srcs)
+	}
+	if dirs, err := walkPkgDirs("."); err != nil || !reflect.DeepEqual(dirs, []string{"."}) {
+		t.Fatal("walkPkgDirs:", dirs, err)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+	load := func(src string) (*types.Package, error) {
+		f, err := os.CreateTemp(t.TempDir(), "stdin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		f.WriteString(src)
+		f.Seek(0, 0)
+		os.Stdin = f
+		srcs, err := expandArgs([]string{"-"})
+		if err != nil || len(srcs) != 1 || srcs[0].name != *filename {
+			t.Fatal("expandArgs:", srcs, err)
+		}
+		return srcs[0].load(token.NewFileSet(), &types.Config{})
+	}
+	pkg, err := load("package foo\n\nfunc F() {}\n")
+	if err != nil || pkg.Name() != "foo" || pkg.Scope().Lookup("F") == nil {
+		t.Fatal("load:", pkg, err)
+	}
+	*filename = "foo.go"
+	defer func() { *filename = "<stdin>" }()
+	if _, err = load("package foo\n\nfunc F() {\n"); err == nil || !strings.HasPrefix(err.Error(), "foo.go:3:") {
+		t.Fatal("load:", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	defer func() {
+		*internal, *exported, *nameExp, *kinds = false, false, "", ""
+		nameRE, kindsToPrint = nil, nil
+	}()
+	pkg := loadTest(t, "testdata/foo", "")
+	printFiltered := func(name, kind string) string {
+		*nameExp, *kinds = name, kind
+		nameRE, kindsToPrint = nil, nil
+		if err := initFilter(); err != nil {
+			t.Fatal("initFilter:", err)
+		}
+		var buf bytes.Buffer
+		printDecls(&buf, pkg)
+		return buf.String()
+	}
+	*internal = true
+	if ret := printFiltered("^[NOs]", "func,var"); ret != "func NewPoint(x int, y int) *Point\nvar Origin Point\nfunc scale(p Point, n int) Point\n" {
+		t.Fatal("printDecls:", ret)
+	}
+	*exported = true
+	if ret := printFiltered("", "const, type"); ret != "type Bar int\ntype Point struct{X int; Y int; tag string}\ntype Stringer interface{String() string}\nconst Version untyped string\n" {
+		t.Fatal("printDecls:", ret)
+	}
+	*kinds = "method"
+	if err := initFilter(); err == nil || err.Error() != `-kind: unknown kind "method"` {
+		t.Fatal("initFilter:", err)
+	}
+	*nameExp = "("
+	if err := initFilter(); err == nil {
+		t.Fatal("initFilter: no error?")
+	}
+}
+
+func TestLoadMultiPkgs(t *testing.T) {
+	fset := token.NewFileSet()
+	src := &pkgSource{name: "testdata/multi", dir: "testdata/multi"}
+	_, err := src.load(fset, &types.Config{})
+	if err == nil || err.Error() != "testdata/multi: multiple packages a, b" {
+		t.Fatal("load:", err)
+	}
+}
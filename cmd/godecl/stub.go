@@ -0,0 +1,103 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/types"
+	"os"
+	"strconv"
+)
+
+// -----------------------------------------------------------------------------
+
+// genStub generates a Go file (a package named `stubPkg`) of gox bindings for
+// the package, like:
+//
+//	// PkgPath is the import path of package fmt.
+//	const PkgPath = "fmt"
+//
+//	// Pkg is package fmt imported by a gox package.
+//	type Pkg struct {
+//		*gox.PkgRef
+//	}
+//
+//	// Import imports package fmt.
+//	func Import(pkg *gox.Package) Pkg {
+//		return Pkg{pkg.Import(PkgPath)}
+//	}
+//
+//	// SigPrintln is the signature of fmt.Println.
+//	const SigPrintln = "func(a ...any) (n int, err error)"
+//
+//	// Println returns the func fmt.Println.
+//	func (p Pkg) Println() gox.Ref {
+//		return p.PkgRef.Ref("Println")
+//	}
+//
+// Only exported declarations printed (see filter) have bindings.
+func genStub(stubPkg string, pkg *types.Package) ([]byte, error) {
+	path := pkg.Path()
+	if path == "" {
+		return nil, errors.New("-stub: import path of the package is unknown (use -pkgpath)")
+	}
+	name := pkg.Name()
+	qf := types.RelativeTo(pkg)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by godecl -stub; DO NOT EDIT.\n\npackage %s\n\n", stubPkg)
+	fmt.Fprintf(&b, "import \"github.com/goplus/gox\"\n\n")
+	fmt.Fprintf(&b, "// PkgPath is the import path of package %s.\nconst PkgPath = %s\n\n", name, strconv.Quote(path))
+	fmt.Fprintf(&b, "// Pkg is package %s imported by a gox package.\ntype Pkg struct {\n*gox.PkgRef\n}\n\n", name)
+	fmt.Fprintf(&b, "// Import imports package %s.\nfunc Import(pkg *gox.Package) Pkg {\nreturn Pkg{pkg.Import(PkgPath)}\n}\n", name)
+
+	scope := pkg.Scope()
+	for _, n := range scope.Names() {
+		o := scope.Lookup(n)
+		if !o.Exported() || !filter(o) {
+			continue
+		}
+		var kind string
+		switch o.(type) {
+		case *types.Func:
+			kind = "func"
+			fmt.Fprintf(&b, "\n// Sig%s is the signature of %s.%s.\nconst Sig%s = %s\n",
+				n, name, n, n, strconv.Quote(types.TypeString(o.Type(), qf)))
+		case *types.TypeName:
+			kind = "type"
+		case *types.Var:
+			kind = "var"
+		case *types.Const:
+			kind = "const"
+		default:
+			continue
+		}
+		fmt.Fprintf(&b, "\n// %s returns the %s %s.%s.\nfunc (p Pkg) %s() gox.Ref {\nreturn p.PkgRef.Ref(%s)\n}\n",
+			n, kind, name, n, n, strconv.Quote(n))
+	}
+	return format.Source(b.Bytes())
+}
+
+func writeStub(file, stubPkg string, pkg *types.Package) error {
+	src, err := genStub(stubPkg, pkg)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, src, 0666)
+}
+
+// -----------------------------------------------------------------------------
@@ -0,0 +1,4 @@
+package foo
+
+// Bar is declared in another file.
+type Bar int
@@ -0,0 +1,36 @@
+package foo
+
+import "fmt"
+
+// Version is the version of package foo.
+const Version = "1.0"
+
+// Stringer is implemented by *Point.
+type Stringer interface {
+	String() string
+}
+
+// Point is a point.
+type Point struct {
+	X, Y int
+	tag  string
+}
+
+func (p *Point) String() string {
+	return fmt.Sprint(p.X, p.Y)
+}
+
+func (p Point) Add(q Point) Point {
+	return Point{p.X + q.X, p.Y + q.Y, p.tag}
+}
+
+// Origin is the zero point.
+var Origin Point
+
+func NewPoint(x, y int) *Point {
+	return &Point{X: x, Y: y}
+}
+
+func scale(p Point, n int) Point {
+	return Point{p.X * n, p.Y * n, p.tag}
+}
@@ -0,0 +1,3 @@
+package foo_test
+
+func Ignored() {}
@@ -0,0 +1,303 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// goxgen generates a Go package from a JSON spec of types, constants and
+// function stubs by gox APIs. For example:
+//
+//	{
+//		"package": "shape",
+//		"imports": ["fmt"],
+//		"consts": [{"name": "Max", "type": "int", "value": "100"}],
+//		"types": [
+//			{"name": "Point", "doc": "Point is a 2D point.", "fields": [
+//				{"name": "X", "type": "int", "tag": "json:\"x\""},
+//				{"name": "Y", "type": "int", "tag": "json:\"y\""}
+//			]},
+//			{"name": "ID", "type": "string"}
+//		],
+//		"funcs": [
+//			{"name": "String", "recv": "p *Point", "results": [{"type": "string"}],
+//			 "body": "return fmt.Sprint(p.X, \",\", p.Y)"},
+//			{"name": "Dist", "params": [{"name": "a", "type": "Point"}], "results": [{"type": "int"}]}
+//		]
+//	}
+//
+// A function without body is generated as a stub that panics. The spec is
+// decoded by the format given by -f, or by the extension of the spec file.
+// Only JSON is built in, so goxgen needs no dependencies other than gox
+// itself; other formats (like YAML) can be added to `formats`.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/goplus/gox"
+)
+
+var (
+	output = flag.String("o", "", "output file (default stdout)")
+	format = flag.String("f", "", "format of the spec file (default by its extension)")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: goxgen [-o output.go] [-f format] spec.json\n")
+	flag.PrintDefaults()
+}
+
+// Format decodes a spec file into a Spec.
+type Format interface {
+	Unmarshal(data []byte, spec *Spec) error
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) Unmarshal(data []byte, spec *Spec) error {
+	return json.Unmarshal(data, spec)
+}
+
+// formats are the supported formats of spec files, by name (which is also
+// the file extension).
+var formats = map[string]Format{
+	"json": jsonFormat{},
+}
+
+// decodeSpec decodes `data` of the spec file `file` in format `name`. If
+// name is empty, the format is the extension of file.
+func decodeSpec(file, name string, data []byte) (*Spec, error) {
+	if name == "" {
+		name = strings.TrimPrefix(filepath.Ext(file), ".")
+	}
+	f, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("goxgen: unsupported spec format %q", name)
+	}
+	var spec Spec
+	if err := f.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// Spec describes a package to generate.
+type Spec struct {
+	Package string      `json:"package"`
+	Path    string      `json:"path"`
+	Imports []string    `json:"imports"`
+	Consts  []*Value    `json:"consts"`
+	Vars    []*Value    `json:"vars"`
+	Types   []*TypeSpec `json:"types"`
+	Funcs   []*FuncSpec `json:"funcs"`
+}
+
+// Value describes a constant or a variable. Type and Value are Go source.
+type Value struct {
+	Name  string `json:"name"`
+	Doc   string `json:"doc"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// TypeSpec describes a named type. It is a struct type if Fields isn't
+// empty, otherwise its underlying type is Type.
+type TypeSpec struct {
+	Name   string   `json:"name"`
+	Doc    string   `json:"doc"`
+	Type   string   `json:"type"`
+	Fields []*Field `json:"fields"`
+}
+
+// Field describes a struct field or a function parameter.
+type Field struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Tag  string `json:"tag"`
+}
+
+// FuncSpec describes a function or a method. Recv is in form `name Type`,
+// and Body is a Go statement list.
+type FuncSpec struct {
+	Name     string   `json:"name"`
+	Doc      string   `json:"doc"`
+	Recv     string   `json:"recv"`
+	Params   []*Field `json:"params"`
+	Results  []*Field `json:"results"`
+	Variadic bool     `json:"variadic"`
+	Body     string   `json:"body"`
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		return
+	}
+	b, err := os.ReadFile(flag.Arg(0))
+	check(err)
+	spec, err := decodeSpec(flag.Arg(0), *format, b)
+	check(err)
+
+	pkg, err := generate(spec)
+	check(err)
+	if *output != "" {
+		err = pkg.WriteFile(*output)
+	} else {
+		err = pkg.WriteTo(os.Stdout)
+	}
+	check(err)
+}
+
+func check(err error) {
+	if err != nil {
+		log.Panicln(err)
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+func generate(spec *Spec) (pkg *gox.Package, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	pkg = gox.NewPackage(spec.Path, spec.Package, nil)
+	for _, path := range spec.Imports {
+		pkg.Import(path)
+	}
+	cb := pkg.CB()
+	decls := make([]*gox.TypeDecl, len(spec.Types))
+	for i, t := range spec.Types { // declare types first, so they can refer to each other
+		defs := pkg.NewTypeDefs()
+		if t.Doc != "" {
+			defs.SetComments(docOf(t.Doc))
+		}
+		decls[i] = defs.NewType(t.Name)
+	}
+	for i, t := range spec.Types {
+		var typ types.Type
+		if t.Fields != nil {
+			fields := make([]*types.Var, len(t.Fields))
+			tags := make([]string, len(t.Fields))
+			for i, fld := range t.Fields {
+				fields[i] = types.NewField(token.NoPos, pkg.Types, fld.Name, typeOf(cb, fld.Type), false)
+				tags[i] = fld.Tag
+			}
+			typ = types.NewStruct(fields, tags)
+		} else {
+			typ = typeOf(cb, t.Type)
+		}
+		decls[i].InitType(pkg, typ)
+	}
+	for _, c := range spec.Consts {
+		defs := pkg.NewConstDefs(pkg.Types.Scope())
+		if c.Doc != "" {
+			defs.SetComments(docOf(c.Doc))
+		}
+		defs.New(func(cb *gox.CodeBuilder) int {
+			cb.ValFromSource(c.Value)
+			return 1
+		}, 0, token.NoPos, optTypeOf(cb, c.Type), c.Name)
+	}
+	for _, v := range spec.Vars {
+		defs := pkg.NewVarDefs(pkg.Types.Scope())
+		if v.Doc != "" {
+			defs.SetComments(docOf(v.Doc))
+		}
+		if v.Value == "" {
+			defs.New(token.NoPos, optTypeOf(cb, v.Type), v.Name)
+		} else {
+			defs.New(token.NoPos, optTypeOf(cb, v.Type), v.Name).InitStart(pkg).
+				ValFromSource(v.Value).EndInit(1)
+		}
+	}
+	for _, f := range spec.Funcs {
+		genFunc(pkg, f)
+	}
+	return
+}
+
+func genFunc(pkg *gox.Package, f *FuncSpec) {
+	cb := pkg.CB()
+	var recv *gox.Param
+	if f.Recv != "" {
+		name, typ := "", f.Recv
+		if pos := strings.IndexByte(f.Recv, ' '); pos > 0 {
+			name, typ = f.Recv[:pos], strings.TrimSpace(f.Recv[pos+1:])
+		}
+		recv = pkg.NewParam(token.NoPos, name, typeOf(cb, typ))
+	}
+	fn := pkg.NewFunc(recv, f.Name, tupleOf(pkg, f.Params, f.Variadic), tupleOf(pkg, f.Results, false), f.Variadic)
+	if f.Doc != "" {
+		fn.SetComments(pkg, docOf(f.Doc))
+	}
+	fn.BodyStart(pkg)
+	if f.Body != "" {
+		cb.QuoteStmts(f.Body, nil)
+	} else {
+		cb.Val(pkg.Builtin().Ref("panic")).Val("not implemented").Call(1).EndStmt()
+	}
+	cb.End()
+}
+
+func tupleOf(pkg *gox.Package, fields []*Field, variadic bool) *types.Tuple {
+	if fields == nil {
+		return nil
+	}
+	vars := make([]*types.Var, len(fields))
+	for i, fld := range fields {
+		typ := typeOf(pkg.CB(), fld.Type)
+		if variadic && i == len(fields)-1 {
+			typ = types.NewSlice(typ)
+		}
+		vars[i] = pkg.NewParam(token.NoPos, fld.Name, typ)
+	}
+	return types.NewTuple(vars...)
+}
+
+func optTypeOf(cb *gox.CodeBuilder, typ string) types.Type {
+	if typ == "" {
+		return nil
+	}
+	return typeOf(cb, typ)
+}
+
+func typeOf(cb *gox.CodeBuilder, typ string) types.Type {
+	cb.ValFromSource(typ)
+	t, ok := cb.Get(-1).Type.(*gox.TypeType)
+	cb.InternalStack().Pop()
+	if !ok {
+		log.Panicln(typ, "is not a type")
+	}
+	return t.Type()
+}
+
+func docOf(doc string) *ast.CommentGroup {
+	lines := strings.Split(strings.TrimRight(doc, "\n"), "\n")
+	list := make([]*ast.Comment, len(lines))
+	for i, line := range lines {
+		list[i] = &ast.Comment{Text: "// " + line}
+	}
+	list[0].Text = "\n" + list[0].Text
+	return &ast.CommentGroup{List: list}
+}
+
+// ----------------------------------------------------------------------------
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestGenerate(t *testing.T) {
+	file := filepath.Join("testdata", "shape.json")
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := decodeSpec(file, "", b)
+	if err != nil {
+		t.Fatal("decodeSpec:", err)
+	}
+	pkg, err := generate(spec)
+	if err != nil {
+		t.Fatal("generate:", err)
+	}
+	var buf bytes.Buffer
+	if err = pkg.WriteTo(&buf); err != nil {
+		t.Fatal("WriteTo:", err)
+	}
+	golden := filepath.Join("testdata", "shape.golden")
+	if *update {
+		if err = os.WriteFile(golden, buf.Bytes(), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.Bytes(); !bytes.Equal(got, want) {
+		t.Fatalf("%s mismatch:\n==> got:\n%s\n==> want:\n%s", golden, got, want)
+	}
+}
+
+func TestDecodeSpecFormat(t *testing.T) {
+	if _, err := decodeSpec("a.yaml", "", nil); err == nil || err.Error() != `goxgen: unsupported spec format "yaml"` {
+		t.Fatal("decodeSpec:", err)
+	}
+	spec, err := decodeSpec("a.spec", "json", []byte(`{"package": "foo"}`))
+	if err != nil || spec.Package != "foo" {
+		t.Fatal("decodeSpec:", spec, err)
+	}
+}
+
+func TestGenerateError(t *testing.T) {
+	spec := &Spec{Package: "foo", Vars: []*Value{{Name: "x", Type: "1"}}}
+	if _, err := generate(spec); err == nil {
+		t.Fatal("generate: no error")
+	}
+}
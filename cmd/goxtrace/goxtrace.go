@@ -0,0 +1,259 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// goxtrace renders the instruction trace printed by gox (see gox.SetDebug)
+// as an indented report: instructions are indented by the blocks they're in,
+// and unbalanced blocks are reported. For example:
+//
+//	go test -run TestFoo -v 2>&1 | goxtrace -func main
+//
+// prints:
+//
+//	=== RUN   TestFoo
+//	NewFunc main func()
+//	    If
+//	        Val x int
+//	    Then
+//	        Val Println func(a ...any) (n int, err error)
+//	        Val Hi string
+//	        Call 1 0 // func(a ...any) (n int, err error)
+//	    End // If
+//	!! panic: forget to call EndStmt()?
+//	!!     at End // If (line 9)
+//	!!     in Func main (line 2)
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	showMatch = flag.Bool("match", false, "print matching traces (lines beginning with ==>)")
+	funcExp   = flag.String("func", "", "print only traces of functions whose names match `regexp`")
+	grepExp   = flag.String("grep", "", "print only instructions matching `regexp` (and the blocks they're in)")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: goxtrace [-match] [-func regexp] [-grep regexp] [trace.log ...]\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	var funcRE, grepRE *regexp.Regexp
+	if *funcExp != "" {
+		funcRE = regexp.MustCompile(*funcExp)
+	}
+	if *grepExp != "" {
+		grepRE = regexp.MustCompile(*grepExp)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	p := &tracer{w: w, funcRE: funcRE, grepRE: grepRE}
+	if flag.NArg() == 0 {
+		p.run(os.Stdin)
+		return
+	}
+	for _, file := range flag.Args() {
+		f, err := os.Open(file)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		p.run(f)
+		f.Close()
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// block represents a block opened by an instruction (such as If, Switch and
+// NewFunc), which is closed by `End // <name>`.
+type block struct {
+	name string // name printed by End
+	desc string
+	line int
+	show bool // print traces in this block
+}
+
+type tracer struct {
+	w      *bufio.Writer
+	funcRE *regexp.Regexp
+	grepRE *regexp.Regexp
+	blocks []*block
+	line   int
+
+	lastEnd string // End of the last trace (End panics after it's traced)
+}
+
+// openers maps instructions opening a block to names printed by End.
+var openers = map[string]string{
+	"NewFunc":                "Func",
+	"NewClosure":             "Func",
+	"CallInlineClosureStart": "Func",
+	"Block":                  "Block",
+	"VBlock":                 "Vblock",
+	"If":                     "If",
+	"Switch":                 "Switch",
+	"Case":                   "Case",
+	"TypeSwitch":             "TypeSwitch",
+	"TypeCase":               "TypeCase",
+	"Select":                 "Select",
+	"CommCase":               "CommCase",
+	"For":                    "For",
+	"ForRange":               "ForRange",
+	"Assert":                 "Assert",
+}
+
+// sections are instructions which separate parts of a block, and are printed
+// with the outer indent.
+var sections = map[string]bool{
+	"Then":            true,
+	"Else":            true,
+	"Post":            true,
+	"RangeAssignThen": true,
+	"TypeAssertThen":  true,
+}
+
+var logPrefix = regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d(\.\d+)? `)
+
+func (p *tracer) run(r io.Reader) {
+	p.line = 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		p.line++
+		p.trace(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	p.reset("EOF")
+}
+
+func (p *tracer) trace(text string) {
+	loc := logPrefix.FindStringIndex(text)
+	if loc == nil {
+		switch {
+		case strings.HasPrefix(text, "=== RUN"):
+			p.reset("")
+			fmt.Fprintln(p.w, text)
+		case strings.HasPrefix(text, "panic:"):
+			p.reset(text)
+		}
+		return
+	}
+	msg := text[loc[1]:]
+	if strings.HasPrefix(msg, "==>") {
+		if *showMatch && p.visible() {
+			p.print(len(p.blocks), msg)
+		}
+		return
+	}
+	p.lastEnd = ""
+	instr := msg
+	if pos := strings.IndexByte(msg, ' '); pos >= 0 {
+		instr = msg[:pos]
+	}
+	switch {
+	case instr == "End":
+		name := strings.TrimSpace(strings.TrimPrefix(msg, "End //"))
+		n := len(p.blocks)
+		if n == 0 {
+			fmt.Fprintf(p.w, "!! %s (line %d): no open block\n", msg, p.line)
+			return
+		}
+		b := p.blocks[n-1]
+		if b.show {
+			p.print(n-1, msg)
+		}
+		if b.name != name {
+			fmt.Fprintf(p.w, "!! %s (line %d) doesn't match %s (line %d)\n", msg, p.line, b.desc, b.line)
+		}
+		p.blocks = p.blocks[:n-1]
+		p.lastEnd = fmt.Sprintf("%s (line %d)", msg, p.line)
+	case strings.HasPrefix(instr, "NewClosure"): // NewClosure is followed by signature directly
+		p.open("NewClosure", msg)
+	case openers[instr] != "":
+		p.open(instr, msg)
+	case sections[instr]:
+		if n := len(p.blocks); n > 0 && p.visible() {
+			p.print(n-1, msg)
+		}
+	default:
+		if p.visible() && (p.grepRE == nil || p.grepRE.MatchString(msg)) {
+			p.print(len(p.blocks), msg)
+		}
+	}
+}
+
+func (p *tracer) open(instr, msg string) {
+	name := openers[instr]
+	desc := name
+	show := p.visible()
+	if name == "Func" {
+		fields := strings.Fields(msg)
+		if instr == "NewFunc" && len(fields) > 1 {
+			desc += " " + fields[1]
+		}
+		if p.funcRE != nil && len(p.blocks) == 0 {
+			show = instr == "NewFunc" && len(fields) > 1 && p.funcRE.MatchString(fields[1])
+		}
+	}
+	if show {
+		p.print(len(p.blocks), msg)
+	}
+	p.blocks = append(p.blocks, &block{name: name, desc: desc, line: p.line, show: show})
+}
+
+// visible reports whether traces of the current block are printed.
+func (p *tracer) visible() bool {
+	if n := len(p.blocks); n > 0 {
+		return p.blocks[n-1].show
+	}
+	return p.funcRE == nil
+}
+
+func (p *tracer) print(indent int, msg string) {
+	fmt.Fprintf(p.w, "%s%s\n", strings.Repeat("    ", indent), msg)
+}
+
+// reset reports open blocks (if `why` isn't empty), and clears them.
+func (p *tracer) reset(why string) {
+	if why != "" && len(p.blocks) > 0 {
+		if why == "EOF" {
+			why = "unclosed blocks at EOF"
+		}
+		fmt.Fprintf(p.w, "!! %s\n", why)
+		if p.lastEnd != "" {
+			fmt.Fprintf(p.w, "!!     at %s\n", p.lastEnd)
+		}
+		for i := len(p.blocks) - 1; i >= 0; i-- {
+			b := p.blocks[i]
+			fmt.Fprintf(p.w, "!!     in %s (line %d)\n", b.desc, b.line)
+		}
+	}
+	p.blocks = p.blocks[:0]
+	p.lastEnd = ""
+}
+
+// -----------------------------------------------------------------------------
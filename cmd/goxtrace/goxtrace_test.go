@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func runTrace(t *testing.T, trace string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	p := &tracer{w: w}
+	p.run(strings.NewReader(trace))
+	w.Flush()
+	return buf.String()
+}
+
+func TestAssert(t *testing.T) {
+	got := runTrace(t, `=== RUN   TestAssert
+2022/01/02 15:04:05 NewFunc main func()
+2022/01/02 15:04:05 Assert
+2022/01/02 15:04:05 Val x int
+2022/01/02 15:04:05 End // Assert
+2022/01/02 15:04:05 End // Func
+`)
+	want := `=== RUN   TestAssert
+NewFunc main func()
+    Assert
+        Val x int
+    End // Assert
+End // Func
+`
+	if got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUnbalanced(t *testing.T) {
+	got := runTrace(t, `=== RUN   TestIf
+2022/01/02 15:04:05 NewFunc main func()
+2022/01/02 15:04:05 If
+2022/01/02 15:04:05 Val x int
+2022/01/02 15:04:05 End // Func
+`)
+	want := `=== RUN   TestIf
+NewFunc main func()
+    If
+        Val x int
+    End // Func
+!! End // Func (line 5) doesn't match If (line 3)
+!! unclosed blocks at EOF
+!!     at End // Func (line 5)
+!!     in Func main (line 2)
+`
+	if got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -14,17 +14,18 @@
 package gox
 
 import (
-	"errors"
 	"fmt"
 	"go/ast"
 	"go/constant"
 	"go/token"
 	"go/types"
 	"log"
+	"math"
 	"math/big"
 	"reflect"
 	"strconv"
 	"strings"
+	"unsafe"
 
 	"github.com/goplus/gox/internal"
 	"golang.org/x/tools/go/types/typeutil"
@@ -105,6 +106,8 @@ type funcBodyCtx struct {
 	codeBlockCtx
 	fn     *Func
 	labels map[string]*Label
+	temps  []*types.Var // released temporary variables, see NewTemp
+	owner  *types.Func  // the outermost named function, see initDepOwner
 }
 
 func (p *funcBodyCtx) checkLabels(cb *CodeBuilder) {
@@ -140,11 +143,19 @@ type CodeBuilder struct {
 	rec       Recorder
 	loadNamed LoadNamedFunc
 	handleErr func(err error)
-	closureParamInsts
+	errMode   ErrorMode
+	errs      []error // errors recorded in ErrorCollect mode
 	vFieldsMgr
+	underlyings map[*types.Named]types.Type // memoized underlying types of named types
+	btiCache    map[types.Type]*builtinTI   // memoized builtinTIs by type identity
+	blocks      []string                    // comments of open blocks if any limit is set, see pushBlock
+	maxBlocks   int
+	limited     bool // MaxStackDepth or MaxBlockDepth is set
 	iotav       int
+	assertMode  AssertMode
 	commentOnce bool
 	noSkipConst bool
+	probing     bool // computing types only, see optionalChainType
 }
 
 func (p *CodeBuilder) init(pkg *Package) {
@@ -156,8 +167,13 @@ func (p *CodeBuilder) init(pkg *Package) {
 	}
 	p.noSkipConst = conf.NoSkipConstant
 	p.handleErr = conf.HandleErr
+	p.errMode = conf.ErrorMode
 	if p.handleErr == nil {
-		p.handleErr = defaultHandleErr
+		if p.errMode == ErrorCollect {
+			p.handleErr = p.recordErr
+		} else {
+			p.handleErr = defaultHandleErr
+		}
 	}
 	p.rec = conf.Recorder
 	p.interp = conf.NodeInterpreter
@@ -171,7 +187,13 @@ func (p *CodeBuilder) init(pkg *Package) {
 	}
 	p.current.scope = pkg.Types.Scope()
 	p.stk.Init()
-	p.closureParamInsts.init()
+	if conf.MaxStackDepth > 0 {
+		p.stk.SetLimit(conf.MaxStackDepth, func() {
+			p.panicCodeErrorf(token.NoPos, "stack depth exceeds %d\n%s", conf.MaxStackDepth, p.openBlocks())
+		})
+	}
+	p.maxBlocks = conf.MaxBlockDepth
+	p.limited = conf.MaxStackDepth > 0 || conf.MaxBlockDepth > 0
 }
 
 func defaultLoadNamed(at *Package, t *types.Named) {
@@ -235,6 +257,10 @@ func (p *CodeBuilder) panicCodeErrorf(pos token.Pos, format string, args ...inte
 	panic(p.newCodeError(pos, fmt.Sprintf(format, args...)))
 }
 
+func (p *CodeBuilder) recordErr(err error) {
+	p.errs = append(p.errs, err)
+}
+
 // Scope returns current scope.
 func (p *CodeBuilder) Scope() *types.Scope {
 	return p.current.scope
@@ -253,6 +279,11 @@ func (p *CodeBuilder) Pkg() *Package {
 func (p *CodeBuilder) startFuncBody(fn *Func, src []ast.Node, old *funcBodyCtx) *CodeBuilder {
 	p.current.fn, old.fn = fn, p.current.fn
 	p.current.labels, old.labels = nil, p.current.labels
+	p.current.temps, old.temps = nil, p.current.temps
+	old.owner = p.current.owner
+	if fn.Name() != "" {
+		p.current.owner = fn.Func
+	}
 	p.startBlockStmt(fn, src, "func "+fn.Name(), &old.codeBlockCtx)
 	scope := p.current.scope
 	sig := fn.Type().(*types.Signature)
@@ -277,6 +308,8 @@ func (p *CodeBuilder) endFuncBody(old funcBodyCtx) []ast.Stmt {
 	p.current.checkLabels(p)
 	p.current.fn = old.fn
 	p.current.labels = old.labels
+	p.current.temps = old.temps
+	p.current.owner = old.owner
 	stmts, _ := p.endBlockStmt(&old.codeBlockCtx)
 	return stmts
 }
@@ -286,12 +319,48 @@ func (p *CodeBuilder) startBlockStmt(current codeBlock, src []ast.Node, comment
 	if src != nil {
 		start, end = src[0].Pos(), src[0].End()
 	}
+	p.pushBlock(start, comment)
 	scope := types.NewScope(p.current.scope, start, end, comment)
 	p.current.codeBlockCtx, *old = codeBlockCtx{current, scope, p.stk.Len(), nil, nil, 0}, p.current.codeBlockCtx
 	return p
 }
 
+// pushBlock records a block opened for diagnostics of exceeded limits, and
+// checks MaxBlockDepth. Nothing is recorded if no limit is set.
+func (p *CodeBuilder) pushBlock(pos token.Pos, comment string) {
+	if !p.limited {
+		return
+	}
+	if len(p.blocks) == p.maxBlocks && p.maxBlocks > 0 {
+		p.panicCodeErrorf(pos, "too many nested blocks (more than %d)\n%s", p.maxBlocks, p.openBlocks())
+	}
+	p.blocks = append(p.blocks, comment)
+}
+
+func (p *CodeBuilder) popBlock() {
+	if n := len(p.blocks); n > 0 {
+		p.blocks = p.blocks[:n-1]
+	}
+}
+
+// openBlocks describes the innermost open blocks for diagnostics.
+func (p *CodeBuilder) openBlocks() string {
+	const max = 8
+	var b strings.Builder
+	b.WriteString("\topen blocks (innermost first):")
+	n := len(p.blocks)
+	for i := n - 1; i >= 0 && i >= n-max; i-- {
+		b.WriteString("\n\t\t")
+		b.WriteString(p.blocks[i])
+	}
+	if n > max {
+		fmt.Fprintf(&b, "\n\t\t... (%d more)", n-max)
+	}
+	return b.String()
+}
+
 func (p *CodeBuilder) endBlockStmt(old *codeBlockCtx) ([]ast.Stmt, int) {
+	p.popBlock()
 	flows := p.current.flows
 	if p.current.label != nil {
 		p.emitStmt(&ast.EmptyStmt{})
@@ -309,6 +378,7 @@ func (p *CodeBuilder) clearBlockStmt() []ast.Stmt {
 }
 
 func (p *CodeBuilder) startVBlockStmt(current codeBlock, comment string, old *vblockCtx) *CodeBuilder {
+	p.pushBlock(token.NoPos, comment)
 	*old = vblockCtx{codeBlock: p.current.codeBlock, scope: p.current.scope}
 	scope := types.NewScope(p.current.scope, token.NoPos, token.NoPos, comment)
 	p.current.codeBlock, p.current.scope = current, scope
@@ -316,6 +386,7 @@ func (p *CodeBuilder) startVBlockStmt(current codeBlock, comment string, old *vb
 }
 
 func (p *CodeBuilder) endVBlockStmt(old *vblockCtx) {
+	p.popBlock()
 	p.current.codeBlock, p.current.scope = old.codeBlock, old.scope
 }
 
@@ -339,21 +410,124 @@ func (p *CodeBuilder) startStmtAt(stmt ast.Stmt) int {
 //	...
 //	cb.commitStmt(idx)
 func (p *CodeBuilder) commitStmt(idx int) {
+	moveStmts(p.current.stmts, idx, idx+1)
+}
+
+// moveStmts moves stmts[from:] to stmts[at] (at <= from).
+func moveStmts(stmts []ast.Stmt, at, from int) {
+	if at < from && from < len(stmts) {
+		tail := append([]ast.Stmt(nil), stmts[from:]...)
+		copy(stmts[at+len(tail):], stmts[at:from])
+		copy(stmts[at:], tail)
+	}
+}
+
+// StmtHandle refers to a statement of a block, so that statements can be
+// inserted before or after it (or it can be replaced) when the block has
+// more statements. See CodeBuilder.LastStmt.
+type StmtHandle struct {
+	stmt  ast.Stmt // nil means the beginning of the block
+	scope *types.Scope
+}
+
+// LastStmt returns a handle of the last statement of the current block, or
+// of the beginning of the block if it has no statements yet. A frontend can
+// take it before a statement, and insert statements needed by the statement
+// (such as declarations of temporary variables) after it halfway through an
+// expression:
+//
+//	h := cb.LastStmt()
+//	... // in the middle of an expression
+//	cb.InsertAfter(h, func(cb *gox.CodeBuilder) {
+//		cb.NewVar(typ, "tmp")
+//	})
+func (p *CodeBuilder) LastStmt() StmtHandle {
+	var stmt ast.Stmt
+	if n := len(p.current.stmts); n > 0 {
+		stmt = p.current.stmts[n-1]
+	}
+	return StmtHandle{stmt, p.current.scope}
+}
+
+// InsertBefore inserts statements emitted by `emit` before the statement `h`
+// of the current block.
+func (p *CodeBuilder) InsertBefore(h StmtHandle, emit func(cb *CodeBuilder)) *CodeBuilder {
+	if debugInstr {
+		log.Println("InsertBefore")
+	}
+	p.insertStmts(p.stmtIndex(h, "InsertBefore"), emit)
+	return p
+}
+
+// InsertAfter inserts statements emitted by `emit` after the statement `h`
+// of the current block.
+func (p *CodeBuilder) InsertAfter(h StmtHandle, emit func(cb *CodeBuilder)) *CodeBuilder {
+	if debugInstr {
+		log.Println("InsertAfter")
+	}
+	p.insertStmts(p.stmtIndex(h, "InsertAfter")+1, emit)
+	return p
+}
+
+// ReplaceStmt replaces the statement `h` of the current block with statements
+// emitted by `emit`. `h` is invalid after that.
+func (p *CodeBuilder) ReplaceStmt(h StmtHandle, emit func(cb *CodeBuilder)) *CodeBuilder {
+	if debugInstr {
+		log.Println("ReplaceStmt")
+	}
+	idx := p.stmtIndex(h, "ReplaceStmt")
+	if idx < 0 {
+		log.Panicln("ReplaceStmt: no statement to replace")
+	}
+	idx += p.insertStmts(idx, emit)
 	stmts := p.current.stmts
-	n := len(stmts) - 1
-	if n > idx {
-		stmt := stmts[idx]
-		copy(stmts[idx:], stmts[idx+1:])
-		stmts[n] = stmt
+	p.pkg.unrefPkgs(stmts[idx])
+	p.current.stmts = append(stmts[:idx], stmts[idx+1:]...)
+	return p
+}
+
+func (p *CodeBuilder) stmtIndex(h StmtHandle, op string) int {
+	if h.scope != p.current.scope {
+		log.Panicln(op + ": statement isn't in the current block")
 	}
+	if h.stmt == nil {
+		return -1
+	}
+	stmts := p.current.stmts
+	for i := len(stmts) - 1; i >= 0; i-- {
+		if stmts[i] == h.stmt {
+			return i
+		}
+	}
+	log.Panicln(op + ": statement not found")
+	return -1
+}
+
+// insertStmts inserts statements emitted by `emit` at stmts[at], and returns
+// the number of them.
+func (p *CodeBuilder) insertStmts(at int, emit func(cb *CodeBuilder)) int {
+	if at < 0 {
+		at = 0
+	}
+	scope, from := p.current.scope, len(p.current.stmts)
+	emit(p)
+	if p.current.scope != scope {
+		log.Panicln("statements are emitted outside of the current block")
+	}
+	moveStmts(p.current.stmts, at, from)
+	return len(p.current.stmts) - from
 }
 
 func (p *CodeBuilder) emitStmt(stmt ast.Stmt) {
-	if p.comments != nil {
-		p.pkg.setStmtComments(stmt, p.comments)
-		if p.commentOnce {
-			p.comments = nil
-		}
+	comments := p.comments
+	if comments != nil && p.commentOnce {
+		p.comments = nil
+	}
+	if p.pkg.conf.LineDirectives {
+		comments = p.pkg.withLineDirective(comments, stmt)
+	}
+	if comments != nil {
+		p.pkg.setStmtComments(stmt, comments)
 	}
 	if p.current.label != nil {
 		p.current.label.Stmt = stmt
@@ -362,6 +536,52 @@ func (p *CodeBuilder) emitStmt(stmt ast.Stmt) {
 	p.current.stmts = append(p.current.stmts, stmt)
 }
 
+// RawStmt emits a pre-built (or parsed) statement as is, without type checking.
+// `objs` (optional) are objects declared by the statement, which are inserted
+// into the current scope so that they can be referenced by later instructions.
+// Nothing is inserted if any of `objs` is redeclared. Positions of the
+// statement are cleared, and an identifier X of `X.Sel` in it, which isn't
+// declared in the current scope (or its parents) or in the statement itself,
+// is taken as a reference of the imported package named X (see RawDecl).
+func (p *CodeBuilder) RawStmt(stmt ast.Stmt, objs ...types.Object) *CodeBuilder {
+	if debugInstr {
+		log.Println("RawStmt", reflect.TypeOf(stmt))
+	}
+	scope := p.current.scope
+	for i, obj := range objs {
+		if err := p.checkRedecl(scope, obj, objs[:i]); err != nil {
+			panic(err)
+		}
+	}
+	for _, obj := range objs {
+		scope.Insert(obj)
+	}
+	resetPos(reflect.ValueOf(stmt))
+	p.pkg.file.refRawPkgs(scope, stmt)
+	p.emitStmt(stmt)
+	return p
+}
+
+// checkRedecl checks if `obj` is declared in `scope` already, or is one of
+// `objs` to be declared together with it.
+func (p *CodeBuilder) checkRedecl(scope *types.Scope, obj types.Object, objs []types.Object) error {
+	old := scope.Lookup(obj.Name())
+	if old == nil {
+		for _, o := range objs {
+			if o.Name() == obj.Name() {
+				old = o
+				break
+			}
+		}
+	}
+	if old != nil {
+		oldpos := p.fset.Position(old.Pos())
+		return p.newCodeErrorf(
+			obj.Pos(), "%s redeclared in this block\n\tprevious declaration at %v", obj.Name(), oldpos)
+	}
+	return nil
+}
+
 func (p *CodeBuilder) startInitExpr(current codeBlock) (old codeBlock) {
 	p.current.codeBlock, old = current, p.current.codeBlock
 	return
@@ -391,10 +611,12 @@ func (p *CodeBuilder) SetComments(comments *ast.CommentGroup, once bool) *CodeBu
 	return p
 }
 
-// ReturnErr func
-func (p *CodeBuilder) ReturnErr(outer bool) *CodeBuilder {
+// ReturnErr returns the error on the top of the stack with zero values of
+// other results. If `wrap` is specified, the error is wrapped as
+// `fmt.Errorf(wrap, err)`, where `wrap` is a format string like "open: %w".
+func (p *CodeBuilder) ReturnErr(outer bool, wrap ...string) *CodeBuilder {
 	if debugInstr {
-		log.Println("ReturnErr", outer)
+		log.Println("ReturnErr", outer, wrap)
 	}
 	fn := p.current.fn
 	if outer {
@@ -408,6 +630,15 @@ func (p *CodeBuilder) ReturnErr(outer bool) *CodeBuilder {
 	if n > 0 {
 		last := results.At(n - 1)
 		if last.Type() == TyError { // last result is error
+			if wrap != nil {
+				if strings.Count(wrap[0], "%w") != 1 {
+					log.Panicf("ReturnErr: format %q should contain exactly one %%w\n", wrap[0])
+				}
+				err := p.stk.Pop()
+				p.Val(p.pkg.Import("fmt").Ref("Errorf")).Val(wrap[0])
+				p.stk.Push(err)
+				p.Call(2)
+			}
 			err := p.stk.Pop()
 			for i := 0; i < n-1; i++ {
 				p.doZeroLit(results.At(i).Type(), false)
@@ -421,6 +652,79 @@ func (p *CodeBuilder) ReturnErr(outer bool) *CodeBuilder {
 	panic("TODO: last result type isn't an error")
 }
 
+// ErrAction specifies what CheckErr does with a non-nil error.
+type ErrAction int
+
+const (
+	// ErrReturn returns the error with zero values of other results.
+	ErrReturn ErrAction = iota
+	// ErrPanic panics with the error.
+	ErrPanic
+)
+
+// CheckErr takes an error on the top of the stack and generates:
+//
+//	if err != nil {
+//		return ...zero values..., err // or panic(err)
+//	}
+//
+// If the error isn't a variable (eg. a call expression), it generates:
+//
+//	if err := expr; err != nil {
+//		...
+//	}
+func (p *CodeBuilder) CheckErr(action ErrAction, src ...ast.Node) *CodeBuilder {
+	if debugInstr {
+		log.Println("CheckErr", action)
+	}
+	return p.checkErr(action, "", src)
+}
+
+// CheckErrReturn takes an error on the top of the stack and generates code
+// like CheckErr(ErrReturn). If `wrap` isn't empty, the error is wrapped as
+// `fmt.Errorf(wrap, err)` like ReturnErr:
+//
+//	if err != nil {
+//		return ...zero values..., fmt.Errorf("open: %w", err)
+//	}
+func (p *CodeBuilder) CheckErrReturn(wrap string, src ...ast.Node) *CodeBuilder {
+	if debugInstr {
+		log.Println("CheckErrReturn", wrap)
+	}
+	return p.checkErr(ErrReturn, wrap, src)
+}
+
+func (p *CodeBuilder) checkErr(action ErrAction, wrap string, src []ast.Node) *CodeBuilder {
+	err := p.stk.Pop()
+	if !types.AssignableTo(err.Type, TyError) {
+		code, pos := p.loadExpr(err.Src)
+		p.panicCodeErrorf(pos, "cannot use %s (type %v) as error value", code, err.Type)
+	}
+	p.If(src...)
+	if _, ok := err.Val.(*ast.Ident); !ok {
+		p.DefineVarStart(token.NoPos, "err")
+		p.stk.Push(err)
+		p.EndInit(1)
+		err = p.VarVal("err").stk.Pop()
+	}
+	p.stk.Push(err)
+	p.CompareNil(token.NEQ).Then()
+	switch action {
+	case ErrPanic:
+		p.Val(p.pkg.Builtin().Ref("panic"))
+		p.stk.Push(err)
+		p.Call(1).EndStmt()
+	default:
+		p.stk.Push(err)
+		if wrap != "" {
+			p.ReturnErr(false, wrap)
+		} else {
+			p.ReturnErr(false)
+		}
+	}
+	return p.End()
+}
+
 func (p *CodeBuilder) returnResults(n int) {
 	var rets []ast.Expr
 	if n > 0 {
@@ -444,9 +748,8 @@ func (p *CodeBuilder) Return(n int, src ...ast.Node) *CodeBuilder {
 	checkFuncResults(p.pkg, p.stk.GetArgs(n), results, getSrc(src))
 	if fn.isInline() {
 		for i := n - 1; i >= 0; i-- {
-			key := closureParamInst{fn, results.At(i)}
 			elem := p.stk.Pop()
-			p.doVarRef(p.paramInsts[key], nil, false)
+			p.doVarRef(fn.paramInsts[results.At(i)], nil, false)
 			p.stk.Push(elem)
 			p.doAssignWith(1, 1, nil)
 		}
@@ -493,57 +796,103 @@ func (p *CodeBuilder) CallWith(n int, flags InstrFlags, src ...ast.Node) *CodeBu
 	return p
 }
 
-type closureParamInst struct {
-	inst  *Func
-	param *types.Var
-}
-
-type closureParamInsts struct {
-	paramInsts map[closureParamInst]*types.Var
-}
-
-func (p *closureParamInsts) init() {
-	p.paramInsts = make(map[closureParamInst]*types.Var)
-}
-
 func (p *CodeBuilder) getEndingLabel(fn *Func) *Label {
-	key := closureParamInst{fn, nil}
-	if v, ok := p.paramInsts[key]; ok {
-		return p.current.labels[v.Name()]
+	if fn.ending == nil {
+		fn.ending = p.NewLabel(token.NoPos, p.pkg.autoName())
 	}
-	ending := p.pkg.autoName()
-	p.paramInsts[key] = types.NewParam(token.NoPos, nil, ending, nil)
-	return p.NewLabel(token.NoPos, ending)
+	return fn.ending
 }
 
-func (p *CodeBuilder) needEndingLabel(fn *Func) (*Label, bool) {
-	key := closureParamInst{fn, nil}
-	if v, ok := p.paramInsts[key]; ok {
-		return p.current.labels[v.Name()], true
-	}
-	return nil, false
-}
-
-func (p *Func) inlineClosureEnd(cb *CodeBuilder) {
-	if ending, ok := cb.needEndingLabel(p); ok {
-		cb.Label(ending)
+func (p *Func) inlineClosureEnd(cb *CodeBuilder, src ast.Node) {
+	if p.ending != nil {
+		cb.Label(p.ending)
 	}
 	sig := p.Type().(*types.Signature)
-	cb.emitStmt(&ast.BlockStmt{List: cb.endFuncBody(p.old)})
+	body := cb.endFuncBody(p.old)
+	var stmt ast.Stmt = &ast.BlockStmt{List: body}
+	if needFuncBoundary(body) {
+		// defer and recover rely on a function boundary, so the body is called
+		// as a real closure, which can't jump out to its caller.
+		if escapeInline(body) {
+			cb.panicCodeError(getSrcPos(src), "can't use defer or recover in an inline closure that jumps out of it")
+		}
+		stmt = &ast.ExprStmt{X: &ast.CallExpr{Fun: &ast.FuncLit{
+			Type: &ast.FuncType{Params: &ast.FieldList{}},
+			Body: &ast.BlockStmt{List: body},
+		}}}
+	}
+	cb.emitStmt(stmt)
 	cb.stk.PopN(p.getInlineCallArity())
 	results := sig.Results()
-	for i, n := 0, results.Len(); i < n; i++ { // return results & clean env
-		key := closureParamInst{p, results.At(i)}
-		cb.pushVal(cb.paramInsts[key], nil)
-		delete(cb.paramInsts, key)
+	for i, n := 0, results.Len(); i < n; i++ { // return results
+		cb.pushVal(p.paramInsts[results.At(i)], nil)
+	}
+	p.paramInsts, p.ending = nil, nil // clean env
+}
+
+// needFuncBoundary reports whether stmts of an inline closure use defer or
+// recover (not in nested closures).
+func needFuncBoundary(stmts []ast.Stmt) (ret bool) {
+	for _, stmt := range stmts {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.DeferStmt:
+				ret = true
+			case *ast.CallExpr:
+				if fn, ok := n.Fun.(*ast.Ident); ok && fn.Name == "recover" {
+					ret = true
+				}
+			}
+			return !ret
+		})
 	}
-	for i, n := 0, getParamLen(sig); i < n; i++ { // clean env
-		key := closureParamInst{p, getParam(sig, i)}
-		delete(cb.paramInsts, key)
+	return
+}
+
+// escapeInline reports whether stmts of an inline closure return from its
+// caller, or break (continue) a statement of its caller.
+func escapeInline(stmts []ast.Stmt) bool {
+	escaped := false
+	v := &inlineFlows{escaped: &escaped}
+	for _, stmt := range stmts {
+		ast.Walk(v, stmt)
 	}
+	return escaped
 }
 
-// CallInlineClosureStart func
+type inlineFlows struct {
+	loops, breaks int // depth of loops, and of statements to break
+	escaped       *bool
+}
+
+func (p *inlineFlows) Visit(node ast.Node) ast.Visitor {
+	switch n := node.(type) {
+	case *ast.FuncLit:
+		return nil
+	case *ast.ReturnStmt:
+		*p.escaped = true
+	case *ast.BranchStmt:
+		if n.Label == nil { // labels are of the inline closure itself
+			switch n.Tok {
+			case token.BREAK:
+				*p.escaped = *p.escaped || p.breaks == 0
+			case token.CONTINUE:
+				*p.escaped = *p.escaped || p.loops == 0
+			}
+		}
+	case *ast.ForStmt, *ast.RangeStmt:
+		return &inlineFlows{p.loops + 1, p.breaks + 1, p.escaped}
+	case *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+		return &inlineFlows{p.loops, p.breaks + 1, p.escaped}
+	}
+	return p
+}
+
+// CallInlineClosureStart func. If the body of the inline closure uses defer or
+// recover, it's called as a real closure instead, as they depend on a function
+// boundary.
 func (p *CodeBuilder) CallInlineClosureStart(sig *types.Signature, arity int, ellipsis bool) *CodeBuilder {
 	if debugInstr {
 		log.Println("CallInlineClosureStart", arity, ellipsis)
@@ -580,8 +929,7 @@ func (p *CodeBuilder) emitVar(pkg *Package, closure *Func, param *types.Var, wit
 	} else {
 		p.NewVar(param.Type(), name)
 	}
-	key := closureParamInst{closure, param}
-	p.paramInsts[key] = p.current.scope.Lookup(name).(*types.Var)
+	closure.paramInsts[param] = p.current.scope.Lookup(name).(*types.Var)
 }
 
 // NewClosure func
@@ -673,6 +1021,49 @@ func (p *CodeBuilder) NewAutoVar(pos token.Pos, name string, pv **types.Var) *Co
 	return p
 }
 
+// NewTemp returns a temporary variable of type `typ` in the current function.
+// It reuses a temporary released by ReleaseTemp if there is one of the same
+// type in scope, otherwise it declares a new one in the current block. The
+// value of a reused temporary is the last value assigned to it.
+func (p *CodeBuilder) NewTemp(typ types.Type) *types.Var {
+	temps := p.current.temps
+	for i, v := range temps {
+		if types.Identical(v.Type(), typ) && inScope(v.Parent(), p.current.scope) {
+			if debugInstr {
+				log.Println("NewTemp", v.Name(), typ, "// reused")
+			}
+			p.current.temps = append(temps[:i], temps[i+1:]...)
+			return v
+		}
+	}
+	name := p.pkg.autoName()
+	if debugInstr {
+		log.Println("NewTemp", name, typ)
+	}
+	p.NewVar(typ, name)
+	return p.current.scope.Lookup(name).(*types.Var)
+}
+
+// ReleaseTemp releases the temporary variable `v` returned by NewTemp, so
+// that it can be reused by NewTemp after that.
+func (p *CodeBuilder) ReleaseTemp(v *types.Var) *CodeBuilder {
+	if debugInstr {
+		log.Println("ReleaseTemp", v.Name())
+	}
+	p.current.temps = append(p.current.temps, v)
+	return p
+}
+
+// inScope checks if `at` is `scope` or one of its parents.
+func inScope(at, scope *types.Scope) bool {
+	for ; scope != nil; scope = scope.Parent() {
+		if scope == at {
+			return true
+		}
+	}
+	return false
+}
+
 // VarRef func: p.VarRef(nil) means underscore (_)
 func (p *CodeBuilder) VarRef(ref interface{}, src ...ast.Node) *CodeBuilder {
 	return p.doVarRef(ref, getSrc(src), true)
@@ -692,16 +1083,8 @@ func (p *CodeBuilder) doVarRef(ref interface{}, src ast.Node, allowDebug bool) *
 			if allowDebug && debugInstr {
 				log.Println("VarRef", v.Name(), v.Type())
 			}
-			fn := p.current.fn
-			if fn != nil && fn.isInline() { // is in an inline call
-				key := closureParamInst{fn, v}
-				if arg, ok := p.paramInsts[key]; ok { // replace param with arg
-					v = arg
-				}
-			}
-			p.stk.Push(&internal.Elem{
-				Val: toObjectExpr(p.pkg, v), Type: &refType{typ: v.Type()}, Src: src,
-			})
+			v = p.paramInst(v)
+			p.stk.Push(p.stk.New(toObjectExpr(p.pkg, v), &refType{typ: v.Type()}, nil, src))
 		default:
 			code, pos := p.loadExpr(src)
 			p.panicCodeErrorf(pos, "%s is not a variable", code)
@@ -1145,7 +1528,7 @@ func (p *CodeBuilder) Slice(slice3 bool, src ...ast.Node) *CodeBuilder { // a[i:
 	if slice3 {
 		exprMax = args[3].Val
 	}
-	// TODO: check type
+	p.checkSliceIndices(args, srcExpr)
 	elem := &internal.Elem{
 		Val: &ast.SliceExpr{
 			X: x.Val, Low: args[1].Val, High: args[2].Val, Max: exprMax, Slice3: slice3,
@@ -1163,14 +1546,17 @@ func (p *CodeBuilder) Index(nidx int, twoValue bool, src ...ast.Node) *CodeBuild
 	}
 	args := p.stk.GetArgs(nidx + 1)
 	if enableTypeParams && nidx > 0 {
-		if _, ok := args[1].Type.(*TypeType); ok {
+		if _, ok := args[1].Type.(*TypeType); ok || (nidx > 1 && p.isGeneric(args[0].Type)) {
 			return p.inferType(nidx, args, src...)
 		}
 	}
+	srcExpr := getSrc(src)
 	if nidx != 1 {
+		if nidx > 1 {
+			p.panicCodeError(getSrcPos(srcExpr), "invalid operation: more than one index")
+		}
 		panic("Index doesn't support a[i, j...] yet")
 	}
-	srcExpr := getSrc(src)
 	typs, allowTwoValue := p.getIdxValTypes(args[0].Type, false, srcExpr)
 	var tyRet types.Type
 	if twoValue { // elem, ok = a[key]
@@ -1185,10 +1571,10 @@ func (p *CodeBuilder) Index(nidx int, twoValue bool, src ...ast.Node) *CodeBuild
 	} else { // elem = a[key]
 		tyRet = typs[1]
 	}
+	p.checkIndex(args[0], args[1], typs[0], allowTwoValue)
 	elem := &internal.Elem{
 		Val: &ast.IndexExpr{X: args[0].Val, Index: args[1].Val}, Type: tyRet, Src: srcExpr,
 	}
-	// TODO: check index type
 	p.stk.Ret(2, elem)
 	return p
 }
@@ -1211,9 +1597,9 @@ func (p *CodeBuilder) IndexRef(nidx int, src ...ast.Node) *CodeBuilder {
 		tyMapElem := &unboundMapElemType{key: args[1].Type, typ: t}
 		elemRef.Type = &refType{typ: tyMapElem}
 	} else {
-		typs, _ := p.getIdxValTypes(typ, true, elemRef.Src)
+		typs, isMap := p.getIdxValTypes(typ, true, elemRef.Src)
 		elemRef.Type = &refType{typ: typs[1]}
-		// TODO: check index type
+		p.checkIndex(args[0], args[1], typs[0], isMap)
 	}
 	p.stk.Ret(2, elemRef)
 	return p
@@ -1253,6 +1639,104 @@ retry:
 	return nil, false
 }
 
+// checkIndex checks the index `idx` of `x`, which must be assignable to the
+// key type of a map, or an integer (in range if it's a constant) otherwise.
+func (p *CodeBuilder) checkIndex(x, idx *internal.Elem, key types.Type, isMap bool) {
+	if isMap {
+		if err := matchType(p.pkg, idx, key, "map index"); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if v := p.checkIntIndex(idx); v >= 0 {
+		if max := p.indexLen(x); max >= 0 && v >= max {
+			src, pos := p.loadExpr(idx.Src)
+			p.panicCodeErrorf(pos, "invalid argument: index %s out of bounds [0:%d]", src, max)
+		}
+	}
+}
+
+// checkSliceIndices checks indices of a slice expression x[low:high:max]
+// (args are x, low, high and max if any). Indices must be integers, and
+// constant ones must be in range and satisfy low <= high <= max.
+func (p *CodeBuilder) checkSliceIndices(args []*internal.Elem, src ast.Node) {
+	max := p.indexLen(args[0])
+	if max >= 0 {
+		max++ // the length is a valid index of slice expressions
+	}
+	ind := make([]int64, len(args)-1)
+	for i, idx := range args[1:] {
+		ind[i] = -1
+		if idx.Val == nil { // omitted
+			continue
+		}
+		if v := p.checkIntIndex(idx); v >= 0 {
+			if max >= 0 && v >= max {
+				src, pos := p.loadExpr(idx.Src)
+				p.panicCodeErrorf(pos, "invalid argument: index %s out of bounds [0:%d]", src, max)
+			}
+			ind[i] = v
+		}
+	}
+	for i, x := range ind {
+		for j := i + 1; j < len(ind); j++ {
+			if y := ind[j]; y >= 0 && y < x {
+				pos := getSrcPos(args[j+1].Src)
+				if pos == token.NoPos {
+					pos = getSrcPos(src)
+				}
+				p.panicCodeErrorf(pos, "invalid slice indices: %d < %d", y, x)
+			}
+		}
+	}
+}
+
+// checkIntIndex checks an index `idx` which must be an integer. It returns
+// the value of `idx` if it's a constant, or -1 otherwise.
+func (p *CodeBuilder) checkIntIndex(idx *internal.Elem) int64 {
+	if idx.CVal == nil {
+		if _, ok := idx.Type.(*types.TypeParam); !ok && !isNormalInt(p, idx) {
+			src, pos := p.loadExpr(idx.Src)
+			p.panicCodeErrorf(pos, "invalid argument: index %s (type %v) must be integer", src, idx.Type)
+		}
+		return -1
+	}
+	v := constant.ToInt(idx.CVal)
+	if v.Kind() != constant.Int || (!isUntyped(p.pkg, idx.Type) && !isNormalInt(p, idx)) {
+		src, pos := p.loadExpr(idx.Src)
+		p.panicCodeErrorf(pos, "invalid argument: index %s (type %v) must be integer", src, idx.Type)
+	}
+	if constant.Sign(v) < 0 {
+		src, pos := p.loadExpr(idx.Src)
+		p.panicCodeErrorf(pos, "invalid argument: index %s (constant of type %v) must not be negative", src, types.Default(idx.Type))
+	}
+	n, ok := constant.Int64Val(v)
+	if !ok {
+		src, pos := p.loadExpr(idx.Src)
+		p.panicCodeErrorf(pos, "invalid argument: index %s overflows int", src)
+	}
+	return n
+}
+
+// indexLen returns the length of `x` if it's known (an array, a pointer to
+// array or a constant string), or -1 otherwise.
+func (p *CodeBuilder) indexLen(x *internal.Elem) int64 {
+	if x.CVal != nil && x.CVal.Kind() == constant.String {
+		return int64(len(constant.StringVal(x.CVal)))
+	}
+	typ := x.Type
+	if t, ok := typ.(*types.Pointer); ok {
+		typ = t.Elem()
+	}
+	if t, ok := typ.(*types.Named); ok {
+		typ = p.getUnderlying(t)
+	}
+	if t, ok := typ.(*types.Array); ok {
+		return t.Len()
+	}
+	return -1
+}
+
 var (
 	tyInt = types.Typ[types.Int]
 )
@@ -1335,16 +1819,24 @@ func (p *CodeBuilder) Val(v interface{}, src ...ast.Node) *CodeBuilder {
 			log.Println("Val", v, reflect.TypeOf(v))
 		}
 	}
-	fn := p.current.fn
-	if fn != nil && fn.isInline() { // is in an inline call
-		if param, ok := v.(*types.Var); ok {
-			key := closureParamInst{fn, param}
-			if arg, ok := p.paramInsts[key]; ok { // replace param with arg
-				v = arg
+	if param, ok := v.(*types.Var); ok {
+		v = p.paramInst(param)
+	}
+	return p.pushVal(v, getSrc(src))
+}
+
+// paramInst returns the instance of `v` if it's a param (or result) of an
+// open inline closure, which can be referenced in closures nested in it,
+// otherwise it returns `v`.
+func (p *CodeBuilder) paramInst(v *types.Var) *types.Var {
+	for fn := p.current.fn; fn != nil; fn = fn.old.fn {
+		if fn.isInline() {
+			if arg, ok := fn.paramInsts[v]; ok { // replace param with arg
+				return arg
 			}
 		}
 	}
-	return p.pushVal(v, getSrc(src))
+	return v
 }
 
 func (p *CodeBuilder) pushVal(v interface{}, src ast.Node) *CodeBuilder {
@@ -1557,11 +2049,20 @@ func (p *CodeBuilder) Member(name string, flag MemberFlag, src ...ast.Node) (kin
 }
 
 func (p *CodeBuilder) getUnderlying(t *types.Named) types.Type {
+	if u, ok := p.underlyings[t]; ok {
+		return u
+	}
 	u := t.Underlying()
 	if u == nil {
 		p.loadNamed(p.pkg, t)
 		u = t.Underlying()
 	}
+	if u != nil && u != types.Typ[types.Invalid] { // don't memoize an uninitialized type
+		if p.underlyings == nil {
+			p.underlyings = make(map[*types.Named]types.Type)
+		}
+		p.underlyings[t] = u
+	}
 	return u
 }
 
@@ -1578,14 +2079,10 @@ func (p *CodeBuilder) ensureLoaded(typ types.Type) {
 }
 
 func getUnderlying(pkg *Package, typ types.Type) types.Type {
-	u := typ.Underlying()
-	if u == nil {
-		if t, ok := typ.(*types.Named); ok {
-			pkg.cb.loadNamed(pkg, t)
-			u = t.Underlying()
-		}
+	if t, ok := typ.(*types.Named); ok {
+		return pkg.cb.getUnderlying(t)
 	}
-	return u
+	return typ.Underlying()
 }
 
 func (p *CodeBuilder) findMember(
@@ -1690,6 +2187,7 @@ func (p *CodeBuilder) method(
 				Type: methodTypeOf(typ),
 				Src:  src,
 			})
+			p.recordInitDep(method)
 			if p.rec != nil {
 				p.rec.Member(src, method)
 			}
@@ -2051,8 +2549,8 @@ retry:
 		checkDivisionByZero(cb, args[0], args[1])
 	}
 	if op == token.EQL || op == token.NEQ {
-		if !ComparableTo(pkg, args[0], args[1]) {
-			return nil, errors.New("mismatched types")
+		if err = CheckComparable(pkg, args[0], args[1]); err != nil {
+			return
 		}
 		ret = &internal.Elem{
 			Val: &ast.BinaryExpr{
@@ -2085,6 +2583,12 @@ func (p *CodeBuilder) BinaryOp(op token.Token, src ...ast.Node) *CodeBuilder {
 		if src == "" {
 			src = op.String()
 		}
+		if tyNil := types.Typ[types.UntypedNil]; args[0].Type == tyNil && args[1].Type == tyNil {
+			p.panicCodeErrorf(pos, "invalid operation: %s (operator %v not defined on nil)", src, op)
+		}
+		if e, ok := err.(*comparableError); ok {
+			p.panicCodeErrorf(pos, "invalid operation: %s (%v)", src, e.reason)
+		}
 		p.panicCodeErrorf(
 			pos, "invalid operation: %s (mismatched types %v and %v)", src, args[0].Type, args[1].Type)
 	}
@@ -2130,7 +2634,7 @@ var (
 
 // CompareNil func
 func (p *CodeBuilder) CompareNil(op token.Token, src ...ast.Node) *CodeBuilder {
-	return p.Val(nil).BinaryOp(op)
+	return p.Val(nil).BinaryOp(op, src...)
 }
 
 // UnaryOp:
@@ -2152,7 +2656,11 @@ func (p *CodeBuilder) UnaryOp(op token.Token, params ...interface{}) *CodeBuilde
 	if debugInstr {
 		log.Println("UnaryOp", op, "flags:", flags)
 	}
-	ret, err := callOpFunc(p, op, unaryOps[:], p.stk.GetArgs(1), flags)
+	args := p.stk.GetArgs(1)
+	if args[0].Type == types.Typ[types.UntypedNil] {
+		p.panicCodeErrorf(getSrcPos(src), "invalid operation: operator %v not defined on nil", op)
+	}
+	ret, err := callOpFunc(p, op, unaryOps[:], args, flags)
 	if err != nil {
 		panic(err)
 	}
@@ -2161,6 +2669,284 @@ func (p *CodeBuilder) UnaryOp(op token.Token, params ...interface{}) *CodeBuilde
 	return p
 }
 
+// TernaryMode specifies how Ternary lowers a conditional expression.
+type TernaryMode int
+
+const (
+	// TernaryClosure lowers `cond ? a : b` to an immediately-invoked closure:
+	//
+	//	func() T {
+	//		if cond {
+	//			return a
+	//		}
+	//		return b
+	//	}()
+	TernaryClosure TernaryMode = iota
+
+	// TernaryTempVar lowers `cond ? a : b` to a temporary variable assigned
+	// by an if statement right before the current statement:
+	//
+	//	var _autoGo_1 T
+	//	if cond {
+	//		_autoGo_1 = a
+	//	} else {
+	//		_autoGo_1 = b
+	//	}
+	//
+	// It falls back to TernaryClosure at package level and in the header of
+	// an if, for or switch statement, where no statements can be emitted. It
+	// also falls back when operands on the stack before cond have calls or
+	// receive operations, which would be evaluated after the hoisted ones.
+	TernaryTempVar
+)
+
+// Ternary takes cond, a and b on the top of the stack and pushes the value of
+// the conditional expression `cond ? a : b`. Type of the expression T is
+// unified from types of a and b.
+func (p *CodeBuilder) Ternary(mode TernaryMode, src ...ast.Node) *CodeBuilder {
+	if debugInstr {
+		log.Println("Ternary", mode)
+	}
+	args := p.stk.GetArgs(3)
+	cond, a, b := args[0], args[1], args[2]
+	if t, ok := cond.Type.Underlying().(*types.Basic); !ok || t.Info()&types.IsBoolean == 0 {
+		code, pos := p.loadExpr(cond.Src)
+		p.panicCodeErrorf(pos, "non-boolean condition in conditional expression: %s", code)
+	}
+	typ := p.ternaryType(a, b, src)
+	if mode == TernaryTempVar && (p.current.fn == nil || p.inStmtHeader() || p.hasEffectsBefore(3)) {
+		mode = TernaryClosure
+	}
+	p.stk.PopN(3)
+	pkg := p.pkg
+	if mode == TernaryTempVar {
+		name := pkg.autoName()
+		p.NewVar(typ, name)
+		v := p.current.scope.Lookup(name)
+		p.If()
+		p.stk.Push(cond)
+		p.Then().VarRef(v)
+		p.stk.Push(a)
+		p.Assign(1).Else().VarRef(v)
+		p.stk.Push(b)
+		p.Assign(1).End()
+		return p.Val(v, src...)
+	}
+	ret := NewTuple(pkg.NewParam(token.NoPos, "", typ))
+	p.NewClosure(nil, ret, false).BodyStart(pkg).If()
+	p.stk.Push(cond)
+	p.Then()
+	p.stk.Push(a)
+	p.Return(1).End()
+	p.stk.Push(b)
+	return p.Return(1).End().Call(0)
+}
+
+// inStmtHeader checks if the current block is the header (init, cond or post
+// statement) of an if, for or switch statement.
+func (p *CodeBuilder) inStmtHeader() bool {
+	switch t := p.current.codeBlock.(type) {
+	case *ifStmt:
+		return t.cond == nil
+	case *forStmt:
+		return t.body != nil || t.old2.codeBlock == nil
+	case *switchStmt:
+		return t.tag == nil
+	}
+	return false
+}
+
+// hasEffectsBefore checks if operands of the current block on the stack,
+// except the top `n` ones, have function calls or receive operations, whose
+// order of evaluation is specified.
+func (p *CodeBuilder) hasEffectsBefore(n int) bool {
+	m := p.stk.Len() - p.current.base - n
+	if m <= 0 {
+		return false
+	}
+	for _, arg := range p.stk.GetArgs(m + n)[:m] {
+		if arg.CVal == nil && hasEffects(arg.Val) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasEffects(expr ast.Expr) (ret bool) {
+	ast.Inspect(expr, func(node ast.Node) bool {
+		switch v := node.(type) {
+		case *ast.CallExpr:
+			ret = true
+		case *ast.UnaryExpr:
+			ret = v.Op == token.ARROW
+		case *ast.FuncLit: // body of a closure isn't evaluated here
+			return false
+		}
+		return !ret
+	})
+	return
+}
+
+func (p *CodeBuilder) ternaryType(a, b *internal.Elem, src []ast.Node) types.Type {
+	pkg := p.pkg
+	ta, tb := a.Type, b.Type
+	if types.Identical(ta, tb) {
+		if ta == types.Typ[types.UntypedNil] {
+			p.panicCodeError(getPos(src), "use of untyped nil in conditional expression")
+		}
+		return Default(pkg, ta)
+	}
+	untypedA, untypedB := isUntyped(pkg, ta), isUntyped(pkg, tb)
+	switch {
+	case untypedA && untypedB:
+		if t := commonType(pkg, ta, tb); t != nil {
+			return Default(pkg, t)
+		}
+	case untypedA:
+		if AssignableTo(pkg, ta, tb) {
+			return tb
+		}
+	case untypedB:
+		if AssignableTo(pkg, tb, ta) {
+			return ta
+		}
+	default:
+		if AssignableTo(pkg, ta, tb) {
+			return tb
+		}
+		if AssignableTo(pkg, tb, ta) {
+			return ta
+		}
+	}
+	p.panicCodeErrorf(getPos(src), "mismatched types %v and %v in conditional expression", ta, tb)
+	return nil
+}
+
+// OptionalChain takes x on the top of the stack and pushes the value of the
+// optional chaining expression `x?.name0?.name1...`, which is the zero value
+// if any intermediate value is nil. If twoValue is true, it pushes an extra
+// bool value reporting whether the whole chain is evaluated. Member access of
+// a pointer or an interface is guarded by a nil check, and member access of a
+// map is lowered to a comma-ok index expression:
+//
+//	var _autoGo_1 T
+//	var _autoGo_2 bool // if twoValue
+//	if x != nil {
+//		if _autoGo_3, _autoGo_4 := x.name0["name1"]; _autoGo_4 {
+//			_autoGo_1, _autoGo_2 = _autoGo_3.name2, true
+//		}
+//	}
+func (p *CodeBuilder) OptionalChain(names []string, twoValue bool, src ...ast.Node) *CodeBuilder {
+	if debugInstr {
+		log.Println("OptionalChain", names, twoValue)
+	}
+	if len(names) == 0 {
+		panic("OptionalChain: no member")
+	}
+	x := p.stk.Get(-1)
+	typ := p.optionalChainType(x, names, src)
+	p.stk.Pop()
+	pkg := p.pkg
+	name := pkg.autoName()
+	p.NewVar(typ, name)
+	vars := []types.Object{p.current.scope.Lookup(name)}
+	if twoValue {
+		name = pkg.autoName()
+		p.NewVar(types.Typ[types.Bool], name)
+		vars = append(vars, p.current.scope.Lookup(name))
+	}
+	nif, last := 0, len(names)-1
+	cur := x
+	for i, name := range names {
+		switch p.optionalUnderlying(cur.Type).(type) {
+		case *types.Map:
+			if i == last {
+				for _, v := range vars {
+					p.VarRef(v)
+				}
+				p.stk.Push(cur)
+				p.Val(name).Index(1, twoValue).Assign(len(vars), 1)
+				continue
+			}
+			v, ok := pkg.autoName(), pkg.autoName()
+			p.If().DefineVarStart(token.NoPos, v, ok)
+			p.stk.Push(cur)
+			p.Val(name).Index(1, true).EndInit(1).
+				VarVal(ok).Then()
+			cur = p.VarVal(v).stk.Pop()
+			nif++
+			continue
+		case *types.Pointer, *types.Interface:
+			p.If()
+			if _, ok := cur.Val.(*ast.Ident); !ok {
+				v := pkg.autoName()
+				p.DefineVarStart(token.NoPos, v)
+				p.stk.Push(cur)
+				p.EndInit(1)
+				cur = p.VarVal(v).stk.Pop()
+			}
+			p.stk.Push(cur)
+			p.Val(nil).BinaryOp(token.NEQ).Then()
+			nif++
+		}
+		p.stk.Push(cur)
+		p.MemberVal(name)
+		if i == last {
+			val := p.stk.Pop()
+			for _, v := range vars {
+				p.VarRef(v)
+			}
+			p.stk.Push(val)
+			if twoValue {
+				p.Val(true)
+			}
+			p.Assign(len(vars), len(vars))
+		} else {
+			cur = p.stk.Pop()
+		}
+	}
+	for ; nif > 0; nif-- {
+		p.End()
+	}
+	for _, v := range vars {
+		p.Val(v, src...)
+	}
+	return p
+}
+
+// optionalChainType computes the type of an optional chain by MemberVal on
+// fake elements, with the recorder and recording of init dependencies
+// suppressed, as the expressions are never emitted.
+func (p *CodeBuilder) optionalChainType(x *internal.Elem, names []string, src []ast.Node) types.Type {
+	rec, probing := p.rec, p.probing
+	p.rec, p.probing = nil, true
+	defer func() {
+		p.rec, p.probing = rec, probing
+	}()
+	t := x.Type
+	for _, name := range names {
+		if m, ok := p.optionalUnderlying(t).(*types.Map); ok {
+			if !AssignableTo(p.pkg, types.Typ[types.UntypedString], m.Key()) {
+				code, pos := p.loadExpr(getSrc(src))
+				p.panicCodeErrorf(pos, "invalid optional chain %s (map key type %v isn't string)", code, m.Key())
+			}
+			t = m.Elem()
+			continue
+		}
+		p.stk.Push(&internal.Elem{Val: x.Val, Type: t})
+		p.MemberVal(name, src...)
+		t = p.stk.Pop().Type
+	}
+	return t
+}
+
+func (p *CodeBuilder) optionalUnderlying(t types.Type) types.Type {
+	if named, ok := t.(*types.Named); ok {
+		return p.getUnderlying(named)
+	}
+	return t.Underlying()
+}
+
 // Send func
 func (p *CodeBuilder) Send() *CodeBuilder {
 	if debugInstr {
@@ -2168,7 +2954,22 @@ func (p *CodeBuilder) Send() *CodeBuilder {
 	}
 	val := p.stk.Pop()
 	ch := p.stk.Pop()
-	// TODO: check types
+	typ := ch.Type
+	if t, ok := typ.(*types.Named); ok {
+		typ = p.getUnderlying(t)
+	}
+	t, ok := typ.(*types.Chan)
+	if !ok {
+		src, pos := p.loadExpr(ch.Src)
+		p.panicCodeErrorf(pos, "invalid operation: cannot send to non-channel %s (type %v)", src, ch.Type)
+	}
+	if t.Dir() == types.RecvOnly {
+		src, pos := p.loadExpr(ch.Src)
+		p.panicCodeErrorf(pos, "invalid operation: cannot send to receive-only channel %s (type %v)", src, ch.Type)
+	}
+	if err := matchType(p.pkg, val, t.Elem(), "send"); err != nil {
+		panic(err)
+	}
 	p.emitStmt(&ast.SendStmt{Chan: ch.Val, Value: val.Val})
 	return p
 }
@@ -2187,6 +2988,110 @@ func (p *CodeBuilder) Defer() *CodeBuilder {
 	return p
 }
 
+// namedErrResult returns the last result of the current function if it's a
+// named error, otherwise nil.
+func (p *CodeBuilder) namedErrResult() *types.Var {
+	results := p.current.fn.Type().(*types.Signature).Results()
+	if n := results.Len(); n > 0 {
+		if v := results.At(n - 1); v.Type() == TyError && v.Name() != "" && v.Name() != "_" {
+			return v
+		}
+	}
+	return nil
+}
+
+// freshName returns `name` if it isn't declared in the current scope (or its
+// parents), otherwise an auto-generated name.
+func (p *CodeBuilder) freshName(name string) string {
+	if _, o := p.current.scope.LookupParent(name, token.NoPos); o != nil {
+		return p.pkg.autoName()
+	}
+	return name
+}
+
+// DeferClose takes a value on the top of the stack and generates
+// `defer x.Close()`. If the current function has a named error result `err`
+// and Close returns an error, the error is captured into it:
+//
+//	defer func(x T) {
+//		if cerr := x.Close(); cerr != nil && err == nil {
+//			err = cerr
+//		}
+//	}(x)
+//
+// x (or &x if Close is a method of *T) is passed as an argument, so it's
+// evaluated when defer executes, as `defer x.Close()` does. The names `x` and `cerr` are replaced by
+// auto-generated ones if they are declared already.
+func (p *CodeBuilder) DeferClose(src ...ast.Node) *CodeBuilder {
+	if debugInstr {
+		log.Println("DeferClose")
+	}
+	x := p.stk.Get(-1)
+	p.MemberVal("Close", src...)
+	sig, ok := p.stk.Get(-1).Type.(*types.Signature)
+	err := p.namedErrResult()
+	if !ok || err == nil || sig.Results().Len() != 1 || sig.Results().At(0).Type() != TyError {
+		return p.Call(0).Defer()
+	}
+	p.stk.Pop()
+	pkg := p.pkg
+	typ := x.Type
+	if o, _, _ := types.LookupFieldOrMethod(typ, false, pkg.Types, "Close"); o == nil { // Close of *T
+		typ = types.NewPointer(typ)
+	}
+	params := NewTuple(pkg.NewParam(token.NoPos, p.freshName("x"), typ))
+	p.NewClosure(params, nil, false).BodyStart(pkg)
+	cerr := p.freshName("cerr")
+	p.If().DefineVarStart(token.NoPos, cerr).Val(params.At(0)).MemberVal("Close").Call(0).EndInit(1).
+		VarVal(cerr).CompareNil(token.NEQ).Val(err).CompareNil(token.EQL).BinaryOp(token.LAND).Then().
+		/**/ VarRef(err).VarVal(cerr).Assign(1).
+		End().
+		End()
+	p.stk.Push(x)
+	if typ != x.Type {
+		p.UnaryOp(token.AND)
+	}
+	return p.Call(1).Defer()
+}
+
+// DeferUnlock takes a value on the top of the stack (eg. a sync.Mutex) and
+// generates `defer x.Unlock()`.
+func (p *CodeBuilder) DeferUnlock(src ...ast.Node) *CodeBuilder {
+	if debugInstr {
+		log.Println("DeferUnlock")
+	}
+	return p.MemberVal("Unlock", src...).Call(0).Defer()
+}
+
+// DeferRecover generates the following code to convert a panic into the named
+// error result `err` of the current function:
+//
+//	defer func() {
+//		if e := recover(); e != nil {
+//			err = fmt.Errorf("%v", e)
+//		}
+//	}()
+//
+// The name `e` is replaced by an auto-generated one if it's declared already.
+func (p *CodeBuilder) DeferRecover() *CodeBuilder {
+	if debugInstr {
+		log.Println("DeferRecover")
+	}
+	err := p.namedErrResult()
+	if err == nil {
+		panic("DeferRecover: the last result of the function isn't a named error")
+	}
+	pkg := p.pkg
+	p.NewClosure(nil, nil, false).BodyStart(pkg)
+	e := p.freshName("e")
+	return p.If().DefineVarStart(token.NoPos, e).Val(pkg.Builtin().Ref("recover")).Call(0).EndInit(1).
+		/**/ VarVal(e).CompareNil(token.NEQ).Then().
+		/**/ VarRef(err).Val(pkg.Import("fmt").Ref("Errorf")).Val("%v").VarVal(e).Call(2).Assign(1).
+		End().
+		End().
+		Call(0).Defer()
+}
+
 // Go func
 func (p *CodeBuilder) Go() *CodeBuilder {
 	if debugInstr {
@@ -2211,6 +3116,42 @@ func (p *CodeBuilder) Block(src ...ast.Node) *CodeBuilder {
 	return p
 }
 
+// AssertMode specifies how statements of an assert block are emitted.
+type AssertMode int
+
+const (
+	// AssertAlways emits assert blocks as plain block statements.
+	AssertAlways AssertMode = iota
+	// AssertDebug guards assert blocks by `if debugAsserts { ... }`. The
+	// debugAsserts constant is defined in AssertDebugFile (true) and
+	// AssertReleaseFile (false), selected by the `debug` build tag.
+	AssertDebug
+	// AssertNever strips assert blocks from generated code.
+	AssertNever
+)
+
+// SetAssertMode sets how following assert blocks are emitted.
+func (p *CodeBuilder) SetAssertMode(mode AssertMode) *CodeBuilder {
+	p.assertMode = mode
+	return p
+}
+
+// AssertMode returns how assert blocks are emitted.
+func (p *CodeBuilder) AssertMode() AssertMode {
+	return p.assertMode
+}
+
+// Assert starts an assert block, whose statements are emitted according to
+// the current AssertMode.
+func (p *CodeBuilder) Assert(src ...ast.Node) *CodeBuilder {
+	if debugInstr {
+		log.Println("Assert")
+	}
+	stmt := &assertStmt{}
+	p.startBlockStmt(stmt, src, "assert statement", &stmt.old)
+	return p
+}
+
 // VBlock starts a vblock statement.
 func (p *CodeBuilder) VBlock() *CodeBuilder {
 	if debugInstr {
@@ -2374,14 +3315,13 @@ func (p *CodeBuilder) Select(src ...ast.Node) *CodeBuilder {
 	return p
 }
 
-// CommCase starts case body of a select..case statement.
+// CommCase starts case body of a select..case statement. n=0 means the
+// default case, and n=1 means a case of the last statement, which must be a
+// send statement or a receive operation (which may be assigned to variables).
 func (p *CodeBuilder) CommCase(n int, src ...ast.Node) *CodeBuilder {
 	if debugInstr {
 		log.Println("CommCase", n)
 	}
-	if n > 1 {
-		panic("TODO: multi commStmt in select..case?")
-	}
 	if flow, ok := p.current.codeBlock.(*selectStmt); ok {
 		flow.CommCase(p, n, src...)
 		return p
@@ -2491,15 +3431,19 @@ func (p *CodeBuilder) Continue(l *Label) *CodeBuilder {
 }
 
 // Fallthrough func
-func (p *CodeBuilder) Fallthrough() *CodeBuilder {
+func (p *CodeBuilder) Fallthrough(src ...ast.Node) *CodeBuilder {
 	if debugInstr {
 		log.Println("Fallthrough")
 	}
-	if flow, ok := p.current.codeBlock.(*caseStmt); ok {
-		flow.Fallthrough(p)
-		return p
+	switch flow := p.current.codeBlock.(type) {
+	case *caseStmt:
+		flow.Fallthrough(p, getPos(src))
+	case *typeCaseStmt:
+		p.panicCodeError(getPos(src), "cannot fallthrough in type switch")
+	default:
+		p.panicCodeError(getPos(src), "fallthrough statement out of place")
 	}
-	panic("please use fallthrough in case statement")
+	return p
 }
 
 // For func
@@ -2559,6 +3503,176 @@ func (p *CodeBuilder) ResetStmt() {
 	p.stk.SetLen(p.current.base)
 }
 
+// Guard builds a statement by calling `stmt`. In ErrorCollect mode, if an
+// error of the code (a CodeError, MatchError or ImportError) is raised, Guard
+// records it and drops the statement (or the declaration at package level)
+// partially built, including the blocks it opened, names it declared and
+// imported packages it referred to, so that building can go on with the next
+// statement. In ErrorPanic mode, it just
+// calls `stmt`.
+func (p *CodeBuilder) Guard(stmt func(cb *CodeBuilder)) *CodeBuilder {
+	if p.errMode != ErrorCollect {
+		stmt(p)
+	} else {
+		p.guard(stmt)
+	}
+	return p
+}
+
+func (p *CodeBuilder) guard(stmt func(cb *CodeBuilder)) {
+	current, valDecl := p.current, p.valDecl
+	nstk, nblocks := p.stk.Len(), len(p.blocks)
+	scope := current.scope
+	names := scope.Names()
+	pkg, file := p.pkg, p.pkg.file
+	ndecls, nvarDecls := len(file.decls), len(pkg.varDecls)
+	var last *ast.GenDecl // specs can be added to it by VarDefs, etc.
+	var nspecs int
+	if ndecls > 0 {
+		if last, _ = file.decls[ndecls-1].(*ast.GenDecl); last != nil {
+			nspecs = len(last.Specs)
+		}
+	}
+	mark := file.startRefLog()
+	defer func() {
+		e := recover()
+		if e == nil {
+			file.endRefLog(mark, false)
+			return
+		}
+		p.recordErr(codeErrorOf(e))
+		file.endRefLog(mark, true)
+		p.current, p.valDecl = current, valDecl
+		if scope.Len() != len(names) {
+			deleteNames(scope, names)
+		}
+		p.stk.SetLen(nstk)
+		p.blocks = p.blocks[:nblocks]
+		if len(file.decls) > ndecls { // declarations at package level
+			file.decls = file.decls[:ndecls]
+		}
+		if last != nil && len(last.Specs) > nspecs {
+			last.Specs = last.Specs[:nspecs]
+		}
+		pkg.varDecls = pkg.varDecls[:nvarDecls]
+	}()
+	stmt(p)
+}
+
+// deleteNames deletes names declared in `scope` since it had `names`. As
+// types.Scope provides no way to delete a name, they are deleted from its map
+// of objects directly, so that objects left still report `scope` as their
+// parent.
+func deleteNames(scope *types.Scope, names []string) {
+	elems := reflect.ValueOf(scope).Elem().FieldByName("elems")
+	if elems.Kind() != reflect.Map {
+		log.Panicln("deleteNames: unknown layout of types.Scope")
+	}
+	elems = reflect.NewAt(elems.Type(), unsafe.Pointer(elems.UnsafeAddr())).Elem()
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	for _, name := range scope.Names() {
+		if !keep[name] {
+			elems.SetMapIndex(reflect.ValueOf(name), reflect.Value{})
+		}
+	}
+}
+
+// codeErrorOf returns `e` recovered from a panic if it is an error of the code
+// (a CodeError, MatchError or ImportError), or panics again.
+func codeErrorOf(e interface{}) error {
+	switch e.(type) {
+	case *CodeError, *MatchError, *ImportError:
+		return e.(error)
+	}
+	panic(e)
+}
+
+// tryInstr executes the instruction `instr` taking `arity` values from the
+// stack. If it raises an error of the code, tryInstr restores the values taken
+// and returns the error.
+func (p *CodeBuilder) tryInstr(arity int, instr func()) (err error) {
+	args := append([]*internal.Elem(nil), p.stk.GetArgs(arity)...)
+	vals := make([]internal.Elem, arity)
+	for i, arg := range args {
+		vals[i] = *arg
+	}
+	base := p.stk.Len() - arity
+	defer func() {
+		if e := recover(); e != nil {
+			err = codeErrorOf(e)
+			for i, arg := range args {
+				*arg = vals[i]
+			}
+			p.stk.SetLen(base)
+			p.stk.Ret(0, args...)
+		}
+	}()
+	instr()
+	return
+}
+
+// CallEx is like CallWith, but returns the error instead of panicking if the
+// call is invalid, in which case the stack isn't changed.
+func (p *CodeBuilder) CallEx(n int, flags InstrFlags, src ...ast.Node) error {
+	arity := n + 1
+	if _, ok := p.stk.Get(-arity).Type.(*btiMethodType); ok {
+		arity++
+	}
+	return p.tryInstr(arity, func() {
+		p.CallWith(n, flags, src...)
+	})
+}
+
+// MemberValEx is like MemberVal, but returns the kind of the member, and the
+// error instead of panicking if there is no such member, in which case the
+// stack isn't changed.
+func (p *CodeBuilder) MemberValEx(name string, src ...ast.Node) (kind MemberKind, err error) {
+	return p.memberEx(name, MemberFlagVal, src)
+}
+
+// MemberRefEx is like MemberRef, but returns the kind of the member, and the
+// error instead of panicking if there is no such member, in which case the
+// stack isn't changed.
+func (p *CodeBuilder) MemberRefEx(name string, src ...ast.Node) (kind MemberKind, err error) {
+	return p.memberEx(name, MemberFlagRef, src)
+}
+
+func (p *CodeBuilder) memberEx(name string, flag MemberFlag, src []ast.Node) (kind MemberKind, err error) {
+	if e := p.tryInstr(1, func() {
+		kind, err = p.Member(name, flag, src...)
+	}); e != nil {
+		return MemberInvalid, e
+	}
+	return
+}
+
+// BinaryOpEx is like BinaryOp, but returns the error instead of panicking if
+// the operation is invalid, in which case the stack isn't changed.
+func (p *CodeBuilder) BinaryOpEx(op token.Token, src ...ast.Node) error {
+	return p.tryInstr(2, func() {
+		p.BinaryOp(op, src...)
+	})
+}
+
+// UnaryOpEx is like UnaryOp, but returns the error instead of panicking if the
+// operation is invalid, in which case the stack isn't changed.
+func (p *CodeBuilder) UnaryOpEx(op token.Token, params ...interface{}) error {
+	return p.tryInstr(1, func() {
+		p.UnaryOp(op, params...)
+	})
+}
+
+// IndexEx is like Index, but returns the error instead of panicking if the
+// index expression is invalid, in which case the stack isn't changed.
+func (p *CodeBuilder) IndexEx(nidx int, twoValue bool, src ...ast.Node) error {
+	return p.tryInstr(nidx+1, func() {
+		p.Index(nidx, twoValue, src...)
+	})
+}
+
 // EndStmt func
 func (p *CodeBuilder) EndStmt() *CodeBuilder {
 	n := p.stk.Len() - p.current.base
@@ -2567,7 +3681,7 @@ func (p *CodeBuilder) EndStmt() *CodeBuilder {
 			panic("syntax error: unexpected newline, expecting := or = or comma")
 		}
 		if e := p.stk.Pop(); p.noSkipConst || e.CVal == nil { // skip constant
-			p.emitStmt(&ast.ExprStmt{X: e.Val})
+			p.emitStmt(p.pkg.newExprStmt(e.Val))
 		}
 	}
 	return p
@@ -2627,6 +3741,45 @@ func (p *CodeBuilder) Get(idx int) *Element {
 	return p.stk.Get(idx)
 }
 
+// EvalConst evaluates the expression at index `idx` of the stack (like Get,
+// -1 means the top of the stack) as a constant expression, so that frontends
+// can check constant contexts like array lengths and case labels. It returns
+// the value and type of the constant (which is untyped if the expression is),
+// or an error if the expression isn't constant or its value overflows its
+// type.
+func (p *CodeBuilder) EvalConst(idx int) (constant.Value, types.Type, error) {
+	e := p.stk.Get(idx)
+	src, pos := p.loadExpr(e.Src)
+	if e.CVal == nil || e.CVal.Kind() == constant.Unknown {
+		if src == "" {
+			return nil, e.Type, p.newCodeErrorf(pos, "value of type %v is not constant", e.Type)
+		}
+		return nil, e.Type, p.newCodeErrorf(pos, "%s (value of type %v) is not constant", src, e.Type)
+	}
+	val := e.CVal
+	if t, ok := e.Type.Underlying().(*types.Basic); ok && t.Info()&types.IsUntyped == 0 {
+		info, kind := t.Info(), t.Kind()
+		switch {
+		case info&types.IsInteger != 0:
+			if val = constant.ToInt(val); val.Kind() != constant.Int {
+				return nil, e.Type, p.newCodeErrorf(pos, "constant %v truncated to integer", e.CVal)
+			}
+			if outOfRange(kind, val) {
+				return nil, e.Type, p.newCodeErrorf(pos, "constant %v overflows %v", val, e.Type)
+			}
+		case info&types.IsFloat != 0:
+			val = constant.ToFloat(val)
+			if f, _ := constant.Float64Val(val); kind == types.Float32 && math.IsInf(float64(float32(f)), 0) ||
+				math.IsInf(f, 0) {
+				return nil, e.Type, p.newCodeErrorf(pos, "constant %v overflows %v", val, e.Type)
+			}
+		case info&types.IsComplex != 0:
+			val = constant.ToComplex(val)
+		}
+	}
+	return val, e.Type, nil
+}
+
 // ----------------------------------------------------------------------------
 
 type InternalStack = internal.Stack
@@ -0,0 +1,145 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"fmt"
+	"go/token"
+	"go/types"
+	"log"
+)
+
+// ----------------------------------------------------------------------------
+
+// MismatchKind represents why a type doesn't implement an interface or isn't
+// assignable to another type.
+type MismatchKind int
+
+const (
+	// MismatchType means the types just don't match.
+	MismatchType MismatchKind = iota
+
+	// MismatchMissingMethod means a method of the interface is missing.
+	MismatchMissingMethod
+
+	// MismatchWrongMethod means a method of the interface has a different
+	// signature.
+	MismatchWrongMethod
+
+	// MismatchPointerRecv means a method of the interface has a pointer
+	// receiver, so that only the pointer type implements the interface.
+	MismatchPointerRecv
+)
+
+// Mismatch explains why the type V doesn't implement the interface T, or
+// why a value of V isn't assignable to T. Frontends can build their own
+// diagnostics on it, or just use its Error message.
+type Mismatch struct {
+	Kind MismatchKind
+	V, T types.Type
+
+	// Method is the method of the interface which V doesn't have (not nil
+	// unless Kind is MismatchType).
+	Method *types.Func
+
+	// Have is the method of V with the wrong signature (not nil if Kind is
+	// MismatchWrongMethod).
+	Have *types.Func
+}
+
+func (p *Mismatch) Error() string {
+	switch p.Kind {
+	case MismatchMissingMethod:
+		return fmt.Sprintf("%v does not implement %v (missing method %s)", p.V, p.T, p.Method.Name())
+	case MismatchWrongMethod:
+		return fmt.Sprintf("%v does not implement %v (wrong type for method %s: have %v, want %v)",
+			p.V, p.T, p.Method.Name(), p.Have.Type(), p.Method.Type())
+	case MismatchPointerRecv:
+		return fmt.Sprintf("%v does not implement %v (method %s has pointer receiver)", p.V, p.T, p.Method.Name())
+	}
+	return fmt.Sprintf("cannot use type %v as type %v", p.V, p.T)
+}
+
+// CheckImplements checks whether the type V implements the interface T (or a
+// named type whose underlying type is an interface). It returns nil if it
+// does, otherwise a Mismatch explaining why not.
+func CheckImplements(pkg *Package, V, T types.Type) *Mismatch {
+	pkg.cb.ensureLoaded(V)
+	pkg.cb.ensureLoaded(T)
+	it, ok := getUnderlying(pkg, T).(*types.Interface)
+	if !ok {
+		return &Mismatch{Kind: MismatchType, V: V, T: T}
+	}
+	m, wrongType := types.MissingMethod(V, it, true)
+	if m == nil {
+		return nil
+	}
+	ret := &Mismatch{Kind: MismatchMissingMethod, V: V, T: T, Method: m}
+	if wrongType {
+		obj, _, _ := types.LookupFieldOrMethod(V, false, m.Pkg(), m.Name())
+		if have, ok := obj.(*types.Func); ok {
+			ret.Kind, ret.Have = MismatchWrongMethod, have
+		} else if obj, _, _ = types.LookupFieldOrMethod(V, true, m.Pkg(), m.Name()); obj != nil {
+			ret.Kind = MismatchPointerRecv
+		}
+	}
+	return ret
+}
+
+// AssertImplements checks whether the type T implements the interface iface
+// (see CheckImplements), and generates an assertion of it, which also keeps
+// the generated code from compiling if T is changed:
+//
+//	var _ iface = (*U)(nil) // T is *U
+//	var _ iface = U{}       // T is a struct type U
+//
+// It returns the Mismatch (without generating anything) if T doesn't
+// implement iface.
+func (p *Package) AssertImplements(T, iface types.Type) error {
+	if debugInstr {
+		log.Println("AssertImplements", T, iface)
+	}
+	if ret := CheckImplements(p, T, iface); ret != nil {
+		return ret
+	}
+	p.NewVarDefs(p.Types.Scope()).NewAndInit(func(cb *CodeBuilder) int {
+		switch getUnderlying(p, T).(type) {
+		case *types.Struct, *types.Array:
+			cb.ZeroLit(T)
+		default:
+			cb.Typ(T).ZeroLit(T).Call(1)
+		}
+		return 1
+	}, token.NoPos, iface, "_")
+	return nil
+}
+
+// CheckAssignable checks whether a value of type V (and value `pv`, which can
+// be nil) is assignable to a variable of type T. It returns nil if it is,
+// otherwise a Mismatch explaining why not.
+func CheckAssignable(pkg *Package, V, T types.Type, pv *Element) *Mismatch {
+	if AssignableConv(pkg, V, T, pv) {
+		return nil
+	}
+	if _, ok := getUnderlying(pkg, T).(*types.Interface); ok && !isUntyped(pkg, V) {
+		if _, ok = getUnderlying(pkg, V).(*types.Interface); !ok {
+			if ret := CheckImplements(pkg, V, T); ret != nil {
+				return ret
+			}
+		}
+	}
+	return &Mismatch{Kind: MismatchType, V: V, T: T}
+}
+
+// ----------------------------------------------------------------------------
@@ -0,0 +1,179 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package driver provides the scaffolding of generators using gox, which are
+// usually invoked by //go:generate:
+//
+//	//go:generate go run ./gen -o zz_gen.go
+//
+//	func main() {
+//		// or: d := driver.New("gen"); (define flags by d.Flags); d.Main(...)
+//		driver.Main("gen", func(d *driver.Driver) (*gox.Package, error) {
+//			pkg := gox.NewPackage("", d.Package, nil)
+//			...
+//			return pkg, nil
+//		})
+//	}
+//
+// It parses common flags, selects the output file, writes it only if its
+// content is changed, and reports errors (including errors raised by gox
+// instructions) in the form of "name: error".
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/goplus/gox"
+)
+
+// ----------------------------------------------------------------------------
+
+// Driver represents a run of a generator.
+type Driver struct {
+	// Name is name of the generator, used in usage and error messages.
+	Name string
+
+	// Output is the output file (-o). It defaults to `$GOFILE` with suffix
+	// "_gen.go" instead of ".go" (or "<Name>_gen.go" if $GOFILE isn't set).
+	// "-" means stdout.
+	Output string
+
+	// Package is name of the generated package (-pkg), which defaults to
+	// $GOPACKAGE (or "main" if it isn't set).
+	Package string
+
+	// Check is to report an error if the output isn't up to date, instead of
+	// writing it (-check).
+	Check bool
+
+	// Flags is the flag set of the generator. Flags of the generator itself
+	// can be defined before Parse is called.
+	Flags *flag.FlagSet
+
+	// Stdout and Stderr default to os.Stdout and os.Stderr.
+	Stdout, Stderr io.Writer
+}
+
+// New creates a Driver with the common flags defined.
+func New(name string) *Driver {
+	p := &Driver{Name: name, Stdout: os.Stdout, Stderr: os.Stderr}
+	p.Flags = flag.NewFlagSet(name, flag.ContinueOnError)
+	p.Flags.StringVar(&p.Output, "o", "", "output `file` (\"-\" means stdout)")
+	p.Flags.StringVar(&p.Package, "pkg", "", "package `name` of the generated code")
+	p.Flags.BoolVar(&p.Check, "check", false, "report an error if the output isn't up to date, instead of writing it")
+	return p
+}
+
+// Parse parses command line arguments (without the program name), and applies
+// defaults of the output file and the package name from the environment set
+// by go generate.
+func (p *Driver) Parse(args []string) error {
+	p.Flags.SetOutput(p.Stderr)
+	if err := p.Flags.Parse(args); err != nil {
+		return err
+	}
+	if p.Output == "" {
+		if gofile := os.Getenv("GOFILE"); gofile != "" {
+			p.Output = strings.TrimSuffix(gofile, ".go") + "_gen.go"
+		} else {
+			p.Output = p.Name + "_gen.go"
+		}
+	}
+	if p.Package == "" {
+		if p.Package = os.Getenv("GOPACKAGE"); p.Package == "" {
+			p.Package = "main"
+		}
+	}
+	return nil
+}
+
+// ErrOutdated is returned by Write in check mode if the output isn't up to date.
+var ErrOutdated = errors.New("output is out of date")
+
+// Write writes a file named fname of `pkg` into the output file, if its content
+// is changed. It returns whether the output file is (or, in check mode, would
+// be) changed.
+func (p *Driver) Write(pkg *gox.Package, fname ...string) (changed bool, err error) {
+	var buf bytes.Buffer
+	if err = pkg.WriteTo(&buf, fname...); err != nil {
+		return
+	}
+	if p.Output == "-" {
+		_, err = p.Stdout.Write(buf.Bytes())
+		return true, err
+	}
+	if old, e := os.ReadFile(p.Output); e == nil && bytes.Equal(old, buf.Bytes()) {
+		return false, nil
+	}
+	if p.Check {
+		return true, fmt.Errorf("%s: %w", p.Output, ErrOutdated)
+	}
+	return true, os.WriteFile(p.Output, buf.Bytes(), 0666)
+}
+
+// Run calls `gen` to generate the package, and writes it. Errors raised by gox
+// instructions (a *gox.CodeError or *gox.MatchError panics) are recovered and
+// returned.
+func (p *Driver) Run(gen func(d *Driver) (*gox.Package, error)) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			switch e := e.(type) {
+			case *gox.CodeError:
+				err = e
+			case *gox.MatchError:
+				err = e
+			default:
+				panic(e)
+			}
+		}
+	}()
+	pkg, err := gen(p)
+	if err != nil {
+		return
+	}
+	_, err = p.Write(pkg)
+	return
+}
+
+// Errorf reports an error in the form of "name: error".
+func (p *Driver) Errorf(format string, args ...interface{}) {
+	fmt.Fprintf(p.Stderr, "%s: %s\n", p.Name, fmt.Sprintf(format, args...))
+}
+
+// Main creates a Driver named `name` and calls its Main method.
+func Main(name string, gen func(d *Driver) (*gox.Package, error)) {
+	New(name).Main(gen)
+}
+
+// Main parses flags of os.Args, runs `gen`, and writes the generated package.
+// It exits with status 1 if there is an error (2 for bad flags).
+func (p *Driver) Main(gen func(d *Driver) (*gox.Package, error)) {
+	if err := p.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+	if err := p.Run(gen); err != nil {
+		p.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
+
+// ----------------------------------------------------------------------------
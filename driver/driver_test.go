@@ -0,0 +1,110 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goplus/gox"
+)
+
+func genFoo(d *Driver) (*gox.Package, error) {
+	pkg := gox.NewPackage("", d.Package, nil)
+	pkg.NewFunc(nil, "Foo", nil, nil, false).BodyStart(pkg).End()
+	return pkg, nil
+}
+
+func TestParse(t *testing.T) {
+	t.Setenv("GOFILE", "foo.go")
+	t.Setenv("GOPACKAGE", "foo")
+	d := New("gen")
+	verbose := d.Flags.Bool("v", false, "verbose")
+	if err := d.Parse([]string{"-v"}); err != nil {
+		t.Fatal("Parse:", err)
+	}
+	if d.Output != "foo_gen.go" || d.Package != "foo" || !*verbose {
+		t.Fatal("Parse:", d.Output, d.Package, *verbose)
+	}
+	t.Setenv("GOFILE", "")
+	t.Setenv("GOPACKAGE", "")
+	d = New("gen")
+	if err := d.Parse([]string{"-o", "x.go", "-check"}); err != nil {
+		t.Fatal("Parse:", err)
+	}
+	if d.Output != "x.go" || d.Package != "main" || !d.Check {
+		t.Fatal("Parse:", d.Output, d.Package, d.Check)
+	}
+	d = New("gen")
+	d.Stderr = new(bytes.Buffer)
+	if err := d.Parse([]string{"-x"}); err == nil {
+		t.Fatal("Parse: no error?")
+	}
+	if d.Parse(nil); d.Output != "gen_gen.go" {
+		t.Fatal("Parse:", d.Output)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	d := New("gen")
+	d.Output = filepath.Join(t.TempDir(), "foo_gen.go")
+	d.Package = "foo"
+	if err := d.Run(genFoo); err != nil {
+		t.Fatal("Run:", err)
+	}
+	b, err := os.ReadFile(d.Output)
+	if err != nil || string(b) != "package foo\n\nfunc Foo() {\n}\n" {
+		t.Fatal("Run:", string(b), err)
+	}
+	pkg, _ := genFoo(d)
+	if changed, err := d.Write(pkg); changed || err != nil {
+		t.Fatal("Write:", changed, err)
+	}
+	d.Check = true
+	pkg.NewFunc(nil, "Bar", nil, nil, false).BodyStart(pkg).End()
+	if changed, err := d.Write(pkg); !changed || !errors.Is(err, ErrOutdated) {
+		t.Fatal("Write:", changed, err)
+	}
+	var buf bytes.Buffer
+	d.Output, d.Stdout = "-", &buf
+	if changed, err := d.Write(pkg); !changed || err != nil || buf.Len() == 0 {
+		t.Fatal("Write:", changed, err)
+	}
+}
+
+func TestRunError(t *testing.T) {
+	d := New("gen")
+	d.Output = filepath.Join(t.TempDir(), "foo_gen.go")
+	err := d.Run(func(d *Driver) (*gox.Package, error) {
+		pkg := gox.NewPackage("", "foo", nil)
+		pkg.NewFunc(nil, "Foo", nil, nil, false).BodyStart(pkg).
+			Val(1).Val("a").BinaryOp(token.ADD)
+		return pkg, nil
+	})
+	switch err.(type) {
+	case *gox.CodeError, *gox.MatchError:
+	default:
+		t.Fatal("Run:", err)
+	}
+	var buf bytes.Buffer
+	d.Stderr = &buf
+	d.Errorf("%v", "oops")
+	if buf.String() != "gen: oops\n" {
+		t.Fatal("Errorf:", buf.String())
+	}
+}
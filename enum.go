@@ -0,0 +1,159 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"go/token"
+	"go/types"
+	"log"
+)
+
+// ----------------------------------------------------------------------------
+
+// Enum represents an enumeration type created by NewEnum.
+type Enum struct {
+	Decl    *TypeDecl
+	Members []*types.Const // nil for blank (`_`) members
+	pkg     *Package
+}
+
+// Type returns the enumeration type.
+func (p *Enum) Type() *types.Named {
+	return p.Decl.Type()
+}
+
+// NewEnum declares an enumeration type `name` with int as its underlying
+// type, the constants `members` of it (valued by iota), and a String method:
+//
+//	type name int
+//
+//	const (
+//		member0 name = iota
+//		member1
+//		...
+//	)
+//
+//	func (v name) String() string
+//
+// A blank (`_`) member skips a value.
+func (p *Package) NewEnum(name string, members ...string) *Enum {
+	if debugInstr {
+		log.Println("NewEnum", name, members)
+	}
+	decl := p.NewTypeDefs().NewType(name)
+	typ := decl.InitType(p, types.Typ[types.Int])
+	ret := &Enum{Decl: decl, Members: make([]*types.Const, len(members)), pkg: p}
+	if len(members) > 0 {
+		scope := p.Types.Scope()
+		defs := p.NewConstDefs(scope).New(func(cb *CodeBuilder) int {
+			cb.Val(iotaObj)
+			return 1
+		}, 0, token.NoPos, typ, members[0])
+		for i := 1; i < len(members); i++ {
+			defs.Next(i, token.NoPos, members[i])
+		}
+		for i, m := range members {
+			if m != "_" {
+				ret.Members[i] = scope.Lookup(m).(*types.Const)
+			}
+		}
+	}
+	ret.newString()
+	return ret
+}
+
+// newString generates:
+//
+//	func (v T) String() string {
+//		switch v {
+//		case member0:
+//			return "member0"
+//		...
+//		}
+//		return "T(" + strconv.Itoa(int(v)) + ")"
+//	}
+func (p *Enum) newString() {
+	pkg := p.pkg
+	typ := p.Type()
+	recv := pkg.NewParam(token.NoPos, "v", typ)
+	ret := NewTuple(pkg.NewParam(token.NoPos, "", types.Typ[types.String]))
+	cb := pkg.NewFunc(recv, "String", nil, ret, false).BodyStart(pkg)
+	cb.Switch().VarVal("v").Then()
+	for _, m := range p.Members {
+		if m != nil {
+			cb.Val(m).Case(1).Val(m.Name()).Return(1).End()
+		}
+	}
+	cb.End()
+	strconv := pkg.Import("strconv")
+	cb.Val(typ.Obj().Name() + "(").
+		Val(strconv.Ref("Itoa")).Typ(types.Typ[types.Int]).VarVal("v").Call(1).Call(1).
+		BinaryOp(token.ADD).Val(")").BinaryOp(token.ADD).
+		Return(1).
+		End()
+}
+
+// TextMarshaler generates MarshalText and UnmarshalText methods of the
+// enumeration type, so that it implements encoding.TextMarshaler and
+// encoding.TextUnmarshaler by names of its members.
+func (p *Enum) TextMarshaler() *Enum {
+	pkg := p.pkg
+	typ := p.Type()
+	tyBytes := types.NewSlice(TyByte)
+	tyError := types.Universe.Lookup("error").Type()
+
+	// func (v T) MarshalText() ([]byte, error) {
+	//	return []byte(v.String()), nil
+	// }
+	recv := pkg.NewParam(token.NoPos, "v", typ)
+	ret := NewTuple(pkg.NewParam(token.NoPos, "", tyBytes), pkg.NewParam(token.NoPos, "", tyError))
+	pkg.NewFunc(recv, "MarshalText", nil, ret, false).BodyStart(pkg).
+		Typ(tyBytes).VarVal("v").MemberVal("String").Call(0).Call(1).Val(nil).
+		Return(2).
+		End()
+
+	// func (v *T) UnmarshalText(text []byte) error {
+	//	switch string(text) {
+	//	case "member0":
+	//		*v = member0
+	//	...
+	//	default:
+	//		return errors.New("invalid T: " + string(text))
+	//	}
+	//	return nil
+	// }
+	recv = pkg.NewParam(token.NoPos, "v", types.NewPointer(typ))
+	params := NewTuple(pkg.NewParam(token.NoPos, "text", tyBytes))
+	ret = NewTuple(pkg.NewParam(token.NoPos, "", tyError))
+	cb := pkg.NewFunc(recv, "UnmarshalText", params, ret, false).BodyStart(pkg)
+	cb.Switch().Typ(types.Typ[types.String]).VarVal("text").Call(1).Then()
+	for _, m := range p.Members {
+		if m != nil {
+			cb.Val(m.Name()).Case(1).VarVal("v").ElemRef().Val(m).Assign(1).End()
+		}
+	}
+	errors := pkg.Import("errors")
+	cb.Case(0).
+		Val(errors.Ref("New")).
+		Val("invalid " + typ.Obj().Name() + ": ").Typ(types.Typ[types.String]).VarVal("text").Call(1).
+		BinaryOp(token.ADD).Call(1).
+		Return(1).
+		End()
+	cb.End().
+		Val(nil).Return(1).
+		End()
+	return p
+}
+
+// ----------------------------------------------------------------------------
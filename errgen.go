@@ -0,0 +1,150 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"go/token"
+	"go/types"
+	"log"
+)
+
+// ----------------------------------------------------------------------------
+
+// SentinelError describes a sentinel error declared by NewSentinelErrors.
+type SentinelError struct {
+	Name string // name of the variable, eg. ErrNotFound
+	Msg  string // message of the error, eg. "not found"
+}
+
+// NewSentinelErrors declares sentinel errors `errs` in a var block, and
+// returns variables of them:
+//
+//	var (
+//		ErrNotFound = errors.New("not found")
+//		...
+//	)
+func (p *Package) NewSentinelErrors(errs ...SentinelError) []*types.Var {
+	if debugInstr {
+		log.Println("NewSentinelErrors", errs)
+	}
+	scope := p.Types.Scope()
+	defs := p.NewVarDefs(scope)
+	errors := p.Import("errors")
+	ret := make([]*types.Var, len(errs))
+	for i, e := range errs {
+		msg := e.Msg
+		defs.NewAndInit(func(cb *CodeBuilder) int {
+			cb.Val(errors.Ref("New")).Val(msg).Call(1)
+			return 1
+		}, token.NoPos, nil, e.Name)
+		ret[i] = scope.Lookup(e.Name).(*types.Var)
+	}
+	return ret
+}
+
+// ----------------------------------------------------------------------------
+
+// ErrorTypeOpts represents options of NewErrorType.
+type ErrorTypeOpts struct {
+	// Code is type of the Code field. There isn't a Code field if it's nil.
+	Code types.Type
+
+	// Wrap generates an Err field holding the underlying error, and an
+	// Unwrap method returning it.
+	Wrap bool
+}
+
+// NewErrorType declares a structured error type `name`, and its Error (and
+// Unwrap) methods:
+//
+//	type T struct {
+//		Code Code  // if opts.Code isn't nil
+//		Msg  string
+//		Err  error // if opts.Wrap
+//	}
+//
+//	func (e *T) Error() string {
+//		if e.Err != nil {
+//			return fmt.Sprintf("%v: %s: %v", e.Code, e.Msg, e.Err)
+//		}
+//		return fmt.Sprintf("%v: %s", e.Code, e.Msg)
+//	}
+//
+//	func (e *T) Unwrap() error {
+//		return e.Err
+//	}
+//
+// Without a Code field, Error returns `e.Msg` (and the underlying error).
+func (p *Package) NewErrorType(name string, opts *ErrorTypeOpts) *types.Named {
+	if opts == nil {
+		opts = &ErrorTypeOpts{}
+	}
+	if debugInstr {
+		log.Println("NewErrorType", name, opts.Code, opts.Wrap)
+	}
+	tyError := types.Universe.Lookup("error").Type()
+	var fields []*types.Var
+	if opts.Code != nil {
+		fields = append(fields, types.NewField(token.NoPos, p.Types, "Code", opts.Code, false))
+	}
+	fields = append(fields, types.NewField(token.NoPos, p.Types, "Msg", types.Typ[types.String], false))
+	if opts.Wrap {
+		fields = append(fields, types.NewField(token.NoPos, p.Types, "Err", tyError, false))
+	}
+	typ := p.NewTypeDefs().NewType(name).InitType(p, types.NewStruct(fields, nil))
+	tyPtr := types.NewPointer(typ)
+
+	recv := p.NewParam(token.NoPos, "e", tyPtr)
+	ret := NewTuple(p.NewParam(token.NoPos, "", types.Typ[types.String]))
+	cb := p.NewFunc(recv, "Error", nil, ret, false).BodyStart(p)
+	if opts.Wrap {
+		cb.If().VarVal("e").MemberVal("Err").Val(nil).BinaryOp(token.NEQ).Then()
+		p.errorMsg(cb, opts.Code != nil, true).Return(1).End()
+	}
+	p.errorMsg(cb, opts.Code != nil, false).Return(1).End()
+
+	if opts.Wrap {
+		recv = p.NewParam(token.NoPos, "e", tyPtr)
+		ret = NewTuple(p.NewParam(token.NoPos, "", tyError))
+		p.NewFunc(recv, "Unwrap", nil, ret, false).BodyStart(p).
+			VarVal("e").MemberVal("Err").Return(1).
+			End()
+	}
+	return typ
+}
+
+// errorMsg pushes the message of the error `e`.
+func (p *Package) errorMsg(cb *CodeBuilder, code, wrap bool) *CodeBuilder {
+	if !code && !wrap {
+		return cb.VarVal("e").MemberVal("Msg")
+	}
+	format, n := "%s", 1
+	if code {
+		format, n = "%v: "+format, n+1
+	}
+	if wrap {
+		format, n = format+": %v", n+1
+	}
+	cb.Val(p.Import("fmt").Ref("Sprintf")).Val(format)
+	if code {
+		cb.VarVal("e").MemberVal("Code")
+	}
+	cb.VarVal("e").MemberVal("Msg")
+	if wrap {
+		cb.VarVal("e").MemberVal("Err")
+	}
+	return cb.Call(n + 1)
+}
+
+// ----------------------------------------------------------------------------
@@ -169,6 +169,108 @@ func TestErrSwitch(t *testing.T) {
 		})
 }
 
+func TestErrSelect(t *testing.T) {
+	tyXchg := types.NewChan(types.SendRecv, types.Typ[types.Int])
+	codeErrorTest(t, "./foo.gop:3:1: multiple defaults in select",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				Select().
+				CommCase(0, source("default", 2, 1)).End().
+				CommCase(0, source("default", 3, 1)).End().
+				End().
+				End()
+		})
+	codeErrorTest(t, "./foo.gop:2:1: select case must be receive, send or assign recv",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(tyXchg, "a").
+				Select().
+				DefineVarStart(0, "x").VarVal("a").EndInit(1).CommCase(1, source("case", 2, 1)).End().
+				End().
+				End()
+		})
+	codeErrorTest(t, "./foo.gop:2:1: select case must be receive, send or assign recv",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(tyXchg, "a").
+				Select().
+				VarVal("a").UnaryOp(token.ARROW).EndStmt().
+				VarVal("a").UnaryOp(token.ARROW).EndStmt().
+				CommCase(2, source("case", 2, 1)).End().
+				End().
+				End()
+		})
+}
+
+func TestErrSwitchInit(t *testing.T) {
+	codeErrorTest(t, "./foo.gop:1:1: var declaration not allowed in switch initializer",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				Switch().NewVar(types.Typ[types.Int], "x").VarVal("x").Then(source("switch", 1, 1)).
+				End().
+				End()
+		})
+	codeErrorTest(t, "./foo.gop:1:1: switch statement has too many init statements",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				Switch().
+				DefineVarStart(0, "x").Val(1).EndInit(1).
+				DefineVarStart(0, "y").Val(2).EndInit(1).
+				VarVal("x").Then(source("switch", 1, 1)).
+				End().
+				End()
+		})
+}
+
+func TestErrFallthrough(t *testing.T) {
+	codeErrorTest(t, "./foo.gop:2:2: cannot fallthrough final case in switch",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				Switch().None().Then().
+				Case(0).
+				Fallthrough(source("fallthrough", 2, 2)).
+				End().
+				End().
+				End()
+		})
+	codeErrorTest(t, "./foo.gop:2:2: fallthrough statement out of place",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				Switch().None().Then().
+				Val(true).Case(1).
+				Fallthrough(source("fallthrough", 2, 2)).
+				Val(ctxRef(pkg, "println")).Call(0).EndStmt().
+				End().
+				Case(0).
+				End().
+				End().
+				End()
+		})
+	codeErrorTest(t, "./foo.gop:2:2: fallthrough statement out of place",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				Switch().None().Then().
+				Val(true).Case(1).
+				If().Val(true).Then().
+				Fallthrough(source("fallthrough", 2, 2)).
+				End().
+				End().
+				End().
+				End()
+		})
+	codeErrorTest(t, "./foo.gop:2:2: cannot fallthrough in type switch",
+		func(pkg *gox.Package) {
+			v := pkg.NewParam(token.NoPos, "v", gox.TyEmptyInterface)
+			pkg.NewFunc(nil, "foo", types.NewTuple(v), nil, false).BodyStart(pkg).
+				TypeSwitch("t").Val(v).TypeAssertThen().
+				Typ(types.Typ[types.Int]).TypeCase(1).
+				Fallthrough(source("fallthrough", 2, 2)).
+				End().
+				End().
+				End()
+		})
+}
+
 func TestErrTypeRedefined(t *testing.T) {
 	codeErrorTest(t, "./foo.gop:2:5: foo redeclared in this block\n\tprevious declaration at ./foo.gop:1:5", func(pkg *gox.Package) {
 		typ := pkg.NewType("foo", source("foo", 1, 5))
@@ -233,7 +335,7 @@ func TestErrBinaryOp(t *testing.T) {
 				/**/ End().
 				End()
 		})
-	codeErrorTest(t, `./foo.gop:2:9: invalid operation: sl == v (mismatched types []int and interface{Bar()})`,
+	codeErrorTest(t, `./foo.gop:2:9: invalid operation: sl == v ([]int does not implement interface{Bar()} (missing method Bar))`,
 		func(pkg *gox.Package) {
 			methods := []*types.Func{
 				types.NewFunc(token.NoPos, pkg.Types, "Bar", types.NewSignatureType(nil, nil, nil, nil, nil, false)),
@@ -253,6 +355,29 @@ func TestErrBinaryOp(t *testing.T) {
 				/**/ End().
 				End()
 		})
+	tyInts := types.NewSlice(types.Typ[types.Int])
+	incomparables := []struct {
+		typ types.Type
+		msg string
+	}{
+		{tyInts, "slice can only be compared to nil"},
+		{types.NewMap(types.Typ[types.Int], types.Typ[types.Int]), "map can only be compared to nil"},
+		{types.NewSignatureType(nil, nil, nil, nil, nil, false), "func can only be compared to nil"},
+		{types.NewStruct([]*types.Var{types.NewField(token.NoPos, nil, "a", tyInts, false)}, nil),
+			"struct containing []int cannot be compared"},
+		{types.NewArray(tyInts, 2), "[2][]int cannot be compared"},
+	}
+	for _, c := range incomparables {
+		typ := c.typ
+		codeErrorTest(t, `./foo.gop:2:9: invalid operation: a == b (`+c.msg+`)`,
+			func(pkg *gox.Package) {
+				pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+					NewVar(typ, "a", "b").
+					/**/ If().VarVal("a").VarVal("b").BinaryOp(token.EQL, source(`a == b`, 2, 9)).Then().
+					/**/ End().
+					End()
+			})
+	}
 }
 
 func TestErrTypeAssert(t *testing.T) {
@@ -339,6 +464,20 @@ func TestErrConst(t *testing.T) {
 				}, 0, position(2, 7), nil, "a", "b").
 				Next(1, position(2, 9), "c", "d", "e")
 		})
+	codeErrorTest(t, "./foo.gop:2:7: missing init expr for const declaration",
+		func(pkg *gox.Package) {
+			pkg.NewConstDefs(pkg.Types.Scope()).
+				Add(nil, position(2, 7), nil, "a")
+		})
+	codeErrorTest(t, "./foo.gop:2:9: const declaration cannot have type without expression",
+		func(pkg *gox.Package) {
+			pkg.NewConstDefs(pkg.Types.Scope()).
+				Add(func(cb *gox.CodeBuilder) int {
+					cb.Val(ctxRef(pkg, "iota"))
+					return 1
+				}, position(2, 7), nil, "a").
+				Add(nil, position(2, 9), types.Typ[types.Int], "b")
+		})
 }
 
 func TestErrNewVar(t *testing.T) {
@@ -428,7 +567,16 @@ func TestErrForRange(t *testing.T) {
 				End().
 				End()
 		})
-	codeErrorTest(t, `./foo.gop:1:17: cannot range over 13 (type untyped int)`,
+	codeErrorTest(t, `./foo.gop:1:17: cannot range over 1.5 (type untyped float)`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				ForRange("a", "b").
+				Val(1.5, source("1.5", 1, 9)).
+				RangeAssignThen(position(1, 17)).
+				End().
+				End()
+		})
+	codeErrorTest(t, `./foo.gop:1:17: range over 13 (type untyped int) permits only one iteration variable`,
 		func(pkg *gox.Package) {
 			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
 				ForRange("a", "b").
@@ -437,13 +585,22 @@ func TestErrForRange(t *testing.T) {
 				End().
 				End()
 		})
-	codeErrorTest(t, `./foo.gop:1:17: cannot range over 13 (type untyped int)`,
+	codeErrorTest(t, `./foo.gop:1:17: range over 13 (type untyped int) permits only one iteration variable`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				ForRange("_", "b").
+				Val(13, source("13", 1, 9)).
+				RangeAssignThen(position(1, 17)).
+				End().
+				End()
+		})
+	codeErrorTest(t, `./foo.gop:1:17: cannot range over 1.5 (type untyped float)`,
 		func(pkg *gox.Package) {
 			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
 				NewVar(types.Typ[types.Int], "a").
 				ForRange().
 				VarRef(ctxRef(pkg, "a")).
-				Val(13, source("13", 1, 9)).
+				Val(1.5, source("1.5", 1, 9)).
 				RangeAssignThen(position(1, 17)).
 				End().
 				End()
@@ -470,6 +627,48 @@ func TestErrForRange(t *testing.T) {
 				End().
 				End()
 		})
+	tyYield := types.NewSignatureType(nil, nil, nil,
+		types.NewTuple(types.NewParam(token.NoPos, nil, "", types.Typ[types.Int])),
+		types.NewTuple(types.NewParam(token.NoPos, nil, "", types.Typ[types.Bool])), false)
+	tySeq := types.NewSignatureType(nil, nil, nil,
+		types.NewTuple(types.NewParam(token.NoPos, nil, "yield", tyYield)), nil, false)
+	codeErrorTest(t, `./foo.gop:1:17: range over seq (type func(yield func(int) bool)) permits only one iteration variable`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(tySeq, "seq").
+				ForRange("a", "b").
+				Val(ctxRef(pkg, "seq"), source("seq", 1, 9)).
+				RangeAssignThen(position(1, 17)).
+				End().
+				End()
+		})
+	tyLoop := types.NewSignatureType(nil, nil, nil, types.NewTuple(types.NewParam(token.NoPos, nil, "yield",
+		types.NewSignatureType(nil, nil, nil, nil, tyYield.Results(), false))), nil, false)
+	codeErrorTest(t, `./foo.gop:1:17: range over loop (type func(yield func() bool)) permits no iteration variables`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(tyLoop, "loop").
+				NewVar(types.Typ[types.Int], "a").
+				ForRange().
+				VarRef(ctxRef(pkg, "a")).
+				Val(ctxRef(pkg, "loop"), source("loop", 1, 9)).
+				RangeAssignThen(position(1, 17)).
+				End().
+				End()
+		})
+	codeErrorTest(t, `./foo.gop:1:17: cannot range over f (type func(yield func(int) int))`,
+		func(pkg *gox.Package) {
+			yield := types.NewSignatureType(nil, nil, nil, tyYield.Params(), tyYield.Params(), false)
+			tyFunc := types.NewSignatureType(nil, nil, nil,
+				types.NewTuple(types.NewParam(token.NoPos, nil, "yield", yield)), nil, false)
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(tyFunc, "f").
+				ForRange("a").
+				Val(ctxRef(pkg, "f"), source("f", 1, 9)).
+				RangeAssignThen(position(1, 17)).
+				End().
+				End()
+		})
 	codeErrorTest(t, `./foo.gop:1:5: cannot assign type string to a (type int) in range`,
 		func(pkg *gox.Package) {
 			tySlice := types.NewSlice(types.Typ[types.String])
@@ -975,6 +1174,147 @@ func TestErrIndex(t *testing.T) {
 		})
 }
 
+func TestErrIndexType(t *testing.T) {
+	tyArr := types.NewArray(types.Typ[types.Int], 3)
+	codeErrorTest(t,
+		`./foo.gop:1:3: invalid argument: index "a" (type untyped string) must be integer`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.NewSlice(types.Typ[types.Int]), "x").
+				Val(ctxRef(pkg, "x")).
+				Val("a", source(`"a"`, 1, 3)).
+				Index(1, false).
+				EndStmt().
+				End()
+		})
+	codeErrorTest(t,
+		`./foo.gop:1:3: invalid argument: index f (type float64) must be integer`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.NewSlice(types.Typ[types.Int]), "x").
+				NewVar(types.Typ[types.Float64], "f").
+				Val(ctxRef(pkg, "x")).
+				Val(ctxRef(pkg, "f"), source("f", 1, 3)).
+				IndexRef(1).
+				Val(1).
+				Assign(1).
+				End()
+		})
+	codeErrorTest(t,
+		`./foo.gop:1:3: invalid argument: index -1 (constant of type int) must not be negative`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.NewSlice(types.Typ[types.Int]), "x").
+				Val(ctxRef(pkg, "x")).
+				Val(-1, source("-1", 1, 3)).
+				Index(1, false).
+				EndStmt().
+				End()
+		})
+	codeErrorTest(t,
+		`./foo.gop:1:3: invalid argument: index 3 out of bounds [0:3]`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(tyArr, "x").
+				Val(ctxRef(pkg, "x")).
+				Val(3, source("3", 1, 3)).
+				Index(1, false).
+				EndStmt().
+				End()
+		})
+	codeErrorTest(t,
+		`./foo.gop:1:3: cannot use 1 (type untyped int) as type string in map index`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.NewMap(types.Typ[types.String], types.Typ[types.Int]), "x").
+				Val(ctxRef(pkg, "x")).
+				Val(1, source("1", 1, 3)).
+				Index(1, false).
+				EndStmt().
+				End()
+		})
+	codeErrorTest(t,
+		`./foo.gop:1:5: invalid argument: index 4 out of bounds [0:4]`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.NewPointer(tyArr), "x").
+				Val(ctxRef(pkg, "x")).
+				None().
+				Val(4, source("4", 1, 5)).
+				Slice(false).
+				EndStmt().
+				End()
+		})
+	codeErrorTest(t,
+		`./foo.gop:1:5: invalid slice indices: 1 < 2`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.NewSlice(types.Typ[types.Int]), "x").
+				Val(ctxRef(pkg, "x")).
+				Val(2, source("2", 1, 3)).
+				Val(1, source("1", 1, 5)).
+				Slice(false).
+				EndStmt().
+				End()
+		})
+	codeErrorTest(t,
+		`./foo.gop:1:7: invalid slice indices: 3 < 5`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.NewSlice(types.Typ[types.Int]), "x").
+				Val(ctxRef(pkg, "x")).
+				None().
+				Val(5, source("5", 1, 5)).
+				Val(3, source("3", 1, 7)).
+				Slice(true).
+				EndStmt().
+				End()
+		})
+}
+
+func TestErrChan(t *testing.T) {
+	codeErrorTest(t,
+		`./foo.gop:1:1: invalid operation: cannot send to receive-only channel ch (type <-chan int)`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.NewChan(types.RecvOnly, types.Typ[types.Int]), "ch").
+				Val(ctxRef(pkg, "ch"), source("ch", 1, 1)).Val(1).Send().
+				End()
+		})
+	codeErrorTest(t,
+		`./foo.gop:1:1: invalid operation: cannot send to non-channel x (type int)`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.Typ[types.Int], "x").
+				Val(ctxRef(pkg, "x"), source("x", 1, 1)).Val(1).Send().
+				End()
+		})
+	codeErrorTest(t,
+		`./foo.gop:1:7: cannot use "hi" (type untyped string) as type int in send`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.NewChan(types.SendOnly, types.Typ[types.Int]), "ch").
+				Val(ctxRef(pkg, "ch"), source("ch", 1, 1)).Val("hi", source(`"hi"`, 1, 7)).Send().
+				End()
+		})
+	codeErrorTest(t,
+		`./foo.gop:1:3: invalid operation: cannot receive from send-only channel ch (type chan<- int)`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.NewChan(types.SendOnly, types.Typ[types.Int]), "ch").
+				Val(ctxRef(pkg, "ch"), source("ch", 1, 3)).UnaryOp(token.ARROW).EndStmt().
+				End()
+		})
+	codeErrorTest(t,
+		`./foo.gop:1:3: invalid operation: cannot receive from non-channel x (type int)`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.Typ[types.Int], "x").
+				Val(ctxRef(pkg, "x"), source("x", 1, 3)).UnaryOp(token.ARROW).EndStmt().
+				End()
+		})
+}
+
 func TestErrIndexRef(t *testing.T) {
 	codeErrorTest(t,
 		`./foo.gop:1:5: cannot assign to x[1] (strings are immutable)`,
@@ -1382,3 +1722,269 @@ type M struct {
 				End()
 		})
 }
+
+func TestErrUntypedNil(t *testing.T) {
+	codeErrorTest(t, "./foo.gop:2:9: use of untyped nil in variable declaration",
+		func(pkg *gox.Package) {
+			pkg.NewVarStart(position(2, 5), nil, "a").Val(nil, source("nil", 2, 9)).EndInit(1)
+		})
+	codeErrorTest(t, "./foo.gop:2:6: use of untyped nil in assignment",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				DefineVarStart(position(2, 1), "a").Val(nil, source("nil", 2, 6)).EndInit(1).
+				End()
+		})
+	codeErrorTest(t, "./foo.gop:2:5: use of untyped nil in assignment",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				VarRef(nil).Val(nil, source("nil", 2, 5)).Assign(1).
+				End()
+		})
+	codeErrorTest(t, "./foo.gop:2:9: invalid operation: nil == nil (operator == not defined on nil)",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				/**/ If().Val(nil).Val(nil).BinaryOp(token.EQL, source("nil == nil", 2, 9)).Then().
+				/**/ End().
+				End()
+		})
+	codeErrorTest(t, "./foo.gop:2:9: invalid operation: a != nil (mismatched types int and untyped nil)",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.Typ[types.Int], "a").
+				/**/ If().VarVal("a").CompareNil(token.NEQ, source("a != nil", 2, 9)).Then().
+				/**/ End().
+				End()
+		})
+	codeErrorTest(t, "./foo.gop:2:5: invalid operation: operator - not defined on nil",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				Val(nil).UnaryOp(token.SUB, false, source("-nil", 2, 5)).EndStmt().
+				End()
+		})
+}
+
+func TestErrTernary(t *testing.T) {
+	codeErrorTest(t,
+		`./foo.gop:2:9: mismatched types int and untyped string in conditional expression`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(types.Typ[types.Int], "a").
+				NewVarStart(nil, "b").
+				Val(true).VarVal("a").Val("x").Ternary(gox.TernaryClosure, source("true ? a : \"x\"", 2, 9)).
+				EndInit(1).
+				End()
+		})
+	codeErrorTest(t,
+		`./foo.gop:2:9: non-boolean condition in conditional expression: 1`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVarStart(nil, "b").
+				Val(1, source("1", 2, 9)).Val(2).Val(3).Ternary(gox.TernaryClosure).
+				EndInit(1).
+				End()
+		})
+}
+
+func TestErrDepthLimits(t *testing.T) {
+	conf := &gox.Config{Fset: gblFset, Importer: gblImp, MaxStackDepth: 3, MaxBlockDepth: 3}
+	codeErrorTestEx(t, gox.NewPackage("", "main", conf), "-: stack depth exceeds 3\n\topen blocks (innermost first):\n\t\tfunc main",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				Val(1).Val(2).Val(3).Val(4)
+		})
+	codeErrorTestEx(t, gox.NewPackage("", "main", conf), "-: too many nested blocks (more than 3)\n\topen blocks (innermost first):\n\t\tif body\n\t\tif statement\n\t\tfunc main",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				If().Val(true).Then().
+				For().Val(true).Then()
+		})
+	codeErrorTestEx(t, gox.NewPackage("", "main", conf), "-: too many nested blocks (more than 3)\n\topen blocks (innermost first):\n\t\tvblock statement\n\t\tvblock statement\n\t\tfunc main",
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				VBlock().VBlock().VBlock()
+		})
+	codeErrorTestEx(t, gox.NewPackage("", "main", conf), "-: stack depth exceeds 3\n\topen blocks (innermost first):\n\t\tfunc main",
+		func(pkg *gox.Package) {
+			cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				Val(1).Val(2)
+			stk := cb.InternalStack()
+			stk.Ret(1, stk.Get(-1), stk.Get(-1), stk.Get(-1))
+		})
+}
+
+func TestErrCollect(t *testing.T) {
+	pos2Positions = map[token.Pos]token.Position{}
+	conf := &gox.Config{
+		Fset: gblFset, Importer: gblImp, DbgPositioner: nodeInterp{}, NodeInterpreter: nodeInterp{},
+		ErrorMode: gox.ErrorCollect,
+	}
+	pkg := gox.NewPackage("", "main", conf)
+	tyInt := types.Typ[types.Int]
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVar(tyInt, "a").
+		Guard(func(cb *gox.CodeBuilder) {
+			cb.VarRef(ctxRef(pkg, "a")).Val("Hi", source(`"Hi"`, 2, 5)).Assign(1)
+		}).
+		Guard(func(cb *gox.CodeBuilder) {
+			cb.If().Val(true).Then().
+				VarRef(ctxRef(pkg, "a")).Val(2.5, source("2.5", 3, 9)).Assign(1).
+				End()
+		}).
+		Guard(func(cb *gox.CodeBuilder) {
+			cb.VarRef(ctxRef(pkg, "a")).Val(3).Assign(1)
+		})
+	cb.NewLabel(position(4, 1), "L")
+	if n := cb.InternalStack().Len(); n != 0 {
+		t.Fatal("TestErrCollect: stack not empty -", n)
+	}
+	cb.End()
+	errs := pkg.Errors()
+	expected := []string{
+		`./foo.gop:2:5: cannot use "Hi" (type untyped string) as type int in assignment`,
+		`./foo.gop:3:9: cannot use 2.5 (type untyped float) as type int in assignment`,
+		`./foo.gop:4:1: label L defined and not used`,
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("TestErrCollect:", errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Fatalf("TestErrCollect: errs[%d] = %v, want %v", i, err, expected[i])
+		}
+	}
+	domTest(t, pkg, `package main
+
+func main() {
+	var a int
+	a = 3
+}
+`)
+}
+
+func TestErrCollectRollback(t *testing.T) {
+	pos2Positions = map[token.Pos]token.Position{}
+	conf := &gox.Config{
+		Fset: gblFset, Importer: gblImp, DbgPositioner: nodeInterp{}, NodeInterpreter: nodeInterp{},
+		ErrorMode: gox.ErrorCollect,
+	}
+	pkg := gox.NewPackage("", "main", conf)
+	itoa := pkg.Import("strconv").Ref("Itoa")
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Guard(func(cb *gox.CodeBuilder) {
+			cb.DefineVarStart(token.NoPos, "x", "y").
+				Val(itoa).Val(1).Call(1).Val(nil, source("nil", 2, 9)).EndInit(2)
+		}).
+		Guard(func(cb *gox.CodeBuilder) {
+			cb.DefineVarStart(token.NoPos, "x").Val(1).EndInit(1)
+		})
+	if n := cb.InternalStack().Len(); n != 0 {
+		t.Fatal("TestErrCollectRollback: stack not empty -", n)
+	}
+	cb.End()
+	errs := pkg.Errors()
+	if len(errs) != 1 || errs[0].Error() != "./foo.gop:2:9: use of untyped nil in assignment" {
+		t.Fatal("TestErrCollectRollback:", errs)
+	}
+	domTest(t, pkg, `package main
+
+func main() {
+	x := 1
+}
+`)
+}
+
+func TestErrCollectRollbackPkg(t *testing.T) {
+	pos2Positions = map[token.Pos]token.Position{}
+	conf := &gox.Config{
+		Fset: gblFset, Importer: gblImp, DbgPositioner: nodeInterp{}, NodeInterpreter: nodeInterp{},
+		ErrorMode: gox.ErrorCollect,
+	}
+	pkg := gox.NewPackage("", "main", conf)
+	cb := pkg.CB()
+	cb.Guard(func(cb *gox.CodeBuilder) {
+		pkg.NewVarStart(token.NoPos, nil, "x").Val(1).Val("s", source(`"s"`, 1, 13)).BinaryOp(token.ADD).EndInit(1)
+	})
+	cb.Guard(func(cb *gox.CodeBuilder) {
+		pkg.NewVarStart(token.NoPos, types.Typ[types.Int], "y").Val("s", source(`"s"`, 2, 13)).EndInit(1)
+	})
+	cb.Guard(func(cb *gox.CodeBuilder) {
+		pkg.NewVarStart(token.NoPos, nil, "x", "y").Val(1).Val(2).EndInit(2)
+	})
+	if errs := pkg.Errors(); len(errs) != 2 {
+		t.Fatal("TestErrCollectRollbackPkg:", errs)
+	}
+	domTest(t, pkg, `package main
+
+var x, y = 1, 2
+`)
+}
+
+func TestErrCollectRollbackTemp(t *testing.T) {
+	pos2Positions = map[token.Pos]token.Position{}
+	conf := &gox.Config{
+		Fset: gblFset, Importer: gblImp, DbgPositioner: nodeInterp{}, NodeInterpreter: nodeInterp{},
+		ErrorMode: gox.ErrorCollect,
+	}
+	pkg := gox.NewPackage("", "main", conf)
+	tyInt := types.Typ[types.Int]
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg)
+	v := cb.NewTemp(tyInt)
+	cb.VarRef(v).Val(1).Assign(1).ReleaseTemp(v).
+		Guard(func(cb *gox.CodeBuilder) {
+			cb.DefineVarStart(token.NoPos, "x", "y").Val(1).Val(nil, source("nil", 2, 12)).EndInit(2)
+		})
+	if w := cb.NewTemp(tyInt); w != v {
+		t.Fatal("TestErrCollectRollbackTemp: temporary not reused -", w.Name())
+	}
+	if o := cb.Scope().Lookup(v.Name()); o != v || o.Parent() != cb.Scope() {
+		t.Fatal("TestErrCollectRollbackTemp: scope not restored")
+	}
+	cb.End()
+	domTest(t, pkg, `package main
+
+func main() {
+	var _autoGo_1 int
+	_autoGo_1 = 1
+}
+`)
+}
+
+func TestErrEx(t *testing.T) {
+	pos2Positions = map[token.Pos]token.Position{}
+	pkg := newMainPackage()
+	tyInt := types.Typ[types.Int]
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVar(tyInt, "a").NewVar(types.Typ[types.String], "s").
+		NewVar(types.NewStruct([]*types.Var{types.NewField(token.NoPos, pkg.Types, "x", tyInt, false)}, nil), "st")
+	a, s, st := ctxRef(pkg, "a"), ctxRef(pkg, "s"), ctxRef(pkg, "st")
+	check := func(err error, msg string, n int) {
+		t.Helper()
+		if err == nil || err.Error() != msg {
+			t.Fatalf("\nError: \"%v\"\nExpected: \"%s\"\n", err, msg)
+		}
+		if stk := cb.InternalStack(); stk.Len() != n {
+			t.Fatal("stack changed:", stk.Len())
+		}
+		cb.ResetStmt()
+	}
+	check(cb.Val(a, source("a", 1, 1)).Val(s).BinaryOpEx(token.ADD, source("a + s", 1, 1)),
+		"./foo.gop:1:1: invalid operation: a + s (mismatched types int and string)", 2)
+	_, err := cb.Val(a, source("a", 2, 1)).MemberValEx("foo", source("a.foo", 2, 1))
+	check(err, "./foo.gop:2:1: a.foo undefined (type int has no field or method foo)", 1)
+	_, err = cb.Val(a, source("a", 3, 1)).MemberRefEx("foo", source("a.foo", 3, 1))
+	check(err, "./foo.gop:3:1: a.foo undefined (type int has no field or method foo)", 1)
+	check(cb.Val(a, source("a", 4, 1)).Val(1).CallEx(1, 0, source("a(1)", 4, 1)),
+		"./foo.gop:4:1: cannot call non-function a(1) (type int)", 2)
+	check(cb.Val(a, source("a", 5, 1)).Val(1).IndexEx(1, false, source("a[1]", 5, 1)),
+		"./foo.gop:5:1: invalid operation: a[1] (type int does not support indexing)", 2)
+	check(cb.Val(nil).UnaryOpEx(token.NOT, false, source("!nil", 6, 1)),
+		"./foo.gop:6:1: invalid operation: operator ! not defined on nil", 1)
+	if err := cb.Val(a).Val(1).BinaryOpEx(token.ADD); err != nil {
+		t.Fatal("BinaryOpEx:", err)
+	}
+	if kind, err := cb.Val(st).MemberValEx("x"); err != nil || kind != gox.MemberField {
+		t.Fatal("MemberValEx:", kind, err)
+	}
+	cb.ResetStmt()
+	cb.End()
+}
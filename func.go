@@ -63,6 +63,12 @@ type Func struct {
 	decl   *ast.FuncDecl
 	old    funcBodyCtx
 	arity1 int // 0 for normal, (arity+1) for inlineClosure
+
+	// instances of params & results of an inline closure, and its ending label.
+	// They live with the inline closure, so an aborted inline call leaves
+	// nothing behind.
+	paramInsts map[*types.Var]*types.Var
+	ending     *Label
 }
 
 // Obj returns this function object.
@@ -115,7 +121,7 @@ func (p *Func) BodyStart(pkg *Package, src ...ast.Node) *CodeBuilder {
 // End is for internal use.
 func (p *Func) End(cb *CodeBuilder, src ast.Node) {
 	if p.isInline() {
-		p.inlineClosureEnd(cb)
+		p.inlineClosureEnd(cb, src)
 		return
 	}
 	pkg := cb.pkg
@@ -152,6 +158,18 @@ func (p *Package) NewFunc(recv *Param, name string, params, results *Tuple, vari
 	return f
 }
 
+// NewInit creates an init function. A package may have multiple init functions,
+// which are called in the order they are created (in one file) after all
+// package-level variables are initialized, no matter where they are.
+func (p *Package) NewInit(pos token.Pos) *Func {
+	sig := types.NewSignatureType(nil, nil, nil, nil, nil, false)
+	f, err := p.NewFuncWith(pos, "init", sig, nil)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
 func getRecv(recvTypePos func() token.Pos) token.Pos {
 	if recvTypePos != nil {
 		return recvTypePos()
@@ -166,6 +184,10 @@ func (p *Package) NewFuncWith(
 		panic("no func name")
 	}
 	cb := p.cb
+	if sig.Recv() == nil && sig.TypeParams() == nil {
+		// a function owns its signature, so that Func.ChangeParams can update it
+		sig = types.NewSignatureType(nil, nil, nil, sig.Params(), sig.Results(), sig.Variadic())
+	}
 	fn := &Func{Func: types.NewFunc(pos, p.Types, name, sig)}
 	if recv := sig.Recv(); IsMethodRecv(recv) { // add method to this type
 		var t *types.Named
@@ -225,7 +247,7 @@ func (p *Package) newClosure(sig *types.Signature) *Func {
 
 func (p *Package) newInlineClosure(sig *types.Signature, arity int) *Func {
 	fn := types.NewFunc(token.NoPos, p.Types, "", sig)
-	return &Func{Func: fn, arity1: arity + 1}
+	return &Func{Func: fn, arity1: arity + 1, paramInsts: make(map[*types.Var]*types.Var)}
 }
 
 func (p *Func) isInline() bool {
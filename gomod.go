@@ -0,0 +1,129 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+
+// GoModOpts represents options of generating go.mod of a module.
+type GoModOpts struct {
+	// Module is the module path. It defaults to path of the package.
+	Module string
+
+	// GoVersion is the go version (like "1.18"), which defaults to "1.18".
+	GoVersion string
+
+	// Versions maps paths of modules which may be required to their versions.
+	// A module is required if a package in it is imported.
+	Versions map[string]string
+}
+
+// GoMod returns content of go.mod of the module containing this package. It
+// requires modules (see GoModOpts.Versions) of non-standard packages imported
+// by files of this package. It's an error if the module of such a package
+// isn't found.
+func (p *Package) GoMod(opts *GoModOpts) ([]byte, error) {
+	if opts == nil {
+		opts = &GoModOpts{}
+	}
+	mod := opts.Module
+	if mod == "" {
+		if mod = p.Types.Path(); mod == "" {
+			return nil, fmt.Errorf("go.mod: module path is unknown")
+		}
+	}
+	goVer := opts.GoVersion
+	if goVer == "" {
+		goVer = "1.18"
+	}
+	requires := make(map[string]string)
+	for _, pkgPath := range p.usedImports() {
+		if stdPkg(pkgPath) || inModule(pkgPath, mod) {
+			continue
+		}
+		dep := ""
+		for m := range opts.Versions { // the longest module path matched
+			if inModule(pkgPath, m) && len(m) > len(dep) {
+				dep = m
+			}
+		}
+		if dep == "" {
+			return nil, fmt.Errorf("go.mod: no module found for package %s", pkgPath)
+		}
+		requires[dep] = opts.Versions[dep]
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "module %s\n\ngo %s\n", mod, goVer)
+	if len(requires) > 0 {
+		deps := make([]string, 0, len(requires))
+		for dep := range requires {
+			deps = append(deps, dep)
+		}
+		sort.Strings(deps)
+		if len(deps) == 1 {
+			fmt.Fprintf(&b, "\nrequire %s %s\n", deps[0], requires[deps[0]])
+		} else {
+			b.WriteString("\nrequire (\n")
+			for _, dep := range deps {
+				fmt.Fprintf(&b, "\t%s %s\n", dep, requires[dep])
+			}
+			b.WriteString(")\n")
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// WriteModule writes all files of this package (see WriteDir) and go.mod (see
+// GoMod) into directory dir, so that dir is a standalone module.
+func (p *Package) WriteModule(dir string, opts *GoModOpts) error {
+	gomod, err := p.GoMod(opts)
+	if err != nil {
+		return err
+	}
+	if err = p.WriteDir(dir); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "go.mod"), gomod, 0666)
+}
+
+// usedImports returns paths of packages imported by files of this package.
+func (p *Package) usedImports() []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, f := range p.files {
+		f.markUsed(p)
+		for _, pkgPath := range f.allPkgPaths {
+			if at := f.importPkgs[pkgPath]; (at.isUsed || at.isForceUsed) && !seen[pkgPath] {
+				seen[pkgPath] = true
+				ret = append(ret, pkgPath)
+			}
+		}
+	}
+	return ret
+}
+
+func inModule(pkgPath, mod string) bool {
+	return pkgPath == mod || strings.HasPrefix(pkgPath, mod) && pkgPath[len(mod)] == '/'
+}
+
+// ----------------------------------------------------------------------------
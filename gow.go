@@ -14,12 +14,22 @@
 package gox
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"go/ast"
+	"go/parser"
+	"go/scanner"
 	"go/token"
 	"go/types"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/goplus/gox/internal/go/format"
@@ -43,7 +53,10 @@ func (p *Package) ASTFile(fname ...string) *ast.File {
 	if debugWriteFile {
 		log.Println("==> ASTFile", f.Name())
 	}
-	decls := f.getDecls(p)
+	decls := f.sortVarDecls(p, f.getDecls(p))
+	if p.conf.GroupVars {
+		decls = groupVarDecls(decls)
+	}
 	return &ast.File{Name: ident(p.Types.Name()), Decls: decls, Imports: getImports(decls)}
 }
 
@@ -61,6 +74,28 @@ func getImports(decls []ast.Decl) []*ast.ImportSpec {
 	return nil
 }
 
+// groupVarDecls merges adjacent var declarations into blocks (see
+// Config.GroupVars). Merged blocks are new nodes, as declarations of a file
+// may be changed after it's written.
+func groupVarDecls(decls []ast.Decl) []ast.Decl {
+	ret := make([]ast.Decl, 0, len(decls))
+	var last *ast.GenDecl // merged block being built
+	for _, decl := range decls {
+		if g, ok := decl.(*ast.GenDecl); ok && g.Tok == token.VAR && g.Doc == nil && len(ret) > 0 {
+			if prev, ok := ret[len(ret)-1].(*ast.GenDecl); ok && prev.Tok == token.VAR {
+				if prev != last {
+					last = &ast.GenDecl{Doc: prev.Doc, Tok: token.VAR, Specs: append([]ast.Spec(nil), prev.Specs...)}
+					ret[len(ret)-1] = last
+				}
+				last.Specs = append(last.Specs, g.Specs...)
+				continue
+			}
+		}
+		ret = append(ret, decl)
+	}
+	return ret
+}
+
 // CommentedASTFile returns commented AST of a file by its fname.
 // If fname is not provided, it returns AST of the default (NOT current) file.
 func (p *Package) CommentedASTFile(fname ...string) *printer.CommentedNodes {
@@ -81,10 +116,69 @@ func (p *Package) WriteTo(dst io.Writer, fname ...string) (err error) {
 	if file == nil {
 		return syscall.ENOENT
 	}
+	return p.writeTo(dst, file, fname...)
+}
+
+// writerPool pools buffered writers of writeTo. The printer writes its output
+// in many small pieces, so it writes to the destination (usually a file)
+// through a buffered writer, instead of hitting it for each piece.
+var writerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewWriterSize(nil, 64<<10)
+	},
+}
+
+func (p *Package) writeTo(dst io.Writer, file *printer.CommentedNodes, fname ...string) (err error) {
+	switch dst.(type) {
+	case *bytes.Buffer, *bufio.Writer: // already buffered
+	default:
+		w := writerPool.Get().(*bufio.Writer)
+		w.Reset(dst)
+		defer func() {
+			if err == nil {
+				err = w.Flush()
+			}
+			w.Reset(nil)
+			writerPool.Put(w)
+		}()
+		dst = w
+	}
+	if header := p.conf.FileHeader; header != "" {
+		if _, err = io.WriteString(dst, fileHeader(header)); err != nil {
+			return
+		}
+	}
+	if f, ok := p.File(fname...); ok && f.buildTag != "" {
+		if _, err = io.WriteString(dst, f.buildHeader()); err != nil {
+			return
+		}
+	}
 	fset := token.NewFileSet()
 	return format.Node(dst, fset, file)
 }
 
+// fileHeader returns lines of Config.FileHeader to write, which are separated
+// from the rest of the file by a blank line, so that they aren't taken as the
+// package doc.
+func fileHeader(header string) string {
+	lines := strings.Split(strings.TrimRight(header, "\n"), "\n")
+	inBlock := false
+	for i, line := range lines {
+		switch {
+		case inBlock:
+			inBlock = !strings.Contains(line, "*/")
+		case strings.HasPrefix(line, "//"):
+		case strings.HasPrefix(line, "/*"):
+			inBlock = !strings.Contains(line[2:], "*/")
+		case line == "":
+			lines[i] = "//"
+		default:
+			lines[i] = "// " + line
+		}
+	}
+	return strings.Join(lines, "\n") + "\n\n"
+}
+
 // WriteFile writes a file named fname.
 // If fname is not provided, it writes the default (NOT current) file.
 func (p *Package) WriteFile(file string, fname ...string) (err error) {
@@ -92,6 +186,10 @@ func (p *Package) WriteFile(file string, fname ...string) (err error) {
 	if ast == nil {
 		return syscall.ENOENT
 	}
+	return p.writeFile(file, ast, fname...)
+}
+
+func (p *Package) writeFile(file string, ast *printer.CommentedNodes, fname ...string) (err error) {
 	if debugWriteFile {
 		log.Println("WriteFile", file)
 	}
@@ -106,8 +204,193 @@ func (p *Package) WriteFile(file string, fname ...string) (err error) {
 			os.Remove(file)
 		}
 	}()
+	return p.writeTo(f, ast, fname...)
+}
+
+// WriteDir writes all files of this package into directory dir.
+// ASTs are built sequentially, then each file is rendered and written in its
+// own goroutine. The file without a name (the default file if
+// Config.DefaultGoFile is empty) is written as AutoGenFile unless it's empty.
+// If writing some files failed, it returns the error of the first one (in
+// order of file names).
+func (p *Package) WriteDir(dir string) (err error) {
+	fnames := make([]string, 0, len(p.files))
+	for fname, f := range p.files {
+		if fname != "" || len(f.decls) > 0 {
+			fnames = append(fnames, fname)
+		}
+	}
+	sort.Strings(fnames)
+	asts := make([]*printer.CommentedNodes, len(fnames))
+	for i, fname := range fnames {
+		asts[i] = p.CommentedASTFile(fname)
+	}
+	errs := make([]error, len(fnames))
+	var wg sync.WaitGroup
+	wg.Add(len(fnames))
+	for i, fname := range fnames {
+		go func(i int, fname string) {
+			defer wg.Done()
+			file := fname
+			if file == "" {
+				file = AutoGenFile
+			}
+			errs[i] = p.writeFile(filepath.Join(dir, file), asts[i], fname)
+		}(i, fname)
+	}
+	wg.Wait()
+	for _, err = range errs {
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// UpdateFile writes a file named fname into `file` incrementally: a top-level
+// declaration whose content (ignoring comments and formatting) isn't changed
+// since `file` was generated keeps its old text, so that hand-edited comments
+// and positions of unchanged declarations are preserved. `file` isn't
+// rewritten if nothing is changed. It returns whether `file` is rewritten.
+// If fname is not provided, it writes the default (NOT current) file.
+func (p *Package) UpdateFile(file string, fname ...string) (changed bool, err error) {
+	var buf bytes.Buffer
+	if err = p.WriteTo(&buf, fname...); err != nil {
+		return
+	}
+	src := buf.Bytes()
+	if old, e := os.ReadFile(file); e == nil {
+		if src = mergeDecls(old, src); bytes.Equal(old, src) {
+			return false, nil
+		}
+	}
+	if debugWriteFile {
+		log.Println("UpdateFile", file)
+	}
+	if err = os.WriteFile(file, src, 0666); err != nil {
+		return
+	}
+	return true, nil
+}
+
+type declChunk struct {
+	hash       [sha256.Size]byte
+	start, end int // offsets of the declaration (including its doc comment)
+}
+
+// mergeDecls returns `src` with its unchanged top-level declarations replaced
+// by their text in `old`.
+func mergeDecls(old, src []byte) []byte {
+	oldKeys, oldDecls, ok := declChunks(old)
+	if !ok {
+		return src
+	}
+	keys, decls, ok := declChunks(src)
+	if !ok {
+		return src
+	}
+	oldIdx := make(map[string]*declChunk, len(oldKeys))
+	for i, key := range oldKeys {
+		oldIdx[key] = oldDecls[i]
+	}
+	var b bytes.Buffer
+	last := 0
+	for i, d := range decls {
+		b.Write(src[last:d.start])
+		if od, ok := oldIdx[keys[i]]; ok && od.hash == d.hash {
+			b.Write(old[od.start:od.end])
+		} else {
+			b.Write(src[d.start:d.end])
+		}
+		last = d.end
+	}
+	b.Write(src[last:])
+	return b.Bytes()
+}
+
+// declChunks splits a Go source into its top-level declarations, which are
+// keyed by their kinds and names.
+func declChunks(src []byte) (keys []string, decls []*declChunk, ok bool) {
 	fset := token.NewFileSet()
-	return format.Node(f, fset, ast)
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return
+	}
+	tf := fset.File(f.Pos())
+	counts := make(map[string]int)
+	for _, decl := range f.Decls {
+		start, end := tf.Offset(decl.Pos()), tf.Offset(decl.End())
+		d := &declChunk{hash: hashTokens(src[start:end]), start: start, end: end}
+		if doc := declDoc(decl); doc != nil {
+			d.start = tf.Offset(doc.Pos())
+		}
+		key := declKey(decl)
+		if n := counts[key]; n > 0 { // such as init functions
+			counts[key] = n + 1
+			key += "#" + strconv.Itoa(n)
+		} else {
+			counts[key] = 1
+		}
+		keys = append(keys, key)
+		decls = append(decls, d)
+	}
+	return keys, decls, true
+}
+
+func declDoc(decl ast.Decl) *ast.CommentGroup {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		return d.Doc
+	case *ast.GenDecl:
+		return d.Doc
+	}
+	return nil
+}
+
+func declKey(decl ast.Decl) string {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if d.Recv != nil && len(d.Recv.List) > 0 {
+			return "func (" + types.ExprString(d.Recv.List[0].Type) + ")." + d.Name.Name
+		}
+		return "func " + d.Name.Name
+	case *ast.GenDecl:
+		var names []string
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				names = append(names, s.Name.Name)
+			case *ast.ValueSpec:
+				for _, name := range s.Names {
+					names = append(names, name.Name)
+				}
+			}
+		}
+		return d.Tok.String() + " " + strings.Join(names, ",")
+	}
+	return ""
+}
+
+// hashTokens hashes tokens of a Go source, ignoring comments and formatting.
+func hashTokens(src []byte) (ret [sha256.Size]byte) {
+	var s scanner.Scanner
+	fset := token.NewFileSet()
+	s.Init(fset.AddFile("", -1, len(src)), src, nil, 0)
+	h := sha256.New()
+	for {
+		_, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.SEMICOLON { // automatically inserted semicolons have "\n" as lit
+			lit = ""
+		}
+		h.Write([]byte(tok.String()))
+		h.Write([]byte(lit))
+		h.Write([]byte{0})
+	}
+	copy(ret[:], h.Sum(nil))
+	return
 }
 
 // ----------------------------------------------------------------------------
@@ -0,0 +1,368 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"go/token"
+	"go/types"
+	"log"
+	"strconv"
+)
+
+// ----------------------------------------------------------------------------
+
+// namedParams returns a copy of `t` whose parameters are all named. An unnamed
+// parameter, or a parameter named `p` (which is used as name of receivers),
+// is named by `prefix` and its index.
+func (p *Package) namedParams(t *types.Tuple, prefix string) *types.Tuple {
+	n := t.Len()
+	if n == 0 {
+		return nil
+	}
+	vars := make([]*types.Var, n)
+	for i := 0; i < n; i++ {
+		v := t.At(i)
+		name := v.Name()
+		if name == "" || name == "_" || name == "p" {
+			name = prefix + strconv.Itoa(i)
+		}
+		vars[i] = p.NewParam(token.NoPos, name, v.Type())
+	}
+	return types.NewTuple(vars...)
+}
+
+// callWithParams calls the function on the top of the stack with `params`.
+func callWithParams(cb *CodeBuilder, params *types.Tuple, variadic bool) *CodeBuilder {
+	n := params.Len()
+	for i := 0; i < n; i++ {
+		cb.Val(params.At(i))
+	}
+	return cb.Call(n, variadic)
+}
+
+// ----------------------------------------------------------------------------
+
+// NewMock generates a mock type `name` implementing the interface `iface`.
+// For each method `Get(key string) (int, error)` of the interface, it
+// generates:
+//
+//	type name struct {
+//		mu       sync.Mutex
+//		GetFunc  func(key string) (ret0 int, ret1 error) // zero values are returned if nil
+//		GetCalls [][]interface{}                         // arguments of each call
+//		...
+//	}
+//
+//	func (p *name) Get(key string) (ret0 int, ret1 error) {
+//		p.mu.Lock()
+//		p.GetCalls = append(p.GetCalls, []interface{}{key})
+//		p.mu.Unlock()
+//		if p.GetFunc != nil {
+//			return p.GetFunc(key)
+//		}
+//		return
+//	}
+func (p *Package) NewMock(name string, iface *types.Interface) *types.Named {
+	if debugInstr {
+		log.Println("NewMock", name, iface)
+	}
+	n := iface.NumMethods()
+	tyCalls := types.NewSlice(types.NewSlice(TyEmptyInterface))
+	mu := p.Import("sync").Ref("Mutex").Type()
+	fields := make([]*types.Var, 0, 1+n*2)
+	fields = append(fields, types.NewField(token.NoPos, p.Types, "mu", mu, false))
+	sigs := make([]*types.Signature, n)
+	for i := 0; i < n; i++ {
+		m := iface.Method(i)
+		sig := m.Type().(*types.Signature)
+		sigs[i] = types.NewSignatureType(nil, nil, nil,
+			p.namedParams(sig.Params(), "arg"), p.namedParams(sig.Results(), "ret"), sig.Variadic())
+		fields = append(fields,
+			types.NewField(token.NoPos, p.Types, m.Name()+"Func", sigs[i], false),
+			types.NewField(token.NoPos, p.Types, m.Name()+"Calls", tyCalls, false))
+	}
+	typ := p.NewTypeDefs().NewType(name).InitType(p, types.NewStruct(fields, nil))
+	builtin := p.Builtin()
+	for i := 0; i < n; i++ {
+		m, sig := iface.Method(i).Name(), sigs[i]
+		params := sig.Params()
+		recv := p.NewParam(token.NoPos, "p", types.NewPointer(typ))
+		cb := p.NewFunc(recv, m, params, sig.Results(), sig.Variadic()).BodyStart(p)
+		cb.VarVal("p").MemberVal("mu").MemberVal("Lock").Call(0).EndStmt().
+			VarVal("p").MemberRef(m + "Calls").
+			Val(builtin.Ref("append")).VarVal("p").MemberVal(m + "Calls")
+		for j := 0; j < params.Len(); j++ {
+			cb.Val(params.At(j))
+		}
+		cb.SliceLit(tyCalls.Elem(), params.Len()).Call(2).Assign(1).
+			VarVal("p").MemberVal("mu").MemberVal("Unlock").Call(0).EndStmt().
+			If().VarVal("p").MemberVal(m + "Func").Val(nil).BinaryOp(token.NEQ).Then()
+		callWithParams(cb.VarVal("p").MemberVal(m+"Func"), params, sig.Variadic())
+		if sig.Results().Len() > 0 {
+			cb.Return(1)
+		} else {
+			cb.EndStmt()
+		}
+		cb.End()
+		if sig.Results().Len() > 0 {
+			cb.Return(0)
+		}
+		cb.End()
+	}
+	return typ
+}
+
+// ----------------------------------------------------------------------------
+
+// WrapperOpts represents options of NewWrapper.
+type WrapperOpts struct {
+	// Methods are names of methods to forward. Defaults to all exported
+	// methods of the inner type.
+	Methods []string
+
+	// Embed embeds the inner value (so that methods not forwarded are still
+	// promoted), instead of holding it in a field named `inner`.
+	Embed bool
+
+	// Hooks adds two fields to the wrapper, which are called (if not nil)
+	// before and after each forwarded call:
+	//
+	//	Before func(method string, args []interface{})
+	//	After  func(method string, results []interface{})
+	Hooks bool
+}
+
+// NewWrapper generates a wrapper type `name` holding a value of the type
+// `inner`, which must be a named type, a pointer to a named type or an
+// interface. For each method `Get(key string) (int, error)` to forward, it
+// generates:
+//
+//	func (p *name) Get(key string) (int, error) {
+//		return p.inner.Get(key)
+//	}
+//
+// or with Hooks:
+//
+//	func (p *name) Get(key string) (int, error) {
+//		if p.Before != nil {
+//			p.Before("Get", []interface{}{key})
+//		}
+//		ret0, ret1 := p.inner.Get(key)
+//		if p.After != nil {
+//			p.After("Get", []interface{}{ret0, ret1})
+//		}
+//		return ret0, ret1
+//	}
+func (p *Package) NewWrapper(name string, inner types.Type, opts *WrapperOpts) *types.Named {
+	if opts == nil {
+		opts = &WrapperOpts{}
+	}
+	if debugInstr {
+		log.Println("NewWrapper", name, inner)
+	}
+	fldName := "inner"
+	if opts.Embed {
+		t := inner
+		if ptr, ok := t.(*types.Pointer); ok {
+			t = ptr.Elem()
+		}
+		named, ok := t.(*types.Named)
+		if !ok {
+			log.Panicln("NewWrapper: can't embed", inner)
+		}
+		fldName = named.Obj().Name()
+	}
+	methods := p.methodsToForward(inner, opts.Methods)
+	fields := []*types.Var{types.NewField(token.NoPos, p.Types, fldName, inner, opts.Embed)}
+	tyVals := types.NewSlice(TyEmptyInterface)
+	if opts.Hooks {
+		str := p.NewParam(token.NoPos, "method", types.Typ[types.String])
+		before := types.NewSignatureType(nil, nil, nil,
+			NewTuple(str, p.NewParam(token.NoPos, "args", tyVals)), nil, false)
+		after := types.NewSignatureType(nil, nil, nil,
+			NewTuple(str, p.NewParam(token.NoPos, "results", tyVals)), nil, false)
+		fields = append(fields,
+			types.NewField(token.NoPos, p.Types, "Before", before, false),
+			types.NewField(token.NoPos, p.Types, "After", after, false))
+	}
+	typ := p.NewTypeDefs().NewType(name).InitType(p, types.NewStruct(fields, nil))
+	for _, m := range methods {
+		sig := m.Type().(*types.Signature)
+		params := p.namedParams(sig.Params(), "arg")
+		recv := p.NewParam(token.NoPos, "p", types.NewPointer(typ))
+		cb := p.NewFunc(recv, m.Name(), params, sig.Results(), sig.Variadic()).BodyStart(p)
+		callInner := func() {
+			callWithParams(cb.VarVal("p").MemberVal(fldName).MemberVal(m.Name()), params, sig.Variadic())
+		}
+		if !opts.Hooks {
+			callInner()
+			if sig.Results().Len() > 0 {
+				cb.Return(1)
+			} else {
+				cb.EndStmt()
+			}
+			cb.End()
+			continue
+		}
+		hook := func(hook string, vals *types.Tuple) {
+			cb.If().VarVal("p").MemberVal(hook).Val(nil).BinaryOp(token.NEQ).Then().
+				VarVal("p").MemberVal(hook).Val(m.Name())
+			for i, n := 0, vals.Len(); i < n; i++ {
+				cb.Val(vals.At(i))
+			}
+			cb.SliceLit(tyVals, vals.Len()).Call(2).EndStmt().
+				End()
+		}
+		hook("Before", params)
+		n := sig.Results().Len()
+		if n == 0 {
+			callInner()
+			cb.EndStmt()
+			hook("After", nil)
+			cb.End()
+			continue
+		}
+		names := make([]string, n)
+		for i := range names {
+			names[i] = "ret" + strconv.Itoa(i)
+		}
+		cb.DefineVarStart(token.NoPos, names...)
+		callInner()
+		cb.EndInit(1)
+		rets := make([]*types.Var, n)
+		for i, name := range names {
+			_, o := cb.Scope().LookupParent(name, token.NoPos)
+			rets[i] = o.(*types.Var)
+		}
+		hook("After", types.NewTuple(rets...))
+		for _, ret := range rets {
+			cb.Val(ret)
+		}
+		cb.Return(n).
+			End()
+	}
+	return typ
+}
+
+func (p *Package) methodsToForward(typ types.Type, names []string) []*types.Func {
+	mset := types.NewMethodSet(typ)
+	if names == nil {
+		ret := make([]*types.Func, 0, mset.Len())
+		for i, n := 0, mset.Len(); i < n; i++ {
+			if m := mset.At(i).Obj(); m.Exported() {
+				ret = append(ret, m.(*types.Func))
+			}
+		}
+		return ret
+	}
+	ret := make([]*types.Func, len(names))
+	for i, name := range names {
+		sel := mset.Lookup(p.Types, name)
+		if sel == nil {
+			log.Panicln(typ, "has no method", name)
+		}
+		ret[i] = sel.Obj().(*types.Func)
+	}
+	return ret
+}
+
+// ----------------------------------------------------------------------------
+
+// NewInterfaceOf generates an interface type `name` containing exported methods
+// of `typ` accepted by `filter` (all if `filter` is nil). Note that the method
+// set of a named type T doesn't contain methods with pointer receivers, so `typ`
+// is usually *T.
+func (p *Package) NewInterfaceOf(name string, typ types.Type, filter func(m *types.Func) bool) *types.Named {
+	if debugInstr {
+		log.Println("NewInterfaceOf", name, typ)
+	}
+	var methods []*types.Func
+	for _, m := range p.methodsToForward(typ, nil) {
+		if filter == nil || filter(m) {
+			sig := m.Type().(*types.Signature)
+			sig = types.NewSignatureType(nil, nil, nil, sig.Params(), sig.Results(), sig.Variadic())
+			methods = append(methods, types.NewFunc(token.NoPos, p.Types, m.Name(), sig))
+		}
+	}
+	t := types.NewInterfaceType(methods, nil).Complete()
+	return p.NewTypeDefs().NewType(name).InitType(p, t)
+}
+
+// ----------------------------------------------------------------------------
+
+// InterfaceBuilder builds an interface type from methods, embedded interfaces
+// and type terms. It is created by Package.NewInterfaceBuilder.
+type InterfaceBuilder struct {
+	pkg       *Package
+	methods   []*types.Func
+	embeddeds []types.Type
+}
+
+// NewInterfaceBuilder starts building an interface type. For example, the
+// constraint `interface { ~int | string; fmt.Stringer; Get() int }` is built by:
+//
+//	pkg.NewInterfaceBuilder().
+//		Union(types.NewTerm(true, tyInt), types.NewTerm(false, tyString)).
+//		Embed(tyStringer).
+//		Method("Get", sigGet).
+//		Type()
+func (p *Package) NewInterfaceBuilder() *InterfaceBuilder {
+	return &InterfaceBuilder{pkg: p}
+}
+
+// Method adds a method `name` of signature `sig` (its receiver is ignored).
+func (p *InterfaceBuilder) Method(name string, sig *types.Signature) *InterfaceBuilder {
+	for _, m := range p.methods {
+		if m.Name() == name {
+			log.Panicln("duplicate method", name)
+		}
+	}
+	sig = types.NewSignatureType(nil, nil, nil, sig.Params(), sig.Results(), sig.Variadic())
+	p.methods = append(p.methods, types.NewFunc(token.NoPos, p.pkg.Types, name, sig))
+	return p
+}
+
+// Embed embeds `typ`. If `typ` isn't an interface, it is embedded as a type
+// term, which makes the interface a constraint.
+func (p *InterfaceBuilder) Embed(typ types.Type) *InterfaceBuilder {
+	p.embeddeds = append(p.embeddeds, typ)
+	return p
+}
+
+// Union embeds the union of `terms`, like `~int | string`.
+func (p *InterfaceBuilder) Union(terms ...*Term) *InterfaceBuilder {
+	if len(terms) == 0 {
+		log.Panicln("Union: no terms")
+	}
+	for _, term := range terms {
+		t := term.Type()
+		if term.Tilde() && !types.Identical(t, t.Underlying()) {
+			log.Panicf("invalid use of ~ (underlying type of %v is %v)\n", t, t.Underlying())
+		}
+		if it, ok := t.Underlying().(*types.Interface); ok && it.NumMethods() > 0 {
+			log.Panicf("cannot use %v in union (%v contains methods)\n", t, t)
+		}
+	}
+	if len(terms) == 1 && !terms[0].Tilde() {
+		return p.Embed(terms[0].Type())
+	}
+	return p.Embed(types.NewUnion(terms))
+}
+
+// Type returns the interface type built.
+func (p *InterfaceBuilder) Type() *types.Interface {
+	return types.NewInterfaceType(p.methods, p.embeddeds).Complete()
+}
+
+// ----------------------------------------------------------------------------
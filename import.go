@@ -21,6 +21,7 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // ----------------------------------------------------------------------------
@@ -37,23 +38,15 @@ type PkgRef struct {
 	Types *types.Package
 
 	nameRefs []*ast.Ident // for internal use
+	nrefs    int          // count of nameRefs not removed
+
+	doc     *ast.CommentGroup // doc comments of the import spec
+	docVers int               // times doc was changed, see importKey
 
 	isForceUsed bool // this package is force-used
 	isUsed      bool
 }
 
-func (p *PkgRef) markUsed(v *ast.Ident) {
-	if p.isUsed {
-		return
-	}
-	for _, ref := range p.nameRefs {
-		if ref == v {
-			p.isUsed = true
-			return
-		}
-	}
-}
-
 // Path returns the package path.
 func (p *PkgRef) Path() string {
 	return p.Types.Path()
@@ -79,6 +72,18 @@ func (p *PkgRef) MarkForceUsed() {
 	p.isForceUsed = true
 }
 
+// Comments returns doc comments of the import spec of this package.
+func (p *PkgRef) Comments() *ast.CommentGroup {
+	return p.doc
+}
+
+// SetComments sets doc comments of the import spec of this package.
+func (p *PkgRef) SetComments(doc *ast.CommentGroup) *PkgRef {
+	p.doc = doc
+	p.docVers++
+	return p
+}
+
 // EnsureImported ensures this package is imported.
 func (p *PkgRef) EnsureImported() {
 }
@@ -211,6 +216,77 @@ func toIndex(c byte) int {
 // Context represents all things between packages.
 type Context struct {
 	chkGopImports map[string]bool
+	builtins      map[builtinKey]*types.Package // shared builtin packages, see newBuiltinDefault
+	preloads      map[string]*preloaded         // packages imported in the background, see Preload
+	mu            sync.Mutex                    // for builtins and preloads
+	impMu         sync.Mutex                    // serializes imports by importers of the Context
+}
+
+// preloaded represents a package imported in the background.
+type preloaded struct {
+	done chan struct{} // closed when pkg and err are set
+	pkg  *types.Package
+	err  error
+}
+
+// Preload starts to import packages `pkgPaths` by `imp` in the background,
+// in order. Packages of this Context wait for a package being preloaded when
+// they import it, instead of importing it again. So a frontend can preload
+// all imports of a file, and start generating code while they are loading; it
+// blocks only when it imports a package which isn't loaded yet.
+//
+// `imp` should be the importer of packages of this Context. Imports by
+// importers of the Context are serialized, as importers aren't required to be
+// safe for concurrent use.
+func (p *Context) Preload(imp types.Importer, pkgPaths ...string) {
+	todo := make([]string, 0, len(pkgPaths))
+	lds := make([]*preloaded, 0, len(pkgPaths))
+	p.mu.Lock()
+	if p.preloads == nil {
+		p.preloads = make(map[string]*preloaded)
+	}
+	for _, pkgPath := range pkgPaths {
+		if _, ok := p.preloads[pkgPath]; !ok {
+			ld := &preloaded{done: make(chan struct{})}
+			p.preloads[pkgPath] = ld
+			todo, lds = append(todo, pkgPath), append(lds, ld)
+		}
+	}
+	p.mu.Unlock()
+	if len(todo) > 0 {
+		go func() {
+			for i, ld := range lds {
+				p.impMu.Lock()
+				ld.pkg, ld.err = imp.Import(todo[i])
+				p.impMu.Unlock()
+				close(ld.done)
+			}
+		}()
+	}
+}
+
+// importPkg imports a package by `imp`, or waits for it if it's preloaded.
+func (p *Context) importPkg(imp types.Importer, pkgPath string) (*types.Package, error) {
+	p.mu.Lock()
+	ld, ok := p.preloads[pkgPath]
+	p.mu.Unlock()
+	if ok {
+		<-ld.done
+		return ld.pkg, ld.err
+	}
+	p.impMu.Lock()
+	defer p.impMu.Unlock()
+	return imp.Import(pkgPath)
+}
+
+// ctxImporter imports packages through a Context, see Context.Preload.
+type ctxImporter struct {
+	ctx *Context
+	imp types.Importer
+}
+
+func (p ctxImporter) Import(pkgPath string) (*types.Package, error) {
+	return p.ctx.importPkg(p.imp, pkgPath)
 }
 
 func NewContext() *Context {
@@ -246,6 +322,12 @@ func (p *Package) Import(pkgPath string, src ...ast.Node) *PkgRef {
 	return p.file.importPkg(p, pkgPath, getSrc(src))
 }
 
+// Preload starts to import packages `pkgPaths` in the background. See
+// Context.Preload.
+func (p *Package) Preload(pkgPaths ...string) {
+	p.ctx.Preload(p.imp.(ctxImporter).imp, pkgPaths...)
+}
+
 // TryImport imports a package by pkgPath. It returns nil if pkgPath not found.
 func (p *Package) TryImport(pkgPath string) *PkgRef {
 	defer func() {
@@ -278,7 +360,11 @@ const (
 
 func (p *Package) autoName() string {
 	p.autoIdx++
-	return goxAutoPrefix + strconv.Itoa(p.autoIdx)
+	prefix := p.file.autoPrefix
+	if prefix == "" {
+		prefix = p.autoPrefix
+	}
+	return prefix + strconv.Itoa(p.autoIdx)
 }
 
 func (p *Package) newAutoNames() *autoNames {
@@ -290,8 +376,10 @@ func (p *Package) newAutoNames() *autoNames {
 }
 
 func scopeHasName(at *types.Scope, name string) bool {
-	if at.Lookup(name) != nil {
-		return true
+	if o := at.Lookup(name); o != nil {
+		if _, ok := o.(*types.PkgName); !ok { // imports of other files don't conflict
+			return true
+		}
 	}
 	for i := at.NumChildren(); i > 0; {
 		i--
@@ -0,0 +1,545 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"fmt"
+	"go/types"
+
+	"github.com/goplus/gox/internal"
+)
+
+// ----------------------------------------------------------------------------
+
+// infer infers the missing type arguments of `tparams` from the explicit type
+// arguments `targs` (can be partial) and the arguments `args` passed to the
+// parameters `params`. If `variadic` is true, arguments of the last parameter
+// `...T` are passed one by one (not as a slice with an ellipsis). Like
+// go/types, it does function argument type inference with typed arguments
+// first, then constraint type inference, and finally uses the default types
+// of untyped arguments.
+func infer(pkg *Package, tparams []*types.TypeParam, targs []types.Type, params *types.Tuple, args []*internal.Elem, variadic bool) ([]types.Type, error) {
+	n := len(tparams)
+	if len(targs) == n {
+		return targs, nil
+	}
+	paramAt := func(i int) types.Type {
+		if last := params.Len() - 1; variadic && i >= last {
+			return params.At(last).Type().(*types.Slice).Elem()
+		}
+		return params.At(i).Type()
+	}
+	u := newUnifier(tparams, targs)
+	var untyped []int
+	for i, arg := range args {
+		par := paramAt(i)
+		if !u.isParameterized(par) {
+			continue
+		}
+		if isUntyped(pkg, arg.Type) {
+			if u.asHandle(par) != nil {
+				untyped = append(untyped, i)
+			}
+			continue
+		}
+		if !u.unify(par, arg.Type, false) {
+			return nil, u.mismatch(par, arg)
+		}
+	}
+	if err := u.inferCore(tparams); err != nil {
+		return nil, err
+	}
+	if untyped != nil {
+		for _, tp := range tparams {
+			if u.at(tp) != nil {
+				continue
+			}
+			var typs []types.Type
+			for _, i := range untyped { // parameters of tp, or type parameters unified with it
+				if par := u.asHandle(paramAt(i)); par != nil && u.handles[par] == u.handles[tp] {
+					typs = append(typs, args[i].Type)
+				}
+			}
+			if t := DefaultOf(pkg, typs...); t != nil && !isUntyped(pkg, t) {
+				u.set(tp, t)
+			}
+		}
+		if err := u.inferCore(tparams); err != nil {
+			return nil, err
+		}
+	}
+	inferred := make([]types.Type, n)
+	for i, tp := range tparams {
+		t := u.at(tp)
+		if t == nil {
+			return nil, fmt.Errorf("cannot infer %s (%v)", tp.Obj().Name(), pkg.Fset.Position(tp.Obj().Pos()))
+		}
+		inferred[i] = t
+	}
+	for iter := 0; iter < n; iter++ { // resolve inferred types referring to others, like T => []E
+		changed := false
+		for i, t := range inferred {
+			if u.isParameterized(t) {
+				if nt := u.subst(t); nt != t {
+					inferred[i] = nt
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			break
+		}
+		for i, tp := range tparams {
+			u.set(tp, inferred[i])
+		}
+	}
+	return inferred, nil
+}
+
+// ----------------------------------------------------------------------------
+
+// unifier unifies types that refer to the type parameters being inferred.
+// Each type parameter has a handle, which is shared by type parameters that
+// are unified with each other.
+type unifier struct {
+	handles map[*types.TypeParam]*types.Type
+}
+
+func newUnifier(tparams []*types.TypeParam, targs []types.Type) *unifier {
+	handles := make(map[*types.TypeParam]*types.Type, len(tparams))
+	for i, tp := range tparams {
+		var t types.Type
+		if i < len(targs) {
+			t = targs[i]
+		}
+		handles[tp] = &t
+	}
+	return &unifier{handles: handles}
+}
+
+func (u *unifier) asHandle(typ types.Type) *types.TypeParam {
+	if tp, ok := typ.(*types.TypeParam); ok && u.handles[tp] != nil {
+		return tp
+	}
+	return nil
+}
+
+func (u *unifier) at(tp *types.TypeParam) types.Type {
+	return *u.handles[tp]
+}
+
+func (u *unifier) set(tp *types.TypeParam, typ types.Type) {
+	*u.handles[tp] = typ
+}
+
+func (u *unifier) join(x, y *types.TypeParam) {
+	hx, hy := u.handles[x], u.handles[y]
+	for tp, h := range u.handles {
+		if h == hy {
+			u.handles[tp] = hx
+		}
+	}
+}
+
+func (u *unifier) unknowns() (n int) {
+	for _, h := range u.handles {
+		if *h == nil {
+			n++
+		}
+	}
+	return
+}
+
+func (u *unifier) mismatch(par types.Type, arg *internal.Elem) error {
+	src := arg.Type.String()
+	if arg.Val != nil {
+		src = types.ExprString(arg.Val)
+	}
+	if tp := u.asHandle(par); tp != nil {
+		return fmt.Errorf(
+			"type %v of %s does not match inferred type %v for %v", arg.Type, src, u.at(tp), tp)
+	}
+	return fmt.Errorf("type %v of %s does not match %v", arg.Type, src, par)
+}
+
+// inferCore infers type parameters from the core types of their constraints,
+// like E of `T interface{ ~[]E }` from T.
+func (u *unifier) inferCore(tparams []*types.TypeParam) error {
+	for {
+		n := u.unknowns()
+		for _, tp := range tparams {
+			core, tilde, single := coreTerm(tp)
+			if core == nil {
+				continue
+			}
+			if tx := u.at(tp); tx != nil {
+				if _, ok := tx.(*types.TypeParam); tilde && !ok {
+					tx = tx.Underlying()
+				}
+				if !u.unify(core, tx, false) {
+					return fmt.Errorf("%s (type %v) does not satisfy %v", tp.Obj().Name(), u.at(tp), tp.Constraint())
+				}
+			} else if single && !tilde {
+				u.set(tp, core)
+			}
+		}
+		if u.unknowns() == n {
+			return nil
+		}
+	}
+}
+
+// coreTerm returns the core type of the constraint of `tp`, whether it has a
+// tilde term, and whether the constraint has a single term.
+func coreTerm(tp *types.TypeParam) (typ types.Type, tilde, single bool) {
+	if iface, ok := tp.Constraint().Underlying().(*types.Interface); ok {
+		return coreTermOf(iface)
+	}
+	return
+}
+
+func coreTermOf(iface *types.Interface) (typ types.Type, tilde, single bool) {
+	if iface.NumEmbeddeds() != 1 {
+		return
+	}
+	switch t := iface.EmbeddedType(0).(type) {
+	case *types.Union:
+		n := t.Len()
+		term := t.Term(0)
+		if n == 1 {
+			return term.Type(), term.Tilde(), true
+		}
+		typ, tilde = term.Type().Underlying(), term.Tilde()
+		for i := 1; i < n; i++ {
+			term = t.Term(i)
+			if !types.Identical(term.Type().Underlying(), typ) {
+				return nil, false, false
+			}
+			tilde = tilde || term.Tilde()
+		}
+		return typ, tilde, false
+	default:
+		if it, ok := t.Underlying().(*types.Interface); ok {
+			return coreTermOf(it)
+		}
+		return t, false, true
+	}
+}
+
+// unify unifies `x` and `y`, and records the types inferred for type
+// parameters. If `exact` is false, a defined type may be unified with a type
+// literal of the same structure, like an argument assigned to a parameter.
+func (u *unifier) unify(x, y types.Type, exact bool) bool {
+	px, py := u.asHandle(x), u.asHandle(y)
+	if px == nil && py != nil {
+		x, y, px, py = y, x, py, px
+	}
+	if px != nil {
+		tx := u.at(px)
+		if py != nil { // both are type parameters being inferred
+			ty := u.at(py)
+			switch {
+			case tx == nil && ty != nil:
+				u.set(px, ty)
+			case tx != nil && ty != nil:
+				if !u.unify(tx, ty, exact) {
+					return false
+				}
+			}
+			u.join(px, py)
+			return true
+		}
+		if tx == nil {
+			u.set(px, y)
+			return true
+		}
+		if !exact && isTypeLit(tx) != isTypeLit(y) && types.Identical(tx.Underlying(), y.Underlying()) {
+			if !isTypeLit(y) { // prefer the defined type
+				u.set(px, y)
+			}
+			return true
+		}
+		return u.unify(tx, y, exact)
+	}
+	if !exact && isTypeLit(x) != isTypeLit(y) {
+		if nx, ok := x.(*types.Named); ok {
+			x = nx.Underlying()
+		} else if ny, ok := y.(*types.Named); ok {
+			y = ny.Underlying()
+		}
+	}
+	switch x := x.(type) {
+	case *types.Array:
+		if y, ok := y.(*types.Array); ok {
+			return x.Len() == y.Len() && u.unify(x.Elem(), y.Elem(), true)
+		}
+	case *types.Slice:
+		if y, ok := y.(*types.Slice); ok {
+			return u.unify(x.Elem(), y.Elem(), true)
+		}
+	case *types.Pointer:
+		if y, ok := y.(*types.Pointer); ok {
+			return u.unify(x.Elem(), y.Elem(), true)
+		}
+	case *types.Map:
+		if y, ok := y.(*types.Map); ok {
+			return u.unify(x.Key(), y.Key(), true) && u.unify(x.Elem(), y.Elem(), true)
+		}
+	case *types.Chan:
+		if y, ok := y.(*types.Chan); ok {
+			return (!exact || x.Dir() == y.Dir()) && u.unify(x.Elem(), y.Elem(), true)
+		}
+	case *types.Signature:
+		if y, ok := y.(*types.Signature); ok && x.TypeParams() == nil && y.TypeParams() == nil {
+			return x.Variadic() == y.Variadic() &&
+				u.unifyTuple(x.Params(), y.Params()) && u.unifyTuple(x.Results(), y.Results())
+		}
+	case *types.Struct:
+		if y, ok := y.(*types.Struct); ok && x.NumFields() == y.NumFields() {
+			for i, n := 0, x.NumFields(); i < n; i++ {
+				fx, fy := x.Field(i), y.Field(i)
+				if fx.Name() != fy.Name() || fx.Embedded() != fy.Embedded() || x.Tag(i) != y.Tag(i) ||
+					!u.unify(fx.Type(), fy.Type(), true) {
+					return false
+				}
+			}
+			return true
+		}
+	case *types.Named:
+		if y, ok := y.(*types.Named); ok && x.Origin().Obj() == y.Origin().Obj() {
+			xargs, yargs := x.TypeArgs(), y.TypeArgs()
+			if xargs.Len() != yargs.Len() {
+				return false
+			}
+			for i, n := 0, xargs.Len(); i < n; i++ {
+				if !u.unify(xargs.At(i), yargs.At(i), true) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return types.Identical(x, y)
+}
+
+func (u *unifier) unifyTuple(x, y *types.Tuple) bool {
+	n := x.Len()
+	if n != y.Len() {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if !u.unify(x.At(i).Type(), y.At(i).Type(), true) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTypeLit(typ types.Type) bool {
+	switch typ.(type) {
+	case *types.Named, *types.TypeParam:
+		return false
+	}
+	return true
+}
+
+// isParameterized checks if `typ` refers to the type parameters being
+// inferred.
+func (u *unifier) isParameterized(typ types.Type) bool {
+	switch t := typ.(type) {
+	case *types.TypeParam:
+		return u.handles[t] != nil
+	case *types.Pointer:
+		return u.isParameterized(t.Elem())
+	case *types.Slice:
+		return u.isParameterized(t.Elem())
+	case *types.Array:
+		return u.isParameterized(t.Elem())
+	case *types.Chan:
+		return u.isParameterized(t.Elem())
+	case *types.Map:
+		return u.isParameterized(t.Key()) || u.isParameterized(t.Elem())
+	case *types.Signature:
+		return u.isParameterizedTuple(t.Params()) || u.isParameterizedTuple(t.Results())
+	case *types.Struct:
+		for i, n := 0, t.NumFields(); i < n; i++ {
+			if u.isParameterized(t.Field(i).Type()) {
+				return true
+			}
+		}
+	case *types.Named:
+		targs := t.TypeArgs()
+		for i, n := 0, targs.Len(); i < n; i++ {
+			if u.isParameterized(targs.At(i)) {
+				return true
+			}
+		}
+	case *types.Interface:
+		for i, n := 0, t.NumExplicitMethods(); i < n; i++ {
+			if u.isParameterized(t.ExplicitMethod(i).Type()) {
+				return true
+			}
+		}
+		for i, n := 0, t.NumEmbeddeds(); i < n; i++ {
+			if u.isParameterized(t.EmbeddedType(i)) {
+				return true
+			}
+		}
+	case *types.Union:
+		for i, n := 0, t.Len(); i < n; i++ {
+			if u.isParameterized(t.Term(i).Type()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (u *unifier) isParameterizedTuple(t *types.Tuple) bool {
+	for i, n := 0, t.Len(); i < n; i++ {
+		if u.isParameterized(t.At(i).Type()) {
+			return true
+		}
+	}
+	return false
+}
+
+// subst replaces the type parameters in `typ` by the types inferred for them.
+// It returns `typ` itself if nothing is replaced.
+func (u *unifier) subst(typ types.Type) types.Type {
+	switch t := typ.(type) {
+	case *types.TypeParam:
+		if u.handles[t] != nil {
+			if tx := u.at(t); tx != nil {
+				return tx
+			}
+		}
+	case *types.Pointer:
+		if elem := u.subst(t.Elem()); elem != t.Elem() {
+			return types.NewPointer(elem)
+		}
+	case *types.Slice:
+		if elem := u.subst(t.Elem()); elem != t.Elem() {
+			return types.NewSlice(elem)
+		}
+	case *types.Array:
+		if elem := u.subst(t.Elem()); elem != t.Elem() {
+			return types.NewArray(elem, t.Len())
+		}
+	case *types.Chan:
+		if elem := u.subst(t.Elem()); elem != t.Elem() {
+			return types.NewChan(t.Dir(), elem)
+		}
+	case *types.Map:
+		key, elem := u.subst(t.Key()), u.subst(t.Elem())
+		if key != t.Key() || elem != t.Elem() {
+			return types.NewMap(key, elem)
+		}
+	case *types.Signature:
+		params, results := u.substTuple(t.Params()), u.substTuple(t.Results())
+		if params != t.Params() || results != t.Results() {
+			return types.NewSignatureType(t.Recv(), nil, nil, params, results, t.Variadic())
+		}
+	case *types.Struct:
+		n := t.NumFields()
+		fields := make([]*types.Var, n)
+		tags := make([]string, n)
+		changed := false
+		for i := 0; i < n; i++ {
+			fld := t.Field(i)
+			if ft := u.subst(fld.Type()); ft != fld.Type() {
+				fld = types.NewField(fld.Pos(), fld.Pkg(), fld.Name(), ft, fld.Embedded())
+				changed = true
+			}
+			fields[i], tags[i] = fld, t.Tag(i)
+		}
+		if changed {
+			return types.NewStruct(fields, tags)
+		}
+	case *types.Named:
+		targs := t.TypeArgs()
+		n := targs.Len()
+		args := make([]types.Type, n)
+		changed := false
+		for i := 0; i < n; i++ {
+			if args[i] = u.subst(targs.At(i)); args[i] != targs.At(i) {
+				changed = true
+			}
+		}
+		if changed {
+			if ret, err := types.Instantiate(nil, t.Origin(), args, false); err == nil {
+				return ret
+			}
+		}
+	case *types.Interface:
+		n := t.NumExplicitMethods()
+		methods := make([]*types.Func, n)
+		changed := false
+		for i := 0; i < n; i++ {
+			m := t.ExplicitMethod(i)
+			if sig := u.subst(m.Type()); sig != m.Type() {
+				sig := sig.(*types.Signature)
+				m = types.NewFunc(m.Pos(), m.Pkg(), m.Name(), types.NewSignatureType(nil, nil, nil, sig.Params(), sig.Results(), sig.Variadic()))
+				changed = true
+			}
+			methods[i] = m
+		}
+		n = t.NumEmbeddeds()
+		embeddeds := make([]types.Type, n)
+		for i := 0; i < n; i++ {
+			if embeddeds[i] = u.subst(t.EmbeddedType(i)); embeddeds[i] != t.EmbeddedType(i) {
+				changed = true
+			}
+		}
+		if changed {
+			return types.NewInterfaceType(methods, embeddeds).Complete()
+		}
+	case *types.Union:
+		n := t.Len()
+		terms := make([]*types.Term, n)
+		changed := false
+		for i := 0; i < n; i++ {
+			term := t.Term(i)
+			if tt := u.subst(term.Type()); tt != term.Type() {
+				term = types.NewTerm(term.Tilde(), tt)
+				changed = true
+			}
+			terms[i] = term
+		}
+		if changed {
+			return types.NewUnion(terms)
+		}
+	}
+	return typ
+}
+
+func (u *unifier) substTuple(t *types.Tuple) *types.Tuple {
+	n := t.Len()
+	vars := make([]*types.Var, n)
+	changed := false
+	for i := 0; i < n; i++ {
+		v := t.At(i)
+		if vt := u.subst(v.Type()); vt != v.Type() {
+			v = types.NewParam(v.Pos(), v.Pkg(), v.Name(), vt)
+			changed = true
+		}
+		vars[i] = v
+	}
+	if changed {
+		return types.NewTuple(vars...)
+	}
+	return t
+}
+
+// ----------------------------------------------------------------------------
@@ -0,0 +1,332 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+
+// initDepOwner returns what depends on objects referenced now: the outermost
+// package-level var declaration being initialized, or the outermost named
+// function being built.
+func (p *CodeBuilder) initDepOwner() interface{} {
+	scope := p.pkg.Types.Scope()
+	var owner *ValueDecl
+	for v := p.valDecl; v != nil; v = v.oldv {
+		if v.tok == token.VAR && v.scope == scope {
+			owner = v
+		}
+	}
+	if owner != nil {
+		return owner
+	}
+	if fn := p.current.owner; fn != nil {
+		return fn
+	}
+	return nil
+}
+
+// recordInitDep records a reference of a package-level variable, function or
+// method of this package, which initialization of variables depends on (see
+// Package.InitOrder).
+func (p *CodeBuilder) recordInitDep(o types.Object) {
+	if p.probing {
+		return
+	}
+	switch v := o.(type) {
+	case *types.Var:
+	case *types.Func:
+	case *Func:
+		o = v.Func
+	default:
+		return
+	}
+	owner := p.initDepOwner()
+	if owner == nil {
+		return
+	}
+	if fn, ok := o.(*types.Func); ok && fn.Type().(*types.Signature).Recv() != nil {
+		if fn = originMethod(fn); fn == nil || fn.Pkg() != p.pkg.Types {
+			return
+		}
+		o = fn
+	} else if p.pkg.Types.Scope().Lookup(o.Name()) != o {
+		return
+	}
+	pkg := p.pkg
+	if pkg.initDeps == nil {
+		pkg.initDeps = make(map[interface{}][]types.Object)
+	}
+	pkg.initDeps[owner] = append(pkg.initDeps[owner], o)
+}
+
+// originMethod returns the declared method of a method of an instantiated
+// generic type (whose bodies are built with the declared ones).
+func originMethod(fn *types.Func) *types.Func {
+	recv := fn.Type().(*types.Signature).Recv().Type()
+	if t, ok := recv.(*types.Pointer); ok {
+		recv = t.Elem()
+	}
+	t, ok := recv.(*types.Named)
+	if !ok || t.Origin() == t {
+		return fn
+	}
+	orig := t.Origin()
+	for i, n := 0, orig.NumMethods(); i < n; i++ {
+		if m := orig.Method(i); m.Name() == fn.Name() {
+			return m
+		}
+	}
+	return nil
+}
+
+// initDepName returns the name of a dependency in an initialization cycle:
+// name of a variable or function, or T.name of a method.
+func initDepName(o types.Object) string {
+	if fn, ok := o.(*types.Func); ok {
+		if recv := fn.Type().(*types.Signature).Recv(); recv != nil {
+			typ := recv.Type()
+			if t, ok := typ.(*types.Pointer); ok {
+				typ = t.Elem()
+			}
+			if t, ok := typ.(*types.Named); ok {
+				return t.Obj().Name() + "." + fn.Name()
+			}
+		}
+	}
+	return o.Name()
+}
+
+// ----------------------------------------------------------------------------
+
+type initOrder struct {
+	pkg    *Package
+	declOf map[*types.Var]*ValueDecl
+	funcs  map[*types.Func][]*ValueDecl // memoized var dependencies of functions
+}
+
+// deps returns var declarations which the initializer of `decl` depends on,
+// directly or through functions it refers to.
+func (p *initOrder) deps(decl *ValueDecl) []*ValueDecl {
+	var ret []*ValueDecl
+	for _, o := range p.pkg.initDeps[decl] {
+		ret = p.depsOf(o, ret, nil)
+	}
+	return ret
+}
+
+func (p *initOrder) depsOf(o types.Object, ret []*ValueDecl, visiting map[*types.Func]bool) []*ValueDecl {
+	switch o := o.(type) {
+	case *types.Var:
+		if decl, ok := p.declOf[o]; ok {
+			ret = append(ret, decl)
+		}
+	case *types.Func:
+		deps, ok := p.funcs[o]
+		if !ok {
+			if visiting[o] { // recursive functions
+				return ret
+			}
+			if visiting == nil {
+				visiting = make(map[*types.Func]bool)
+			}
+			visiting[o] = true
+			for _, ref := range p.pkg.initDeps[o] {
+				deps = p.depsOf(ref, deps, visiting)
+			}
+			delete(visiting, o)
+			if len(visiting) == 0 { // memoize only complete results
+				p.funcs[o] = deps
+			}
+		}
+		ret = append(ret, deps...)
+	}
+	return ret
+}
+
+// InitOrder returns package-level var declarations in the order they're
+// initialized: repeatedly, the earliest one in declaration order which
+// doesn't depend on uninitialized variables (see "Package initialization" of
+// the Go spec). Dependencies are variables and functions referenced by their
+// initializers (and functions referenced by these functions, etc.). It returns
+// a *CodeError if there is an initialization cycle.
+func (p *Package) InitOrder() ([]*VarDecl, error) {
+	decls := make([]*ValueDecl, 0, len(p.varDecls))
+	for _, decl := range p.varDecls {
+		if len(decl.spec.Names) > 0 { // not deleted
+			decls = append(decls, decl)
+		}
+	}
+	io := &initOrder{
+		pkg: p, declOf: make(map[*types.Var]*ValueDecl), funcs: make(map[*types.Func][]*ValueDecl)}
+	for _, decl := range decls {
+		for _, name := range decl.names {
+			if v, ok := decl.scope.Lookup(name).(*types.Var); ok && name != "_" {
+				io.declOf[v] = decl
+			}
+		}
+	}
+	deps := make(map[*ValueDecl][]*ValueDecl, len(decls))
+	for _, decl := range decls {
+		deps[decl] = io.deps(decl)
+	}
+	inited := make(map[*ValueDecl]bool, len(decls))
+	ret := make([]*VarDecl, 0, len(decls))
+	for len(ret) < len(decls) {
+		var next *ValueDecl
+	search:
+		for _, decl := range decls {
+			if inited[decl] {
+				continue
+			}
+			for _, dep := range deps[decl] {
+				if !inited[dep] {
+					continue search
+				}
+			}
+			next = decl
+			break
+		}
+		if next == nil {
+			return nil, p.initCycle(io, decls, inited)
+		}
+		inited[next] = true
+		ret = append(ret, next)
+	}
+	return ret, nil
+}
+
+// initCycle returns an error describing an initialization cycle among
+// uninitialized declarations, like:
+//
+//	initialization cycle:
+//		a refers to
+//		f refers to
+//		a
+func (p *Package) initCycle(io *initOrder, decls []*ValueDecl, inited map[*ValueDecl]bool) error {
+	var path []string
+	var start *ValueDecl
+	visited := make(map[interface{}]bool)
+	var find func(owner interface{}) bool
+	find = func(owner interface{}) bool {
+		for _, o := range p.initDeps[owner] {
+			var next interface{} = o
+			if v, ok := o.(*types.Var); ok {
+				decl, ok := io.declOf[v]
+				if !ok {
+					continue
+				}
+				if decl == start {
+					path = append(path, v.Name())
+					return true
+				}
+				next = decl
+			}
+			if visited[next] {
+				continue
+			}
+			visited[next] = true
+			path = append(path, initDepName(o))
+			if find(next) {
+				return true
+			}
+			path = path[:len(path)-1]
+		}
+		return false
+	}
+	for _, decl := range decls {
+		if inited[decl] {
+			continue
+		}
+		start = decl
+		path = append(path[:0], strings.Join(decl.names, ", "))
+		for k := range visited {
+			delete(visited, k)
+		}
+		if find(decl) {
+			return p.cb.newCodeError(decl.pos, "initialization cycle:\n\t"+strings.Join(path, " refers to\n\t"))
+		}
+	}
+	return p.cb.newCodeError(token.NoPos, "initialization cycle")
+}
+
+// sortVarDecls returns declarations of a file with package-level var
+// declarations sorted in the order they're initialized (see InitOrder),
+// keeping positions of other declarations. It returns decls unchanged if there
+// is an initialization cycle, or a var declaration block has declarations out
+// of order. Otherwise it sorts a copy of decls, as they're still owned by the
+// file (a file may be written many times while being built).
+func (p *File) sortVarDecls(this *Package, decls []ast.Decl) []ast.Decl {
+	if this.initDeps == nil { // no variable is initialized by others
+		return decls
+	}
+	order, err := this.InitOrder()
+	if err != nil {
+		return decls
+	}
+	index := make(map[ast.Spec]int, len(order))
+	for i, decl := range order {
+		if decl.spec != nil {
+			index[decl.spec] = i
+		}
+	}
+	var slots, keys []int
+	key := -1
+	for i, decl := range decls {
+		if g, ok := decl.(*ast.GenDecl); ok && g.Tok == token.VAR {
+			for _, spec := range g.Specs { // a block without tracked specs follows the previous one
+				if idx, ok := index[spec]; ok {
+					if idx < key && spec != g.Specs[0] { // out of order in a block
+						return decls
+					}
+					key = idx
+				}
+			}
+			slots, keys = append(slots, i), append(keys, key)
+		}
+	}
+	if sort.IntsAreSorted(keys) {
+		return decls
+	}
+	gens := make([]ast.Decl, len(slots))
+	for i, slot := range slots {
+		gens[i] = decls[slot]
+	}
+	sort.Stable(&declsByKey{gens, keys})
+	ret := append([]ast.Decl(nil), decls...)
+	for i, slot := range slots {
+		ret[slot] = gens[i]
+	}
+	return ret
+}
+
+type declsByKey struct {
+	decls []ast.Decl
+	keys  []int
+}
+
+func (p *declsByKey) Len() int           { return len(p.decls) }
+func (p *declsByKey) Less(i, j int) bool { return p.keys[i] < p.keys[j] }
+func (p *declsByKey) Swap(i, j int) {
+	p.decls[i], p.decls[j] = p.decls[j], p.decls[i]
+	p.keys[i], p.keys[j] = p.keys[j], p.keys[i]
+}
+
+// ----------------------------------------------------------------------------
@@ -21,7 +21,10 @@ import (
 
 // -----------------------------------------------------------------------------
 
-const defaultStkSize = 64
+const (
+	defaultStkSize = 64
+	elemBlockSize  = 32
+)
 
 type Elem struct {
 	Val  ast.Expr
@@ -32,7 +35,27 @@ type Elem struct {
 
 // A Stack represents a FILO container.
 type Stack struct {
-	data []*Elem
+	data     []*Elem
+	free     []Elem // unused Elems of the current block
+	max      int    // max depth (0 means no limit)
+	overflow func() // called when pushing a value would exceed max
+	onPush   func(v *Elem)
+}
+
+// New allocates a new Elem. Elems are allocated in blocks (of elemBlockSize
+// Elems, 2KB on 64-bit platforms) to reduce count of allocations. An Elem is
+// never reused, so it's safe to hold it after it's popped. There is no free
+// list, as it can't be known when an Elem isn't held any longer: holding an
+// Elem retains its whole block, including values of the other Elems in it.
+// Blocks are kept small to bound such retention.
+func (p *Stack) New(val ast.Expr, typ types.Type, cval constant.Value, src ast.Node) *Elem {
+	if len(p.free) == 0 {
+		p.free = make([]Elem, elemBlockSize)
+	}
+	e := &p.free[0]
+	p.free = p.free[1:]
+	e.Val, e.Type, e.CVal, e.Src = val, typ, cval, src
+	return e
 }
 
 // NewStack creates a Stack instance.
@@ -52,6 +75,9 @@ func (p *Stack) Get(idx int) *Elem {
 
 // Set returns the value at specified index.
 func (p *Stack) Set(idx int, v *Elem) {
+	if p.onPush != nil {
+		p.onPush(v)
+	}
 	p.data[len(p.data)+idx] = v
 }
 
@@ -62,11 +88,38 @@ func (p *Stack) GetArgs(arity int) []*Elem {
 
 // Ret pops n values from this stack, and then pushes results.
 func (p *Stack) Ret(arity int, results ...*Elem) {
+	if len(p.data)-arity+len(results) > p.max && p.max > 0 {
+		p.overflow()
+	}
+	if p.onPush != nil {
+		for _, v := range results {
+			p.onPush(v)
+		}
+	}
 	p.data = append(p.data[:len(p.data)-arity], results...)
 }
 
+// SetLimit sets max depth of this stack. `overflow` is called (instead of
+// pushing) when pushing values by Push or Ret would exceed it, and it
+// shouldn't return.
+func (p *Stack) SetLimit(max int, overflow func()) {
+	p.max, p.overflow = max, overflow
+}
+
+// OnPush sets a function called with each value pushed into this stack (by
+// Push, Set and Ret).
+func (p *Stack) OnPush(fn func(v *Elem)) {
+	p.onPush = fn
+}
+
 // Push pushes a value into this stack.
 func (p *Stack) Push(v *Elem) {
+	if len(p.data) == p.max && p.max > 0 {
+		p.overflow()
+	}
+	if p.onPush != nil {
+		p.onPush(v)
+	}
 	p.data = append(p.data, v)
 }
 
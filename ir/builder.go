@@ -0,0 +1,287 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package ir
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"log"
+	"reflect"
+	"strconv"
+)
+
+// ----------------------------------------------------------------------------
+
+// Builder records instructions into a Program. Its methods mirror those of
+// gox.CodeBuilder.
+type Builder struct {
+	Prog *Program
+}
+
+// NewBuilder creates a Builder to record a package named `name`.
+func NewBuilder(pkgPath, name string) *Builder {
+	return &Builder{Prog: &Program{PkgPath: pkgPath, Name: name}}
+}
+
+func (p *Builder) emit(instr *Instr) *Builder {
+	p.Prog.Instrs = append(p.Prog.Instrs, instr)
+	return p
+}
+
+func (p *Builder) op(op Op) *Builder {
+	return p.emit(&Instr{Op: op})
+}
+
+// Func starts a function body. It must be ended by End.
+func (p *Builder) Func(name string, params, results *types.Tuple, variadic bool) *Builder {
+	return p.emit(&Instr{
+		Op: OpFunc, Name: name, Params: EncodeTuple(params), Results: EncodeTuple(results), Flag: variadic,
+	})
+}
+
+// End func
+func (p *Builder) End() *Builder {
+	return p.op(OpEnd)
+}
+
+// EndStmt func
+func (p *Builder) EndStmt() *Builder {
+	return p.op(OpEndStmt)
+}
+
+// EndInit func
+func (p *Builder) EndInit(n int) *Builder {
+	return p.emit(&Instr{Op: OpEndInit, N: n})
+}
+
+// Val func
+func (p *Builder) Val(v interface{}) *Builder {
+	instr := &Instr{Op: OpVal}
+	switch val := v.(type) {
+	case types.Object:
+		instr.Obj = EncodeObj(val)
+	case *ast.BasicLit:
+		instr.Lit = &Lit{Kind: val.Kind.String(), Value: val.Value}
+	case int:
+		instr.Lit = &Lit{Kind: token.INT.String(), Value: strconv.Itoa(val)}
+	case string:
+		instr.Lit = &Lit{Kind: token.STRING.String(), Value: strconv.Quote(val)}
+	case float64:
+		instr.Lit = &Lit{Kind: token.FLOAT.String(), Value: strconv.FormatFloat(val, 'g', -1, 64)}
+	case rune:
+		instr.Lit = &Lit{Kind: token.CHAR.String(), Value: strconv.QuoteRune(val)}
+	case bool:
+		instr.Obj = &Obj{Name: strconv.FormatBool(val)}
+	case nil:
+		instr.Obj = &Obj{Name: "nil"}
+	default:
+		log.Panicln("ir.Builder.Val: unsupported value -", reflect.TypeOf(v))
+	}
+	return p.emit(instr)
+}
+
+// Typ func
+func (p *Builder) Typ(typ types.Type) *Builder {
+	return p.emit(&Instr{Op: OpTyp, Type: EncodeType(typ)})
+}
+
+// VarVal pushes a variable looked up by its name in the current scope.
+func (p *Builder) VarVal(name string) *Builder {
+	return p.emit(&Instr{Op: OpVal, Obj: &Obj{Name: name}})
+}
+
+// VarRef func: p.VarRef(nil) means underscore (_). ref can be a types.Object,
+// or a name to look up in the current scope.
+func (p *Builder) VarRef(ref interface{}) *Builder {
+	instr := &Instr{Op: OpVarRef}
+	switch v := ref.(type) {
+	case nil:
+	case string:
+		instr.Obj = &Obj{Name: v}
+	case types.Object:
+		instr.Obj = EncodeObj(v)
+	default:
+		log.Panicln("ir.Builder.VarRef: unsupported ref -", reflect.TypeOf(ref))
+	}
+	return p.emit(instr)
+}
+
+// Call func
+func (p *Builder) Call(n int, ellipsis ...bool) *Builder {
+	return p.emit(&Instr{Op: OpCall, N: n, Flag: ellipsis != nil && ellipsis[0]})
+}
+
+// BinaryOp func
+func (p *Builder) BinaryOp(op token.Token) *Builder {
+	return p.emit(&Instr{Op: OpBinaryOp, Name: op.String()})
+}
+
+// UnaryOp func
+func (p *Builder) UnaryOp(op token.Token) *Builder {
+	return p.emit(&Instr{Op: OpUnaryOp, Name: op.String()})
+}
+
+// MemberVal func
+func (p *Builder) MemberVal(name string) *Builder {
+	return p.emit(&Instr{Op: OpMemberVal, Name: name})
+}
+
+// MemberRef func
+func (p *Builder) MemberRef(name string) *Builder {
+	return p.emit(&Instr{Op: OpMemberRef, Name: name})
+}
+
+// Index func
+func (p *Builder) Index(nidx int) *Builder {
+	return p.emit(&Instr{Op: OpIndex, N: nidx})
+}
+
+// IndexRef func
+func (p *Builder) IndexRef(nidx int) *Builder {
+	return p.emit(&Instr{Op: OpIndexRef, N: nidx})
+}
+
+// Assign func
+func (p *Builder) Assign(lhs int, rhs ...int) *Builder {
+	v := lhs
+	if rhs != nil {
+		v = rhs[0]
+	}
+	return p.emit(&Instr{Op: OpAssign, N: lhs, M: v})
+}
+
+// AssignOp func
+func (p *Builder) AssignOp(op token.Token) *Builder {
+	return p.emit(&Instr{Op: OpAssignOp, Name: op.String()})
+}
+
+// IncDec func
+func (p *Builder) IncDec(op token.Token) *Builder {
+	return p.emit(&Instr{Op: OpIncDec, Name: op.String()})
+}
+
+// DefineVarStart func
+func (p *Builder) DefineVarStart(names ...string) *Builder {
+	return p.emit(&Instr{Op: OpDefineVarStart, Names: names})
+}
+
+// NewVar func
+func (p *Builder) NewVar(typ types.Type, names ...string) *Builder {
+	return p.emit(&Instr{Op: OpNewVar, Type: encodeOptType(typ), Names: names})
+}
+
+// NewVarStart func
+func (p *Builder) NewVarStart(typ types.Type, names ...string) *Builder {
+	return p.emit(&Instr{Op: OpNewVarStart, Type: encodeOptType(typ), Names: names})
+}
+
+// NewConstStart func
+func (p *Builder) NewConstStart(typ types.Type, names ...string) *Builder {
+	return p.emit(&Instr{Op: OpNewConstStart, Type: encodeOptType(typ), Names: names})
+}
+
+func encodeOptType(typ types.Type) *Type {
+	if typ == nil {
+		return nil
+	}
+	return EncodeType(typ)
+}
+
+// Return func
+func (p *Builder) Return(n int) *Builder {
+	return p.emit(&Instr{Op: OpReturn, N: n})
+}
+
+// Block func
+func (p *Builder) Block() *Builder {
+	return p.op(OpBlock)
+}
+
+// If func
+func (p *Builder) If() *Builder {
+	return p.op(OpIf)
+}
+
+// Then func
+func (p *Builder) Then() *Builder {
+	return p.op(OpThen)
+}
+
+// Else func
+func (p *Builder) Else() *Builder {
+	return p.op(OpElse)
+}
+
+// For func
+func (p *Builder) For() *Builder {
+	return p.op(OpFor)
+}
+
+// Post func
+func (p *Builder) Post() *Builder {
+	return p.op(OpPost)
+}
+
+// ForRange func
+func (p *Builder) ForRange(names ...string) *Builder {
+	return p.emit(&Instr{Op: OpForRange, Names: names})
+}
+
+// RangeAssignThen func
+func (p *Builder) RangeAssignThen() *Builder {
+	return p.op(OpRangeAssignThen)
+}
+
+// Switch func
+func (p *Builder) Switch() *Builder {
+	return p.op(OpSwitch)
+}
+
+// Case func
+func (p *Builder) Case(n int) *Builder {
+	return p.emit(&Instr{Op: OpCase, N: n})
+}
+
+// Break func
+func (p *Builder) Break() *Builder {
+	return p.op(OpBreak)
+}
+
+// Continue func
+func (p *Builder) Continue() *Builder {
+	return p.op(OpContinue)
+}
+
+// None func
+func (p *Builder) None() *Builder {
+	return p.op(OpNone)
+}
+
+// SliceLit func
+func (p *Builder) SliceLit(typ types.Type, arity int) *Builder {
+	return p.emit(&Instr{Op: OpSliceLit, Type: encodeOptType(typ), N: arity})
+}
+
+// MapLit func
+func (p *Builder) MapLit(typ types.Type, arity int) *Builder {
+	return p.emit(&Instr{Op: OpMapLit, Type: encodeOptType(typ), N: arity})
+}
+
+// StructLit func
+func (p *Builder) StructLit(typ types.Type, arity int, keyVal bool) *Builder {
+	return p.emit(&Instr{Op: OpStructLit, Type: EncodeType(typ), N: arity, Flag: keyVal})
+}
+
+// ----------------------------------------------------------------------------
@@ -0,0 +1,229 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package ir defines a serializable form of the gox CodeBuilder instruction
+// stream and a replayer that reconstructs a gox.Package from it.
+//
+// A Program is plain data, so it can be encoded by encoding/json (or any
+// other codec) to cache frontend compilation results, or to pass them across
+// process boundaries.
+package ir
+
+import (
+	"go/types"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+
+// Program represents an instruction stream that builds a package.
+type Program struct {
+	PkgPath string   `json:"path"`
+	Name    string   `json:"name"`
+	Instrs  []*Instr `json:"instrs"`
+}
+
+// Op represents an instruction of the CodeBuilder.
+type Op = string
+
+const (
+	OpFunc            Op = "func"     // Name, Params, Results, Flag(variadic)
+	OpEnd             Op = "end"      //
+	OpEndStmt         Op = "endstmt"  //
+	OpEndInit         Op = "endinit"  // N
+	OpVal             Op = "val"      // Lit or Obj
+	OpTyp             Op = "typ"      // Type
+	OpVarRef          Op = "varref"   // Obj (nil means `_`)
+	OpCall            Op = "call"     // N, Flag(ellipsis)
+	OpBinaryOp        Op = "binop"    // Name(token)
+	OpUnaryOp         Op = "unop"     // Name(token)
+	OpMemberVal       Op = "member"   // Name
+	OpMemberRef       Op = "mref"     // Name
+	OpIndex           Op = "index"    // N
+	OpIndexRef        Op = "iref"     // N
+	OpAssign          Op = "assign"   // N(lhs), M(rhs)
+	OpAssignOp        Op = "assignop" // Name(token)
+	OpIncDec          Op = "incdec"   // Name(token)
+	OpDefineVarStart  Op = "define"   // Names
+	OpNewVar          Op = "var"      // Type, Names
+	OpNewVarStart     Op = "varinit"  // Type, Names
+	OpNewConstStart   Op = "const"    // Type, Names
+	OpReturn          Op = "return"   // N
+	OpBlock           Op = "block"    //
+	OpIf              Op = "if"       //
+	OpThen            Op = "then"     //
+	OpElse            Op = "else"     //
+	OpFor             Op = "for"      //
+	OpPost            Op = "post"     //
+	OpForRange        Op = "range"    // Names
+	OpRangeAssignThen Op = "rthen"    //
+	OpSwitch          Op = "switch"   //
+	OpCase            Op = "case"     // N
+	OpBreak           Op = "break"    //
+	OpContinue        Op = "continue" //
+	OpNone            Op = "none"     //
+	OpSliceLit        Op = "slice"    // Type, N
+	OpMapLit          Op = "map"      // Type, N
+	OpStructLit       Op = "struct"   // Type, N, Flag(keyVal)
+)
+
+// Instr represents an instruction. Which fields are used depends on Op.
+type Instr struct {
+	Op      Op       `json:"op"`
+	N       int      `json:"n,omitempty"`
+	M       int      `json:"m,omitempty"`
+	Flag    bool     `json:"f,omitempty"`
+	Name    string   `json:"s,omitempty"`
+	Names   []string `json:"names,omitempty"`
+	Lit     *Lit     `json:"lit,omitempty"`
+	Obj     *Obj     `json:"obj,omitempty"`
+	Type    *Type    `json:"t,omitempty"`
+	Params  []*Var   `json:"in,omitempty"`
+	Results []*Var   `json:"out,omitempty"`
+}
+
+// Lit represents a basic literal.
+type Lit struct {
+	Kind  string `json:"k"` // INT, FLOAT, IMAG, CHAR or STRING
+	Value string `json:"v"`
+}
+
+// Obj represents a reference to an object. An empty Pkg means looking up
+// Name in the current scope.
+type Obj struct {
+	Pkg  string `json:"p,omitempty"`
+	Name string `json:"n"`
+}
+
+// Var represents a parameter or a struct field.
+type Var struct {
+	Name     string `json:"n,omitempty"`
+	Type     *Type  `json:"t"`
+	Tag      string `json:"tag,omitempty"`
+	Embedded bool   `json:"e,omitempty"`
+}
+
+// Kind represents kind of a Type.
+type Kind = string
+
+const (
+	Basic     Kind = "basic"
+	Named     Kind = "named"
+	Pointer   Kind = "ptr"
+	Slice     Kind = "slice"
+	Array     Kind = "array"
+	Map       Kind = "map"
+	Chan      Kind = "chan"
+	Signature Kind = "func"
+	Struct    Kind = "struct"
+	Interface Kind = "iface"
+)
+
+// Type represents an encoded types.Type.
+type Type struct {
+	Kind     Kind    `json:"k"`
+	Name     string  `json:"n,omitempty"` // basic: name; named: pkgPath.Name; interface method: name
+	Key      *Type   `json:"key,omitempty"`
+	Elem     *Type   `json:"elem,omitempty"`
+	Len      int64   `json:"len,omitempty"`
+	Dir      int     `json:"dir,omitempty"`
+	Params   []*Var  `json:"in,omitempty"`     // signature
+	Results  []*Var  `json:"out,omitempty"`    // signature
+	Variadic bool    `json:"va,omitempty"`     // signature
+	Fields   []*Var  `json:"fields,omitempty"` // struct, embedded interfaces
+	Methods  []*Type `json:"methods,omitempty"`
+}
+
+// ----------------------------------------------------------------------------
+
+// EncodeType encodes a types.Type.
+func EncodeType(typ types.Type) *Type {
+	switch t := typ.(type) {
+	case *types.Basic:
+		return &Type{Kind: Basic, Name: t.Name()}
+	case *types.Named:
+		o := t.Obj()
+		if o.Pkg() == nil { // error
+			return &Type{Kind: Basic, Name: o.Name()}
+		}
+		return &Type{Kind: Named, Name: o.Pkg().Path() + "." + o.Name()}
+	case *types.Pointer:
+		return &Type{Kind: Pointer, Elem: EncodeType(t.Elem())}
+	case *types.Slice:
+		return &Type{Kind: Slice, Elem: EncodeType(t.Elem())}
+	case *types.Array:
+		return &Type{Kind: Array, Elem: EncodeType(t.Elem()), Len: t.Len()}
+	case *types.Map:
+		return &Type{Kind: Map, Key: EncodeType(t.Key()), Elem: EncodeType(t.Elem())}
+	case *types.Chan:
+		return &Type{Kind: Chan, Elem: EncodeType(t.Elem()), Dir: int(t.Dir())}
+	case *types.Signature:
+		return &Type{
+			Kind: Signature, Params: EncodeTuple(t.Params()), Results: EncodeTuple(t.Results()),
+			Variadic: t.Variadic(),
+		}
+	case *types.Struct:
+		n := t.NumFields()
+		fields := make([]*Var, n)
+		for i := 0; i < n; i++ {
+			fld := t.Field(i)
+			fields[i] = &Var{
+				Name: fld.Name(), Type: EncodeType(fld.Type()), Tag: t.Tag(i), Embedded: fld.Embedded(),
+			}
+		}
+		return &Type{Kind: Struct, Fields: fields}
+	case *types.Interface:
+		ret := &Type{Kind: Interface}
+		for i, n := 0, t.NumExplicitMethods(); i < n; i++ {
+			m := t.ExplicitMethod(i)
+			mt := EncodeType(m.Type())
+			mt.Name = m.Name()
+			ret.Methods = append(ret.Methods, mt)
+		}
+		for i, n := 0, t.NumEmbeddeds(); i < n; i++ {
+			ret.Fields = append(ret.Fields, &Var{Type: EncodeType(t.EmbeddedType(i)), Embedded: true})
+		}
+		return ret
+	}
+	panic("ir.EncodeType: unsupported type - " + typ.String())
+}
+
+// EncodeTuple encodes a parameter list.
+func EncodeTuple(t *types.Tuple) []*Var {
+	n := t.Len()
+	if n == 0 {
+		return nil
+	}
+	ret := make([]*Var, n)
+	for i := 0; i < n; i++ {
+		v := t.At(i)
+		ret[i] = &Var{Name: v.Name(), Type: EncodeType(v.Type())}
+	}
+	return ret
+}
+
+// EncodeObj encodes a reference to an object. Package-level objects are
+// referenced by their package paths, and other objects by their names.
+func EncodeObj(o types.Object) *Obj {
+	if pkg := o.Pkg(); pkg != nil && o.Parent() == pkg.Scope() {
+		return &Obj{Pkg: pkg.Path(), Name: o.Name()}
+	}
+	return &Obj{Name: o.Name()}
+}
+
+func splitName(name string) (pkgPath, sel string) {
+	pos := strings.LastIndexByte(name, '.')
+	return name[:pos], name[pos+1:]
+}
+
+// ----------------------------------------------------------------------------
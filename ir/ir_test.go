@@ -0,0 +1,150 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package ir_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/token"
+	"go/types"
+	"testing"
+
+	"github.com/goplus/gox"
+	"github.com/goplus/gox/ir"
+	"github.com/goplus/gox/packages"
+)
+
+func TestReplay(t *testing.T) {
+	fset := token.NewFileSet()
+	imp := packages.NewImporter(fset)
+	fmt, err := imp.Import("fmt")
+	if err != nil {
+		t.Fatal("Import fmt failed:", err)
+	}
+	tyInt := types.Typ[types.Int]
+	params := types.NewTuple(
+		types.NewParam(token.NoPos, nil, "a", tyInt), types.NewParam(token.NoPos, nil, "b", tyInt))
+	results := types.NewTuple(types.NewParam(token.NoPos, nil, "", tyInt))
+	b := ir.NewBuilder("foo", "foo")
+	b.Func("add", params, results, false).
+		DefineVarStart("c").VarVal("a").VarVal("b").BinaryOp(token.ADD).EndInit(1).
+		If().VarVal("c").Val(0).BinaryOp(token.LSS).Then().
+		/**/ VarRef("c").Val(0).Assign(1).
+		End().
+		Val(fmt.Scope().Lookup("Println")).VarVal("c").Call(1).EndStmt().
+		VarVal("c").Return(1).
+		End()
+
+	data, err := json.Marshal(b.Prog)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	var prog ir.Program
+	if err = json.Unmarshal(data, &prog); err != nil {
+		t.Fatal("json.Unmarshal failed:", err)
+	}
+	pkg, err := ir.Replay(&prog, &gox.Config{Fset: fset, Importer: imp})
+	if err != nil {
+		t.Fatal("ir.Replay failed:", err)
+	}
+	var buf bytes.Buffer
+	if err = pkg.WriteTo(&buf); err != nil {
+		t.Fatal("WriteTo failed:", err)
+	}
+	if ret := buf.String(); ret != `package foo
+
+import "fmt"
+
+func add(a int, b int) int {
+	c := a + b
+	if c < 0 {
+		c = 0
+	}
+	fmt.Println(c)
+	return c
+}
+` {
+		t.Fatal("TestReplay:", ret)
+	}
+
+	_, err = ir.Replay(&ir.Program{Instrs: []*ir.Instr{{Op: "unknown"}}}, nil)
+	if err == nil || err.Error() != `ir: instr #0: unknown op "unknown"` {
+		t.Fatal("ir.Replay:", err)
+	}
+}
+
+func TestReplayByteRune(t *testing.T) {
+	tyByte := types.Universe.Lookup("byte").Type()
+	tyRune := types.Universe.Lookup("rune").Type()
+	params := types.NewTuple(
+		types.NewParam(token.NoPos, nil, "b", tyByte), types.NewParam(token.NoPos, nil, "r", tyRune))
+	results := types.NewTuple(types.NewParam(token.NoPos, nil, "", tyRune))
+	b := ir.NewBuilder("foo", "foo")
+	b.Func("conv", params, results, false).
+		VarVal("r").Return(1).
+		End()
+
+	data, err := json.Marshal(b.Prog)
+	if err != nil {
+		t.Fatal("json.Marshal failed:", err)
+	}
+	var prog ir.Program
+	if err = json.Unmarshal(data, &prog); err != nil {
+		t.Fatal("json.Unmarshal failed:", err)
+	}
+	pkg, err := ir.Replay(&prog, nil)
+	if err != nil {
+		t.Fatal("ir.Replay failed:", err)
+	}
+	var buf bytes.Buffer
+	if err = pkg.WriteTo(&buf); err != nil {
+		t.Fatal("WriteTo failed:", err)
+	}
+	if ret := buf.String(); ret != `package foo
+
+func conv(b byte, r rune) rune {
+	return r
+}
+` {
+		t.Fatal("TestReplayByteRune:", ret)
+	}
+}
+
+func TestEncodeType(t *testing.T) {
+	fields := []*types.Var{types.NewField(token.NoPos, nil, "A", types.Typ[types.Int], false)}
+	typs := []types.Type{
+		types.NewMap(types.Typ[types.String], types.NewSlice(types.NewPointer(types.Typ[types.Int]))),
+		types.NewChan(types.RecvOnly, types.NewArray(types.Typ[types.Uint8], 4)),
+		types.NewStruct(fields, []string{`json:"a"`}),
+		types.Universe.Lookup("error").Type(),
+	}
+	for _, typ := range typs {
+		data, err := json.Marshal(ir.EncodeType(typ))
+		if err != nil {
+			t.Fatal("json.Marshal failed:", err)
+		}
+		b := ir.NewBuilder("foo", "foo")
+		b.Prog.Instrs = append(b.Prog.Instrs, &ir.Instr{Op: ir.OpNewVar, Names: []string{"x"}})
+		var enc ir.Type
+		json.Unmarshal(data, &enc)
+		b.Prog.Instrs[0].Type = &enc
+		pkg, err := ir.Replay(b.Prog, nil)
+		if err != nil {
+			t.Fatal("ir.Replay failed:", err)
+		}
+		if ret := pkg.Types.Scope().Lookup("x").Type(); !types.Identical(ret, typ) {
+			t.Fatal("TestEncodeType:", ret, typ)
+		}
+	}
+}
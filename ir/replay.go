@@ -0,0 +1,276 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package ir
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"github.com/goplus/gox"
+)
+
+// ----------------------------------------------------------------------------
+
+// Replay reconstructs a package by executing instructions of prog.
+func Replay(prog *Program, conf *gox.Config) (pkg *gox.Package, err error) {
+	pkg = gox.NewPackage(prog.PkgPath, prog.Name, conf)
+	err = ReplayTo(pkg, prog.Instrs)
+	return
+}
+
+// ReplayTo executes instrs on the code builder of pkg.
+func ReplayTo(pkg *gox.Package, instrs []*Instr) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			switch v := e.(type) {
+			case error:
+				err = v
+			default:
+				err = fmt.Errorf("%v", v)
+			}
+		}
+	}()
+	r := &replayer{pkg: pkg, cb: pkg.CB()}
+	for i, instr := range instrs {
+		r.idx = i
+		r.exec(instr)
+	}
+	return
+}
+
+type replayer struct {
+	pkg *gox.Package
+	cb  *gox.CodeBuilder
+	idx int
+}
+
+func (p *replayer) panicf(format string, args ...interface{}) {
+	panic(fmt.Errorf("ir: instr #%d: %s", p.idx, fmt.Sprintf(format, args...)))
+}
+
+func (p *replayer) exec(instr *Instr) {
+	cb := p.cb
+	switch instr.Op {
+	case OpFunc:
+		params := p.tuple(instr.Params)
+		results := p.tuple(instr.Results)
+		p.pkg.NewFunc(nil, instr.Name, params, results, instr.Flag).BodyStart(p.pkg)
+	case OpEnd:
+		cb.End()
+	case OpEndStmt:
+		cb.EndStmt()
+	case OpEndInit:
+		cb.EndInit(instr.N)
+	case OpVal:
+		if lit := instr.Lit; lit != nil {
+			cb.Val(&ast.BasicLit{Kind: p.token(lit.Kind), Value: lit.Value})
+		} else {
+			cb.Val(p.obj(instr.Obj))
+		}
+	case OpTyp:
+		cb.Typ(p.typ(instr.Type))
+	case OpVarRef:
+		if instr.Obj == nil {
+			cb.VarRef(nil)
+		} else {
+			cb.VarRef(p.obj(instr.Obj))
+		}
+	case OpCall:
+		cb.Call(instr.N, instr.Flag)
+	case OpBinaryOp:
+		cb.BinaryOp(p.token(instr.Name))
+	case OpUnaryOp:
+		cb.UnaryOp(p.token(instr.Name))
+	case OpMemberVal:
+		cb.MemberVal(instr.Name)
+	case OpMemberRef:
+		cb.MemberRef(instr.Name)
+	case OpIndex:
+		cb.Index(instr.N, false)
+	case OpIndexRef:
+		cb.IndexRef(instr.N)
+	case OpAssign:
+		cb.Assign(instr.N, instr.M)
+	case OpAssignOp:
+		cb.AssignOp(p.token(instr.Name))
+	case OpIncDec:
+		cb.IncDec(p.token(instr.Name))
+	case OpDefineVarStart:
+		cb.DefineVarStart(token.NoPos, instr.Names...)
+	case OpNewVar:
+		cb.NewVar(p.optTyp(instr.Type), instr.Names...)
+	case OpNewVarStart:
+		cb.NewVarStart(p.optTyp(instr.Type), instr.Names...)
+	case OpNewConstStart:
+		cb.NewConstStart(p.optTyp(instr.Type), instr.Names...)
+	case OpReturn:
+		cb.Return(instr.N)
+	case OpBlock:
+		cb.Block()
+	case OpIf:
+		cb.If()
+	case OpThen:
+		cb.Then()
+	case OpElse:
+		cb.Else()
+	case OpFor:
+		cb.For()
+	case OpPost:
+		cb.Post()
+	case OpForRange:
+		cb.ForRange(instr.Names...)
+	case OpRangeAssignThen:
+		cb.RangeAssignThen(token.NoPos)
+	case OpSwitch:
+		cb.Switch()
+	case OpCase:
+		cb.Case(instr.N)
+	case OpBreak:
+		cb.Break(nil)
+	case OpContinue:
+		cb.Continue(nil)
+	case OpNone:
+		cb.None()
+	case OpSliceLit:
+		cb.SliceLit(p.optTyp(instr.Type), instr.N)
+	case OpMapLit:
+		cb.MapLit(p.optTyp(instr.Type), instr.N)
+	case OpStructLit:
+		cb.StructLit(p.typ(instr.Type), instr.N, instr.Flag)
+	default:
+		p.panicf("unknown op %q", instr.Op)
+	}
+}
+
+var tokens = func() map[string]token.Token {
+	ret := make(map[string]token.Token)
+	for tok := token.ILLEGAL; tok <= token.TILDE; tok++ {
+		ret[tok.String()] = tok
+	}
+	return ret
+}()
+
+func (p *replayer) token(s string) token.Token {
+	if tok, ok := tokens[s]; ok {
+		return tok
+	}
+	p.panicf("unknown token %q", s)
+	return token.ILLEGAL
+}
+
+func (p *replayer) obj(o *Obj) types.Object {
+	if o == nil {
+		p.panicf("missing object")
+	}
+	if o.Pkg == "" {
+		if _, v := p.cb.Scope().LookupParent(o.Name, token.NoPos); v != nil {
+			return v
+		}
+	} else if o.Pkg == p.pkg.Path() {
+		if v := p.pkg.Types.Scope().Lookup(o.Name); v != nil {
+			return v
+		}
+	} else if v := p.pkg.Import(o.Pkg).TryRef(o.Name); v != nil {
+		return v
+	}
+	p.panicf("undefined: %s", o.Name)
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+
+var basicTypes = func() map[string]types.Type {
+	ret := make(map[string]types.Type)
+	for _, t := range types.Typ {
+		ret[t.Name()] = t
+	}
+	for _, name := range []string{"byte", "rune", "error"} { // aliases aren't in types.Typ
+		ret[name] = types.Universe.Lookup(name).Type()
+	}
+	return ret
+}()
+
+func (p *replayer) optTyp(t *Type) types.Type {
+	if t == nil {
+		return nil
+	}
+	return p.typ(t)
+}
+
+func (p *replayer) typ(t *Type) types.Type {
+	if t == nil {
+		p.panicf("missing type")
+	}
+	switch t.Kind {
+	case Basic:
+		if typ, ok := basicTypes[t.Name]; ok {
+			return typ
+		}
+	case Named:
+		pkgPath, name := splitName(t.Name)
+		if o := p.obj(&Obj{Pkg: pkgPath, Name: name}); o != nil {
+			if tn, ok := o.(*types.TypeName); ok {
+				return tn.Type()
+			}
+		}
+	case Pointer:
+		return types.NewPointer(p.typ(t.Elem))
+	case Slice:
+		return types.NewSlice(p.typ(t.Elem))
+	case Array:
+		return types.NewArray(p.typ(t.Elem), t.Len)
+	case Map:
+		return types.NewMap(p.typ(t.Key), p.typ(t.Elem))
+	case Chan:
+		return types.NewChan(types.ChanDir(t.Dir), p.typ(t.Elem))
+	case Signature:
+		return types.NewSignatureType(nil, nil, nil, p.tuple(t.Params), p.tuple(t.Results), t.Variadic)
+	case Struct:
+		fields := make([]*types.Var, len(t.Fields))
+		tags := make([]string, len(t.Fields))
+		for i, fld := range t.Fields {
+			fields[i] = types.NewField(token.NoPos, p.pkg.Types, fld.Name, p.typ(fld.Type), fld.Embedded)
+			tags[i] = fld.Tag
+		}
+		return types.NewStruct(fields, tags)
+	case Interface:
+		methods := make([]*types.Func, len(t.Methods))
+		for i, m := range t.Methods {
+			sig := p.typ(m).(*types.Signature)
+			methods[i] = types.NewFunc(token.NoPos, p.pkg.Types, m.Name, sig)
+		}
+		embeddeds := make([]types.Type, len(t.Fields))
+		for i, fld := range t.Fields {
+			embeddeds[i] = p.typ(fld.Type)
+		}
+		return types.NewInterfaceType(methods, embeddeds).Complete()
+	}
+	p.panicf("unknown type %s %s", t.Kind, t.Name)
+	return nil
+}
+
+func (p *replayer) tuple(vars []*Var) *types.Tuple {
+	if vars == nil {
+		return nil
+	}
+	ret := make([]*types.Var, len(vars))
+	for i, v := range vars {
+		ret[i] = p.pkg.NewParam(token.NoPos, v.Name, p.typ(v.Type))
+	}
+	return types.NewTuple(ret...)
+}
+
+// ----------------------------------------------------------------------------
@@ -0,0 +1,140 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"go/types"
+	"log"
+	"sort"
+)
+
+// ----------------------------------------------------------------------------
+
+// Method represents a method of a MethodSet.
+type Method struct {
+	// Name is name of the method, which may differ from name of Obj for an
+	// extension method.
+	Name string
+
+	// Obj is the method (a *types.Func), or the function implementing an
+	// extension method, whose first parameter is the receiver.
+	Obj types.Object
+
+	// Sel is the selection of the method, or nil for an extension method.
+	Sel *types.Selection
+}
+
+// IsExt checks if the method is an extension method (see InitBuiltin).
+func (p *Method) IsExt() bool {
+	return p.Sel == nil
+}
+
+// MethodSet represents methods of a type sorted by name.
+type MethodSet []*Method
+
+// Lookup returns the method named `name`, or nil if not found.
+func (p MethodSet) Lookup(name string) *Method {
+	i := sort.Search(len(p), func(i int) bool {
+		return p[i].Name >= name
+	})
+	if i < len(p) && p[i].Name == name {
+		return p[i]
+	}
+	return nil
+}
+
+// MethodSet returns method sets of values of type `typ` and of pointers to
+// them. Methods of delay-loaded types are loaded, and extension methods of
+// builtin types (like methods of slices, see InitBuiltin) are merged, so the
+// method sets are what member lookup of CodeBuilder sees. If `typ` is a
+// pointer or an interface, `ptr` is nil.
+func (p *Package) MethodSet(typ types.Type) (val, ptr MethodSet) {
+	if debugInstr {
+		log.Println("MethodSet", typ)
+	}
+	p.loadEmbedded(typ, make(map[types.Type]bool))
+	ext := p.extMethods(typ)
+	val = newMethodSet(types.NewMethodSet(typ), ext)
+	switch getUnderlying(p, typ).(type) {
+	case *types.Pointer, *types.Interface:
+	default:
+		ptr = newMethodSet(types.NewMethodSet(types.NewPointer(typ)), ext)
+	}
+	return
+}
+
+func newMethodSet(mset *types.MethodSet, ext []*Method) MethodSet {
+	n := mset.Len()
+	ret := make(MethodSet, n, n+len(ext))
+	seen := make(map[string]bool, n)
+	for i := 0; i < n; i++ {
+		sel := mset.At(i)
+		name := sel.Obj().Name()
+		ret[i], seen[name] = &Method{Name: name, Obj: sel.Obj(), Sel: sel}, true
+	}
+	for _, m := range ext { // methods hide extension methods of the same name
+		if !seen[m.Name] {
+			ret, seen[m.Name] = append(ret, m), true
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// extMethods returns extension methods of `typ`: ones of the named type, and
+// then ones of its underlying type.
+func (p *Package) extMethods(typ types.Type) (ext []*Method) {
+	cb := &p.cb
+	if t, ok := typ.(*types.Named); ok {
+		ext = appendExtMethods(ext, cb.getBuiltinTI(t))
+		typ = cb.getUnderlying(t)
+	}
+	switch typ.(type) {
+	case *types.Basic, *types.Slice, *types.Map, *types.Chan:
+		ext = appendExtMethods(ext, cb.getBuiltinTI(typ))
+	}
+	return
+}
+
+func appendExtMethods(ext []*Method, bti *builtinTI) []*Method {
+	if bti != nil {
+		for _, m := range bti.methods {
+			ext = append(ext, &Method{Name: m.name, Obj: m.fn})
+		}
+	}
+	return ext
+}
+
+// loadEmbedded loads delay-loaded types of `typ` and its embedded fields.
+func (p *Package) loadEmbedded(typ types.Type, loaded map[types.Type]bool) {
+	if t, ok := typ.(*types.Pointer); ok {
+		typ = t.Elem()
+	}
+	if loaded[typ] {
+		return
+	}
+	loaded[typ] = true
+	p.cb.ensureLoaded(typ)
+	if t, ok := getUnderlying(p, typ).(*types.Struct); ok {
+		for i, n := 0, t.NumFields(); i < n; i++ {
+			if fld := t.Field(i); fld.Embedded() {
+				p.loadEmbedded(fld.Type(), loaded)
+			}
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
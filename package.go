@@ -14,12 +14,20 @@
 package gox
 
 import (
+	"fmt"
 	"go/ast"
+	"go/build"
+	"go/build/constraint"
+	"go/constant"
+	"go/parser"
 	"go/token"
 	"go/types"
 	"log"
+	"os"
 	"path"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -132,21 +140,87 @@ type Config struct {
 	// NoSkipConstant is to disable optimization of skipping constant (optional).
 	NoSkipConstant bool
 
+	// AutoPrefix specifies prefix of auto-generated names (optional). It
+	// defaults to "_autoGo_".
+	AutoPrefix string
+
+	// ArenaMode is to allocate the most common ast nodes (idents, calls, etc.)
+	// in chunks, which are freed together with the package (optional). It
+	// lowers GC overhead of long-running processes generating many packages,
+	// at the cost that holding a node retains its whole chunk.
+	ArenaMode bool
+
+	// MaxStackDepth and MaxBlockDepth limit depth of the internal stack and
+	// count of nested open blocks (optional, 0 means no limit). A CodeError
+	// is raised when they are exceeded, which protects an embedder from a
+	// frontend bug that would otherwise exhaust memory.
+	MaxStackDepth, MaxBlockDepth int
+
+	// RecordSrcPos is to record src nodes of generated expressions, so that
+	// positions of generated code can be mapped to positions of the source
+	// code of the frontend, and vice versa (see Package.WriteToWithPosMap).
+	RecordSrcPos bool
+
+	// FileHeader is written at the top of every file of the package, above
+	// its build constraints and package clause (optional). It's usually a
+	// `// Code generated by X. DO NOT EDIT.` line followed by license text.
+	// Lines of it which aren't comments are commented out by `//`.
+	FileHeader string
+
+	// LineDirectives is to write a `//line file:line` directive before each
+	// statement, whose position is of the first src node (passed to
+	// instructions like Val, Call, etc.) of the statement, so that panics and
+	// debuggers of the generated code map back to the source code of the
+	// frontend. Positions of src nodes are resolved by Fset. It implies
+	// RecordSrcPos.
+	LineDirectives bool
+
+	// GroupVars is to write adjacent package-level var declarations (such as
+	// ones created by NewVar, NewVarStart, etc.) as a single `var ( ... )`
+	// block, unless a declaration has its own doc. Declarations themselves
+	// aren't changed, so they can still be changed after a file is written.
+	GroupVars bool
+
+	// ErrorMode specifies how errors of the code built are handled (optional).
+	// It defaults to ErrorPanic.
+	ErrorMode ErrorMode
+
 	// (internal) only for testing
 	DbgPositioner dbgPositioner
 }
 
+// ErrorMode specifies how a CodeBuilder handles errors of the code built.
+type ErrorMode int
+
+const (
+	// ErrorPanic panics on the first error, which aborts building.
+	ErrorPanic ErrorMode = iota
+
+	// ErrorCollect records errors, which are returned by Package.Errors. An
+	// error still aborts the statement raising it, but CodeBuilder.Guard
+	// records it and goes on with the next statement. Errors which don't
+	// abort building (like unused labels) are recorded too, unless
+	// Config.HandleErr is set.
+	ErrorCollect
+)
+
 // ----------------------------------------------------------------------------
 
 type File struct {
-	decls        []ast.Decl
-	allPkgPaths  []string
-	importPkgs   map[string]*PkgRef
-	pkgBig       *PkgRef
-	pkgUnsafe    *PkgRef
-	fname        string
-	removedExprs bool
-	defaultFile  bool
+	decls       []ast.Decl
+	allPkgPaths []string           // paths of imported packages in import order
+	importPkgs  map[string]*PkgRef // set of allPkgPaths: path => imported package
+	pkgBig      *PkgRef
+	pkgUnsafe   *PkgRef
+	fname       string
+	buildTag    string                 // expression of the //go:build constraint ("" means none)
+	plusBuild   bool                   // also write legacy // +build lines
+	pkgRefs     map[*ast.Ident]*PkgRef // package name refs => imported packages
+	refLog      []*ast.Ident           // package name refs made in CodeBuilder.Guard
+	nrefLogs    int                    // depth of nested Guards logging refs
+	autoPrefix  string                 // prefix of auto-generated names ("" means the package's)
+	importCache *importCache           // see importSpecs
+	defaultFile bool
 }
 
 // Name returns the name of this file.
@@ -154,6 +228,67 @@ func (p *File) Name() string {
 	return p.fname
 }
 
+// SetAutoPrefix sets prefix of auto-generated names in this file, so that
+// files of a package contributed by different generators don't produce
+// colliding names. Files use the prefix of the package if it isn't set.
+func (p *File) SetAutoPrefix(prefix string) {
+	checkAutoPrefix(prefix)
+	p.autoPrefix = prefix
+}
+
+// checkAutoPrefix panics if auto-generated names with `prefix` aren't valid
+// identifiers.
+func checkAutoPrefix(prefix string) {
+	if !token.IsIdentifier(prefix + "1") {
+		log.Panicln("invalid auto prefix:", strconv.Quote(prefix))
+	}
+}
+
+// SetBuildConstraint sets the build constraint of this file. `expr` is a
+// build expression (such as `linux && !386`) written as a //go:build line at
+// the top of the file. If plusBuild is true, equivalent legacy // +build lines
+// are written too, for Go versions before 1.17. An empty `expr` removes the
+// constraint.
+func (p *File) SetBuildConstraint(expr string, plusBuild bool) error {
+	if expr == "" {
+		p.buildTag, p.plusBuild = "", false
+		return nil
+	}
+	x, err := constraint.Parse("//go:build " + expr)
+	if err != nil {
+		return err
+	}
+	if plusBuild {
+		if _, err = constraint.PlusBuildLines(x); err != nil {
+			return err
+		}
+	}
+	p.buildTag, p.plusBuild = x.String(), plusBuild
+	return nil
+}
+
+// BuildConstraint returns the build expression of this file ("" means none).
+func (p *File) BuildConstraint() string {
+	return p.buildTag
+}
+
+// buildHeader returns the build constraint lines written before the package
+// clause of this file.
+func (p *File) buildHeader() string {
+	if p.buildTag == "" {
+		return ""
+	}
+	header := "//go:build " + p.buildTag + "\n"
+	if p.plusBuild {
+		x, _ := constraint.Parse(header)
+		lines, _ := constraint.PlusBuildLines(x)
+		for _, line := range lines {
+			header += line + "\n"
+		}
+	}
+	return header + "\n"
+}
+
 func (p *File) importPkg(this *Package, pkgPath string, src ast.Node) *PkgRef {
 	if strings.HasPrefix(pkgPath, ".") { // canonical pkgPath
 		pkgPath = path.Join(this.Path(), pkgPath)
@@ -179,57 +314,280 @@ func (p *File) importPkg(this *Package, pkgPath string, src ast.Node) *PkgRef {
 }
 
 func (p *File) markUsed(this *Package) {
-	if p.removedExprs {
-		// travel all ast nodes to mark used
-		p.markUsedBy(this, reflect.ValueOf(p.decls))
-		return
-	}
-	// no removed exprs, mark used simplely
 	for _, pkgImport := range p.importPkgs {
-		if pkgImport.nameRefs != nil {
+		if pkgImport.nrefs > 0 {
 			pkgImport.isUsed = true
 		}
 	}
 }
 
-var (
-	tyAstNode    = reflect.TypeOf((*ast.Node)(nil)).Elem()
-	tySelExprPtr = reflect.TypeOf((*ast.SelectorExpr)(nil))
-)
+// refPkg records `x` as a reference of the imported package `at`.
+func (p *File) refPkg(at *PkgRef, x *ast.Ident) {
+	at.nameRefs = append(at.nameRefs, x)
+	at.nrefs++
+	if p.pkgRefs == nil {
+		p.pkgRefs = make(map[*ast.Ident]*PkgRef)
+	}
+	p.pkgRefs[x] = at
+	if p.nrefLogs > 0 {
+		p.refLog = append(p.refLog, x)
+	}
+}
 
-func (p *File) markUsedBy(this *Package, val reflect.Value) {
-retry:
-	switch val.Kind() {
-	case reflect.Slice:
-		for i, n := 0, val.Len(); i < n; i++ {
-			p.markUsedBy(this, val.Index(i))
+// startRefLog starts logging references of imported packages, and returns
+// the mark of references logged from now on (see CodeBuilder.Guard).
+func (p *File) startRefLog() int {
+	p.nrefLogs++
+	return len(p.refLog)
+}
+
+// endRefLog ends logging started by startRefLog. If `drop` is true,
+// references logged since `mark` are dropped.
+func (p *File) endRefLog(mark int, drop bool) {
+	if drop {
+		for _, x := range p.refLog[mark:] {
+			p.unrefPkg(x)
 		}
-	case reflect.Ptr:
-		if val.IsNil() {
-			return
-		}
-		t := val.Type()
-		if t == tySelExprPtr {
-			x := val.Interface().(*ast.SelectorExpr).X
-			if sym, ok := x.(*ast.Ident); ok {
-				name := sym.Name
-				for _, at := range p.importPkgs {
-					if at.Types != nil && at.Types.Name() == name { // pkg.Object
-						at.markUsed(sym)
-					}
-				}
+		p.refLog = p.refLog[:mark]
+	}
+	if p.nrefLogs--; p.nrefLogs == 0 {
+		p.refLog = nil
+	}
+}
+
+// refRawPkgs records references of imported packages in `node`, a raw node
+// (see RawDecl) built in `scope`: an identifier X of `X.Sel` is taken as a
+// reference of the package named X, unless X is declared in `scope` (or its
+// parents) or in `node` itself. Aliases of imports aren't known here, so the
+// first package named X in import order is always picked if there are many.
+func (p *File) refRawPkgs(scope *types.Scope, node ast.Node) {
+	if len(p.allPkgPaths) == 0 {
+		return
+	}
+	r := &rawRefs{file: p, scope: scope}
+	r.walk(newRawScope(nil), node)
+}
+
+// rawScope is a scope of names declared in a raw node.
+type rawScope struct {
+	parent *rawScope
+	names  map[string]struct{}
+}
+
+func newRawScope(parent *rawScope) *rawScope {
+	return &rawScope{parent: parent}
+}
+
+func (p *rawScope) declare(name string) {
+	if p.names == nil {
+		p.names = make(map[string]struct{})
+	}
+	p.names[name] = struct{}{}
+}
+
+func (p *rawScope) declared(name string) bool {
+	for ; p != nil; p = p.parent {
+		if _, ok := p.names[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// rawRefs finds references of imported packages in a raw node.
+type rawRefs struct {
+	file  *File
+	scope *types.Scope
+}
+
+func (p *rawRefs) ref(s *rawScope, x *ast.Ident) {
+	if s.declared(x.Name) {
+		return
+	}
+	if p.scope != nil {
+		if at, o := p.scope.LookupParent(x.Name, token.NoPos); o != nil && at != types.Universe {
+			if _, ok := o.(*types.PkgName); !ok {
+				return
+			}
+		}
+	}
+	f := p.file
+	for _, pkgPath := range f.allPkgPaths {
+		if at := f.importPkgs[pkgPath]; at.Types.Name() == x.Name {
+			f.refPkg(at, x)
+			break
+		}
+	}
+}
+
+func (p *rawRefs) declare(s *rawScope, names []*ast.Ident) {
+	for _, name := range names {
+		if name.Name != "_" {
+			s.declare(name.Name)
+		}
+	}
+}
+
+func (p *rawRefs) declareFields(s *rawScope, fields *ast.FieldList) {
+	if fields != nil {
+		for _, fld := range fields.List {
+			p.declare(s, fld.Names)
+		}
+	}
+}
+
+func (p *rawRefs) declareExprs(s *rawScope, exprs ...ast.Expr) {
+	for _, e := range exprs {
+		if ident, ok := e.(*ast.Ident); ok && ident.Name != "_" {
+			s.declare(ident.Name)
+		}
+	}
+}
+
+func (p *rawRefs) walkFunc(s *rawScope, recv *ast.FieldList, typ *ast.FuncType, body *ast.BlockStmt) {
+	s = newRawScope(s)
+	p.declareFields(s, typ.TypeParams)
+	p.walk(s, recv)
+	p.walk(s, typ)
+	if body != nil {
+		p.declareFields(s, recv)
+		p.declareFields(s, typ.Params)
+		p.declareFields(s, typ.Results)
+		p.walkList(s, body.List)
+	}
+}
+
+func (p *rawRefs) walkList(s *rawScope, stmts []ast.Stmt) {
+	for _, stmt := range stmts {
+		p.walk(s, stmt)
+	}
+}
+
+func (p *rawRefs) walk(s *rawScope, node ast.Node) {
+	if node == nil || reflect.ValueOf(node).IsNil() {
+		return
+	}
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.SelectorExpr:
+			if x, ok := v.X.(*ast.Ident); ok {
+				p.ref(s, x)
+				return false
+			}
+		case *ast.FuncDecl:
+			p.walkFunc(s, v.Recv, v.Type, v.Body)
+			return false
+		case *ast.FuncLit:
+			p.walkFunc(s, nil, v.Type, v.Body)
+			return false
+		case *ast.BlockStmt:
+			p.walkList(newRawScope(s), v.List)
+			return false
+		case *ast.AssignStmt:
+			if v.Tok != token.DEFINE {
+				break
+			}
+			for _, e := range v.Rhs {
+				p.walk(s, e)
+			}
+			p.declareExprs(s, v.Lhs...)
+			return false
+		case *ast.ValueSpec:
+			p.walk(s, v.Type)
+			for _, e := range v.Values {
+				p.walk(s, e)
+			}
+			p.declare(s, v.Names)
+			return false
+		case *ast.TypeSpec:
+			s.declare(v.Name.Name)
+			inner := newRawScope(s)
+			p.declareFields(inner, v.TypeParams)
+			p.walk(inner, v.TypeParams)
+			p.walk(inner, v.Type)
+			return false
+		case *ast.IfStmt:
+			inner := newRawScope(s)
+			p.walk(inner, v.Init)
+			p.walk(inner, v.Cond)
+			p.walk(inner, v.Body)
+			p.walk(inner, v.Else)
+			return false
+		case *ast.ForStmt:
+			inner := newRawScope(s)
+			p.walk(inner, v.Init)
+			p.walk(inner, v.Cond)
+			p.walk(inner, v.Post)
+			p.walk(inner, v.Body)
+			return false
+		case *ast.RangeStmt:
+			p.walk(s, v.X)
+			inner := newRawScope(s)
+			if v.Tok == token.DEFINE {
+				p.declareExprs(inner, v.Key, v.Value)
 			} else {
-				p.markUsedBy(this, reflect.ValueOf(x))
+				p.walk(inner, v.Key)
+				p.walk(inner, v.Value)
 			}
-		} else if t.Implements(tyAstNode) { // ast.Node
-			elem := val.Elem()
-			for i, n := 0, elem.NumField(); i < n; i++ {
-				p.markUsedBy(this, elem.Field(i))
+			p.walk(inner, v.Body)
+			return false
+		case *ast.SwitchStmt:
+			inner := newRawScope(s)
+			p.walk(inner, v.Init)
+			p.walk(inner, v.Tag)
+			p.walk(inner, v.Body)
+			return false
+		case *ast.TypeSwitchStmt:
+			inner := newRawScope(s)
+			p.walk(inner, v.Init)
+			p.walk(inner, v.Assign)
+			p.walk(inner, v.Body)
+			return false
+		case *ast.CaseClause:
+			for _, e := range v.List {
+				p.walk(s, e)
 			}
+			p.walkList(newRawScope(s), v.Body)
+			return false
+		case *ast.CommClause:
+			inner := newRawScope(s)
+			p.walk(inner, v.Comm)
+			p.walkList(inner, v.Body)
+			return false
 		}
-	case reflect.Interface:
-		val = val.Elem()
-		goto retry
+		return true
+	})
+}
+
+// unrefPkg drops `x` as a reference of an imported package. It returns false
+// if `x` isn't a reference of this file.
+func (p *File) unrefPkg(x *ast.Ident) bool {
+	at, ok := p.pkgRefs[x]
+	if ok {
+		at.nrefs--
+		delete(p.pkgRefs, x)
+	}
+	return ok
+}
+
+// unrefPkgs drops references of imported packages in `nodes`, which are
+// removed from (or replaced in) files of the package, so that packages only
+// referenced by them aren't imported any more.
+func (p *Package) unrefPkgs(nodes ...ast.Node) {
+	for _, node := range nodes {
+		if node == nil {
+			continue
+		}
+		ast.Inspect(node, func(n ast.Node) bool {
+			if x, ok := n.(*ast.Ident); ok && !p.file.unrefPkg(x) {
+				for _, f := range p.files {
+					if f != p.file && f.unrefPkg(x) {
+						break
+					}
+				}
+			}
+			return true
+		})
 	}
 }
 
@@ -239,6 +597,36 @@ func (p *File) getDecls(this *Package) (decls []ast.Decl) {
 	if n == 0 {
 		return p.decls
 	}
+	specs := p.importSpecs(this)
+	addGopPkg := p.defaultFile && shouldAddGopPkg(this)
+	if len(specs) == 0 && !addGopPkg {
+		return p.decls
+	}
+	decls = make([]ast.Decl, 0, len(p.decls)+2)
+	decls = append(decls, &ast.GenDecl{Tok: token.IMPORT, Specs: specs})
+	if addGopPkg {
+		decls = append(decls, &ast.GenDecl{Tok: token.CONST, Specs: []ast.Spec{
+			&ast.ValueSpec{
+				Names: []*ast.Ident{{Name: gopPackage}},
+				Values: []ast.Expr{
+					&ast.Ident{Name: "true"},
+				},
+			},
+		}})
+	}
+	decls = append(decls, p.decls...)
+	return
+}
+
+// importSpecs returns specs of the import decl. They are cached until imports
+// of the file (or names which may conflict with them) change, because files
+// with hundreds of imports may be written many times (such as in watch mode).
+func (p *File) importSpecs(this *Package) []ast.Spec {
+	key := p.importKey(this)
+	if c := p.importCache; c != nil && equalInts(c.key, key) {
+		return c.specs
+	}
+	n := len(p.allPkgPaths)
 	specs := make([]ast.Spec, 0, n)
 	names := this.newAutoNames()
 	for _, pkgPath := range p.allPkgPaths {
@@ -246,6 +634,7 @@ func (p *File) getDecls(this *Package) (decls []ast.Decl) {
 		if !pkgImport.isUsed { // unused
 			if pkgImport.isForceUsed { // force-used
 				specs = append(specs, &ast.ImportSpec{
+					Doc:  pkgImport.doc,
 					Name: underscore, // _
 					Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(pkgPath)},
 				})
@@ -265,28 +654,61 @@ func (p *File) getDecls(this *Package) (decls []ast.Decl) {
 			}
 		}
 		specs = append(specs, &ast.ImportSpec{
+			Doc:  pkgImport.doc,
 			Name: name,
 			Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(pkgPath)},
 		})
 	}
-	addGopPkg := p.defaultFile && shouldAddGopPkg(this)
-	if len(specs) == 0 && !addGopPkg {
-		return p.decls
+	p.importCache = &importCache{key: key, specs: specs}
+	return specs
+}
+
+// importCache caches specs of the import decl of a file.
+type importCache struct {
+	key   []int // see importKey
+	specs []ast.Spec
+}
+
+// importKey returns what specs of the import decl depend on: count of objects
+// in the package (objects are never removed, so a new object which may
+// conflict with a package name changes it), and state of each import. Count
+// of name refs of an import is included, as new refs must be renamed, too.
+// So are changes of its doc comments.
+func (p *File) importKey(this *Package) []int {
+	key := make([]int, 1, 2*len(p.allPkgPaths)+1)
+	key[0] = countObjects(this.Types.Scope())
+	for _, pkgPath := range p.allPkgPaths {
+		pkgImport := p.importPkgs[pkgPath]
+		v := len(pkgImport.nameRefs) << 2
+		if pkgImport.isUsed {
+			v |= 1
+		}
+		if pkgImport.isForceUsed {
+			v |= 2
+		}
+		key = append(key, v, pkgImport.docVers)
 	}
-	decls = make([]ast.Decl, 0, len(p.decls)+2)
-	decls = append(decls, &ast.GenDecl{Tok: token.IMPORT, Specs: specs})
-	if addGopPkg {
-		decls = append(decls, &ast.GenDecl{Tok: token.CONST, Specs: []ast.Spec{
-			&ast.ValueSpec{
-				Names: []*ast.Ident{{Name: gopPackage}},
-				Values: []ast.Expr{
-					&ast.Ident{Name: "true"},
-				},
-			},
-		}})
+	return key
+}
+
+func countObjects(scope *types.Scope) int {
+	n := scope.Len()
+	for i, c := 0, scope.NumChildren(); i < c; i++ {
+		n += countObjects(scope.Child(i))
 	}
-	decls = append(decls, p.decls...)
-	return
+	return n
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, v := range a {
+		if b[i] != v {
+			return false
+		}
+	}
+	return true
 }
 
 func (p *File) big(this *Package) *PkgRef {
@@ -321,11 +743,21 @@ type Package struct {
 	conf           *Config
 	ctx            *Context
 	builtin        *types.Package
+	sharedBuiltin  *types.Package // objects of builtin are of it, see newBuiltinDefault
 	utBigInt       *types.Named
 	utBigRat       *types.Named
 	utBigFlt       *types.Named
 	autoIdx        int
+	autoPrefix     string
+	arena          *nodeArena                     // nil if not in arena mode
+	overloads      map[overloadKey]int            // memoized candidates of overloads, see matchOverload
+	srcs           map[ast.Node]ast.Node          // src nodes of generated nodes, see Config.RecordSrcPos
+	varDecls       []*ValueDecl                   // package-level var declarations, see InitOrder
+	initDeps       map[interface{}][]types.Object // see recordInitDep
+	funcRefs       map[*types.Func][]*ast.Ident   // references of package-level functions, see findCalls
 	commentedStmts map[ast.Stmt]*ast.CommentGroup
+	debugAsserts   *types.Const
+	literalizers   map[reflect.Type]Literalizer // see SetLiteralizer
 	implicitCast   func(pkg *Package, V, T types.Type, pv *Element) bool
 	allowRedecl    bool // for c2go
 	isGopPkg       bool
@@ -366,7 +798,7 @@ func NewPackage(pkgPath, name string, conf *Config) *Package {
 		conf:  conf,
 		ctx:   ctx,
 	}
-	pkg.imp = imp
+	pkg.imp = ctxImporter{ctx, imp}
 	pkg.Types = conf.Types
 	if pkg.Types == nil {
 		pkg.Types = types.NewPackage(pkgPath, name)
@@ -376,7 +808,20 @@ func NewPackage(pkgPath, name string, conf *Config) *Package {
 	pkg.utBigInt = conf.UntypedBigInt
 	pkg.utBigRat = conf.UntypedBigRat
 	pkg.utBigFlt = conf.UntypedBigFloat
+	pkg.autoPrefix = conf.AutoPrefix
+	if pkg.autoPrefix == "" {
+		pkg.autoPrefix = goxAutoPrefix
+	} else {
+		checkAutoPrefix(pkg.autoPrefix)
+	}
+	if conf.ArenaMode {
+		pkg.arena = new(nodeArena)
+	}
 	pkg.cb.init(pkg)
+	if conf.RecordSrcPos || conf.LineDirectives {
+		pkg.srcs = make(map[ast.Node]ast.Node)
+		pkg.cb.stk.OnPush(pkg.recordSrc)
+	}
 	return pkg
 }
 
@@ -394,6 +839,15 @@ func (p *Package) setStmtComments(stmt ast.Stmt, comments *ast.CommentGroup) {
 	p.commentedStmts[stmt] = comments
 }
 
+// SetAutoPrefix sets prefix of auto-generated names of the package, and
+// returns the old one to restore. A generator can call it to use its own
+// prefix during its invocation. See also File.SetAutoPrefix.
+func (p *Package) SetAutoPrefix(prefix string) (old string) {
+	checkAutoPrefix(prefix)
+	old, p.autoPrefix = p.autoPrefix, prefix
+	return
+}
+
 // SetRedeclarable sets to allow redeclaration of variables/functions or not.
 func (p *Package) SetRedeclarable(allowRedecl bool) {
 	p.allowRedecl = allowRedecl
@@ -424,6 +878,12 @@ func (p *Package) CB() *CodeBuilder {
 	return &p.cb
 }
 
+// Errors returns the errors recorded in ErrorCollect mode in order, see
+// Config.ErrorMode.
+func (p *Package) Errors() []error {
+	return p.cb.errs
+}
+
 // SetCurFile sets new current file to write.
 // If createIfNotExists is true, then create a new file named `fname` if it not exists.
 // It returns an `old` file to restore in the future (by calling `RestoreCurFile`).
@@ -432,8 +892,7 @@ func (p *Package) SetCurFile(fname string, createIfNotExists bool) (old *File, e
 	f, ok := p.files[fname]
 	if !ok {
 		if createIfNotExists {
-			f = &File{importPkgs: make(map[string]*PkgRef), fname: fname}
-			p.files[fname] = f
+			f = p.newFile(fname)
 		} else {
 			return nil, syscall.ENOENT
 		}
@@ -442,6 +901,423 @@ func (p *Package) SetCurFile(fname string, createIfNotExists bool) (old *File, e
 	return
 }
 
+// CreateFile creates a new empty file named `fname` (with its own imports)
+// without changing the current file. It returns syscall.EEXIST if the file
+// already exists. Use SetCurFile to write declarations into it.
+func (p *Package) CreateFile(fname string) (f *File, err error) {
+	if _, ok := p.files[fname]; ok {
+		return nil, syscall.EEXIST
+	}
+	return p.newFile(fname), nil
+}
+
+func (p *Package) newFile(fname string) *File {
+	f := &File{importPkgs: make(map[string]*PkgRef), fname: fname}
+	p.files[fname] = f
+	return f
+}
+
+// LoadFile parses and type-checks an existing Go file `filename` of this
+// package (see parser.ParseFile for the `src` argument), and adds it to the
+// package as a file named by the base name of `filename`. Objects declared in
+// it can be referenced by the code builder, and new declarations can be
+// appended to it by setting it as the current file (see SetCurFile). Comments
+// are preserved, but since positions of loaded nodes are cleared, ones other
+// than doc and line comments of declarations, fields and specs are moved before
+// the statement (or into the doc of the declaration) they belong to. Comments
+// of imports are dropped.
+func (p *Package) LoadFile(filename string, src interface{}) (f *File, err error) {
+	astFile, err := p.parseFile(filename, src)
+	if err != nil {
+		return
+	}
+	files, err := p.loadFiles([]*ast.File{astFile})
+	if err != nil {
+		return
+	}
+	return files[0], nil
+}
+
+// RawDecl appends a pre-built (or parsed) declaration to the current file as
+// is, without type checking. `objs` (optional) are objects declared by it,
+// which are inserted into the package scope (methods are added to their
+// receiver types instead) so that they can be referenced by the code builder.
+// Nothing is inserted if any of `objs` is redeclared. Positions of the
+// declaration are cleared, and an identifier X of `X.Sel` in it, which isn't
+// declared in the package or in the declaration itself, is taken as a
+// reference of the imported package named X (see Import). Aliases of imports
+// aren't known, so the first package named X in import order is picked.
+func (p *Package) RawDecl(decl ast.Decl, objs ...types.Object) error {
+	if debugInstr {
+		log.Println("RawDecl", reflect.TypeOf(decl))
+	}
+	scope := p.Types.Scope()
+	recvs := make([]*types.Named, len(objs))
+	for i, obj := range objs {
+		if fn, ok := obj.(*types.Func); ok {
+			if recv := fn.Type().(*types.Signature).Recv(); recv != nil {
+				typ := recv.Type()
+				if t, ok := typ.(*types.Pointer); ok {
+					typ = t.Elem()
+				}
+				if t, ok := typ.(*types.Named); ok {
+					recvs[i] = t
+					continue
+				}
+				return p.cb.newCodeErrorf(obj.Pos(), "invalid receiver type %v", recv.Type())
+			}
+		}
+		if err := p.cb.checkRedecl(scope, obj, objs[:i]); err != nil {
+			return err
+		}
+	}
+	for i, obj := range objs {
+		if t := recvs[i]; t != nil {
+			t.AddMethod(obj.(*types.Func))
+		} else {
+			scope.Insert(obj)
+		}
+	}
+	resetPos(reflect.ValueOf(decl))
+	p.file.refRawPkgs(scope, decl)
+	p.file.decls = append(p.file.decls, decl)
+	return nil
+}
+
+// OpenPackage parses and type-checks the Go package in directory dir (test
+// files and files excluded by build constraints are skipped), and returns it as
+// a Package whose files are loaded like LoadFile (comments included), so that
+// tools can append new declarations to its files (see SetCurFile), add methods
+// to its types, etc., and write it again.
+func OpenPackage(pkgPath, dir string, conf *Config) (*Package, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var filenames []string
+	var name string
+	for _, e := range entries {
+		fname := e.Name()
+		if e.IsDir() || !strings.HasSuffix(fname, ".go") || strings.HasSuffix(fname, "_test.go") {
+			continue
+		}
+		if ok, err := build.Default.MatchFile(dir, fname); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		filename := filepath.Join(dir, fname)
+		f, err := parser.ParseFile(token.NewFileSet(), filename, nil, parser.PackageClauseOnly)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			name = f.Name.Name
+		} else if f.Name.Name != name {
+			return nil, fmt.Errorf("OpenPackage: found packages %s and %s in %s", name, f.Name.Name, dir)
+		}
+		filenames = append(filenames, filename)
+	}
+	if filenames == nil {
+		return nil, fmt.Errorf("OpenPackage: no Go files in %s", dir)
+	}
+	pkg := NewPackage(pkgPath, name, conf)
+	astFiles := make([]*ast.File, len(filenames))
+	for i, filename := range filenames {
+		if astFiles[i], err = pkg.parseFile(filename, nil); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = pkg.loadFiles(astFiles); err != nil {
+		return nil, err
+	}
+	return pkg, nil
+}
+
+func (p *Package) parseFile(filename string, src interface{}) (*ast.File, error) {
+	fname := filepath.Base(filename)
+	if _, ok := p.files[fname]; ok {
+		return nil, fmt.Errorf("LoadFile: file %s exists", fname)
+	}
+	astFile, err := parser.ParseFile(p.Fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	if name := astFile.Name.Name; name != p.Types.Name() {
+		return nil, fmt.Errorf("LoadFile: found package %s in %s, expected %s", name, filename, p.Types.Name())
+	}
+	for _, spec := range astFile.Imports {
+		if spec.Name != nil && spec.Name.Name == "." {
+			return nil, fmt.Errorf("LoadFile: dot import of %s isn't supported", spec.Path.Value)
+		}
+	}
+	return astFile, nil
+}
+
+// loadFiles type-checks parsed files of this package together (so that they
+// can refer to each other), and adds them to the package.
+func (p *Package) loadFiles(astFiles []*ast.File) (files []*File, err error) {
+	info := &types.Info{Uses: make(map[*ast.Ident]types.Object)}
+	conf := &types.Config{Importer: importerOnly{p.imp}}
+	if err = types.NewChecker(conf, p.Fset, p.Types, info).Files(astFiles); err != nil {
+		return
+	}
+	files = make([]*File, len(astFiles))
+	for i, astFile := range astFiles {
+		fname := filepath.Base(p.Fset.Position(astFile.Package).Filename)
+		files[i] = p.loadFile(fname, astFile, info)
+	}
+	return
+}
+
+func (p *Package) loadFile(fname string, astFile *ast.File, info *types.Info) *File {
+	f := &File{importPkgs: make(map[string]*PkgRef), fname: fname}
+	for _, decl := range astFile.Decls {
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+			for _, spec := range d.Specs {
+				spec := spec.(*ast.ImportSpec)
+				pkgPath, _ := strconv.Unquote(spec.Path.Value)
+				at := f.importPkg(p, pkgPath, spec)
+				if spec.Name != nil && spec.Name.Name == "_" {
+					at.MarkForceUsed()
+				}
+			}
+			continue
+		}
+		f.decls = append(f.decls, decl)
+	}
+	for _, decl := range f.decls {
+		ast.Inspect(decl, func(node ast.Node) bool {
+			if x, ok := node.(*ast.Ident); ok {
+				if o, ok := info.Uses[x].(*types.PkgName); ok {
+					imported := o.Imported()
+					x.Name = imported.Name() // it will be renamed on writing if needed
+					f.refPkg(f.importPkgs[imported.Path()], x)
+				}
+			}
+			return true
+		})
+	}
+	p.loadComments(astFile, f.decls)
+	resetPos(reflect.ValueOf(f.decls))
+	p.files[fname] = f
+	return f
+}
+
+// loadComments keeps comments of loaded decls, which can't be printed by their
+// positions as those are cleared. Doc and line comments of fields and specs
+// are printed as is. Other comments in a function body are moved before the
+// statement they belong to, and the rest (such as free-floating comments
+// between decls) are merged into the doc of the decl or field they belong to.
+// Comments of imports and the package clause are dropped.
+func (p *Package) loadComments(astFile *ast.File, decls []ast.Decl) {
+	cmap := ast.NewCommentMap(p.Fset, astFile, astFile.Comments)
+	if len(cmap) == 0 {
+		return
+	}
+	stmtComments := make(map[ast.Stmt]*ast.CommentGroup)
+	for i, decl := range decls {
+		var path []ast.Node
+		ast.Inspect(decl, func(node ast.Node) bool {
+			if node == nil {
+				path = path[:len(path)-1]
+				return false
+			}
+			path = append(path, node)
+			for _, g := range cmap[node] {
+				switch {
+				case isOwnComment(node, g):
+				case g.Pos() > decl.End(): // such as comments at the end of the file
+					if i+1 < len(decls) {
+						appendDoc(declDocRef(decls[i+1]), g)
+					} else {
+						appendDoc(declDocRef(decl), g)
+					}
+				default:
+					if stmt := commentStmt(path); stmt != nil {
+						doc := stmtComments[stmt]
+						appendDoc(&doc, g)
+						stmtComments[stmt] = doc
+					} else {
+						appendDoc(commentHolder(path), g)
+					}
+				}
+			}
+			return true
+		})
+	}
+	for stmt, doc := range stmtComments {
+		for _, c := range doc.List {
+			c.Slash = token.NoPos
+		}
+		doc.List[0].Text = "\n" + doc.List[0].Text
+		p.setStmtComments(stmt, doc)
+	}
+	for _, decl := range decls {
+		ast.Inspect(decl, func(node ast.Node) bool {
+			switch x := node.(type) {
+			case *ast.FieldList:
+				var prev *ast.CommentGroup
+				for _, f := range x.List {
+					prev = leadComment(f.Doc, prev, f.Comment)
+				}
+			case *ast.GenDecl:
+				var prev *ast.CommentGroup
+				for _, spec := range x.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						prev = leadComment(spec.Doc, prev, spec.Comment)
+					case *ast.ValueSpec:
+						prev = leadComment(spec.Doc, prev, spec.Comment)
+					}
+				}
+			}
+			return true
+		})
+	}
+}
+
+// leadComment makes the doc of a field or spec start on a new line, unless
+// the line comment prev of the previous one ends the line already, and
+// separates its line comment from the code before it, as generated comments
+// do (see ValueDecl.SetComments and SetLineComment). It returns the line
+// comment.
+func leadComment(doc, prev, comment *ast.CommentGroup) *ast.CommentGroup {
+	if doc != nil && prev == nil {
+		doc.List[0].Text = "\n" + doc.List[0].Text
+	}
+	if comment != nil {
+		comment.List[0].Text = " " + comment.List[0].Text
+	}
+	return comment
+}
+
+// isOwnComment reports whether g is printed with node already.
+func isOwnComment(node ast.Node, g *ast.CommentGroup) bool {
+	switch x := node.(type) {
+	case *ast.FuncDecl:
+		return x.Doc == g
+	case *ast.GenDecl:
+		return x.Doc == g
+	case *ast.Field:
+		return x.Doc == g || x.Comment == g
+	case *ast.TypeSpec:
+		return x.Doc == g || x.Comment == g
+	case *ast.ValueSpec:
+		return x.Doc == g || x.Comment == g
+	}
+	return false
+}
+
+// commentStmt returns the innermost statement of path which is in a statement
+// list, or nil if there is no such statement.
+func commentStmt(path []ast.Node) ast.Stmt {
+	for i := len(path) - 1; i > 0; i-- {
+		switch path[i-1].(type) {
+		case *ast.BlockStmt, *ast.CaseClause, *ast.CommClause:
+			if stmt, ok := path[i].(ast.Stmt); ok {
+				return stmt
+			}
+		}
+	}
+	return nil
+}
+
+// commentHolder returns the address of the doc of the innermost node of path
+// which has one printed.
+func commentHolder(path []ast.Node) **ast.CommentGroup {
+	for i := len(path) - 1; i > 0; i-- {
+		switch x := path[i].(type) {
+		case *ast.Field:
+			switch path[i-2].(type) {
+			case *ast.StructType, *ast.InterfaceType:
+				return &x.Doc
+			}
+		case *ast.TypeSpec:
+			if decl := path[i-1].(*ast.GenDecl); decl.Lparen.IsValid() {
+				return &x.Doc
+			}
+		case *ast.ValueSpec:
+			if decl, ok := path[i-1].(*ast.GenDecl); ok && decl.Lparen.IsValid() {
+				return &x.Doc
+			}
+		}
+	}
+	return declDocRef(path[0].(ast.Decl))
+}
+
+func declDocRef(decl ast.Decl) **ast.CommentGroup {
+	switch x := decl.(type) {
+	case *ast.FuncDecl:
+		return &x.Doc
+	case *ast.GenDecl:
+		return &x.Doc
+	}
+	panic("unreachable")
+}
+
+// appendDoc merges comments of g into doc in the order of their positions.
+func appendDoc(doc **ast.CommentGroup, g *ast.CommentGroup) {
+	if *doc == nil {
+		*doc = &ast.CommentGroup{List: g.List}
+		return
+	}
+	list := append(append([]*ast.Comment(nil), (*doc).List...), g.List...)
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Slash < list[j].Slash
+	})
+	(*doc).List = list
+}
+
+var (
+	tyPos          = reflect.TypeOf(token.NoPos)
+	tyAstObjectPtr = reflect.TypeOf((*ast.Object)(nil))
+	tyAstScopePtr  = reflect.TypeOf((*ast.Scope)(nil))
+	tyCallExpr     = reflect.TypeOf(ast.CallExpr{})
+	tyTypeSpec     = reflect.TypeOf(ast.TypeSpec{})
+)
+
+// resetPos clears positions of loaded ast nodes, so that they are printed the
+// same way as generated ones. Positions used as flags (such as Ellipsis of a
+// call) are set to 1 instead.
+func resetPos(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if t := v.Type(); !v.IsNil() && t != tyAstObjectPtr && t != tyAstScopePtr {
+			resetPos(v.Elem())
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			resetPos(v.Elem())
+		}
+	case reflect.Slice:
+		for i, n := 0, v.Len(); i < n; i++ {
+			resetPos(v.Index(i))
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i, n := 0, v.NumField(); i < n; i++ {
+			fld := v.Field(i)
+			if fld.Type() != tyPos {
+				resetPos(fld)
+			} else if fld.Int() != 0 {
+				switch name := t.Field(i).Name; {
+				case name == "Ellipsis" && t == tyCallExpr, name == "Assign" && t == tyTypeSpec:
+					fld.SetInt(1)
+				default:
+					fld.SetInt(0)
+				}
+			}
+		}
+	}
+}
+
+// importerOnly hides ImportFrom of an importer, so that packages are imported
+// the same way as Package.Import does.
+type importerOnly struct {
+	types.Importer
+}
+
 // CurFile returns the current file.
 func (p *Package) CurFile() *File {
 	return p.file
@@ -455,14 +1331,61 @@ func (p *Package) RestoreCurFile(file *File) {
 // File returns a file by its name.
 // If `fname` is not provided, it returns the default (NOT current) file.
 func (p *Package) File(fname ...string) (file *File, ok bool) {
-	var name string
+	file, ok = p.files[p.fileName(fname...)]
+	return
+}
+
+func (p *Package) fileName(fname ...string) string {
 	if len(fname) == 1 {
-		name = fname[0]
-	} else {
-		name = p.conf.DefaultGoFile
+		return fname[0]
 	}
-	file, ok = p.files[name]
-	return
+	return p.conf.DefaultGoFile
+}
+
+const (
+	// AutoGenFile is the file name WriteDir uses for the default file if
+	// Config.DefaultGoFile is empty.
+	AutoGenFile = "gop_autogen.go"
+	// AssertDebugFile is the file that defines debugAsserts for `debug` builds.
+	AssertDebugFile = "gox_assert_debug.go"
+	// AssertReleaseFile is the file that defines debugAsserts for release builds.
+	AssertReleaseFile = "gox_assert_release.go"
+)
+
+const debugAssertsName = "debugAsserts"
+
+// assertsGuard returns the debugAsserts constant that guards assert blocks in
+// AssertDebug mode. It creates AssertDebugFile and AssertReleaseFile on first use.
+func (p *Package) assertsGuard() *types.Const {
+	if p.debugAsserts == nil {
+		o := types.NewConst(token.NoPos, p.Types, debugAssertsName, types.Typ[types.Bool], constant.MakeBool(false))
+		if old := p.Types.Scope().Insert(o); old != nil {
+			log.Panicln("assertsGuard:", debugAssertsName, "redeclared in this block")
+		}
+		p.debugAsserts = o
+		p.newBuildTagFile(AssertDebugFile, "debug", &ast.GenDecl{Tok: token.CONST, Specs: []ast.Spec{
+			&ast.ValueSpec{Names: []*ast.Ident{ident(debugAssertsName)}, Values: []ast.Expr{ident("true")}},
+		}})
+		p.newBuildTagFile(AssertReleaseFile, "!debug", &ast.GenDecl{Tok: token.CONST, Specs: []ast.Spec{
+			&ast.ValueSpec{Names: []*ast.Ident{ident(debugAssertsName)}, Values: []ast.Expr{ident("false")}},
+		}})
+	}
+	return p.debugAsserts
+}
+
+func (p *Package) newBuildTagFile(fname, buildTag string, decls ...ast.Decl) {
+	f := &File{importPkgs: make(map[string]*PkgRef), fname: fname, buildTag: buildTag, decls: decls}
+	p.files[fname] = f
+}
+
+// FileNames returns names of all files of this package in sorted order.
+func (p *Package) FileNames() []string {
+	fnames := make([]string, 0, len(p.files))
+	for fname := range p.files {
+		fnames = append(fnames, fname)
+	}
+	sort.Strings(fnames)
+	return fnames
 }
 
 // ForEachFile walks all files to `doSth`.
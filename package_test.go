@@ -22,8 +22,14 @@ import (
 	"go/types"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/goplus/gox"
@@ -224,6 +230,38 @@ func main() {
 `)
 }
 
+func TestMethodSet(t *testing.T) {
+	pkg := newMainPackage()
+	bytes := pkg.Import("bytes")
+	buf := bytes.Ref("Buffer").Type()
+	foo := pkg.NewType("foo").InitType(pkg, types.NewStruct([]*types.Var{
+		types.NewField(token.NoPos, pkg.Types, "Buffer", buf, true)}, nil))
+	recv := pkg.NewParam(token.NoPos, "p", foo)
+	pkg.NewFunc(recv, "Len", nil, types.NewTuple(pkg.NewParam(token.NoPos, "", types.Typ[types.Int])), false).
+		BodyStart(pkg).Val(0).Return(1).End()
+	val, ptr := pkg.MethodSet(foo)
+	if m := val.Lookup("Len"); m == nil || m.IsExt() || m.Obj.Pkg() != pkg.Types {
+		t.Fatal("MethodSet: Len of foo", m)
+	}
+	if val.Lookup("WriteString") != nil {
+		t.Fatal("MethodSet: WriteString of foo")
+	}
+	if m := ptr.Lookup("WriteString"); m == nil || len(m.Sel.Index()) != 2 {
+		t.Fatal("MethodSet: WriteString of *foo", m)
+	}
+	val, ptr = pkg.MethodSet(types.NewSlice(types.Typ[types.String]))
+	if m := val.Lookup("Join"); m == nil || !m.IsExt() || m.Obj.Name() != "Join" || ptr.Lookup("Join") == nil {
+		t.Fatal("MethodSet: Join of []string", m)
+	}
+	if _, ptr = pkg.MethodSet(types.NewPointer(foo)); ptr != nil {
+		t.Fatal("MethodSet: ptr of *foo", ptr)
+	}
+	val, _ = pkg.MethodSet(types.Typ[types.Int])
+	if m := val.Lookup("String"); m == nil || m.Obj.Name() != "Itoa" {
+		t.Fatal("MethodSet: String of int", m)
+	}
+}
+
 func TestPrintlnPrintln(t *testing.T) {
 	pkg := newMainPackage()
 	fmt := pkg.Import("fmt")
@@ -344,6 +382,172 @@ func main() {
 `)
 }
 
+func TestTypeOf(t *testing.T) {
+	pkg := newMainPackage()
+	tagged := reflect.TypeOf(struct {
+		Name string `json:"name"`
+	}{})
+	if st := pkg.TypeOf(tagged).(*types.Struct); st.Tag(0) != `json:"name"` {
+		t.Fatal("TypeOf: struct tag -", st.Tag(0))
+	}
+	typs := []reflect.Type{
+		reflect.TypeOf(time.Duration(0)),
+		reflect.TypeOf(struct {
+			Name string
+			Age  int
+		}{}),
+		reflect.TypeOf(map[string][]*time.Time(nil)),
+		reflect.TypeOf(func(int, ...string) error { return nil }),
+		reflect.TypeOf((<-chan [2]uint8)(nil)),
+		reflect.TypeOf((*interface{ Close() error })(nil)).Elem(),
+	}
+	for i, typ := range typs {
+		pkg.NewVar(token.NoPos, pkg.TypeOf(typ), "t"+strconv.Itoa(i))
+	}
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVarStart(nil, "a", "b", "c").
+		Val(time.Second).Val(int64(3)).Val(reflect.TypeOf(uint(0))).Val(1).Call(1).
+		EndInit(3).
+		End()
+	domTest(t, pkg, `package main
+
+import "time"
+
+var t0 time.Duration
+var t1 struct {
+	Name string
+	Age  int
+}
+var t2 map[string][]*time.Time
+var t3 func(int, ...string) error
+var t4 <-chan [2]uint8
+var t5 interface {
+	Close() error
+}
+
+func main() {
+	var a, b, c = time.Duration(1000000000), int64(3), uint(1)
+}
+`)
+}
+
+func TestValLit(t *testing.T) {
+	pkg := newMainPackage()
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVarStart(nil, "a").ValLit(map[string][]int{"b": {2, 3}, "a": {1}, "c": nil}).EndInit(1).
+		NewVarStart(nil, "b").ValLit([]interface{}{1, "x", 1.5, int64(2), nil, []byte(nil)}).EndInit(1).
+		NewVarStart(nil, "c").ValLit(struct {
+		Name    string
+		Timeout time.Duration
+		Ratio   float32
+		Tags    map[int]bool
+		Next    *[2]float64
+	}{Name: "foo", Timeout: time.Second, Ratio: 0.1, Next: &[2]float64{1, 2.5}}).EndInit(1).
+		NewVarStart(nil, "d").ValLit([]time.Duration{time.Second}).EndInit(1).
+		End()
+	domTest(t, pkg, `package main
+
+import "time"
+
+func main() {
+	var a = map[string][]int{"a": {1}, "b": {2, 3}, "c": nil}
+	var b = []interface {
+	}{1, "x", 1.5, int64(2), nil, []uint8(nil)}
+	var c = struct {
+		Name    string
+		Timeout time.Duration
+		Ratio   float32
+		Tags    map[int]bool
+		Next    *[2]float64
+	}{Name: "foo", Timeout: 1000000000, Ratio: 0.1, Next: &[2]float64{1.0, 2.5}}
+	var d = []time.Duration{1000000000}
+}
+`)
+	defer func() {
+		if e := recover(); e == nil {
+			t.Fatal("ValLit: no error?")
+		}
+	}()
+	pkg.CB().ValLit([]func(){func() {}})
+}
+
+func TestValLitEx(t *testing.T) {
+	pkg := newMainPackage()
+	cyclic := []interface{}{nil}
+	cyclic[0] = cyclic
+	m := map[string]interface{}{}
+	m["m"] = m
+	shared := []int{1}
+	n := 1
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg)
+	for i, v := range []interface{}{cyclic, m, &n} {
+		if err := cb.ValLitEx(v); err == nil {
+			t.Fatal("ValLitEx: no error?", i)
+		}
+	}
+	if cb.InternalStack().Len() != 0 {
+		t.Fatal("ValLitEx: stack is changed")
+	}
+	cb.NewVarStart(nil, "a").ValLit([][]int{shared, shared}).EndInit(1).
+		NewVarStart(nil, "b").ValLit(new(int)).EndInit(1).
+		End()
+	domTest(t, pkg, `package main
+
+func main() {
+	var a = [][]int{{1}, {1}}
+	var b = new(int)
+}
+`)
+}
+
+func TestValLitNeg(t *testing.T) {
+	pkg := newMainPackage()
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVarStart(nil, "a", "b").Val(int64(-5)).Val(float32(-1.5)).EndInit(2).
+		NewVarStart(nil, "c").ValLit([]float64{-2, 0.5}).EndInit(1).
+		NewVarStart(nil, "d").Val(-time.Second).EndInit(1).
+		End()
+	domTest(t, pkg, `package main
+
+import "time"
+
+func main() {
+	var a, b = int64(-5), float32(-1.5)
+	var c = []float64{-2.0, 0.5}
+	var d = time.Duration(-1000000000)
+}
+`)
+}
+
+func TestLiteralizer(t *testing.T) {
+	pkg := newMainPackage()
+	pkg.SetLiteralizer(reflect.TypeOf(time.Duration(0)), gox.LitDuration)
+	pkg.SetLiteralizer(reflect.TypeOf((*regexp.Regexp)(nil)), gox.LitRegexp)
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVarStart(nil, "a", "b").Val(time.Second).Val(regexp.MustCompile(`^a+$`)).EndInit(2).
+		NewVarStart(nil, "c").ValLit([]time.Duration{0, 90 * time.Minute, 1500 * time.Millisecond, 3}).EndInit(1).
+		NewVarStart(nil, "d").ValLit(map[string]*regexp.Regexp{"x": regexp.MustCompile(`x\d`), "y": nil}).EndInit(1).
+		End()
+	pkg.SetLiteralizer(reflect.TypeOf(time.Duration(0)), nil)
+	cb := pkg.CB().Val(time.Second)
+	if _, ok := cb.InternalStack().Pop().Val.(*ast.CallExpr); !ok {
+		t.Fatal("SetLiteralizer: not removed")
+	}
+	domTest(t, pkg, `package main
+
+import (
+	"time"
+	"regexp"
+)
+
+func main() {
+	var a, b = time.Second, regexp.MustCompile("^a+$")
+	var c = []time.Duration{time.Duration(0), 90 * time.Minute, 1500 * time.Millisecond, 3 * time.Nanosecond}
+	var d = map[string]*regexp.Regexp{"x": regexp.MustCompile("x\\d"), "y": nil}
+}
+`)
+}
+
 func TestTestingFile(t *testing.T) {
 	pkg := newMainPackage()
 	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).End()
@@ -391,6 +595,270 @@ func foo() {
 	})
 }
 
+func TestCreateFile(t *testing.T) {
+	gt := newGoxTest()
+	if _, err := gt.LoadGoPackage("foo", "foo.go", "package foo\n\nfunc F() {}\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gt.LoadGoPackage("bar", "bar.go", "package bar\n\nfunc B(interface{}) {}\n"); err != nil {
+		t.Fatal(err)
+	}
+	pkg := gt.NewPackage("", "main")
+	for _, fname := range []string{"types.go", "funcs.go"} {
+		if _, err := pkg.CreateFile(fname); err != nil {
+			t.Fatal("pkg.CreateFile failed:", err)
+		}
+	}
+	if _, err := pkg.CreateFile("types.go"); err != syscall.EEXIST {
+		t.Fatal("pkg.CreateFile:", err)
+	}
+	if pkg.CurFile().Name() != "" {
+		t.Fatal("TestCreateFile: curfile =", pkg.CurFile().Name())
+	}
+	old, _ := pkg.SetCurFile("types.go", false)
+	pkg.NewType("T").InitType(pkg, types.Typ[types.Int])
+	pkg.RestoreCurFile(old)
+	old, _ = pkg.SetCurFile("funcs.go", false)
+	pkg.NewFunc(nil, "f", nil, nil, false).BodyStart(pkg).
+		Val(pkg.Import("foo").Ref("F")).Call(0).EndStmt().
+		End()
+	pkg.RestoreCurFile(old)
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(pkg.Import("bar").Ref("B")).Val(ctxRef(pkg, "T")).Val(1).Call(1).Call(1).EndStmt().
+		End()
+	domTestEx(t, pkg, `package main
+
+type T int
+`, "types.go")
+	domTestEx(t, pkg, `package main
+
+import "foo"
+
+func f() {
+	foo.F()
+}
+`, "funcs.go")
+	domTest(t, pkg, `package main
+
+import "bar"
+
+func main() {
+	bar.B(T(1))
+}
+`)
+	if names := pkg.FileNames(); !reflect.DeepEqual(names, []string{"", "funcs.go", "types.go"}) {
+		t.Fatal("pkg.FileNames:", names)
+	}
+}
+
+func TestBuildConstraint(t *testing.T) {
+	pkg := newMainPackage()
+	for _, fname := range []string{"foo_linux.go", "foo_other.go"} {
+		old, _ := pkg.SetCurFile(fname, true)
+		pkg.NewFunc(nil, "f"+fname[4:5], nil, nil, false).BodyStart(pkg).End()
+		pkg.RestoreCurFile(old)
+	}
+	linux, _ := pkg.File("foo_linux.go")
+	if err := linux.SetBuildConstraint("linux", false); err != nil {
+		t.Fatal("SetBuildConstraint failed:", err)
+	}
+	other, _ := pkg.File("foo_other.go")
+	if err := other.SetBuildConstraint("!linux&&(386 || amd64)", true); err != nil {
+		t.Fatal("SetBuildConstraint failed:", err)
+	}
+	if expr := other.BuildConstraint(); expr != "!linux && (386 || amd64)" {
+		t.Fatal("BuildConstraint:", expr)
+	}
+	if err := other.SetBuildConstraint("linux &&", false); err == nil {
+		t.Fatal("SetBuildConstraint: no error?")
+	}
+	domTestEx(t, pkg, `//go:build linux
+
+package main
+
+func fl() {
+}
+`, "foo_linux.go")
+	domTestEx(t, pkg, `//go:build !linux && (386 || amd64)
+// +build !linux
+// +build 386 amd64
+
+package main
+
+func fo() {
+}
+`, "foo_other.go")
+	other.SetBuildConstraint("", false)
+	domTestEx(t, pkg, `package main
+
+func fo() {
+}
+`, "foo_other.go")
+}
+
+func TestGroupVars(t *testing.T) {
+	pkg := gox.NewPackage("", "main", &gox.Config{GroupVars: true})
+	pkg.NewVar(token.NoPos, types.Typ[types.Int], "a")
+	pkg.NewVarStart(token.NoPos, nil, "b").Val("Hi").EndInit(1)
+	defs := pkg.NewVarDefs(pkg.Types.Scope())
+	defs.New(token.NoPos, types.Typ[types.Int], "c", "d")
+	defs.New(token.NoPos, types.Typ[types.String], "e")
+	pkg.NewVarDefs(pkg.Types.Scope()).SetComments(comment("\n// f is a var.")).
+		New(token.NoPos, types.Typ[types.Int], "f")
+	pkg.NewVar(token.NoPos, types.Typ[types.Int], "g")
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVar(types.Typ[types.Int], "x").
+		NewVar(types.Typ[types.Int], "y").
+		End()
+	pkg.NewVar(token.NoPos, types.Typ[types.Int], "h")
+	domTest(t, pkg, `package main
+
+var (
+	a    int
+	b    = "Hi"
+	c, d int
+	e    string
+)
+
+// f is a var.
+var (
+	f int
+	g int
+)
+
+func main() {
+	var x int
+	var y int
+}
+
+var h int
+`)
+}
+
+func TestFileHeader(t *testing.T) {
+	pkg := gox.NewPackage("", "main", &gox.Config{
+		FileHeader: "// Code generated by gen. DO NOT EDIT.\n\n/*\n Copyright 2023 Foo\n*/\nLicensed under MIT.\n",
+	})
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).End()
+	old, _ := pkg.SetCurFile("foo_linux.go", true)
+	pkg.NewFunc(nil, "f", nil, nil, false).BodyStart(pkg).End()
+	pkg.RestoreCurFile(old)
+	f, _ := pkg.File("foo_linux.go")
+	f.SetBuildConstraint("linux", false)
+	const header = `// Code generated by gen. DO NOT EDIT.
+//
+/*
+ Copyright 2023 Foo
+*/
+// Licensed under MIT.
+
+`
+	domTest(t, pkg, header+`package main
+
+func main() {
+}
+`)
+	domTestEx(t, pkg, header+`//go:build linux
+
+package main
+
+func f() {
+}
+`, "foo_linux.go")
+}
+
+func TestWriteDir(t *testing.T) {
+	pkg := newMainPackage()
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).End()
+	for _, fname := range []string{"a.go", "b.go", "c.go"} {
+		old, _ := pkg.SetCurFile(fname, true)
+		pkg.NewFunc(nil, "f"+fname[:1], nil, nil, false).BodyStart(pkg).End()
+		pkg.RestoreCurFile(old)
+	}
+	dir := t.TempDir()
+	if err := pkg.WriteDir(dir); err != nil {
+		t.Fatal("pkg.WriteDir failed:", err)
+	}
+	for _, fname := range []string{"a.go", "b.go", "c.go"} {
+		b, err := os.ReadFile(filepath.Join(dir, fname))
+		if err != nil {
+			t.Fatal("os.ReadFile failed:", err)
+		}
+		if expected := "package main\n\nfunc f" + fname[:1] + "() {\n}\n"; string(b) != expected {
+			t.Fatalf("%s:\n%s\nExpected:\n%s\n", fname, b, expected)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, gox.AutoGenFile)); err != nil || string(b) != "package main\n\nfunc main() {\n}\n" {
+		t.Fatal("pkg.WriteDir:", string(b), err)
+	}
+	if err := pkg.WriteDir(filepath.Join(dir, "nonexist")); err == nil {
+		t.Fatal("pkg.WriteDir: no error?")
+	}
+}
+
+func TestWriteDirDefaultFile(t *testing.T) {
+	pkg := newMainPackage()
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).End()
+	dir := t.TempDir()
+	if err := pkg.WriteDir(dir); err != nil {
+		t.Fatal("pkg.WriteDir failed:", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 || entries[0].Name() != gox.AutoGenFile {
+		t.Fatal("os.ReadDir:", entries, err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, gox.AutoGenFile))
+	if err != nil || string(b) != "package main\n\nfunc main() {\n}\n" {
+		t.Fatal("pkg.WriteDir:", string(b), err)
+	}
+}
+
+func TestUpdateFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "a.go")
+	newPkg := func(ret int) *gox.Package {
+		pkg := newMainPackage()
+		pkg.NewFunc(nil, "foo", nil, nil, false).BodyStart(pkg).End()
+		results := gox.NewTuple(pkg.NewParam(token.NoPos, "", types.Typ[types.Int]))
+		pkg.NewFunc(nil, "bar", nil, results, false).BodyStart(pkg).
+			Val(ret).Return(1).
+			End()
+		return pkg
+	}
+	update := func(ret int, expected bool) {
+		changed, err := newPkg(ret).UpdateFile(file)
+		if err != nil || changed != expected {
+			t.Fatal("pkg.UpdateFile:", changed, err)
+		}
+	}
+	update(1, true)
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal("os.ReadFile failed:", err)
+	}
+	b = bytes.Replace(b, []byte("func foo() {\n}"), []byte("// foo does nothing.\nfunc foo() {\n\t// TODO\n}"), 1)
+	if err = os.WriteFile(file, b, 0666); err != nil {
+		t.Fatal("os.WriteFile failed:", err)
+	}
+	update(1, false)
+	update(2, true)
+	b, _ = os.ReadFile(file)
+	if expected := `package main
+
+// foo does nothing.
+func foo() {
+	// TODO
+}
+func bar() int {
+	return 2
+}
+`; string(b) != expected {
+		t.Fatalf("%s\nExpected:\n%s\n", b, expected)
+	}
+	if _, err = newPkg(1).UpdateFile(filepath.Join(file, "nonexist.go")); err == nil {
+		t.Fatal("pkg.UpdateFile: no error?")
+	}
+}
+
 func TestMake(t *testing.T) {
 	pkg := newMainPackage()
 	tySlice := types.NewSlice(types.Typ[types.Int])
@@ -952,6 +1420,48 @@ func main() {
 `)
 }
 
+func TestSelectRecv(t *testing.T) {
+	pkg := newMainPackage()
+	tyXchg := types.NewChan(types.SendRecv, types.Typ[types.Int])
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVar(tyXchg, "a", "b").
+		NewVar(types.Typ[types.Int], "v").
+		/**/ Select().
+		/****/ DefineVarStart(0, "x").VarVal("a").UnaryOp(token.ARROW).EndInit(1).CommCase(1).
+		/******/ Val(ctxRef(pkg, "println")).VarVal("x").Call(1).EndStmt().
+		/****/ End().
+		/****/ DefineVarStart(0, "x", "ok").VarVal("b").UnaryOp(token.ARROW, true).EndInit(1).CommCase(1).
+		/******/ If().VarVal("ok").Then().
+		/********/ Break(nil).
+		/******/ End().
+		/******/ Val(ctxRef(pkg, "println")).VarVal("x").Call(1).EndStmt().
+		/****/ End().
+		/****/ VarRef(ctxRef(pkg, "v")).VarVal("a").UnaryOp(token.ARROW).Assign(1).CommCase(1).
+		/****/ End().
+		/****/ VarVal("b").UnaryOp(token.ARROW).EndStmt().CommCase(1).
+		/****/ End().
+		/**/ End().
+		End()
+	domTest(t, pkg, `package main
+
+func main() {
+	var a, b chan int
+	var v int
+	select {
+	case x := <-a:
+		println(x)
+	case x, ok := <-b:
+		if ok {
+			break
+		}
+		println(x)
+	case v = <-a:
+	case <-b:
+	}
+}
+`)
+}
+
 func TestStructLit(t *testing.T) {
 	pkg := newMainPackage()
 	fields := []*types.Var{
@@ -1069,6 +1579,12 @@ func TestSliceLit(t *testing.T) {
 	pkg.CB().NewVarStart(nil, "d").
 		Val(1).
 		SliceLit(types.NewSlice(types.Typ[types.Int]), 1).EndInit(1)
+	pkg.CB().NewVarStart(nil, "e").
+		Val(nil).Val(nil).SliceLit(nil, 2).EndInit(1)
+	pkg.CB().NewVarStart(nil, "f").
+		Val('a').Val(1).SliceLit(nil, 2).EndInit(1)
+	pkg.CB().NewVarStart(nil, "g").
+		Val(1).Val(&ast.BasicLit{Kind: token.IMAG, Value: "2i"}).SliceLit(nil, 2).EndInit(1)
 	domTest(t, pkg, `package main
 
 var a = []string{"a", "b"}
@@ -1076,9 +1592,50 @@ var b = []float64{1, 1.2, 3}
 var c = []interface {
 }{}
 var d = []int{1}
+var e = []interface {
+}{nil, nil}
+var f = []rune{'a', 1}
+var g = []complex128{1, 2i}
 `)
 }
 
+func TestDefaultOf(t *testing.T) {
+	pkg := newMainPackage()
+	untyped := func(kind types.BasicKind) types.Type {
+		return types.Typ[kind]
+	}
+	cases := []struct {
+		typs []types.Type
+		want types.Type
+	}{
+		{[]types.Type{untyped(types.UntypedBool)}, types.Typ[types.Bool]},
+		{[]types.Type{untyped(types.UntypedInt), untyped(types.UntypedRune)}, types.Universe.Lookup("rune").Type()},
+		{[]types.Type{untyped(types.UntypedRune), untyped(types.UntypedFloat)}, types.Typ[types.Float64]},
+		{[]types.Type{untyped(types.UntypedInt), untyped(types.UntypedComplex), untyped(types.UntypedFloat)}, types.Typ[types.Complex128]},
+		{[]types.Type{untyped(types.UntypedInt), types.Typ[types.Uint8]}, types.Typ[types.Uint8]},
+		{[]types.Type{untyped(types.UntypedNil), types.NewSlice(types.Typ[types.Int])}, types.NewSlice(types.Typ[types.Int])},
+		{[]types.Type{untyped(types.UntypedString), untyped(types.UntypedInt)}, nil},
+		{nil, nil},
+	}
+	for _, c := range cases {
+		if ret := gox.DefaultOf(pkg, c.typs...); !(ret == c.want || ret != nil && c.want != nil && types.Identical(ret, c.want)) {
+			t.Fatal("DefaultOf", c.typs, "=>", ret, "expected:", c.want)
+		}
+	}
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		DefineVarStart(token.NoPos, "a").Val(1).Val('a').BinaryOp(token.ADD).EndInit(1).
+		DefineVarStart(token.NoPos, "b").Val(true).EndInit(1).
+		DefineVarStart(token.NoPos, "c").Val(&ast.BasicLit{Kind: token.IMAG, Value: "1i"}).EndInit(1)
+	scope := cb.Scope()
+	cb.End()
+	for name, want := range map[string]types.Type{
+		"a": types.Universe.Lookup("rune").Type(), "b": types.Typ[types.Bool], "c": types.Typ[types.Complex128]} {
+		if o := scope.Lookup(name); o == nil || o.Type() != want {
+			t.Fatal("TestDefaultOf:", name, o)
+		}
+	}
+}
+
 func TestNamedSliceLit(t *testing.T) {
 	pkg := newMainPackage()
 	foo := pkg.NewType("foo").InitType(pkg, types.NewSlice(types.Typ[types.Int]))
@@ -1222,27 +1779,182 @@ func main() {
 	})
 }
 
-func safeRun(t *testing.T, doSth func()) {
-	defer func() {
-		if e := recover(); e == nil {
-			t.Fatal("no error?")
+func TestQuote(t *testing.T) {
+	pkg := newMainPackage()
+	pkg.Import("strings")
+	x := pkg.NewParam(token.NoPos, "x", types.NewSlice(types.Typ[types.String]))
+	ret := pkg.NewParam(token.NoPos, "", types.Typ[types.Int])
+	cb := pkg.NewFunc(nil, "foo", types.NewTuple(x), types.NewTuple(ret), false).BodyStart(pkg)
+	cb.QuoteStmts(`
+	n := 0
+	for i, v := range $x {
+		if strings.HasPrefix(v, "a") {
+			n += i
+		} else if len(v) > $max {
+			continue
 		}
-	}()
-	doSth()
-}
+	}
+	m := map[string][]int{"a": {1, 2}}
+	_ = m
+	var p *struct{ A int }
+	if p != nil {
+		p.A++
+	}`, gox.QuoteArgs{"x": x, "max": 3}).
+		QuoteExpr("$n * 2", gox.QuoteArgs{"n": cb.Scope().Lookup("n")}).
+		Return(1).
+		End()
+	domTest(t, pkg, `package main
 
-func TestConst(t *testing.T) {
-	pkg := newMainPackage()
-	tv := pkg.ConstStart().Val(1).Val(2).BinaryOp(token.ADD).EndConst()
-	if constant.Compare(tv.CVal, token.NEQ, constant.MakeInt64(3)) {
-		t.Fatal("TestConst: != 3, it is", tv.CVal)
+import "strings"
+
+func foo(x []string) int {
+	n := 0
+	for i, v := range x {
+		if strings.HasPrefix(v, "a") {
+			n += i
+		} else if len(v) > 3 {
+			continue
+		}
 	}
-	tv = pkg.ConstStart().Val("1").Val("2").BinaryOp(token.ADD).EndConst()
-	if constant.Compare(tv.CVal, token.NEQ, constant.MakeString("12")) {
-		t.Fatal("TestConst: != 12, it is", tv.CVal)
+	m := map[string][]int{"a": []int{1, 2}}
+	_ = m
+	var p *struct {
+		A int
 	}
+	if p != nil {
+		p.A++
+	}
+	return n * 2
 }
-
+`)
+	safeRun(t, func() {
+		pkg.CB().QuoteExpr("$y", nil)
+	})
+	safeRun(t, func() {
+		pkg.CB().QuoteExpr("undefinedVar", nil)
+	})
+	safeRun(t, func() {
+		pkg.CB().QuoteStmts("if {", nil)
+	})
+}
+
+func TestValFromSource(t *testing.T) {
+	pkg := newMainPackage()
+	pkg.Import("strconv")
+	pkg.NewVar(token.NoPos, types.NewSlice(types.Typ[types.Int]), "b")
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		DefineVarStart(token.NoPos, "a").Val(1).EndInit(1).
+		NewVarStart(nil, "c").ValFromSource("a + b[2]*len(b)").EndInit(1).
+		NewVarStart(nil, "s").ValFromSource(`strconv.Itoa(c) + "x"`).EndInit(1).
+		End()
+	domTest(t, pkg, `package main
+
+import "strconv"
+
+var b []int
+
+func main() {
+	a := 1
+	var c = a + b[2]*len(b)
+	var s = strconv.Itoa(c) + "x"
+}
+`)
+}
+
+func TestAssertMode(t *testing.T) {
+	pkg := newMainPackage()
+	builtin := pkg.Builtin()
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg)
+	if cb.AssertMode() != gox.AssertAlways {
+		t.Fatal("AssertMode:", cb.AssertMode())
+	}
+	cb.Assert().
+		Val(builtin.Ref("println")).Val("always").Call(1).EndStmt().
+		End().
+		SetAssertMode(gox.AssertNever).
+		Assert().
+		Val(builtin.Ref("println")).Val("never").Call(1).EndStmt().
+		End().
+		SetAssertMode(gox.AssertDebug).
+		Assert().
+		Val(builtin.Ref("println")).Val("debug").Call(1).EndStmt().
+		End().
+		End()
+	domTest(t, pkg, `package main
+
+func main() {
+	{
+		println("always")
+	}
+	if debugAsserts {
+		println("debug")
+	}
+}
+`)
+	domTestEx(t, pkg, `//go:build debug
+
+package main
+
+const debugAsserts = true
+`, gox.AssertDebugFile)
+	domTestEx(t, pkg, `//go:build !debug
+
+package main
+
+const debugAsserts = false
+`, gox.AssertReleaseFile)
+}
+
+func TestAssertNeverUnref(t *testing.T) {
+	pkg := newMainPackage()
+	strconv := pkg.Import("strconv")
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		SetAssertMode(gox.AssertNever).
+		Assert().
+		Val(strconv.Ref("Itoa")).Val(1).Call(1).EndStmt().
+		End().
+		End()
+	domTest(t, pkg, `package main
+
+func main() {
+}
+`)
+	var b bytes.Buffer
+	if err := gox.WriteTo(&b, pkg, ""); err != nil {
+		t.Fatal("gox.WriteTo failed:", err)
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "main.go", b.Bytes(), 0)
+	if err != nil {
+		t.Fatal("parser.ParseFile:", err)
+	}
+	var conf types.Config
+	if _, err = conf.Check("main", fset, []*ast.File{f}, nil); err != nil {
+		t.Fatal("conf.Check:", err)
+	}
+}
+
+func safeRun(t *testing.T, doSth func()) {
+	defer func() {
+		if e := recover(); e == nil {
+			t.Fatal("no error?")
+		}
+	}()
+	doSth()
+}
+
+func TestConst(t *testing.T) {
+	pkg := newMainPackage()
+	tv := pkg.ConstStart().Val(1).Val(2).BinaryOp(token.ADD).EndConst()
+	if constant.Compare(tv.CVal, token.NEQ, constant.MakeInt64(3)) {
+		t.Fatal("TestConst: != 3, it is", tv.CVal)
+	}
+	tv = pkg.ConstStart().Val("1").Val("2").BinaryOp(token.ADD).EndConst()
+	if constant.Compare(tv.CVal, token.NEQ, constant.MakeString("12")) {
+		t.Fatal("TestConst: != 12, it is", tv.CVal)
+	}
+}
+
 func TestConstLenCap(t *testing.T) {
 	pkg := newMainPackage()
 	typ := types.NewArray(types.Typ[types.Int], 10)
@@ -1271,6 +1983,39 @@ func TestConstLenCap(t *testing.T) {
 	}
 }
 
+func TestEvalConst(t *testing.T) {
+	pkg := newMainPackage()
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVar(types.Typ[types.Int], "x")
+	evalConst := func(want string, typ types.Type) {
+		t.Helper()
+		val, ret, err := cb.EvalConst(-1)
+		if err != nil {
+			if err.Error() != want {
+				t.Fatal("EvalConst:", err)
+			}
+		} else if val.ExactString() != want || !types.Identical(ret, typ) {
+			t.Fatal("EvalConst:", val, ret)
+		}
+		cb.EndStmt()
+	}
+	cb.Val(ctxRef(pkg, "len")).Val("abc").Call(1)
+	evalConst("3", types.Typ[types.Int])
+	cb.Val(1).Val('a').BinaryOp(token.ADD)
+	evalConst("98", types.Typ[types.UntypedRune])
+	cb.Val(1).Val(2).BinaryOp(token.LSS)
+	evalConst("true", types.Typ[types.UntypedBool])
+	cb.Typ(types.Typ[types.Float32]).Val(2).Call(1)
+	evalConst("2", types.Typ[types.Float32])
+	cb.VarVal("x").Val(1).BinaryOp(token.ADD, source("x + 1", 1, 5))
+	evalConst("./foo.gop:1:5: x + 1 (value of type int) is not constant", nil)
+	cb.Typ(types.Typ[types.Uint8]).Val(300).Call(1)
+	evalConst("-: constant 300 overflows uint8", nil)
+	cb.Typ(types.Typ[types.Float32]).Val(&ast.BasicLit{Kind: token.FLOAT, Value: "1e100"}).Call(1)
+	evalConst("-: constant 1e+100 overflows float32", nil)
+	cb.End()
+}
+
 func TestConstDecl(t *testing.T) {
 	pkg := newMainPackage()
 	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg)
@@ -1352,6 +2097,89 @@ const (
 `)
 }
 
+func TestConstDeclAddNames(t *testing.T) {
+	pkg := newMainPackage()
+	defs := pkg.NewConstDefs(pkg.Types.Scope())
+	defs.New(func(cb *gox.CodeBuilder) int {
+		cb.Val(1)
+		return 1
+	}, 0, token.NoPos, nil, "x").AddNames(func(cb *gox.CodeBuilder) int {
+		cb.Val(2).Val(ctxRef(pkg, "iota"))
+		return 2
+	}, token.NoPos, "y", "z")
+	o := pkg.Types.Scope().Lookup("y")
+	if v, ok := constant.Int64Val(o.(*types.Const).Val()); !ok || v != 2 {
+		t.Fatal("TestConstDeclAddNames failed: y =", v)
+	}
+	defs.Add(func(cb *gox.CodeBuilder) int {
+		cb.Val(ctxRef(pkg, "iota"))
+		return 1
+	}, token.NoPos, types.Typ[types.Int], "a").AddNames(func(cb *gox.CodeBuilder) int {
+		cb.Val(ctxRef(pkg, "iota")).Val(1).BinaryOp(token.ADD)
+		return 1
+	}, token.NoPos, "b")
+	o = pkg.Types.Scope().Lookup("b")
+	if v, ok := constant.Int64Val(o.(*types.Const).Val()); !ok || v != 2 || o.Type() != types.Typ[types.Int] {
+		t.Fatal("TestConstDeclAddNames failed: b =", v, o.Type())
+	}
+	defs.Add(nil, token.NoPos, nil, "c", "d")
+	o = pkg.Types.Scope().Lookup("d")
+	if v, ok := constant.Int64Val(o.(*types.Const).Val()); !ok || v != 3 {
+		t.Fatal("TestConstDeclAddNames failed: d =", v)
+	}
+	safeRun(t, func() {
+		defs.AddNames(func(cb *gox.CodeBuilder) int {
+			cb.Val(3)
+			return 1
+		}, token.NoPos, "e")
+	})
+	domTest(t, pkg, `package main
+
+const (
+	x, y, z     = 1, 2, iota
+	a, b    int = iota, iota + 1
+	c, d
+)
+`)
+}
+
+func TestConstDeclIota(t *testing.T) {
+	pkg := newMainPackage()
+	defs := pkg.NewConstDefs(pkg.Types.Scope())
+	defs.Add(func(cb *gox.CodeBuilder) int {
+		cb.Val(1).Val(ctxRef(pkg, "iota")).BinaryOp(token.SHL)
+		return 1
+	}, token.NoPos, types.Typ[types.Uint16], "a").
+		Add(nil, token.NoPos, nil, "_").
+		Add(nil, token.NoPos, nil, "b").
+		Add(func(cb *gox.CodeBuilder) int {
+			cb.Val(ctxRef(pkg, "iota"))
+			return 1
+		}, token.NoPos, nil, "c").
+		Add(nil, token.NoPos, nil, "d")
+	if n := defs.Iota(); n != 5 {
+		t.Fatal("TestConstDeclIota: iota =", n)
+	}
+	o := pkg.Types.Scope().Lookup("b")
+	if v, ok := constant.Int64Val(o.(*types.Const).Val()); !ok || v != 4 {
+		t.Fatal("TestConstDeclIota failed: b =", v)
+	}
+	o2 := pkg.Types.Scope().Lookup("d")
+	if v, ok := constant.Int64Val(o2.(*types.Const).Val()); !ok || v != 4 {
+		t.Fatal("TestConstDeclIota failed: d =", v)
+	}
+	domTest(t, pkg, `package main
+
+const (
+	a uint16 = 1 << iota
+	_
+	b
+	c = iota
+	d
+)
+`)
+}
+
 func TestDeleteVarDecl(t *testing.T) {
 	pkg := newMainPackage()
 	pkg.SetRedeclarable(true)
@@ -1385,6 +2213,113 @@ var (
 `)
 }
 
+func TestVarDefsComments(t *testing.T) {
+	pkg := newMainPackage()
+	defs := pkg.NewVarDefs(pkg.Types.Scope()).SetComments(comment("\n// globals"))
+	defs.New(token.NoPos, types.Typ[types.Int], "a").
+		SetComments(pkg, comment("\n// a is the first.")).
+		SetLineComment(comment(" // line a"))
+	defs.NewAndInit(func(cb *gox.CodeBuilder) int {
+		cb.Val("hi")
+		return 1
+	}, token.NoPos, nil, "c")
+	b := defs.NewAt(defs.InsertPos(1), token.NoPos, types.Typ[types.Bool], "b").
+		SetLineComment(comment(" // line b"))
+	defs.NewAt(defs.InsertPos(100), token.NoPos, types.Typ[types.Int], "d")
+	if pkg.Docs[b.Ref("b")] != nil || pkg.Docs[pkg.Ref("a")] == nil {
+		t.Fatal("pkg.Docs:", pkg.Docs)
+	}
+	domTest(t, pkg, `package main
+
+// globals
+var (
+// a is the first.
+	a int // line a
+	b bool // line b
+	c = "hi"
+	d int
+)
+`)
+}
+
+func TestImportComments(t *testing.T) {
+	gt := newGoxTest()
+	if _, err := gt.LoadGoPackage("foo", "foo.go", "package foo\n\nfunc F() {}\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gt.LoadGoPackage("bar", "bar.go", "package bar\n"); err != nil {
+		t.Fatal(err)
+	}
+	pkg := gt.NewPackage("", "main")
+	foo := pkg.Import("foo")
+	pkg.Import("bar").SetComments(comment("\n// bar is imported for its side effects")).MarkForceUsed()
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(foo.Ref("F")).Call(0).EndStmt().
+		End()
+	domTest(t, pkg, `package main
+
+import (
+	"foo"
+// bar is imported for its side effects
+	_ "bar"
+)
+
+func main() {
+	foo.F()
+}
+`)
+	foo.SetComments(comment("\n// foo provides F"))
+	if foo.Comments() == nil {
+		t.Fatal("foo.Comments: nil")
+	}
+	domTest(t, pkg, `package main
+
+import (
+// foo provides F
+	"foo"
+// bar is imported for its side effects
+	_ "bar"
+)
+
+func main() {
+	foo.F()
+}
+`)
+}
+
+func TestVarDeclAddNames(t *testing.T) {
+	pkg := newMainPackage()
+	tyInt := types.Typ[types.Int]
+	defs := pkg.NewVarDefs(pkg.Types.Scope())
+	decl := defs.New(token.NoPos, tyInt, "a")
+	defs.New(token.NoPos, types.Typ[types.String], "s")
+	decl.AddNames(pkg, "b", "_").AddNames(pkg, "c")
+	if names := decl.Names(); len(names) != 4 || names[3] != "c" {
+		t.Fatal("decl.Names:", names)
+	}
+	if o := pkg.Ref("c"); o == nil || o.Type() != tyInt {
+		t.Fatal("var c:", o)
+	}
+	n := defs.New(token.NoPos, tyInt, "n")
+	n.InitStart(pkg).Val(1).EndInit(1)
+	func() {
+		defer func() {
+			if e := recover(); e == nil {
+				t.Fatal("AddNames to an initialized spec: no error")
+			}
+		}()
+		n.AddNames(pkg, "m")
+	}()
+	domTest(t, pkg, `package main
+
+var (
+	a, b, _, c int
+	s          string
+	n          int = 1
+)
+`)
+}
+
 func TestVarDecl(t *testing.T) {
 	pkg := newMainPackage()
 	scope := pkg.CB().Scope()
@@ -1513,6 +2448,144 @@ func init() {
 `)
 }
 
+func TestNewInit(t *testing.T) {
+	pkg := newMainPackage()
+	x := pkg.NewVar(token.NoPos, types.Typ[types.Int], "x").Ref("x")
+	pkg.NewInit(token.NoPos).BodyStart(pkg).
+		VarRef(x).Val(1).Assign(1).
+		End()
+	pkg.NewInit(token.NoPos).BodyStart(pkg).
+		Val(ctxRef(pkg, "println")).Val(x).Call(1).EndStmt().
+		End()
+	if pkg.Types.Scope().Lookup("init") != nil {
+		t.Fatal("init is declared in package scope")
+	}
+	domTest(t, pkg, `package main
+
+var x int
+
+func init() {
+	x = 1
+}
+func init() {
+	println(x)
+}
+`)
+}
+
+func TestInitOrder(t *testing.T) {
+	pkg := newMainPackage()
+	b := pkg.NewVar(token.NoPos, types.Typ[types.Int], "b")
+	pkg.NewVar(token.NoPos, types.Typ[types.Int], "c")
+	pkg.NewFunc(nil, "f", nil, gox.NewTuple(pkg.NewParam(token.NoPos, "", types.Typ[types.Int])), false).
+		BodyStart(pkg).
+		Val(ctxRef(pkg, "c")).Return(1).
+		End()
+	pkg.NewVarStart(token.NoPos, nil, "a").Val(ctxRef(pkg, "f")).Call(0).EndInit(1)
+	b.InitStart(pkg).Val(ctxRef(pkg, "a")).Val(1).BinaryOp(token.ADD).EndInit(1)
+	order, err := pkg.InitOrder()
+	if err != nil || len(order) != 3 || order[0].Ref("c") == nil || order[2].Ref("b") == nil {
+		t.Fatal("pkg.InitOrder:", order, err)
+	}
+	domTest(t, pkg, `package main
+
+var c int
+var a = f()
+
+func f() int {
+	return c
+}
+
+var b int = a + 1
+`)
+}
+
+func TestInitCycle(t *testing.T) {
+	pkg := newMainPackage()
+	x := pkg.NewVar(token.NoPos, types.Typ[types.Int], "x")
+	pkg.NewFunc(nil, "f", nil, gox.NewTuple(pkg.NewParam(token.NoPos, "", types.Typ[types.Int])), false).
+		BodyStart(pkg).
+		NewClosure(nil, gox.NewTuple(pkg.NewParam(token.NoPos, "", types.Typ[types.Int])), false).BodyStart(pkg).
+		Val(ctxRef(pkg, "x")).Return(1).
+		End().Call(0).Return(1).
+		End()
+	x.InitStart(pkg).Val(ctxRef(pkg, "f")).Call(0).EndInit(1)
+	if _, err := pkg.InitOrder(); err == nil || err.Error() != `-: initialization cycle:
+	x refers to
+	f refers to
+	x` {
+		t.Fatal("pkg.InitOrder:", err)
+	}
+	domTest(t, pkg, `package main
+
+var x int = f()
+
+func f() int {
+	return func() int {
+		return x
+	}()
+}
+`)
+}
+
+func TestInitCycleMethod(t *testing.T) {
+	pkg := newMainPackage()
+	foo := pkg.NewType("foo").InitType(pkg, types.NewStruct(nil, nil))
+	v := pkg.NewVar(token.NoPos, foo, "v")
+	x := pkg.NewVar(token.NoPos, types.Typ[types.Int], "x")
+	recv := pkg.NewParam(token.NoPos, "p", foo)
+	pkg.NewFunc(recv, "get", nil, gox.NewTuple(pkg.NewParam(token.NoPos, "", types.Typ[types.Int])), false).
+		BodyStart(pkg).
+		Val(ctxRef(pkg, "x")).Return(1).
+		End()
+	x.InitStart(pkg).Val(v.Ref("v")).MemberVal("get").Call(0).EndInit(1)
+	if _, err := pkg.InitOrder(); err == nil || err.Error() != `-: initialization cycle:
+	x refers to
+	foo.get refers to
+	x` {
+		t.Fatal("pkg.InitOrder:", err)
+	}
+}
+
+func TestInitOrderMethod(t *testing.T) {
+	pkg := newMainPackage()
+	foo := pkg.NewType("foo").InitType(pkg, types.NewStruct(nil, nil))
+	pkg.NewVar(token.NoPos, foo, "v")
+	ret := gox.NewTuple(pkg.NewParam(token.NoPos, "", types.Typ[types.Int]))
+	recv := pkg.NewParam(token.NoPos, "p", foo)
+	get := pkg.NewFunc(recv, "get", nil, ret, false)
+	pkg.NewVarStart(token.NoPos, nil, "a").Val(ctxRef(pkg, "v")).MemberVal("get").EndInit(1)
+	g := pkg.NewFunc(nil, "g", nil, ret, false)
+	pkg.NewVarStart(token.NoPos, nil, "b").Val(g).Call(0).EndInit(1)
+	pkg.NewVar(token.NoPos, types.Typ[types.Int], "c")
+	get.BodyStart(pkg).Val(ctxRef(pkg, "c")).Return(1).End()
+	g.BodyStart(pkg).Val(ctxRef(pkg, "c")).Return(1).End()
+	order, err := pkg.InitOrder()
+	if err != nil || len(order) != 4 || order[1].Ref("c") == nil || order[3].Ref("b") == nil {
+		t.Fatal("pkg.InitOrder:", order, err)
+	}
+	domTest(t, pkg, `package main
+
+type foo struct {
+}
+
+var v foo
+
+func (p foo) get() int {
+	return c
+}
+
+var c int
+
+func g() int {
+	return c
+}
+
+var a = v.get
+var b = g()
+`)
+}
+
 func TestFuncAsParam(t *testing.T) {
 	pkg := newMainPackage()
 	v := pkg.NewParam(token.NoPos, "v", types.NewSignatureType(nil, nil, nil, nil, nil, false))
@@ -2155,23 +3228,52 @@ func main() {
 `)
 }
 
-func TestSwitchNoTag(t *testing.T) {
+func TestSwitchInit(t *testing.T) {
 	pkg := newMainPackage()
-	fmt := pkg.Import("fmt")
 	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
-		/**/ DefineVarStart(0, "x").Val(3).EndInit(1).
-		/**/ Switch().None().Then(). // switch {
-		/**/ Val(ctxRef(pkg, "x")).Val(2).BinaryOp(token.EQL).Case(1). // case x == 2:
-		/******/ Val(fmt.Ref("Println")).Val("x = 2").Call(1).EndStmt().
-		/******/ Fallthrough().
-		/******/ End().
-		/**/ Val(ctxRef(pkg, "x")).Val(3).BinaryOp(token.LSS).Case(1). // case x < 3:
-		/******/ Val(fmt.Ref("Println")).Val("x < 3").Call(1).EndStmt().
+		NewVar(types.Typ[types.Int], "n").
+		/**/ Switch().DefineVarStart(0, "x").VarVal("n").EndInit(1).None().Then(). // switch x := n; {
+		/**/ VarVal("x").Val(2).BinaryOp(token.GTR).Case(1). // case x > 2:
+		/******/ Val(ctxRef(pkg, "println")).VarVal("x").Call(1).EndStmt().
 		/******/ End().
-		/**/ Case(0). // default:
-		/******/ Val(fmt.Ref("Println")).Val("other").Call(1).EndStmt().
+		/**/ End().
+		/**/ Switch().VarRef(ctxRef(pkg, "n")).IncDec(token.INC).VarVal("n").Then(). // switch n++; n {
+		/**/ Val(1).Case(1). // case 1:
 		/******/ End().
-		/**/ End(). // end switch
+		/**/ End().
+		End()
+	domTest(t, pkg, `package main
+
+func main() {
+	var n int
+	switch x := n; {
+	case x > 2:
+		println(x)
+	}
+	switch n++; n {
+	case 1:
+	}
+}
+`)
+}
+
+func TestSwitchNoTag(t *testing.T) {
+	pkg := newMainPackage()
+	fmt := pkg.Import("fmt")
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		/**/ DefineVarStart(0, "x").Val(3).EndInit(1).
+		/**/ Switch().None().Then(). // switch {
+		/**/ Val(ctxRef(pkg, "x")).Val(2).BinaryOp(token.EQL).Case(1). // case x == 2:
+		/******/ Val(fmt.Ref("Println")).Val("x = 2").Call(1).EndStmt().
+		/******/ Fallthrough().
+		/******/ End().
+		/**/ Val(ctxRef(pkg, "x")).Val(3).BinaryOp(token.LSS).Case(1). // case x < 3:
+		/******/ Val(fmt.Ref("Println")).Val("x < 3").Call(1).EndStmt().
+		/******/ End().
+		/**/ Case(0). // default:
+		/******/ Val(fmt.Ref("Println")).Val("other").Call(1).EndStmt().
+		/******/ End().
+		/**/ End(). // end switch
 		End()
 	domTest(t, pkg, `package main
 
@@ -2340,6 +3442,100 @@ func main() {
 `)
 }
 
+func TestForRangeFunc(t *testing.T) {
+	pkg := newMainPackage()
+	tyInt, tyStr, tyBool := types.Typ[types.Int], types.Typ[types.String], types.Typ[types.Bool]
+	newIter := func(kv ...types.Type) types.Type {
+		params := make([]*types.Var, len(kv))
+		for i, t := range kv {
+			params[i] = types.NewParam(token.NoPos, nil, "", t)
+		}
+		yield := types.NewSignatureType(nil, nil, nil, types.NewTuple(params...), types.NewTuple(types.NewParam(token.NoPos, nil, "", tyBool)), false)
+		return types.NewSignatureType(nil, nil, nil, types.NewTuple(types.NewParam(token.NoPos, nil, "yield", yield)), nil, false)
+	}
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVar(newIter(tyInt, tyStr), "kv").
+		NewVar(newIter(tyStr), "seq").
+		NewVar(newIter(), "loop").
+		NewVar(tyStr, "s").
+		/**/ ForRange("k", "v").VarVal("kv").RangeAssignThen(token.NoPos).
+		/******/ Val(ctxRef(pkg, "println")).Val(ctxRef(pkg, "k")).Val(ctxRef(pkg, "v")).Call(2).EndStmt().
+		/**/ End().
+		/**/ ForRange("_", "x").VarVal("seq").RangeAssignThen(token.NoPos).
+		/******/ Val(ctxRef(pkg, "println")).Val(ctxRef(pkg, "x")).Call(1).EndStmt().
+		/**/ End().
+		/**/ ForRange().VarRef(ctxRef(pkg, "s")).VarVal("seq").RangeAssignThen(token.NoPos).
+		/**/ End().
+		/**/ ForRange().VarVal("loop").RangeAssignThen(token.NoPos).
+		/**/ End().
+		End()
+	domTest(t, pkg, `package main
+
+func main() {
+	var kv func(yield func(int, string) bool)
+	var seq func(yield func(string) bool)
+	var loop func(yield func() bool)
+	var s string
+	for k, v := range kv {
+		println(k, v)
+	}
+	for x := range seq {
+		println(x)
+	}
+	for s = range seq {
+	}
+	for range loop {
+	}
+}
+`)
+}
+
+func TestForRangeInt(t *testing.T) {
+	pkg := newMainPackage()
+	tyN := pkg.NewType("N").InitType(pkg, types.Typ[types.Int])
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVar(types.Typ[types.Uint8], "n").
+		NewVar(tyN, "m").
+		NewVar(types.Typ[types.Int64], "j").
+		/**/ ForRange("i").Val(10).RangeAssignThen(token.NoPos).
+		/******/ NewVarStart(types.Typ[types.Int], "a").VarVal("i").EndInit(1).
+		/**/ End().
+		/**/ ForRange("i", "_").VarVal("n").RangeAssignThen(token.NoPos).
+		/******/ NewVarStart(types.Typ[types.Uint8], "a").VarVal("i").EndInit(1).
+		/**/ End().
+		/**/ ForRange("i").VarVal("m").RangeAssignThen(token.NoPos).
+		/******/ NewVarStart(tyN, "a").VarVal("i").EndInit(1).
+		/**/ End().
+		/**/ ForRange().VarRef(ctxRef(pkg, "j")).Val(10).RangeAssignThen(token.NoPos).
+		/**/ End().
+		/**/ ForRange().Val(3).RangeAssignThen(token.NoPos).
+		/**/ End().
+		End()
+	domTest(t, pkg, `package main
+
+type N int
+
+func main() {
+	var n uint8
+	var m N
+	var j int64
+	for i := range 10 {
+		var a int = i
+	}
+	for i := range n {
+		var a uint8 = i
+	}
+	for i := range m {
+		var a N = i
+	}
+	for j = range 10 {
+	}
+	for range 3 {
+	}
+}
+`)
+}
+
 func TestForRangeKV(t *testing.T) {
 	pkg := newMainPackage()
 	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
@@ -2643,6 +3839,31 @@ func bar(v foo.NodeSet) {
 `)
 }
 
+func TestOverloadMemo(t *testing.T) {
+	pkg := newMainPackage()
+	foo := pkg.Import("github.com/goplus/gox/internal/foo")
+	nodeSet := foo.Ref("NodeSet").Type()
+	v := pkg.NewParam(token.NoPos, "v", nodeSet)
+	k := pkg.NewParam(token.NoPos, "k", types.Typ[types.String])
+	cb := pkg.NewFunc(nil, "bar", types.NewTuple(v, k), nil, false).BodyStart(pkg)
+	for i := 0; i < 2; i++ {
+		cb.VarRef(v).Val(v).MemberVal("Attr").Val(k).Val(k).Call(2).Assign(1).
+			Val(v).MemberVal("Attr").Val(k).Call(1).EndStmt()
+	}
+	cb.End()
+	domTest(t, pkg, `package main
+
+import "github.com/goplus/gox/internal/foo"
+
+func bar(v foo.NodeSet, k string) {
+	v = v.Attr__1(k, k)
+	v.Attr__0(k)
+	v = v.Attr__1(k, k)
+	v.Attr__0(k)
+}
+`)
+}
+
 func TestPkgVar(t *testing.T) {
 	pkg := newMainPackage()
 	flag := pkg.Import("flag")
@@ -3145,6 +4366,176 @@ func foo(format string, args ...interface {
 `)
 }
 
+func TestReturnErrWrap(t *testing.T) {
+	pkg := newMainPackage()
+	err := pkg.NewParam(token.NoPos, "", gox.TyError)
+	pkg.NewFunc(nil, "foo", nil, gox.NewTuple(err), false).BodyStart(pkg).
+		NewVar(gox.TyError, "err").
+		Val(ctxRef(pkg, "err")).ReturnErr(false, "foo: %w").
+		End()
+	domTest(t, pkg, `package main
+
+import "fmt"
+
+func foo() error {
+	var err error
+	return fmt.Errorf("foo: %w", err)
+}
+`)
+}
+
+func TestDeferHelpers(t *testing.T) {
+	pkg := newMainPackage()
+	os := pkg.Import("os")
+	mu := pkg.NewParam(token.NoPos, "mu", types.NewPointer(pkg.Import("sync").Ref("Mutex").Type()))
+	err := pkg.NewParam(token.NoPos, "err", gox.TyError)
+	pkg.NewFunc(nil, "foo", gox.NewTuple(mu), gox.NewTuple(err), false).BodyStart(pkg).
+		Val(mu).DeferUnlock().
+		DeferRecover().
+		DefineVarStart(token.NoPos, "f", "err").Val(os.Ref("Open")).Val("a.txt").Call(1).EndInit(1).
+		Val(ctxRef(pkg, "f")).DeferClose().
+		Val(os.Ref("Stdout")).DeferClose().
+		Return(0).
+		End()
+	domTest(t, pkg, `package main
+
+import (
+	"os"
+	"sync"
+	"fmt"
+)
+
+func foo(mu *sync.Mutex) (err error) {
+	defer mu.Unlock()
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	f, err := os.Open("a.txt")
+	defer func(x *os.File) {
+		if cerr := x.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}(f)
+	defer func(x *os.File) {
+		if cerr := x.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}(os.Stdout)
+	return
+}
+`)
+}
+
+func TestDeferHelpersNames(t *testing.T) {
+	pkg := newMainPackage()
+	os := pkg.Import("os")
+	file := os.Ref("File").Type()
+	e := pkg.NewParam(token.NoPos, "e", gox.TyError)
+	pkg.NewFunc(nil, "foo", nil, gox.NewTuple(e), false).BodyStart(pkg).
+		DeferRecover().
+		Return(0).
+		End()
+	x := pkg.NewParam(token.NoPos, "x", types.NewPointer(file))
+	cerr := pkg.NewParam(token.NoPos, "cerr", gox.TyError)
+	pkg.NewFunc(nil, "bar", gox.NewTuple(x), gox.NewTuple(cerr), false).BodyStart(pkg).
+		Val(x).DeferClose().
+		NewVar(file, "f").
+		Val(ctxRef(pkg, "f")).DeferClose().
+		Return(0).
+		End()
+	domTest(t, pkg, `package main
+
+import (
+	"os"
+	"fmt"
+)
+
+func foo() (e error) {
+	defer func() {
+		if _autoGo_1 := recover(); _autoGo_1 != nil {
+			e = fmt.Errorf("%v", _autoGo_1)
+		}
+	}()
+	return
+}
+func bar(x *os.File) (cerr error) {
+	defer func(_autoGo_2 *os.File) {
+		if _autoGo_3 := _autoGo_2.Close(); _autoGo_3 != nil && cerr == nil {
+			cerr = _autoGo_3
+		}
+	}(x)
+	var f os.File
+	defer func(_autoGo_4 *os.File) {
+		if _autoGo_5 := _autoGo_4.Close(); _autoGo_5 != nil && cerr == nil {
+			cerr = _autoGo_5
+		}
+	}(&f)
+	return
+}
+`)
+}
+
+func TestCheckErr(t *testing.T) {
+	pkg := newMainPackage()
+	os := pkg.Import("os")
+	n := pkg.NewParam(token.NoPos, "", types.Typ[types.Int])
+	err := pkg.NewParam(token.NoPos, "", gox.TyError)
+	pkg.NewFunc(nil, "foo", nil, gox.NewTuple(n, err), false).BodyStart(pkg).
+		DefineVarStart(token.NoPos, "f", "err").Val(os.Ref("Open")).Val("a.txt").Call(1).EndInit(1).
+		Val(ctxRef(pkg, "err")).CheckErr(gox.ErrReturn).
+		Val(ctxRef(pkg, "f")).MemberVal("Close").Call(0).CheckErr(gox.ErrPanic).
+		Val(1).Val(nil).Return(2).
+		End()
+	domTest(t, pkg, `package main
+
+import "os"
+
+func foo() (int, error) {
+	f, err := os.Open("a.txt")
+	if err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+	return 1, nil
+}
+`)
+}
+
+func TestCheckErrReturn(t *testing.T) {
+	pkg := newMainPackage()
+	os := pkg.Import("os")
+	n := pkg.NewParam(token.NoPos, "", types.Typ[types.Int])
+	err := pkg.NewParam(token.NoPos, "", gox.TyError)
+	pkg.NewFunc(nil, "foo", nil, gox.NewTuple(n, err), false).BodyStart(pkg).
+		DefineVarStart(token.NoPos, "f", "err").Val(os.Ref("Open")).Val("a.txt").Call(1).EndInit(1).
+		Val(ctxRef(pkg, "err")).CheckErrReturn("open: %w").
+		Val(ctxRef(pkg, "f")).MemberVal("Close").Call(0).CheckErrReturn("").
+		Val(1).Val(nil).Return(2).
+		End()
+	domTest(t, pkg, `package main
+
+import (
+	"os"
+	"fmt"
+)
+
+func foo() (int, error) {
+	f, err := os.Open("a.txt")
+	if err != nil {
+		return 0, fmt.Errorf("open: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+`)
+}
+
 func TestCallInlineClosure(t *testing.T) {
 	pkg := newMainPackage()
 	fmt := pkg.Import("fmt")
@@ -3182,6 +4573,54 @@ func foo() error {
 `)
 }
 
+func TestCallInlineClosureNested(t *testing.T) {
+	pkg := newMainPackage()
+	x := pkg.NewParam(token.NoPos, "x", types.Typ[types.Int])
+	ret := pkg.NewParam(token.NoPos, "", types.Typ[types.Int])
+	sig := types.NewSignatureType(nil, nil, nil, gox.NewTuple(x), gox.NewTuple(ret), false)
+	cb := pkg.NewFunc(nil, "foo", nil, nil, false).BodyStart(pkg).
+		DefineVarStart(0, "a").Val(1).
+		CallInlineClosureStart(sig, 1, false).
+		/**/ DefineVarStart(0, "b").Val(x).Val(1).BinaryOp(token.ADD).
+		/**/ CallInlineClosureStart(sig, 1, false).
+		/******/ Val(x).Val(2).BinaryOp(token.MUL).Return(1).
+		/******/ End().
+		/**/ EndInit(1).
+		/**/ DefineVarStart(0, "f")
+	cb.NewClosure(nil, gox.NewTuple(ret), false).BodyStart(pkg).
+		/******/ Val(x).Return(1).
+		/******/ End().
+		/**/ EndInit(1).
+		/**/ Val(x).Val(ctxRef(pkg, "b")).BinaryOp(token.ADD).Return(1).
+		/**/ End().
+		EndInit(1).
+		End()
+	domTest(t, pkg, `package main
+
+func foo() {
+	var _autoGo_1 int
+	{
+		var _autoGo_2 int = 1
+		var _autoGo_3 int
+		{
+			var _autoGo_4 int = _autoGo_2 + 1
+			_autoGo_3 = _autoGo_4 * 2
+			goto _autoGo_5
+		_autoGo_5:
+		}
+		b := _autoGo_3
+		f := func() int {
+			return _autoGo_2
+		}
+		_autoGo_1 = _autoGo_2 + b
+		goto _autoGo_6
+	_autoGo_6:
+	}
+	a := _autoGo_1
+}
+`)
+}
+
 func TestCallInlineClosureAssign(t *testing.T) {
 	pkg := newMainPackage()
 	fmt := pkg.Import("fmt")
@@ -3248,6 +4687,55 @@ func main() {
 `)
 }
 
+func TestCallInlineClosureDefer(t *testing.T) {
+	pkg := newMainPackage()
+	ret := pkg.NewAutoParam("ret")
+	sig := types.NewSignatureType(nil, nil, nil, nil, gox.NewTuple(ret), false)
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(pkg.Builtin().Ref("println")).
+		CallInlineClosureStart(sig, 0, false).
+		/**/ Val(pkg.Builtin().Ref("println")).Val("bye").Call(1).Defer().
+		/**/ Val(ctxRef(pkg, "recover")).Call(0).EndStmt().
+		/**/ Val(1).Return(1).
+		/**/ End().
+		Call(1).EndStmt().
+		End()
+	domTest(t, pkg, `package main
+
+func main() {
+	var _autoGo_1 int
+	func() {
+		defer println("bye")
+		recover()
+		_autoGo_1 = 1
+		goto _autoGo_2
+	_autoGo_2:
+	}()
+	println(_autoGo_1)
+}
+`)
+}
+
+func TestCallInlineClosureDeferErr(t *testing.T) {
+	pkg := newMainPackage()
+	sig := types.NewSignatureType(nil, nil, nil, nil, nil, false)
+	defer func() {
+		if e := recover(); e == nil ||
+			e.(*gox.CodeError).Msg != "can't use defer or recover in an inline closure that jumps out of it" {
+			t.Fatal("TestCallInlineClosureDeferErr:", e)
+		}
+	}()
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		For().None().Then().
+		/**/ CallInlineClosureStart(sig, 0, false).
+		/******/ Val(pkg.Builtin().Ref("println")).Val("bye").Call(1).Defer().
+		/******/ Break(nil).
+		/******/ End().
+		/**/ EndStmt().
+		/**/ End().
+		End()
+}
+
 // ----------------------------------------------------------------------------
 
 func TestExample(t *testing.T) {
@@ -3437,3 +4925,2318 @@ func main() {
 }
 
 // ----------------------------------------------------------------------------
+
+func TestEnum(t *testing.T) {
+	pkg := newMainPackage()
+	e := pkg.NewEnum("Color", "Red", "_", "Blue").TextMarshaler()
+	if e.Members[1] != nil || e.Members[2].Name() != "Blue" {
+		t.Fatal("TestEnum: members -", e.Members)
+	}
+	if v, ok := constant.Int64Val(e.Members[2].Val()); !ok || v != 2 {
+		t.Fatal("TestEnum: Blue =", v)
+	}
+	domTest(t, pkg, `package main
+
+import (
+	"strconv"
+	"errors"
+)
+
+type Color int
+
+const (
+	Red Color = iota
+	_
+	Blue
+)
+
+func (v Color) String() string {
+	switch v {
+	case Red:
+		return "Red"
+	case Blue:
+		return "Blue"
+	}
+	return "Color(" + strconv.Itoa(int(v)) + ")"
+}
+func (v Color) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+func (v *Color) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "Red":
+		*v = Red
+	case "Blue":
+		*v = Blue
+	default:
+		return errors.New("invalid Color: " + string(text))
+	}
+	return nil
+}
+`)
+}
+
+func newStructType(pkg *gox.Package, name string, fields ...*types.Var) *types.Named {
+	return pkg.NewType(name).InitType(pkg, types.NewStruct(fields, nil))
+}
+
+func TestAccessors(t *testing.T) {
+	pkg := newMainPackage()
+	typ := newStructType(pkg, "T",
+		types.NewField(token.NoPos, pkg.Types, "name", types.Typ[types.String], false),
+		types.NewField(token.NoPos, pkg.Types, "Age", types.Typ[types.Int], false))
+	pkg.NewAccessors(typ, gox.AccessorDefault, "name")
+	pkg.NewAccessors(typ, gox.AccessorGetter|gox.AccessorNilCheck, "Age")
+	domTest(t, pkg, `package main
+
+type T struct {
+	name string
+	Age  int
+}
+
+func (p *T) Name() string {
+	return p.name
+}
+func (p *T) SetName(v string) {
+	p.name = v
+}
+func (p *T) GetAge() (ret int) {
+	if p != nil {
+		ret = p.Age
+	}
+	return
+}
+`)
+}
+
+func TestAccessorsConflict(t *testing.T) {
+	pkg := newMainPackage()
+	typ := newStructType(pkg, "T",
+		types.NewField(token.NoPos, pkg.Types, "name", types.Typ[types.String], false),
+		types.NewField(token.NoPos, pkg.Types, "Name", types.Typ[types.String], false),
+		types.NewField(token.NoPos, pkg.Types, "size", types.Typ[types.Int], false),
+		types.NewField(token.NoPos, pkg.Types, "SetSize", types.Typ[types.Int], false))
+	pkg.NewAccessors(typ, gox.AccessorGetter, "name")
+	domTest(t, pkg, `package main
+
+type T struct {
+	name    string
+	Name    string
+	size    int
+	SetSize int
+}
+
+func (p *T) GetName() string {
+	return p.name
+}
+`)
+	defer func() {
+		e := recover()
+		if err, ok := e.(*gox.CodeError); !ok || err.Msg != "T already has a field or method named SetSize" {
+			t.Fatal("TestAccessorsConflict:", e)
+		}
+	}()
+	pkg.NewAccessors(typ, gox.AccessorSetter, "size")
+}
+
+func TestStructBuilder(t *testing.T) {
+	pkg := newMainPackage()
+	base := pkg.NewType("Base").InitType(pkg, types.NewStruct(nil, nil))
+	st := pkg.NewStructType().
+		Field("", types.NewPointer(base), "", true).
+		Field("", types.Typ[types.Int], `json:"-"`, true).
+		Field("Name", types.Typ[types.String], `json:"name,omitempty"`, false).
+		Field("raw", types.Typ[types.String], "a`b", false)
+	typ := pkg.NewType("T").InitType(pkg, st.Type())
+	if fld := typ.Underlying().(*types.Struct).Field(0); !fld.Embedded() || fld.Name() != "Base" {
+		t.Fatal("TestStructBuilder:", fld)
+	}
+	if n := len(st.AST().Fields.List); n != 4 {
+		t.Fatal("TestStructBuilder: len(AST) =", n)
+	}
+	domTest(t, pkg, `package main
+
+type Base struct {
+}
+type T struct {
+	*Base
+	int  `+"`json:\"-\"`"+`
+	Name string `+"`json:\"name,omitempty\"`"+`
+	raw  string "a`+"`"+`b"
+}
+`)
+	defer func() {
+		if e := recover(); e == nil {
+			t.Fatal("TestStructBuilder: no error")
+		}
+	}()
+	st.Field("Name", types.Typ[types.Int], "", false)
+}
+
+func TestTypeDeclNewMethod(t *testing.T) {
+	pkg := newMainPackage()
+	decl := pkg.NewTypeDefs().NewType("T")
+	typ := decl.InitType(pkg, types.NewStruct([]*types.Var{
+		types.NewField(token.NoPos, pkg.Types, "n", types.Typ[types.Int], false),
+	}, nil))
+	params := gox.NewTuple(pkg.NewParam(token.NoPos, "v", types.Typ[types.Int]))
+	results := gox.NewTuple(pkg.NewParam(token.NoPos, "", types.Typ[types.Int]))
+	decl.NewMethod(pkg, "Set", types.NewSignatureType(nil, nil, nil, params, nil, false), true).
+		VarVal("p").MemberRef("n").VarVal("v").Assign(1).
+		End()
+	cb := decl.NewMethod(pkg, "Get", types.NewSignatureType(nil, nil, nil, nil, results, false), false)
+	if fn := cb.Func(); fn.Name() != "Get" {
+		t.Fatal("TestTypeDeclNewMethod:", fn.Name())
+	}
+	cb.VarVal("p").MemberVal("n").Return(1).
+		End()
+	if n := typ.NumMethods(); n != 2 {
+		t.Fatal("TestTypeDeclNewMethod: NumMethods =", n)
+	}
+	domTest(t, pkg, `package main
+
+type T struct {
+	n int
+}
+
+func (p *T) Set(v int) {
+	p.n = v
+}
+func (p T) Get() int {
+	return p.n
+}
+`)
+}
+
+func TestAssertImplements(t *testing.T) {
+	pkg := newMainPackage()
+	sig := types.NewSignatureType(nil, nil, nil, nil, nil, false)
+	iface := pkg.NewType("I").InitType(pkg, types.NewInterfaceType([]*types.Func{
+		types.NewFunc(token.NoPos, pkg.Types, "M", sig),
+	}, nil).Complete())
+	decl := pkg.NewType("T")
+	typ := decl.InitType(pkg, types.NewStruct(nil, nil))
+	decl.NewMethod(pkg, "M", sig, true).End()
+	decl = pkg.NewType("U")
+	typ2 := decl.InitType(pkg, types.Typ[types.Int])
+	decl.NewMethod(pkg, "M", sig, false).End()
+	if err := pkg.AssertImplements(typ, iface); err == nil ||
+		err.(*gox.Mismatch).Kind != gox.MismatchPointerRecv {
+		t.Fatal("TestAssertImplements:", err)
+	}
+	if err := pkg.AssertImplements(types.NewPointer(typ), iface); err != nil {
+		t.Fatal("TestAssertImplements:", err)
+	}
+	if err := pkg.AssertImplements(typ2, iface); err != nil {
+		t.Fatal("TestAssertImplements:", err)
+	}
+	domTest(t, pkg, `package main
+
+type I interface {
+	M()
+}
+type T struct {
+}
+
+func (p *T) M() {
+}
+
+type U int
+
+func (p U) M() {
+}
+
+var _ I = (*T)(nil)
+var _ I = U(0)
+`)
+}
+
+func TestConstructor(t *testing.T) {
+	pkg := newMainPackage()
+	typ := newStructType(pkg, "T",
+		types.NewField(token.NoPos, pkg.Types, "Type", types.Typ[types.String], false),
+		types.NewField(token.NoPos, pkg.Types, "n", types.Typ[types.Int], false))
+	pkg.NewFunc(pkg.NewParam(token.NoPos, "p", types.NewPointer(typ)), "check", nil,
+		gox.NewTuple(pkg.NewParam(token.NoPos, "", types.Universe.Lookup("error").Type())), false).
+		BodyStart(pkg).Val(nil).Return(1).End()
+	pkg.NewConstructor(typ, nil)
+	pkg.NewConstructor(typ, &gox.ConstructorOpts{
+		Name: "NewTWithOpts", Fields: []string{"n"}, Validate: "check", Options: true,
+	})
+	domTest(t, pkg, `package main
+
+type T struct {
+	Type string
+	n    int
+}
+
+func (p *T) check() error {
+	return nil
+}
+func NewT(type_ string, n int) *T {
+	return &T{Type: type_, n: n}
+}
+
+type TOption func(*T)
+
+func NewTWithOpts(n int, opts ...TOption) (*T, error) {
+	ret := &T{n: n}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	if err := ret.check(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+`)
+}
+
+func TestConstructorNames(t *testing.T) {
+	pkg := newMainPackage()
+	tyInt := types.Typ[types.Int]
+	typ := newStructType(pkg, "T",
+		types.NewField(token.NoPos, pkg.Types, "Name", tyInt, false),
+		types.NewField(token.NoPos, pkg.Types, "name", tyInt, false),
+		types.NewField(token.NoPos, pkg.Types, "Ret", tyInt, false),
+		types.NewField(token.NoPos, pkg.Types, "opts", tyInt, false))
+	pkg.NewConstructor(typ, &gox.ConstructorOpts{Options: true})
+	domTest(t, pkg, `package main
+
+type T struct {
+	Name int
+	name int
+	Ret  int
+	opts int
+}
+type TOption func(*T)
+
+func NewT(name int, name2 int, ret2 int, opts2 int, opts ...TOption) *T {
+	ret := &T{Name: name, name: name2, Ret: ret2, opts: opts2}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	return ret
+}
+`)
+}
+
+func TestBuilderType(t *testing.T) {
+	pkg := newMainPackage()
+	typ := newStructType(pkg, "T",
+		types.NewField(token.NoPos, pkg.Types, "name", types.Typ[types.String], false),
+		types.NewField(token.NoPos, pkg.Types, "n", types.Typ[types.Int], false))
+	pkg.NewBuilderType(typ, map[string]gox.F{
+		"n": func(cb *gox.CodeBuilder) int {
+			cb.Val(10)
+			return 1
+		},
+	})
+	domTest(t, pkg, `package main
+
+type T struct {
+	name string
+	n    int
+}
+type TBuilder struct {
+	v T
+}
+
+func NewTBuilder() *TBuilder {
+	return &TBuilder{v: T{n: 10}}
+}
+func (p *TBuilder) WithName(v string) *TBuilder {
+	p.v.name = v
+	return p
+}
+func (p *TBuilder) WithN(v int) *TBuilder {
+	p.v.n = v
+	return p
+}
+func (p *TBuilder) Build() *T {
+	ret := p.v
+	return &ret
+}
+`)
+}
+
+func TestClone(t *testing.T) {
+	pkg := newMainPackage()
+	node := pkg.NewType("Node")
+	tyNode := types.NewPointer(node.Type())
+	node.InitType(pkg, types.NewStruct([]*types.Var{
+		types.NewField(token.NoPos, pkg.Types, "name", types.Typ[types.String], false),
+		types.NewField(token.NoPos, pkg.Types, "next", tyNode, false),
+		types.NewField(token.NoPos, pkg.Types, "kids", types.NewSlice(tyNode), false),
+		types.NewField(token.NoPos, pkg.Types, "ids", types.NewSlice(types.Typ[types.Int]), false),
+		types.NewField(token.NoPos, pkg.Types, "attrs", types.NewMap(types.Typ[types.String], tyNode), false),
+		types.NewField(token.NoPos, pkg.Types, "n", types.NewPointer(types.Typ[types.Int]), false),
+	}, nil))
+	pkg.NewClone(node.Type(), true)
+	typ := newStructType(pkg, "T",
+		types.NewField(token.NoPos, pkg.Types, "root", tyNode, false),
+		types.NewField(token.NoPos, pkg.Types, "m", types.NewMap(types.Typ[types.String], types.Typ[types.Int]), false))
+	pkg.NewClone(typ, false)
+	domTest(t, pkg, `package main
+
+type Node struct {
+	name  string
+	next  *Node
+	kids  []*Node
+	ids   []int
+	attrs map[string]*Node
+	n     *int
+}
+
+func (p *Node) Clone() *Node {
+	return p.cloneWith(make(map[*Node]*Node))
+}
+func (p *Node) cloneWith(seen map[*Node]*Node) *Node {
+	if p == nil {
+		return nil
+	}
+	if v, ok := seen[p]; ok {
+		return v
+	}
+	ret := new(Node)
+	*ret = *p
+	seen[p] = ret
+	if p.next != nil {
+		ret.next = p.next.cloneWith(seen)
+	}
+	if p.kids != nil {
+		ret.kids = make([]*Node, len(p.kids))
+		for i, v := range p.kids {
+			ret.kids[i] = v.cloneWith(seen)
+		}
+	}
+	if p.ids != nil {
+		ret.ids = make([]int, len(p.ids))
+		copy(ret.ids, p.ids)
+	}
+	if p.attrs != nil {
+		ret.attrs = make(map[string]*Node, len(p.attrs))
+		for k, v := range p.attrs {
+			ret.attrs[k] = v.cloneWith(seen)
+		}
+	}
+	if p.n != nil {
+		v := *p.n
+		ret.n = &v
+	}
+	return ret
+}
+
+type T struct {
+	root *Node
+	m    map[string]int
+}
+
+func (p *T) Clone() *T {
+	if p == nil {
+		return nil
+	}
+	ret := new(T)
+	*ret = *p
+	if p.root != nil {
+		ret.root = p.root.Clone()
+	}
+	if p.m != nil {
+		ret.m = make(map[string]int, len(p.m))
+		for k, v := range p.m {
+			ret.m[k] = v
+		}
+	}
+	return ret
+}
+`)
+}
+
+func TestEqual(t *testing.T) {
+	pkg := newMainPackage()
+	tyTime := pkg.Import("time").Ref("Time").Type()
+	typ := newStructType(pkg, "T",
+		types.NewField(token.NoPos, pkg.Types, "name", types.Typ[types.String], false),
+		types.NewField(token.NoPos, pkg.Types, "at", tyTime, false),
+		types.NewField(token.NoPos, pkg.Types, "ids", types.NewSlice(types.Typ[types.Int]), false),
+		types.NewField(token.NoPos, pkg.Types, "m", types.NewMap(types.Typ[types.String], tyTime), false),
+		types.NewField(token.NoPos, pkg.Types, "x", types.NewSlice(types.NewSlice(types.Typ[types.Int])), false),
+		types.NewField(token.NoPos, pkg.Types, "cache", types.NewMap(types.Typ[types.String], types.Typ[types.Int]), false),
+		types.NewField(token.NoPos, pkg.Types, "y", types.NewPointer(types.Typ[types.Int]), false))
+	pkg.NewEqual(typ, map[string]gox.EqualMode{"cache": gox.EqualIgnore, "y": gox.EqualDeep})
+	domTest(t, pkg, `package main
+
+import (
+	"time"
+	"reflect"
+)
+
+type T struct {
+	name  string
+	at    time.Time
+	ids   []int
+	m     map[string]time.Time
+	x     [][]int
+	cache map[string]int
+	y     *int
+}
+
+func (p T) Equal(other T) bool {
+	if p.name != other.name {
+		return false
+	}
+	if !p.at.Equal(other.at) {
+		return false
+	}
+	if len(p.ids) != len(other.ids) {
+		return false
+	}
+	for i, v := range p.ids {
+		if v != other.ids[i] {
+			return false
+		}
+	}
+	if len(p.m) != len(other.m) {
+		return false
+	}
+	for k, v := range p.m {
+		if v2, ok := other.m[k]; !ok || !v2.Equal(v) {
+			return false
+		}
+	}
+	if !reflect.DeepEqual(p.x, other.x) {
+		return false
+	}
+	if !reflect.DeepEqual(p.y, other.y) {
+		return false
+	}
+	return true
+}
+`)
+}
+
+func TestEqualEmbedded(t *testing.T) {
+	pkg := newMainPackage()
+	tyTime := pkg.Import("time").Ref("Time").Type()
+	base := newStructType(pkg, "Base",
+		types.NewField(token.NoPos, pkg.Types, "id", types.Typ[types.Int], false))
+	typ := newStructType(pkg, "T",
+		types.NewField(token.NoPos, pkg.Types, "Base", base, true),
+		types.NewField(token.NoPos, pkg.Types, "Time", tyTime, true),
+		types.NewField(token.NoPos, pkg.Types, "name", types.Typ[types.String], false))
+	pkg.NewEqual(typ, nil)
+	domTest(t, pkg, `package main
+
+import "time"
+
+type Base struct {
+	id int
+}
+type T struct {
+	Base
+	time.Time
+	name string
+}
+
+func (p T) Equal(other T) bool {
+	if p.Base != other.Base {
+		return false
+	}
+	if !p.Time.Equal(other.Time) {
+		return false
+	}
+	if p.name != other.name {
+		return false
+	}
+	return true
+}
+`)
+}
+
+func TestJSONMethodsMarshaler(t *testing.T) {
+	pkg := newMainPackage()
+	tyBytes := types.NewSlice(gox.TyByte)
+	tyError := types.Universe.Lookup("error").Type()
+	level := pkg.NewType("Level").InitType(pkg, types.Typ[types.Int])
+	pkg.NewFunc(pkg.NewParam(token.NoPos, "l", level), "MarshalText", nil,
+		gox.NewTuple(pkg.NewParam(token.NoPos, "", tyBytes), pkg.NewParam(token.NoPos, "", tyError)), false).
+		BodyStart(pkg).Val(nil).Val(nil).Return(2).End()
+	typ := pkg.NewType("T").InitType(pkg, types.NewStruct([]*types.Var{
+		types.NewField(token.NoPos, pkg.Types, "Lvl", level, false),
+	}, []string{`json:"lvl,string"`}))
+	pkg.NewJSONMethods(typ)
+	domTest(t, pkg, `package main
+
+import "encoding/json"
+
+type Level int
+
+func (l Level) MarshalText() ([]byte, error) {
+	return nil, nil
+}
+
+type T struct {
+	Lvl Level `+"`json:\"lvl,string\"`"+`
+}
+
+func (p T) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 25)
+	buf = append(buf, '{')
+	buf = append(buf, "\"lvl\":"...)
+	if b, err := json.Marshal(p.Lvl); err != nil {
+		return nil, err
+	} else {
+		buf = append(buf, b...)
+	}
+	buf = append(buf, ',')
+	if buf[len(buf)-1] == ',' {
+		buf[len(buf)-1] = '}'
+	} else {
+		buf = append(buf, '}')
+	}
+	return buf, nil
+}
+func (p *T) UnmarshalJSON(data []byte) error {
+	type plain T
+	return json.Unmarshal(data, (*plain)(p))
+}
+`)
+}
+
+func TestJSONMethods(t *testing.T) {
+	pkg := newMainPackage()
+	typ := pkg.NewType("T").InitType(pkg, types.NewStruct([]*types.Var{
+		types.NewField(token.NoPos, pkg.Types, "ID", types.Typ[types.Int], false),
+		types.NewField(token.NoPos, pkg.Types, "Name", types.Typ[types.String], false),
+		types.NewField(token.NoPos, pkg.Types, "OK", types.Typ[types.Bool], false),
+		types.NewField(token.NoPos, pkg.Types, "N", types.Typ[types.Uint8], false),
+		types.NewField(token.NoPos, pkg.Types, "Tags", types.NewSlice(types.Typ[types.String]), false),
+		types.NewField(token.NoPos, pkg.Types, "Skip", types.Typ[types.Int], false),
+		types.NewField(token.NoPos, pkg.Types, "x", types.Typ[types.Int], false),
+	}, []string{`json:"id,string"`, "", `json:"ok,omitempty"`, "", `json:"tags,omitempty"`, `json:"-"`, ""}))
+	pkg.NewJSONMethods(typ)
+	domTest(t, pkg, `package main
+
+import (
+	"strconv"
+	"encoding/json"
+)
+
+type T struct {
+	ID   int `+"`json:\"id,string\"`"+`
+	Name string
+	OK   bool `+"`json:\"ok,omitempty\"`"+`
+	N    uint8
+	Tags []string `+"`json:\"tags,omitempty\"`"+`
+	Skip int      `+"`json:\"-\"`"+`
+	x    int
+}
+
+func (p T) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 115)
+	buf = append(buf, '{')
+	buf = append(buf, "\"id\":"...)
+	buf = append(buf, '"')
+	buf = strconv.AppendInt(buf, int64(p.ID), 10)
+	buf = append(buf, '"')
+	buf = append(buf, ',')
+	buf = append(buf, "\"Name\":"...)
+	if b, err := json.Marshal(p.Name); err != nil {
+		return nil, err
+	} else {
+		buf = append(buf, b...)
+	}
+	buf = append(buf, ',')
+	if p.OK {
+		buf = append(buf, "\"ok\":"...)
+		buf = strconv.AppendBool(buf, p.OK)
+		buf = append(buf, ',')
+	}
+	buf = append(buf, "\"N\":"...)
+	buf = strconv.AppendUint(buf, uint64(p.N), 10)
+	buf = append(buf, ',')
+	if len(p.Tags) != 0 {
+		buf = append(buf, "\"tags\":"...)
+		if b, err := json.Marshal(p.Tags); err != nil {
+			return nil, err
+		} else {
+			buf = append(buf, b...)
+		}
+		buf = append(buf, ',')
+	}
+	if buf[len(buf)-1] == ',' {
+		buf[len(buf)-1] = '}'
+	} else {
+		buf = append(buf, '}')
+	}
+	return buf, nil
+}
+func (p *T) UnmarshalJSON(data []byte) error {
+	type plain T
+	return json.Unmarshal(data, (*plain)(p))
+}
+`)
+}
+
+func TestErrorGen(t *testing.T) {
+	pkg := newMainPackage()
+	errs := pkg.NewSentinelErrors(
+		gox.SentinelError{Name: "ErrNotFound", Msg: "not found"},
+		gox.SentinelError{Name: "ErrClosed", Msg: "closed"})
+	if len(errs) != 2 || errs[1].Name() != "ErrClosed" {
+		t.Fatal("NewSentinelErrors:", errs)
+	}
+	pkg.NewErrorType("SimpleError", nil)
+	pkg.NewErrorType("Error", &gox.ErrorTypeOpts{Code: types.Typ[types.Int], Wrap: true})
+	domTest(t, pkg, `package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrClosed   = errors.New("closed")
+)
+
+type SimpleError struct {
+	Msg string
+}
+
+func (e *SimpleError) Error() string {
+	return e.Msg
+}
+
+type Error struct {
+	Code int
+	Msg  string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v: %s: %v", e.Code, e.Msg, e.Err)
+	}
+	return fmt.Sprintf("%v: %s", e.Code, e.Msg)
+}
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+`)
+}
+
+func TestMock(t *testing.T) {
+	pkg := newMainPackage()
+	rc := pkg.Import("io").Ref("ReadCloser").Type().Underlying().(*types.Interface)
+	pkg.NewMock("ReadCloserMock", rc)
+	domTest(t, pkg, `package main
+
+import "sync"
+
+type ReadCloserMock struct {
+	mu         sync.Mutex
+	CloseFunc  func() (ret0 error)
+	CloseCalls [][]interface {
+	}
+	ReadFunc  func(arg0 []byte) (n int, err error)
+	ReadCalls [][]interface {
+	}
+}
+
+func (p *ReadCloserMock) Close() (ret0 error) {
+	p.mu.Lock()
+	p.CloseCalls = append(p.CloseCalls, []interface {
+	}{})
+	p.mu.Unlock()
+	if p.CloseFunc != nil {
+		return p.CloseFunc()
+	}
+	return
+}
+func (p *ReadCloserMock) Read(arg0 []byte) (n int, err error) {
+	p.mu.Lock()
+	p.ReadCalls = append(p.ReadCalls, []interface {
+	}{arg0})
+	p.mu.Unlock()
+	if p.ReadFunc != nil {
+		return p.ReadFunc(arg0)
+	}
+	return
+}
+`)
+}
+
+func TestWrapper(t *testing.T) {
+	pkg := newMainPackage()
+	rc := pkg.Import("io").Ref("ReadCloser").Type()
+	pkg.NewWrapper("ReadCloser", rc, &gox.WrapperOpts{Hooks: true})
+	buf := types.NewPointer(pkg.Import("bytes").Ref("Buffer").Type())
+	pkg.NewWrapper("Buffer", buf, &gox.WrapperOpts{Embed: true, Methods: []string{"Len", "WriteString"}})
+	domTest(t, pkg, `package main
+
+import (
+	"io"
+	"bytes"
+)
+
+type ReadCloser struct {
+	inner  io.ReadCloser
+	Before func(method string, args []interface {
+	})
+	After func(method string, results []interface {
+	})
+}
+
+func (p *ReadCloser) Close() error {
+	if p.Before != nil {
+		p.Before("Close", []interface {
+		}{})
+	}
+	ret0 := p.inner.Close()
+	if p.After != nil {
+		p.After("Close", []interface {
+		}{ret0})
+	}
+	return ret0
+}
+func (p *ReadCloser) Read(arg0 []byte) (n int, err error) {
+	if p.Before != nil {
+		p.Before("Read", []interface {
+		}{arg0})
+	}
+	ret0, ret1 := p.inner.Read(arg0)
+	if p.After != nil {
+		p.After("Read", []interface {
+		}{ret0, ret1})
+	}
+	return ret0, ret1
+}
+
+type Buffer struct {
+	*bytes.Buffer
+}
+
+func (p *Buffer) Len() int {
+	return p.Buffer.Len()
+}
+func (p *Buffer) WriteString(s string) (n int, err error) {
+	return p.Buffer.WriteString(s)
+}
+`)
+}
+
+func TestInterfaceOf(t *testing.T) {
+	pkg := newMainPackage()
+	buf := types.NewPointer(pkg.Import("strings").Ref("Builder").Type())
+	pkg.NewInterfaceOf("StringWriter", buf, func(m *types.Func) bool {
+		return strings.HasPrefix(m.Name(), "Write") || m.Name() == "String"
+	})
+	domTest(t, pkg, `package main
+
+type StringWriter interface {
+	String() string
+	Write(p []byte) (int, error)
+	WriteByte(c byte) error
+	WriteRune(r rune) (int, error)
+	WriteString(s string) (int, error)
+}
+`)
+}
+
+func TestChangeParams(t *testing.T) {
+	pkg := newMainPackage()
+	a := pkg.NewParam(token.NoPos, "a", types.Typ[types.Int])
+	b := pkg.NewParam(token.NoPos, "b", types.Typ[types.String])
+	f := pkg.NewFunc(nil, "f", gox.NewTuple(a, b), nil, false)
+	f.BodyStart(pkg).End()
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(f).Val(1).Val("hi").Call(2).EndStmt().
+		End()
+	c := pkg.NewParam(token.NoPos, "c", types.Typ[types.Bool])
+	err := f.ChangeParams(pkg,
+		gox.ParamChange{Param: b, From: 1},
+		gox.ParamChange{Param: c, From: -1, Default: ast.NewIdent("false")},
+		gox.ParamChange{Param: a, From: 0})
+	if err != nil {
+		t.Fatal("ChangeParams:", err)
+	}
+	if err = f.ChangeParams(pkg, gox.ParamChange{Param: a, From: 3}); err == nil {
+		t.Fatal("ChangeParams: no error")
+	}
+	domTest(t, pkg, `package main
+
+func f(b string, c bool, a int) {
+}
+func main() {
+	f("hi", false, 1)
+}
+`)
+}
+
+func TestChangeParamsByObj(t *testing.T) {
+	pkg := newMainPackage()
+	a := pkg.NewParam(token.NoPos, "a", types.Typ[types.Int])
+	sig := gox.NewTuple(a)
+	f := pkg.NewFunc(nil, "f", sig, nil, false)
+	f.BodyStart(pkg).End()
+	g := pkg.NewFunc(nil, "g", sig, nil, false)
+	g.BodyStart(pkg).End()
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(f).Val(1).Call(1).EndStmt().
+		Val(g).Val(2).Call(1).EndStmt()
+	cb.NewVarStart(nil, "f").Val(g).EndInit(1)
+	cb.VarVal("f").Val(3).Call(1).EndStmt().
+		End()
+	b := pkg.NewParam(token.NoPos, "b", types.Typ[types.Bool])
+	err := f.ChangeParams(pkg,
+		gox.ParamChange{Param: a, From: 0},
+		gox.ParamChange{Param: b, From: -1, Default: ast.NewIdent("true")})
+	if err != nil {
+		t.Fatal("ChangeParams:", err)
+	}
+	if n := g.Type().(*types.Signature).Params().Len(); n != 1 {
+		t.Fatal("signature of g is changed:", g.Type())
+	}
+	domTest(t, pkg, `package main
+
+func f(a int, b bool) {
+}
+func g(a int) {
+}
+func main() {
+	f(1, true)
+	g(2)
+	var f = g
+	f(3)
+}
+`)
+}
+
+func TestChangeParamsOpenCaller(t *testing.T) {
+	pkg := newMainPackage()
+	a := pkg.NewParam(token.NoPos, "a", types.Typ[types.Int])
+	f := pkg.NewFunc(nil, "f", gox.NewTuple(a), nil, false)
+	f.BodyStart(pkg).End()
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(f).Val(1).Call(1).EndStmt()
+	b := pkg.NewParam(token.NoPos, "b", types.Typ[types.Bool])
+	err := f.ChangeParams(pkg,
+		gox.ParamChange{Param: b, From: -1, Default: ast.NewIdent("true")},
+		gox.ParamChange{Param: a, From: 0})
+	if err != nil {
+		t.Fatal("ChangeParams:", err)
+	}
+	cb.If().Val(true).Then().
+		Val(f).Val(false).Val(2).Call(2).EndStmt()
+	c := pkg.NewParam(token.NoPos, "c", types.Typ[types.String])
+	err = f.ChangeParams(pkg,
+		gox.ParamChange{Param: a, From: 1},
+		gox.ParamChange{Param: c, From: -1, Default: ast.NewIdent(`""`)})
+	if err == nil {
+		t.Fatal("ChangeParams: no error")
+	}
+	cb.End().End()
+	domTest(t, pkg, `package main
+
+func f(b bool, a int) {
+}
+func main() {
+	f(true, 1)
+	if true {
+		f(false, 2)
+	}
+}
+`)
+}
+
+func TestChangeParamsError(t *testing.T) {
+	pkg := newMainPackage()
+	a := pkg.NewParam(token.NoPos, "a", types.Typ[types.Int])
+	f := pkg.NewFunc(nil, "f", gox.NewTuple(a), nil, false)
+	f.BodyStart(pkg).End()
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(f).Val(1).Call(1).EndStmt().
+		End()
+	err := f.ChangeParams(pkg,
+		gox.ParamChange{Param: a, From: 0},
+		gox.ParamChange{Param: pkg.NewParam(token.NoPos, "b", types.Typ[types.Int]), From: 0})
+	if err == nil || err.Error() != "ChangeParams: parameter 0 is passed to more than one parameter" {
+		t.Fatal("ChangeParams:", err)
+	}
+	pkg.NewVarStart(token.NoPos, nil, "h").Val(f).EndInit(1)
+	b := pkg.NewParam(token.NoPos, "b", types.Typ[types.Bool])
+	err = f.ChangeParams(pkg,
+		gox.ParamChange{Param: a, From: 0},
+		gox.ParamChange{Param: b, From: -1, Default: ast.NewIdent("true")})
+	if err == nil || err.Error() != "ChangeParams: f is referenced other than by calls, or in blocks not ended" {
+		t.Fatal("ChangeParams:", err)
+	}
+	domTest(t, pkg, `package main
+
+func f(a int) {
+}
+func main() {
+	f(1)
+}
+
+var h = f
+`)
+}
+
+func TestChangeParamsUnref(t *testing.T) {
+	pkg := newMainPackage()
+	time := pkg.Import("time")
+	a := pkg.NewParam(token.NoPos, "a", types.Typ[types.Int])
+	d := pkg.NewParam(token.NoPos, "d", time.Ref("Duration").Type())
+	f := pkg.NewFunc(nil, "f", gox.NewTuple(a, d), nil, false)
+	f.BodyStart(pkg).End()
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(f).Val(1).Val(time.Ref("Second")).Call(2).EndStmt().
+		End()
+	if err := f.ChangeParams(pkg, gox.ParamChange{Param: a, From: 0}); err != nil {
+		t.Fatal("ChangeParams:", err)
+	}
+	domTest(t, pkg, `package main
+
+func f(a int) {
+}
+func main() {
+	f(1)
+}
+`)
+}
+
+func TestThreadContext(t *testing.T) {
+	pkg := newMainPackage()
+	a := pkg.NewParam(token.NoPos, "a", types.Typ[types.Int])
+	f := pkg.NewFunc(nil, "f", gox.NewTuple(a), nil, false)
+	f.BodyStart(pkg).End()
+	g := pkg.NewFunc(nil, "g", nil, nil, false)
+	g.BodyStart(pkg).
+		Val(f).Val(1).Call(1).EndStmt().
+		End()
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(g).Call(0).EndStmt().
+		Val(f).Val(2).Call(1).EndStmt().
+		End()
+	if err := pkg.ThreadContext(f, g); err != nil {
+		t.Fatal("ThreadContext:", err)
+	}
+	domTest(t, pkg, `package main
+
+import "context"
+
+func f(ctx context.Context, a int) {
+}
+func g(ctx context.Context) {
+	f(ctx, 1)
+}
+func main() {
+	g(context.TODO())
+	f(context.TODO(), 2)
+}
+`)
+}
+
+func TestThreadContextErr(t *testing.T) {
+	pkg := newMainPackage()
+	if err := pkg.ThreadContext(nil); err == nil || err.Error() != "ThreadContext: nil function" {
+		t.Fatal("ThreadContext:", err)
+	}
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg)
+	fn := cb.NewClosure(nil, nil, false)
+	fn.BodyStart(pkg).End()
+	cb.Call(0).EndStmt().End()
+	if err := pkg.ThreadContext(fn); err == nil || err.Error() != "ThreadContext: closures aren't supported" {
+		t.Fatal("ThreadContext:", err)
+	}
+}
+
+func TestThreadContextDeclared(t *testing.T) {
+	pkg := newMainPackage()
+	ctx := pkg.NewParam(token.NoPos, "ctx", types.Typ[types.String])
+	f := pkg.NewFunc(nil, "f", gox.NewTuple(ctx), nil, false)
+	f.BodyStart(pkg).End()
+	g := pkg.NewFunc(nil, "g", nil, nil, false)
+	g.BodyStart(pkg).
+		NewVarStart(nil, "ctx").Val(1).EndInit(1).
+		Val(f).Val("hi").Call(1).EndStmt().
+		End()
+	h := pkg.NewFunc(nil, "h", nil, nil, false)
+	cb := h.BodyStart(pkg).
+		DefineVarStart(token.NoPos, "ctx").Val(1).EndInit(1)
+	if err := pkg.ThreadContext(f); err == nil || err.Error() != "ThreadContext: ctx is declared in f already" {
+		t.Fatal("ThreadContext:", err)
+	}
+	if err := pkg.ThreadContext(g); err == nil || err.Error() != "ThreadContext: ctx is declared in g already" {
+		t.Fatal("ThreadContext:", err)
+	}
+	if err := pkg.ThreadContext(h); err == nil || err.Error() != "ThreadContext: ctx is declared in h already" {
+		t.Fatal("ThreadContext:", err)
+	}
+	cb.End()
+	domTest(t, pkg, `package main
+
+func f(ctx string) {
+}
+func g() {
+	var ctx = 1
+	f("hi")
+}
+func h() {
+	ctx := 1
+}
+`)
+}
+
+func TestTernary(t *testing.T) {
+	pkg := newMainPackage()
+	x := pkg.NewParam(token.NoPos, "x", types.Typ[types.Int])
+	pkg.NewFunc(nil, "foo", gox.NewTuple(x), nil, false).BodyStart(pkg).
+		DefineVarStart(token.NoPos, "a").
+		/**/ Val(x).Val(0).BinaryOp(token.GTR).Val(1).Val(2.5).Ternary(gox.TernaryClosure).
+		EndInit(1).
+		DefineVarStart(token.NoPos, "b").
+		/**/ Val(x).Val(0).BinaryOp(token.GTR).Val(x).Val(0).Ternary(gox.TernaryTempVar).
+		EndInit(1).
+		End()
+	domTest(t, pkg, `package main
+
+func foo(x int) {
+	a := func() float64 {
+		if x > 0 {
+			return 1
+		}
+		return 2.5
+	}()
+	var _autoGo_1 int
+	if x > 0 {
+		_autoGo_1 = x
+	} else {
+		_autoGo_1 = 0
+	}
+	b := _autoGo_1
+}
+`)
+}
+
+func TestTernaryFallback(t *testing.T) {
+	pkg := newMainPackage()
+	ret := gox.NewTuple(pkg.NewParam(token.NoPos, "", types.Typ[types.Int]))
+	g := pkg.NewFunc(nil, "g", nil, ret, false)
+	g.BodyStart(pkg).Val(1).Return(1).End()
+	pkg.NewVarStart(token.NoPos, nil, "x").
+		Val(true).Val(1).Val(2).Ternary(gox.TernaryTempVar).EndInit(1)
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		DefineVarStart(token.NoPos, "a").
+		/**/ Val(g).Call(0).Val(ctxRef(pkg, "x")).Val(0).BinaryOp(token.GTR).Val(g).Call(0).Val(2).
+		/**/ Ternary(gox.TernaryTempVar).BinaryOp(token.ADD).
+		EndInit(1).
+		DefineVarStart(token.NoPos, "b").
+		/**/ Val(ctxRef(pkg, "a")).Val(ctxRef(pkg, "x")).Val(0).BinaryOp(token.GTR).Val(g).Call(0).Val(2).
+		/**/ Ternary(gox.TernaryTempVar).BinaryOp(token.ADD).
+		EndInit(1).
+		End()
+	domTest(t, pkg, `package main
+
+func g() int {
+	return 1
+}
+
+var x = func() int {
+	if true {
+		return 1
+	}
+	return 2
+}()
+
+func main() {
+	a := g() + func() int {
+		if x > 0 {
+			return g()
+		}
+		return 2
+	}()
+	var _autoGo_1 int
+	if x > 0 {
+		_autoGo_1 = g()
+	} else {
+		_autoGo_1 = 2
+	}
+	b := a + _autoGo_1
+}
+`)
+}
+
+func TestTernaryInLoop(t *testing.T) {
+	pkg := newMainPackage()
+	x := pkg.NewParam(token.NoPos, "x", types.Typ[types.Int])
+	i := func() *gox.CodeBuilder { // pushes `i > 0 ? x : 0`
+		return pkg.CB().Val(ctxRef(pkg, "i")).Val(0).BinaryOp(token.GTR).Val(x).Val(0)
+	}
+	cb := pkg.NewFunc(nil, "foo", gox.NewTuple(x), nil, false).BodyStart(pkg).
+		For().DefineVarStart(token.NoPos, "i").Val(0).EndInit(1).
+		Val(ctxRef(pkg, "i"))
+	i().Ternary(gox.TernaryTempVar).BinaryOp(token.LSS).Then().
+		Val(ctxRef(pkg, "println")).Val(ctxRef(pkg, "i")).Call(1).EndStmt().
+		NewVarStart(nil, "b")
+	i().Ternary(gox.TernaryTempVar).EndInit(1).
+		If()
+	i().Ternary(gox.TernaryTempVar).Val(1).BinaryOp(token.EQL).Then().
+		End().
+		Post().VarRef(ctxRef(pkg, "i")).IncDec(token.INC).
+		End()
+	cb.End()
+	domTest(t, pkg, `package main
+
+func foo(x int) {
+	for i := 0; i < func() int {
+		if i > 0 {
+			return x
+		}
+		return 0
+	}(); i++ {
+		println(i)
+		var _autoGo_1 int
+		if i > 0 {
+			_autoGo_1 = x
+		} else {
+			_autoGo_1 = 0
+		}
+		var b = _autoGo_1
+		if func() int {
+			if i > 0 {
+				return x
+			}
+			return 0
+		}() == 1 {
+		}
+	}
+}
+`)
+}
+
+func TestOptionalChain(t *testing.T) {
+	pkg := newMainPackage()
+	decl := pkg.NewType("Node")
+	tyNode := types.NewPointer(decl.Type())
+	decl.InitType(pkg, types.NewStruct([]*types.Var{
+		types.NewField(token.NoPos, pkg.Types, "Next", tyNode, false),
+		types.NewField(token.NoPos, pkg.Types, "Attrs", types.NewMap(types.Typ[types.String], tyNode), false),
+		types.NewField(token.NoPos, pkg.Types, "Name", types.Typ[types.String], false),
+	}, nil))
+	n := pkg.NewParam(token.NoPos, "n", tyNode)
+	pkg.NewFunc(nil, "foo", gox.NewTuple(n), nil, false).BodyStart(pkg).
+		DefineVarStart(token.NoPos, "a", "ok").
+		/**/ Val(n).OptionalChain([]string{"Next", "Attrs", "x", "Name"}, true).
+		EndInit(2).
+		DefineVarStart(token.NoPos, "b").
+		/**/ Val(n).MemberVal("Next").OptionalChain([]string{"Attrs", "y"}, false).
+		EndInit(1).
+		End()
+	domTest(t, pkg, `package main
+
+type Node struct {
+	Next  *Node
+	Attrs map[string]*Node
+	Name  string
+}
+
+func foo(n *Node) {
+	var _autoGo_1 string
+	var _autoGo_2 bool
+	if n != nil {
+		if _autoGo_3 := n.Next; _autoGo_3 != nil {
+			if _autoGo_4, _autoGo_5 := _autoGo_3.Attrs["x"]; _autoGo_5 {
+				if _autoGo_4 != nil {
+					_autoGo_1, _autoGo_2 = _autoGo_4.Name, true
+				}
+			}
+		}
+	}
+	a, ok := _autoGo_1, _autoGo_2
+	var _autoGo_6 *Node
+	if _autoGo_7 := n.Next; _autoGo_7 != nil {
+		_autoGo_6 = _autoGo_7.Attrs["y"]
+	}
+	b := _autoGo_6
+}
+`)
+}
+
+type memberRecorder []string
+
+func (p *memberRecorder) Member(id ast.Node, obj types.Object) {
+	*p = append(*p, obj.Name())
+}
+
+func TestOptionalChainProbe(t *testing.T) {
+	var rec memberRecorder
+	conf := &gox.Config{Fset: gblFset, Importer: gblImp, Recorder: &rec}
+	pkg := gox.NewPackage("", "main", conf)
+	decl := pkg.NewType("Node")
+	tyNode := types.NewPointer(decl.Type())
+	decl.InitType(pkg, types.NewStruct([]*types.Var{
+		types.NewField(token.NoPos, pkg.Types, "Next", tyNode, false),
+	}, nil))
+	n := pkg.NewParam(token.NoPos, "n", tyNode)
+	pkg.NewFunc(nil, "foo", gox.NewTuple(n), nil, false).BodyStart(pkg).
+		DefineVarStart(token.NoPos, "a").
+		/**/ Val(n).OptionalChain([]string{"Next", "Next"}, false, &ast.Ident{Name: "n"}).
+		EndInit(1).
+		End()
+	if len(rec) != 2 {
+		t.Fatal("TestOptionalChainProbe:", rec)
+	}
+}
+
+func TestStmtHandle(t *testing.T) {
+	pkg := newMainPackage()
+	tyInt := types.Typ[types.Int]
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg)
+	begin := cb.LastStmt()
+	cb.NewVar(tyInt, "a")
+	h := cb.LastStmt()
+	cb.Val(ctxRef(pkg, "println")).VarVal("a").
+		InsertAfter(h, func(cb *gox.CodeBuilder) {
+			cb.NewVarStart(tyInt, "b").Val(1).EndInit(1)
+		}).
+		VarVal("b").Call(2).EndStmt()
+	last := cb.LastStmt()
+	cb.InsertBefore(last, func(cb *gox.CodeBuilder) {
+		cb.VarRef(ctxRef(pkg, "a")).Val(2).Assign(1)
+	}).InsertAfter(begin, func(cb *gox.CodeBuilder) {
+		cb.Val(ctxRef(pkg, "println")).Val("begin").Call(1).EndStmt()
+	}).ReplaceStmt(last, func(cb *gox.CodeBuilder) {
+		cb.Val(ctxRef(pkg, "println")).VarVal("b").VarVal("a").Call(2).EndStmt()
+	}).End()
+	domTest(t, pkg, `package main
+
+func main() {
+	println("begin")
+	var a int
+	var b int = 1
+	a = 2
+	println(b, a)
+}
+`)
+}
+
+func TestReplaceStmtUnref(t *testing.T) {
+	pkg := newMainPackage()
+	strconv := pkg.Import("strconv")
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(strconv.Ref("Itoa")).Val(1).Call(1).EndStmt()
+	cb.ReplaceStmt(cb.LastStmt(), func(cb *gox.CodeBuilder) {
+		cb.Val(ctxRef(pkg, "println")).Val(1).Call(1).EndStmt()
+	}).End()
+	domTest(t, pkg, `package main
+
+func main() {
+	println(1)
+}
+`)
+}
+
+func TestNewTemp(t *testing.T) {
+	pkg := newMainPackage()
+	tyInt, tyStr := types.Typ[types.Int], types.Typ[types.String]
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg)
+	a := cb.NewTemp(tyInt)
+	cb.VarRef(a).Val(1).Assign(1).ReleaseTemp(a)
+	cb.If().Val(true).Then()
+	b := cb.NewTemp(tyInt)
+	s := cb.NewTemp(tyStr)
+	c := cb.NewTemp(tyInt)
+	if b != a || c == a {
+		t.Fatal("NewTemp: temporary isn't reused")
+	}
+	cb.VarRef(b).VarRef(s).VarRef(c).Val(2).Val("x").Val(3).Assign(3).
+		ReleaseTemp(b).ReleaseTemp(s).ReleaseTemp(c).
+		End()
+	if d := cb.NewTemp(tyInt); d != a {
+		t.Fatal("NewTemp: temporary in scope isn't reused")
+	}
+	cb.End()
+	domTest(t, pkg, `package main
+
+func main() {
+	var _autoGo_1 int
+	_autoGo_1 = 1
+	if true {
+		var _autoGo_2 string
+		var _autoGo_3 int
+		_autoGo_1, _autoGo_2, _autoGo_3 = 2, "x", 3
+	}
+}
+`)
+}
+
+func TestAutoPrefix(t *testing.T) {
+	pkg := gox.NewPackage("", "main", &gox.Config{Fset: gblFset, Importer: gblImp, AutoPrefix: "_gen_"})
+	tyInt := types.Typ[types.Int]
+	cb := pkg.NewFunc(nil, "foo", nil, nil, false).BodyStart(pkg)
+	cb.NewTemp(tyInt)
+	old := pkg.SetAutoPrefix("_tool_")
+	cb.NewTemp(tyInt)
+	pkg.SetAutoPrefix(old)
+	cb.End()
+	old2, err := pkg.SetCurFile("bar.go", true)
+	if err != nil {
+		t.Fatal("pkg.SetCurFile failed:", err)
+	}
+	pkg.CurFile().SetAutoPrefix("_bar_")
+	pkg.NewFunc(nil, "bar", nil, nil, false).BodyStart(pkg).NewTemp(tyInt)
+	pkg.CB().End()
+	pkg.RestoreCurFile(old2)
+	domTest(t, pkg, `package main
+
+func foo() {
+	var _gen_1 int
+	var _tool_2 int
+}
+`)
+	domTestEx(t, pkg, `package main
+
+func bar() {
+	var _bar_3 int
+}
+`, "bar.go")
+	for _, prefix := range []string{"", "1x", "a-"} {
+		safeRun(t, func() { pkg.SetAutoPrefix(prefix) })
+		safeRun(t, func() { pkg.CurFile().SetAutoPrefix(prefix) })
+	}
+	safeRun(t, func() {
+		gox.NewPackage("", "main", &gox.Config{Fset: gblFset, Importer: gblImp, AutoPrefix: "9"})
+	})
+}
+
+func TestTestingFuncs(t *testing.T) {
+	pkg := newMainPackage()
+	pkg.NewTestFunc("Foo", func(cb *gox.CodeBuilder, t *gox.Param) {
+		cb.Val(t).MemberVal("Skip").Val("todo").Call(1).EndStmt()
+	})
+	pkg.NewBenchmarkFunc("BenchmarkFoo", nil)
+	pkg.NewFuzzFunc("Foo", nil)
+	pkg.NewTableTest("Add", []*types.Var{
+		types.NewField(token.NoPos, pkg.Types, "a", types.Typ[types.Int], false),
+		types.NewField(token.NoPos, pkg.Types, "want", types.Typ[types.Int], false),
+	}, [][]interface{}{
+		{"zero", 0, 0},
+		{"one", 1, 2},
+	}, func(cb *gox.CodeBuilder, t *gox.Param, tt types.Object) {
+		cb.If().Val(tt).MemberVal("a").Val(tt).MemberVal("want").BinaryOp(token.GTR).Then().
+			Val(t).MemberVal("Fatal").Val(tt).MemberVal("name").Call(1).EndStmt().
+			End()
+	})
+	domTest(t, pkg, `package main
+`)
+	domTestEx(t, pkg, `package main
+
+import "testing"
+
+func TestFoo(t *testing.T) {
+	t.Skip("todo")
+}
+func BenchmarkFoo(b *testing.B) {
+}
+func FuzzFoo(f *testing.F) {
+}
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		a    int
+		want int
+	}{{"zero", 0, 0}, {"one", 1, 2}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.a > tt.want {
+				t.Fatal(tt.name)
+			}
+		})
+	}
+}
+`, "gox_test.go")
+}
+
+func BenchmarkCodeBuild(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pkg := newMainPackage()
+		cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+			NewVar(types.Typ[types.Int], "a")
+		for j := 0; j < 100; j++ {
+			cb.VarRef(ctxRef(pkg, "a")).VarVal("a").Val(j).BinaryOp(token.ADD).Assign(1)
+		}
+		cb.End()
+	}
+}
+
+func BenchmarkOverloadMatch(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pkg := newMainPackage()
+		builtin := pkg.Builtin()
+		nodeSet := pkg.Import("github.com/goplus/gox/internal/foo").Ref("NodeSet").Type()
+		c128 := pkg.NewParam(token.NoPos, "c128", types.Typ[types.Complex128])
+		v := pkg.NewParam(token.NoPos, "v", nodeSet)
+		cb := pkg.NewFunc(nil, "foo", gox.NewTuple(c128, v), nil, false).BodyStart(pkg)
+		for j := 0; j < 100; j++ {
+			cb.VarRef(c128).Val(builtin.Ref("complex")).Val(builtin.Ref("imag")).Val(c128).Call(1).Val(j).Call(2).
+				Assign(1).
+				VarRef(v).Val(v).MemberVal("Attr").Val("key").Val("val").Call(2).Assign(1)
+		}
+		cb.End()
+	}
+}
+
+func BenchmarkFuncCall(b *testing.B) {
+	gox.SetDebug(0)
+	defer gox.SetDebug(gox.DbgFlagAll)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pkg := newMainPackage()
+		tyInt := types.Typ[types.Int]
+		params := gox.NewTuple(pkg.NewParam(token.NoPos, "a", tyInt), pkg.NewParam(token.NoPos, "b", tyInt))
+		results := gox.NewTuple(pkg.NewParam(token.NoPos, "", tyInt))
+		f := pkg.NewFunc(nil, "f", params, results, false)
+		f.BodyStart(pkg).VarVal("a").Return(1).End()
+		cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg)
+		for j := 0; j < 10000; j++ {
+			cb.Val(f).Val(j).Val(1).Call(2).EndStmt()
+		}
+		cb.End()
+	}
+}
+
+func BenchmarkValLit(b *testing.B) {
+	gox.SetDebug(0)
+	defer gox.SetDebug(gox.DbgFlagAll)
+	b.ReportAllocs()
+	pkg := newMainPackage()
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg)
+	for i := 0; i < b.N; i++ {
+		cb.Val(0).Val(1).Val("").Val(true).Val(false).Val(2).Val("gox").Val(1.5).Val('x')
+		cb.InternalStack().PopN(9)
+	}
+}
+
+func TestLoadFileComments(t *testing.T) {
+	pkg := newMainPackage()
+	_, err := pkg.LoadFile("hello.go", `package main
+
+import "fmt"
+
+// free-floating comment
+
+// T is a type.
+type T struct {
+	Name string // name
+	// Age is an age.
+	Age int
+	Tags []string // tags
+}
+
+var v = T{
+	Name: "x", // inline comment of an expression
+}
+
+// Greet greets.
+func (t *T) Greet() {
+	// say hello
+	fmt.Println("Hello,", t.Name) // line comment
+	if t.Age > 0 {
+		// in a nested block
+		fmt.Println(t.Age)
+	}
+	switch t.Name {
+	case "":
+		// empty
+		return
+	}
+	f := func() {
+		// in a closure
+		fmt.Println()
+	}
+	// call f
+	f()
+}
+
+// trailing comment
+`)
+	if err != nil {
+		t.Fatal("pkg.LoadFile failed:", err)
+	}
+	domTestEx(t, pkg, `package main
+
+import "fmt"
+// free-floating comment
+// T is a type.
+type T struct {
+	Name string // name
+	// Age is an age.
+	Age  int
+	Tags []string // tags
+}
+// inline comment of an expression
+var v = T{Name: "x"}
+// Greet greets.
+// trailing comment
+func (t *T) Greet() {
+// say hello
+	// line comment
+	fmt.Println("Hello,", t.Name)
+	if t.Age > 0 {
+// in a nested block
+		fmt.Println(t.Age)
+	}
+	switch t.Name {
+	case "":
+// empty
+		return
+	}
+	f := func() {
+// in a closure
+		fmt.Println()
+	}
+// call f
+	f()
+}
+`, "hello.go")
+}
+
+func TestLoadFile(t *testing.T) {
+	pkg := newMainPackage()
+	_, err := pkg.LoadFile("/foo/hello.go", `package main
+
+import (
+	"fmt"
+	str "strings"
+)
+
+// Hello says hello.
+func Hello(name string) string {
+	return fmt.Sprint("Hello, ", str.ToUpper(name))
+}
+
+// T is a type.
+type T struct {
+	// A is a field.
+	A int // line comment
+}
+
+// Group of constants.
+const (
+	// X is a constant.
+	X = iota // line comment
+	Y
+)
+`)
+	if err != nil {
+		t.Fatal("pkg.LoadFile failed:", err)
+	}
+	old, err := pkg.SetCurFile("hello.go", false)
+	if err != nil {
+		t.Fatal("pkg.SetCurFile failed:", err)
+	}
+	strings := pkg.Import("strings")
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(ctxRef(pkg, "println")).
+		/**/ Val(ctxRef(pkg, "Hello")).Val(strings.Ref("TrimSpace")).Val(" gox ").Call(1).Call(1).
+		Call(1).EndStmt().
+		End()
+	pkg.RestoreCurFile(old)
+	domTestEx(t, pkg, `package main
+
+import (
+	"fmt"
+	"strings"
+)
+// Hello says hello.
+func Hello(name string) string {
+	return fmt.Sprint("Hello, ", strings.ToUpper(name))
+}
+// T is a type.
+type T struct {
+// A is a field.
+	A int // line comment
+}
+// Group of constants.
+const (
+// X is a constant.
+	X = iota // line comment
+	Y
+)
+
+func main() {
+	println(Hello(strings.TrimSpace(" gox ")))
+}
+`, "hello.go")
+	if _, err = pkg.LoadFile("hello.go", "package main"); err == nil {
+		t.Fatal("pkg.LoadFile: no error?")
+	}
+	if _, err = pkg.LoadFile("foo.go", "package foo"); err == nil {
+		t.Fatal("pkg.LoadFile: no error?")
+	}
+	if _, err = pkg.LoadFile("bar.go", "package main\n\nfunc Hello() {}"); err == nil {
+		t.Fatal("pkg.LoadFile: no error?")
+	}
+	if _, err = pkg.LoadFile("dot.go", "package main\n\nimport . \"fmt\""); err == nil {
+		t.Fatal("pkg.LoadFile: no error?")
+	}
+}
+
+func TestOpenPackage(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go":      "package foo\n\n// T is a type.\ntype T struct {\n\tn int\n}\n",
+		"b.go":      "package foo\n\nfunc (p *T) N() int {\n\t// add the base\n\treturn p.n + base // see c.go\n}\n",
+		"c.go":      "package foo\n\nconst base = 1\n",
+		"a_test.go": "package foo_test\n",
+		"gen.go":    "//go:build ignore\n\npackage main\n",
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pkg, err := gox.OpenPackage("foo", dir, nil)
+	if err != nil {
+		t.Fatal("OpenPackage failed:", err)
+	}
+	if names := pkg.FileNames(); !reflect.DeepEqual(names, []string{"", "a.go", "b.go", "c.go"}) {
+		t.Fatal("TestOpenPackage:", names)
+	}
+	typ := pkg.Types.Scope().Lookup("T").Type().(*types.Named)
+	old, _ := pkg.SetCurFile("b.go", false)
+	ret := gox.NewTuple(pkg.NewParam(token.NoPos, "", types.Typ[types.Int]))
+	pkg.NewFunc(pkg.NewParam(token.NoPos, "p", types.NewPointer(typ)), "Double", nil, ret, false).BodyStart(pkg).
+		VarVal("p").MemberVal("N").Call(0).Val(2).BinaryOp(token.MUL).Return(1).
+		End()
+	pkg.RestoreCurFile(old)
+	domTestEx(t, pkg, `package foo
+
+func (p *T) N() int {
+// add the base
+	// see c.go
+	return p.n + base
+}
+func (p *T) Double() int {
+	return p.N() * 2
+}
+`, "b.go")
+	if _, err = gox.OpenPackage("foo", filepath.Join(dir, "none"), nil); err == nil {
+		t.Fatal("OpenPackage: no error?")
+	}
+	os.WriteFile(filepath.Join(dir, "d.go"), []byte("package bar\n"), 0666)
+	if _, err = gox.OpenPackage("foo", dir, nil); err == nil {
+		t.Fatal("OpenPackage: no error?")
+	}
+	if _, err = gox.OpenPackage("foo", t.TempDir(), nil); err == nil {
+		t.Fatal("OpenPackage: no error?")
+	}
+}
+
+func TestRawDeclAndStmt(t *testing.T) {
+	gt := newGoxTest()
+	_, err := gt.LoadGoPackage("foo", "foo.go", `
+package foo
+
+func Bar() int { return 1 }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := gt.NewPackage("", "main")
+	pkg.Import("foo")
+	f, err := parser.ParseFile(token.NewFileSet(), "raw.go", `package main
+
+func hello() int {
+	return foo.Bar()
+}
+
+var x, y = 1, 2
+`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := gox.NewTuple(pkg.NewParam(token.NoPos, "", types.Typ[types.Int]))
+	hello := types.NewFunc(token.NoPos, pkg.Types, "hello", types.NewSignatureType(nil, nil, nil, nil, ret, false))
+	if err = pkg.RawDecl(f.Decls[0], hello); err != nil {
+		t.Fatal("RawDecl:", err)
+	}
+	if err = pkg.RawDecl(f.Decls[0], hello); err == nil {
+		t.Fatal("RawDecl: no error?")
+	}
+	x := types.NewVar(token.NoPos, pkg.Types, "x", types.Typ[types.Int])
+	y := types.NewVar(token.NoPos, pkg.Types, "y", types.Typ[types.Int])
+	if err = pkg.RawDecl(f.Decls[1], x, y); err != nil {
+		t.Fatal("RawDecl:", err)
+	}
+	stmt := &ast.AssignStmt{
+		Lhs: []ast.Expr{ast.NewIdent("n")}, Tok: token.DEFINE, Rhs: []ast.Expr{ast.NewIdent("x")},
+	}
+	n := types.NewVar(token.NoPos, pkg.Types, "n", types.Typ[types.Int])
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		RawStmt(stmt, n).
+		Val(ctxRef(pkg, "println")).VarVal("n").VarVal("y").Val(ctxRef(pkg, "hello")).Call(0).Call(3).EndStmt().
+		End()
+	domTest(t, pkg, `package main
+
+import "foo"
+
+func hello() int {
+	return foo.Bar()
+}
+
+var x, y = 1, 2
+
+func main() {
+	n := x
+	println(n, y, hello())
+}
+`)
+	defer func() {
+		if e := recover(); e == nil {
+			t.Fatal("RawStmt: no error?")
+		}
+	}()
+	pkg.NewFunc(nil, "f", nil, nil, false).BodyStart(pkg).
+		RawStmt(stmt, n, n)
+}
+
+func TestRawShadowPkg(t *testing.T) {
+	gt := newGoxTest()
+	_, err := gt.LoadGoPackage("foo", "foo.go", `
+package foo
+
+type T struct{ X int }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := gt.NewPackage("", "main")
+	pkg.Import("foo")
+	f, err := parser.ParseFile(token.NewFileSet(), "raw.go", `package main
+
+func get(foo *T) int {
+	return foo.X
+}
+
+func set() {
+	for foo := range 3 {
+		println(foo.X)
+	}
+}
+`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pkg.RawDecl(f.Decls[0]); err != nil {
+		t.Fatal("RawDecl:", err)
+	}
+	if err = pkg.RawDecl(f.Decls[1]); err != nil {
+		t.Fatal("RawDecl:", err)
+	}
+	stmt := &ast.AssignStmt{
+		Lhs: []ast.Expr{ast.NewIdent("_")}, Tok: token.ASSIGN,
+		Rhs: []ast.Expr{&ast.SelectorExpr{X: ast.NewIdent("foo"), Sel: ast.NewIdent("X")}},
+	}
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVar(types.NewPointer(types.Typ[types.Int]), "foo").
+		RawStmt(stmt).
+		End()
+	domTest(t, pkg, `package main
+
+func get(foo *T) int {
+	return foo.X
+}
+func set() {
+	for foo := range 3 {
+		println(foo.X)
+	}
+}
+func main() {
+	var foo *int
+	_ = foo.X
+}
+`)
+}
+
+func TestRawDeclRedecl(t *testing.T) {
+	pkg := newMainPackage()
+	scope := pkg.Types.Scope()
+	decl := &ast.GenDecl{Tok: token.VAR}
+	a := types.NewVar(token.NoPos, pkg.Types, "a", types.Typ[types.Int])
+	b := types.NewVar(token.NoPos, pkg.Types, "b", types.Typ[types.Int])
+	if err := pkg.RawDecl(decl, b); err != nil {
+		t.Fatal("RawDecl:", err)
+	}
+	if err := pkg.RawDecl(decl, a, b); err == nil {
+		t.Fatal("RawDecl: no error?")
+	}
+	if scope.Lookup("a") != nil {
+		t.Fatal("RawDecl: a is inserted")
+	}
+	c := types.NewVar(token.NoPos, pkg.Types, "c", types.Typ[types.Int])
+	if err := pkg.RawDecl(decl, a, c, c); err == nil {
+		t.Fatal("RawDecl: no error?")
+	}
+	if scope.Lookup("a") != nil || scope.Lookup("c") != nil {
+		t.Fatal("RawDecl: a or c is inserted")
+	}
+}
+
+func BenchmarkLargePackage(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		newLargePackage(newMainPackage())
+	}
+}
+
+func BenchmarkLargePackageArena(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		newLargePackage(gox.NewPackage("", "main", &gox.Config{Fset: gblFset, Importer: gblImp, ArenaMode: true}))
+	}
+}
+
+func newLargePackage(pkg *gox.Package) *gox.Package {
+	tyInt, tyStr := types.Typ[types.Int], types.Typ[types.String]
+	for j := 0; j < 100; j++ {
+		params := gox.NewTuple(pkg.NewParam(token.NoPos, "a", tyInt), pkg.NewParam(token.NoPos, "s", tyStr))
+		results := gox.NewTuple(pkg.NewParam(token.NoPos, "", tyInt))
+		pkg.NewFunc(nil, "f"+strconv.Itoa(j), params, results, false).BodyStart(pkg).
+			If().VarVal("s").Val("").BinaryOp(token.NEQ).Then().
+			/**/ Val(ctxRef(pkg, "len")).VarVal("s").Call(1).Return(1).
+			End().
+			VarVal("a").Val(1).BinaryOp(token.ADD).Return(1).
+			End()
+	}
+	return pkg
+}
+
+func TestArenaMode(t *testing.T) {
+	pkg := gox.NewPackage("", "main", &gox.Config{Fset: gblFset, Importer: gblImp, ArenaMode: true})
+	fmt := pkg.Import("fmt")
+	v := pkg.NewParam(token.NoPos, "v", types.Typ[types.Int])
+	foo := pkg.NewFunc(nil, "foo", gox.NewTuple(v), nil, false)
+	foo.BodyStart(pkg).End()
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg)
+	for i := 0; i < 3; i++ {
+		cb.Val(fmt.Ref("Println")).Val(i).Val("x").Call(2).EndStmt().
+			Val(foo).Val(i).Call(1).EndStmt()
+	}
+	cb.End()
+	domTest(t, pkg, `package main
+
+import "fmt"
+
+func foo(v int) {
+}
+func main() {
+	fmt.Println(0, "x")
+	foo(0)
+	fmt.Println(1, "x")
+	foo(1)
+	fmt.Println(2, "x")
+	foo(2)
+}
+`)
+}
+
+func TestSharedBuiltin(t *testing.T) {
+	ctx := gox.NewContext()
+	conf := &gox.Config{Fset: gblFset, Importer: gblImp, Context: ctx}
+	pkg1 := gox.NewPackage("", "main", conf)
+	pkg := gox.NewPackage("", "main", conf)
+	if pkg1.Builtin().Ref("println") != pkg.Builtin().Ref("println") {
+		t.Fatal("builtin objects aren't shared")
+	}
+	if newMainPackage().Builtin().Ref("println") == pkg.Builtin().Ref("println") {
+		t.Fatal("builtin objects are shared between contexts")
+	}
+	sess := gox.NewSession(gblFset, gblImp)
+	pkgs := []*gox.Package{pkg1, pkg, sess.NewPackage("", "main", nil), sess.NewPackage("", "main", nil)}
+	for i := 0; i < len(pkgs); i += 2 {
+		builtin := pkgs[i].Builtin().Types
+		builtin.Scope().Insert(types.NewConst(token.NoPos, builtin, "foo", types.Typ[types.UntypedInt], constant.MakeInt64(1)))
+		if pkgs[i].Builtin().TryRef("foo") == nil || pkgs[i+1].Builtin().TryRef("foo") != nil {
+			t.Fatal("builtin package isn't isolated")
+		}
+	}
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(ctxRef(pkg, "println")).Val("a").Val("b").BinaryOp(token.ADD).Call(1).EndStmt().
+		End()
+	domTest(t, pkg, `package main
+
+func main() {
+	println("a" + "b")
+}
+`)
+}
+
+func BenchmarkNewPackage(b *testing.B) {
+	b.ReportAllocs()
+	conf := &gox.Config{Fset: gblFset, Importer: gblImp, Context: gox.NewContext()}
+	for i := 0; i < b.N; i++ {
+		gox.NewPackage("", "main", conf)
+	}
+}
+
+func TestPreload(t *testing.T) {
+	pkg := newMainPackage()
+	pkg.Preload("fmt", "strings", "github.com/goplus/gox/internal/notfound")
+	pkg.Preload("fmt")
+	if pkg.TryImport("github.com/goplus/gox/internal/notfound") != nil {
+		t.Fatal("pkg.TryImport: no error?")
+	}
+	fmt, strings := pkg.Import("fmt"), pkg.Import("strings")
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(fmt.Ref("Println")).Val(strings.Ref("ToUpper")).Val("gox").Call(1).Call(1).EndStmt().
+		End()
+	domTest(t, pkg, `package main
+
+import (
+	"strings"
+	"fmt"
+)
+
+func main() {
+	fmt.Println(strings.ToUpper("gox"))
+}
+`)
+}
+
+func BenchmarkWriteFile(b *testing.B) {
+	gox.SetDebug(0)
+	defer gox.SetDebug(gox.DbgFlagAll)
+	pkg := newMainPackage()
+	cb := pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg)
+	for i := 0; i < 50000; i++ {
+		cb.Val(ctxRef(pkg, "println")).Val("the quick brown fox jumps over the lazy dog").Val(i).Call(2).EndStmt()
+	}
+	cb.End()
+	file := filepath.Join(b.TempDir(), "main.go")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := pkg.WriteFile(file); err != nil {
+			b.Fatal("pkg.WriteFile failed:", err)
+		}
+	}
+}
+
+func TestImportDeclCache(t *testing.T) {
+	pkg := newMainPackage()
+	fmt := pkg.Import("fmt")
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(fmt.Ref("Println")).Val("Hi").Call(1).EndStmt().
+		End()
+	domTest(t, pkg, `package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("Hi")
+}
+`)
+	strings := pkg.Import("strings")
+	pkg.NewFunc(nil, "foo", nil, nil, false).BodyStart(pkg).
+		Val(fmt.Ref("Println")).Val(strings.Ref("ToUpper")).Val("gox").Call(1).Call(1).EndStmt().
+		End()
+	domTest(t, pkg, `package main
+
+import (
+	"strings"
+	"fmt"
+)
+
+func main() {
+	fmt.Println("Hi")
+}
+func foo() {
+	fmt.Println(strings.ToUpper("gox"))
+}
+`)
+	pkg.NewVar(token.NoPos, types.Typ[types.Int], "strings")
+	domTest(t, pkg, `package main
+
+import (
+	strings1 "strings"
+	"fmt"
+)
+
+func main() {
+	fmt.Println("Hi")
+}
+func foo() {
+	fmt.Println(strings1.ToUpper("gox"))
+}
+
+var strings int
+`)
+}
+
+func BenchmarkWriteManyImports(b *testing.B) {
+	gox.SetDebug(0)
+	defer gox.SetDebug(gox.DbgFlagAll)
+	pkg := newMainPackage()
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).End()
+	for _, path := range []string{
+		"bufio", "bytes", "errors", "flag", "fmt", "io", "log", "math", "os", "path",
+		"sort", "strconv", "strings", "sync", "time", "unicode", "go/ast", "go/token", "go/types",
+	} {
+		pkg.Import(path).MarkForceUsed()
+	}
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := gox.WriteTo(&buf, pkg); err != nil {
+			b.Fatal("gox.WriteTo failed:", err)
+		}
+	}
+}
+
+func TestPosMap(t *testing.T) {
+	fset := token.NewFileSet()
+	expr, err := parser.ParseExprFrom(fset, "foo.gop", "println(x + 1, true)", 0)
+	if err != nil {
+		t.Fatal("parser.ParseExprFrom:", err)
+	}
+	call := expr.(*ast.CallExpr)
+	sum := call.Args[0].(*ast.BinaryExpr)
+	conf := &gox.Config{Fset: gblFset, Importer: gblImp, RecordSrcPos: true}
+	pkg := gox.NewPackage("", "main", conf)
+	x := pkg.NewParam(token.NoPos, "x", types.Typ[types.Int])
+	pkg.NewFunc(nil, "main", gox.NewTuple(x), nil, false).BodyStart(pkg).
+		Val(ctxRef(pkg, "println"), call.Fun).
+		Val(x, sum.X).Val(1, sum.Y).BinaryOp(token.ADD, sum).
+		Val(true, call.Args[1]).
+		CallWith(2, 0, call).EndStmt().
+		End()
+	var buf bytes.Buffer
+	m, err := pkg.WriteToWithPosMap(&buf)
+	if err != nil {
+		t.Fatal("WriteToWithPosMap:", err)
+	}
+	code := buf.String()
+	off := strings.Index(code, "x+1")
+	if off < 0 {
+		t.Fatal("unexpected code:", code)
+	}
+	if src := m.Src(off); src != sum.X {
+		t.Fatal("m.Src(x):", src)
+	}
+	if src := m.Src(off + 1); src != sum {
+		t.Fatal("m.Src(+):", src)
+	}
+	if src := m.Src(strings.Index(code, "println")); src != call.Fun {
+		t.Fatal("m.Src(println):", src)
+	}
+	if src := m.Src(strings.Index(code, "true")); src != call.Args[1] {
+		t.Fatal("m.Src(true):", src)
+	}
+	if src := m.Src(0); src != nil {
+		t.Fatal("m.Src(0):", src)
+	}
+	if start, end, ok := m.Offset(sum.OpPos); !ok || code[start:end] != "x+1" {
+		t.Fatal("m.Offset(+):", start, end, ok)
+	}
+	if start, end, ok := m.Offset(sum.Y.Pos()); !ok || code[start:end] != "1" {
+		t.Fatal("m.Offset(1):", start, end, ok)
+	}
+	if start, end, ok := m.Offset(call.Lparen); !ok || code[start:end] != "println(x+1, true)" {
+		t.Fatal("m.Offset(call):", code[start:end], ok)
+	}
+	if _, err = newMainPackage().WriteToWithPosMap(&buf); err != gox.ErrNoSrcPos {
+		t.Fatal("WriteToWithPosMap:", err)
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	fset := token.NewFileSet()
+	expr, err := parser.ParseExprFrom(fset, "foo.gop", "println(x + 1)", 0)
+	if err != nil {
+		t.Fatal("parser.ParseExprFrom:", err)
+	}
+	call := expr.(*ast.CallExpr)
+	sum := call.Args[0].(*ast.BinaryExpr)
+	conf := &gox.Config{Fset: fset, Importer: gblImp, RecordSrcPos: true, DefaultGoFile: "main.go"}
+	pkg := gox.NewPackage("", "main", conf)
+	x := pkg.NewParam(token.NoPos, "x", types.Typ[types.Int])
+	pkg.NewFunc(nil, "main", gox.NewTuple(x), nil, false).BodyStart(pkg).
+		Val(ctxRef(pkg, "println"), call.Fun).
+		Val(x, sum.X).Val(1, sum.Y).BinaryOp(token.ADD, sum).
+		CallWith(1, 0, call).EndStmt().
+		End()
+	m, err := pkg.SourceMap()
+	if err != nil {
+		t.Fatal("pkg.SourceMap:", err)
+	}
+	var ret []string
+	for _, v := range m {
+		ret = append(ret, v.Pos.String()+"-"+strconv.Itoa(v.End.Column)+" => "+v.SrcPos.String()+"-"+strconv.Itoa(v.SrcEnd.Column))
+	}
+	expected := []string{
+		"main.go:4:2-16 => foo.gop:1:1-15",
+		"main.go:4:2-9 => foo.gop:1:1-8",
+		"main.go:4:10-15 => foo.gop:1:9-14",
+		"main.go:4:10-11 => foo.gop:1:9-10",
+		"main.go:4:14-15 => foo.gop:1:13-14",
+	}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Fatal("pkg.SourceMap:", ret)
+	}
+	if _, err = pkg.SourceMap("unknown"); err != syscall.ENOENT {
+		t.Fatal("pkg.SourceMap:", err)
+	}
+}
+
+func TestLineDirectives(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "foo.gop", "package main\n\nfunc main() {\n\tprintln(1)\n\tif true {\n\t\tprintln(2)\n\t}\n}\n", 0)
+	if err != nil {
+		t.Fatal("parser.ParseFile:", err)
+	}
+	body := f.Decls[0].(*ast.FuncDecl).Body.List
+	call1 := body[0].(*ast.ExprStmt).X.(*ast.CallExpr)
+	ifStmt := body[1].(*ast.IfStmt)
+	call2 := ifStmt.Body.List[0].(*ast.ExprStmt).X.(*ast.CallExpr)
+	conf := &gox.Config{Fset: fset, Importer: gblImp, LineDirectives: true}
+	pkg := gox.NewPackage("", "main", conf)
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(ctxRef(pkg, "println"), call1.Fun).Val(1, call1.Args[0]).CallWith(1, 0, call1).EndStmt().
+		If().Val(true, ifStmt.Cond).Then().
+		SetComments(comment("\n// print 2"), true).
+		Val(ctxRef(pkg, "println"), call2.Fun).Val(2, call2.Args[0]).CallWith(1, 0, call2).EndStmt().
+		End().
+		NewVar(types.Typ[types.Int], "a").
+		End()
+	var buf bytes.Buffer
+	if err = pkg.WriteTo(&buf); err != nil {
+		t.Fatal("WriteTo:", err)
+	}
+	code := buf.String()
+	if expected := `package main
+
+func main() {
+//line foo.gop:4
+	println(1)
+//line foo.gop:5
+	if true {
+// print 2
+//line foo.gop:6
+		println(2)
+	}
+	var a int
+}
+`; code != expected {
+		t.Fatalf("\nResult:\n%s\nExpected:\n%s\n", code, expected)
+	}
+	genFset := token.NewFileSet()
+	gen, err := parser.ParseFile(genFset, "main.go", code, 0)
+	if err != nil {
+		t.Fatal("parser.ParseFile:", err)
+	}
+	ast.Inspect(gen, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.BasicLit); ok && lit.Value == "2" {
+			if pos := genFset.Position(lit.Pos()); pos.Filename != "foo.gop" || pos.Line != 6 {
+				t.Fatal("position of 2:", pos)
+			}
+		}
+		return true
+	})
+}
+
+func TestGoMod(t *testing.T) {
+	pkg := gox.NewPackage("example.com/app", "main", &gox.Config{Fset: gblFset, Importer: gblImp})
+	fmt := pkg.Import("fmt")
+	foo := pkg.Import("github.com/goplus/gox/internal/foo")
+	pkg.Import("golang.org/x/tools/go/ast/astutil") // not used
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(fmt.Ref("Println")).Val(foo.Ref("CallBar")).Call(1).EndStmt().
+		End()
+	opts := &gox.GoModOpts{Versions: map[string]string{
+		"github.com/goplus":     "v0.1.0",
+		"github.com/goplus/gox": "v1.12.8",
+		"golang.org/x/tools":    "v0.16.1",
+	}}
+	b, err := pkg.GoMod(opts)
+	if err != nil || string(b) != `module example.com/app
+
+go 1.18
+
+require github.com/goplus/gox v1.12.8
+` {
+		t.Fatal("pkg.GoMod:", string(b), err)
+	}
+	pkg.NewFunc(nil, "init", nil, nil, false).BodyStart(pkg).
+		Val(ctxRef(pkg, "println")).Val(pkg.Import("golang.org/x/tools/go/ast/astutil").Ref("Apply")).Call(1).EndStmt().
+		End()
+	opts.Module, opts.GoVersion = "example.com", "1.21"
+	b, err = pkg.GoMod(opts)
+	if err != nil || string(b) != `module example.com
+
+go 1.21
+
+require (
+	github.com/goplus/gox v1.12.8
+	golang.org/x/tools v0.16.1
+)
+` {
+		t.Fatal("pkg.GoMod:", string(b), err)
+	}
+	if _, err = pkg.GoMod(nil); err == nil || err.Error() != "go.mod: no module found for package github.com/goplus/gox/internal/foo" {
+		t.Fatal("pkg.GoMod:", err)
+	}
+	if _, err = newMainPackage().GoMod(nil); err == nil {
+		t.Fatal("pkg.GoMod: no error?")
+	}
+	dir := t.TempDir()
+	if err = pkg.WriteModule(dir, opts); err != nil {
+		t.Fatal("pkg.WriteModule:", err)
+	}
+	if b, err = os.ReadFile(filepath.Join(dir, "go.mod")); err != nil || !strings.HasPrefix(string(b), "module example.com\n") {
+		t.Fatal("pkg.WriteModule:", string(b), err)
+	}
+	if b, err = os.ReadFile(filepath.Join(dir, gox.AutoGenFile)); err != nil || !strings.Contains(string(b), "func init() {") {
+		t.Fatal("pkg.WriteModule:", string(b), err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	sess := gox.NewSession(gblFset, gblImp)
+	foo := sess.NewPackage("example.com/foo", "foo", nil)
+	foo.NewFunc(nil, "Bar", nil, nil, false).BodyStart(foo).End()
+	pkg := sess.NewPackage("", "main", nil)
+	if pkg.Fset != gblFset {
+		t.Fatal("pkg.Fset isn't shared")
+	}
+	if p, ok := sess.Package("example.com/foo"); !ok || p != foo {
+		t.Fatal("sess.Package failed:", p, ok)
+	}
+	fmt := pkg.Import("fmt")
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(pkg.Import("example.com/foo").Ref("Bar")).Call(0).EndStmt().
+		Val(fmt.Ref("Println")).Call(0).EndStmt().
+		End()
+	domTest(t, pkg, `package main
+
+import (
+	"fmt"
+	"example.com/foo"
+)
+
+func main() {
+	foo.Bar()
+	fmt.Println()
+}
+`)
+	if p, err := sess.Import("fmt"); err != nil || p != fmt.Types {
+		t.Fatal("sess.Import failed:", p, err)
+	}
+}
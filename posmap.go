@@ -0,0 +1,252 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/goplus/gox/internal"
+)
+
+// ----------------------------------------------------------------------------
+
+// recordSrc records the src node of an expression pushed into the stack. A
+// node shared by expressions of different src nodes (like `nil` and `true`)
+// has no src, as it's ambiguous.
+func (p *Package) recordSrc(e *internal.Elem) {
+	if e.Val == nil || e.Src == nil {
+		return
+	}
+	if old, ok := p.srcs[e.Val]; !ok {
+		p.srcs[e.Val] = e.Src
+	} else if old != e.Src {
+		p.srcs[e.Val] = nil
+	}
+}
+
+// withLineDirective returns `comments` of the statement `stmt` followed by a
+// line directive of it, or `comments` if the position of `stmt` is unknown.
+func (p *Package) withLineDirective(comments *ast.CommentGroup, stmt ast.Stmt) *ast.CommentGroup {
+	pos := p.stmtSrcPos(stmt)
+	if !pos.IsValid() {
+		return comments
+	}
+	// A //line directive must start at the beginning of a line. Only the line
+	// is specified, as columns of the written code depend on its indentation.
+	at := p.Fset.Position(pos)
+	text := fmt.Sprintf("//line %s:%d", at.Filename, at.Line)
+	ret := &ast.CommentGroup{}
+	if comments != nil {
+		ret.List = append(ret.List, comments.List...)
+	}
+	if n := len(ret.List); n == 0 || !strings.HasPrefix(strings.TrimLeft(ret.List[n-1].Text, "\n"), "//") {
+		text = "\n" + text
+	}
+	ret.List = append(ret.List, &ast.Comment{Text: text})
+	return ret
+}
+
+// stmtSrcPos returns position of the first src node of `stmt` in preorder.
+func (p *Package) stmtSrcPos(stmt ast.Stmt) (pos token.Pos) {
+	ast.Inspect(stmt, func(n ast.Node) bool {
+		if pos.IsValid() {
+			return false
+		}
+		if e, ok := n.(ast.Expr); ok {
+			if src := p.srcs[e]; src != nil {
+				pos = src.Pos()
+				return false
+			}
+		}
+		return true
+	})
+	return
+}
+
+// PosMap maps positions of written code to src nodes passed to instructions
+// (whose positions are of the source code of the frontend), and vice versa.
+// It helps tools such as language servers to go across the boundary of code
+// generation.
+type PosMap struct {
+	file  *token.File
+	fset  *token.FileSet // of src nodes
+	nodes []mappedNode
+}
+
+type mappedNode struct {
+	pos, end token.Pos // of the written code
+	src      ast.Node
+}
+
+// ErrNoSrcPos is returned by WriteToWithPosMap if Config.RecordSrcPos isn't set.
+var ErrNoSrcPos = errors.New("src nodes aren't recorded (see Config.RecordSrcPos)")
+
+// WriteToWithPosMap writes a file named fname to dst like WriteTo, and returns
+// the PosMap of the written code. Config.RecordSrcPos is required.
+func (p *Package) WriteToWithPosMap(dst io.Writer, fname ...string) (*PosMap, error) {
+	if p.srcs == nil {
+		return nil, ErrNoSrcPos
+	}
+	file := p.CommentedASTFile(fname...)
+	if file == nil {
+		return nil, syscall.ENOENT
+	}
+	var buf bytes.Buffer
+	if err := p.writeTo(&buf, file, fname...); err != nil {
+		return nil, err
+	}
+	code := buf.Bytes()
+	if _, err := dst.Write(code); err != nil {
+		return nil, err
+	}
+
+	// The written code is parsed again to get positions of its nodes, which
+	// are paired with nodes of the generated AST in the order of traversal.
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, p.fileName(fname...), code, 0)
+	if err != nil {
+		return nil, err
+	}
+	gen, written := preorder(file.Node.(ast.Node)), preorder(f)
+	ret := &PosMap{file: fset.File(f.Pos()), fset: p.Fset}
+	for i, j := 0, 0; i < len(gen) && j < len(written); {
+		if x, y := gen[i], written[j]; sameNodeType(x, y) {
+			if src := p.srcs[x]; src != nil {
+				ret.nodes = append(ret.nodes, mappedNode{y.Pos(), y.End(), src})
+			}
+			i++
+			j++
+		} else if _, ok := x.(*ast.ParenExpr); ok { // parens stripped by the printer
+			i++
+		} else if l, ok := x.(*ast.FieldList); ok && len(l.List) == 0 { // empty results
+			i++
+		} else if _, ok := y.(*ast.ParenExpr); ok { // parens added by the printer
+			j++
+		} else { // can't pair nodes any more
+			break
+		}
+	}
+	return ret, nil
+}
+
+// SourceMap returns mappings from positions of the written code of a file
+// named fname to positions of src nodes, in order of the written code. It's
+// the same as WriteToWithPosMap followed by PosMap.Mappings, except that the
+// code is discarded. If fname is not provided, it maps the default (NOT
+// current) file.
+func (p *Package) SourceMap(fname ...string) ([]Mapping, error) {
+	m, err := p.WriteToWithPosMap(io.Discard, fname...)
+	if err != nil {
+		return nil, err
+	}
+	return m.Mappings(), nil
+}
+
+func preorder(node ast.Node) (nodes []ast.Node) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n.(type) {
+		case nil:
+		case *ast.CommentGroup, *ast.Comment:
+			return false
+		default:
+			nodes = append(nodes, n)
+		}
+		return true
+	})
+	return
+}
+
+func sameNodeType(x, y ast.Node) bool {
+	switch x := x.(type) {
+	case *ast.Ident:
+		y, ok := y.(*ast.Ident)
+		return ok && x.Name == y.Name
+	case *ast.BasicLit:
+		y, ok := y.(*ast.BasicLit)
+		return ok && x.Kind == y.Kind
+	}
+	return reflect.TypeOf(x) == reflect.TypeOf(y)
+}
+
+// A Mapping maps a range of the written code to its src node.
+type Mapping struct {
+	Pos, End       token.Position // range of the written code (//line directives are ignored)
+	SrcPos, SrcEnd token.Position // range of the src node (resolved by Config.Fset)
+}
+
+// Mappings returns all mappings of the written code in order of the written
+// code (outer expressions come before inner ones starting at the same
+// position).
+func (p *PosMap) Mappings() []Mapping {
+	ret := make([]Mapping, len(p.nodes))
+	for i, n := range p.nodes {
+		ret[i] = Mapping{
+			Pos:    p.file.PositionFor(n.pos, false),
+			End:    p.file.PositionFor(n.end, false),
+			SrcPos: p.fset.Position(n.src.Pos()),
+			SrcEnd: p.fset.Position(n.src.End()),
+		}
+	}
+	return ret
+}
+
+// Src returns the src node of the innermost expression containing the offset
+// of the written code, or nil if not found.
+func (p *PosMap) Src(offset int) ast.Node {
+	if offset < 0 || offset > p.file.Size() {
+		return nil
+	}
+	pos := p.file.Pos(offset)
+	var ret *mappedNode
+	for i := range p.nodes {
+		if n := &p.nodes[i]; n.pos <= pos && pos < n.end {
+			if ret == nil || n.end-n.pos < ret.end-ret.pos {
+				ret = n
+			}
+		}
+	}
+	if ret == nil {
+		return nil
+	}
+	return ret.src
+}
+
+// Offset returns the range [start, end) of the written code generated from
+// the innermost src node containing pos (a position of the source code of
+// the frontend).
+func (p *PosMap) Offset(pos token.Pos) (start, end int, ok bool) {
+	var ret *mappedNode
+	for i := range p.nodes {
+		if n := &p.nodes[i]; n.src.Pos() <= pos && pos < n.src.End() {
+			if ret == nil || n.src.End()-n.src.Pos() < ret.src.End()-ret.src.Pos() {
+				ret = n
+			}
+		}
+	}
+	if ret == nil {
+		return
+	}
+	return p.file.Offset(ret.pos), p.file.Offset(ret.end), true
+}
+
+// ----------------------------------------------------------------------------
@@ -0,0 +1,708 @@
+/*
+ Copyright 2021 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+
+// QuoteArgs binds placeholders of a quoted code fragment. A placeholder `$x`
+// is bound to QuoteArgs["x"], which can be:
+//   - types.Type: $x is a type.
+//   - *Element: $x is the element.
+//   - *PkgRef: $x is a package, e.g. `$x.Println`.
+//   - others: $x is cb.Val(QuoteArgs["x"]).
+type QuoteArgs = map[string]interface{}
+
+const quotePrefix = "_quoteGo_"
+
+// QuoteExpr parses a Go expression containing placeholders (eg. `$x + len($y)`),
+// type-checks it in the current scope and pushes the result.
+func (p *CodeBuilder) QuoteExpr(code string, args QuoteArgs, src ...ast.Node) *CodeBuilder {
+	if debugInstr {
+		log.Println("QuoteExpr", code)
+	}
+	q := &quoter{cb: p, args: args, src: src}
+	expr, err := parser.ParseExpr(q.preprocess(code))
+	if err != nil {
+		p.panicCodeErrorf(getPos(src), "%v", err)
+	}
+	q.expr(expr, nil)
+	return p
+}
+
+// ValFromSource parses a Go expression (eg. `a + f(b)[2]`), type-checks it
+// against the current scope and imports, and pushes the result.
+func (p *CodeBuilder) ValFromSource(expr string, src ...ast.Node) *CodeBuilder {
+	return p.QuoteExpr(expr, nil, src...)
+}
+
+// QuoteStmts parses a Go statement list containing placeholders (eg. `if $x != nil { return $x }`),
+// type-checks it in the current scope and emits it.
+func (p *CodeBuilder) QuoteStmts(code string, args QuoteArgs, src ...ast.Node) *CodeBuilder {
+	if debugInstr {
+		log.Println("QuoteStmts", code)
+	}
+	q := &quoter{cb: p, args: args, src: src}
+	f, err := parser.ParseFile(token.NewFileSet(), "", "package p; func _() {"+q.preprocess(code)+"\n}", 0)
+	if err != nil {
+		p.panicCodeErrorf(getPos(src), "%v", err)
+	}
+	q.stmts(f.Decls[0].(*ast.FuncDecl).Body.List)
+	return p
+}
+
+type quoter struct {
+	cb   *CodeBuilder
+	args QuoteArgs
+	src  []ast.Node
+}
+
+// preprocess replaces placeholders `$x` with valid identifiers.
+func (p *quoter) preprocess(code string) string {
+	var s scanner.Scanner
+	var b strings.Builder
+	fset := token.NewFileSet()
+	file := fset.AddFile("", -1, len(code))
+	s.Init(file, []byte(code), nil, 0)
+	last := 0
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.ILLEGAL && lit == "$" {
+			off := file.Offset(pos)
+			b.WriteString(code[last:off])
+			b.WriteString(quotePrefix)
+			last = off + 1
+		}
+	}
+	b.WriteString(code[last:])
+	return b.String()
+}
+
+func (p *quoter) panicf(format string, args ...interface{}) {
+	p.cb.panicCodeErrorf(getPos(p.src), format, args...)
+}
+
+func (p *quoter) arg(name string) (arg interface{}, ok bool) {
+	if strings.HasPrefix(name, quotePrefix) {
+		name = name[len(quotePrefix):]
+		if arg, ok = p.args[name]; !ok {
+			p.panicf("placeholder $%s is not bound", name)
+		}
+	}
+	return
+}
+
+func (p *quoter) lookup(name string) types.Object {
+	if _, o := p.cb.Scope().LookupParent(name, token.NoPos); o != nil {
+		return o
+	}
+	p.panicf("undefined: %s", name)
+	return nil
+}
+
+// lookupPkg returns the package named `x` if it isn't shadowed by other objects.
+func (p *quoter) lookupPkg(x ast.Expr) *PkgRef {
+	v, ok := x.(*ast.Ident)
+	if !ok {
+		return nil
+	}
+	if arg, ok := p.arg(v.Name); ok {
+		pkg, _ := arg.(*PkgRef)
+		return pkg
+	}
+	if _, o := p.cb.Scope().LookupParent(v.Name, token.NoPos); o != nil {
+		return nil
+	}
+	f := p.cb.pkg.file
+	for _, pkgPath := range f.allPkgPaths {
+		if pkg := f.importPkgs[pkgPath]; pkg.Types.Name() == v.Name {
+			return pkg
+		}
+	}
+	return nil
+}
+
+func (p *quoter) pkgRef(pkg *PkgRef, name string) types.Object {
+	if o := pkg.TryRef(name); o != nil {
+		return o
+	}
+	p.panicf("undefined: %s.%s", pkg.Types.Name(), name)
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+
+func (p *quoter) exprs(exprs []ast.Expr) {
+	for _, e := range exprs {
+		p.expr(e, nil)
+	}
+}
+
+// expr pushes an expression. If expected isn't nil, it is the type of an
+// elided composite literal.
+func (p *quoter) expr(expr ast.Expr, expected types.Type) {
+	cb, src := p.cb, p.src
+	switch v := expr.(type) {
+	case *ast.Ident:
+		if arg, ok := p.arg(v.Name); ok {
+			switch a := arg.(type) {
+			case types.Type:
+				cb.Typ(a, src...)
+			case *Element:
+				cb.stk.Push(a)
+			default:
+				cb.Val(a, src...)
+			}
+			return
+		}
+		cb.Val(p.lookup(v.Name), src...)
+	case *ast.BasicLit:
+		cb.Val(&ast.BasicLit{Kind: v.Kind, Value: v.Value}, src...)
+	case *ast.ParenExpr:
+		p.expr(v.X, nil)
+	case *ast.SelectorExpr:
+		if pkg := p.lookupPkg(v.X); pkg != nil {
+			cb.Val(p.pkgRef(pkg, v.Sel.Name), src...)
+			return
+		}
+		p.expr(v.X, nil)
+		cb.MemberVal(v.Sel.Name, src...)
+	case *ast.StarExpr:
+		p.expr(v.X, nil)
+		cb.Star(src...)
+	case *ast.UnaryExpr:
+		p.expr(v.X, nil)
+		cb.UnaryOp(v.Op, false, getSrc(src))
+	case *ast.BinaryExpr:
+		p.expr(v.X, nil)
+		p.expr(v.Y, nil)
+		cb.BinaryOp(v.Op, src...)
+	case *ast.CallExpr:
+		p.expr(v.Fun, nil)
+		p.exprs(v.Args)
+		var flags InstrFlags
+		if v.Ellipsis != token.NoPos {
+			flags = InstrFlagEllipsis
+		}
+		cb.CallWith(len(v.Args), flags, src...)
+	case *ast.IndexExpr:
+		p.expr(v.X, nil)
+		p.expr(v.Index, nil)
+		cb.Index(1, false, src...)
+	case *ast.SliceExpr:
+		p.expr(v.X, nil)
+		p.optExpr(v.Low)
+		p.optExpr(v.High)
+		if v.Slice3 {
+			p.expr(v.Max, nil)
+		}
+		cb.Slice(v.Slice3, src...)
+	case *ast.TypeAssertExpr:
+		if v.Type == nil {
+			p.panicf("use of .(type) outside type switch")
+		}
+		p.expr(v.X, nil)
+		cb.TypeAssert(p.typ(v.Type), false, src...)
+	case *ast.CompositeLit:
+		p.compositeLit(v, expected)
+	case *ast.ArrayType, *ast.MapType, *ast.ChanType, *ast.FuncType, *ast.StructType, *ast.InterfaceType:
+		cb.Typ(p.typ(v), src...)
+	default:
+		p.panicf("unsupported expression in quoted code: %T", expr)
+	}
+}
+
+func (p *quoter) optExpr(expr ast.Expr) {
+	if expr == nil {
+		p.cb.None()
+	} else {
+		p.expr(expr, nil)
+	}
+}
+
+func (p *quoter) compositeLit(v *ast.CompositeLit, expected types.Type) {
+	cb, src := p.cb, p.src
+	var typ types.Type
+	var isPtr bool
+	if v.Type != nil {
+		typ = p.typ(v.Type)
+	} else if expected != nil {
+		typ = expected
+		if t, ok := typ.(*types.Pointer); ok { // []*T{{...}} means []*T{&T{...}}
+			typ, isPtr = t.Elem(), true
+		}
+	} else {
+		p.panicf("missing type in composite literal")
+	}
+	t := typ
+	if named, ok := t.(*types.Named); ok {
+		t = cb.getUnderlying(named)
+	}
+	n := len(v.Elts)
+	keyVal := n > 0
+	if keyVal {
+		_, keyVal = v.Elts[0].(*ast.KeyValueExpr)
+	}
+	switch tt := t.(type) {
+	case *types.Struct:
+		if keyVal {
+			for _, elt := range v.Elts {
+				kv := elt.(*ast.KeyValueExpr)
+				name, _ := kv.Key.(*ast.Ident)
+				idx := -1
+				for i, nf := 0, tt.NumFields(); name != nil && i < nf; i++ {
+					if tt.Field(i).Name() == name.Name {
+						idx = i
+						break
+					}
+				}
+				if idx < 0 {
+					p.panicf("unknown field %v in struct literal", types.ExprString(kv.Key))
+				}
+				cb.Val(idx)
+				p.expr(kv.Value, tt.Field(idx).Type())
+			}
+			n <<= 1
+		} else {
+			for i, elt := range v.Elts {
+				var ft types.Type
+				if i < tt.NumFields() {
+					ft = tt.Field(i).Type()
+				}
+				p.expr(elt, ft)
+			}
+		}
+		cb.StructLit(typ, n, keyVal, src...)
+	case *types.Map:
+		for _, elt := range v.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				p.panicf("missing key in map literal")
+			}
+			p.expr(kv.Key, tt.Key())
+			p.expr(kv.Value, tt.Elem())
+		}
+		cb.MapLit(typ, n<<1, src...)
+	case *types.Slice:
+		p.elts(v.Elts, keyVal, tt.Elem())
+		if keyVal {
+			n <<= 1
+		}
+		cb.SliceLitEx(typ, n, keyVal, src...)
+	case *types.Array:
+		p.elts(v.Elts, keyVal, tt.Elem())
+		if keyVal {
+			n <<= 1
+		}
+		cb.ArrayLitEx(typ, n, keyVal, src...)
+	default:
+		p.panicf("invalid composite literal type %v", typ)
+	}
+	if isPtr {
+		cb.UnaryOp(token.AND, false, getSrc(src))
+	}
+}
+
+func (p *quoter) elts(elts []ast.Expr, keyVal bool, elem types.Type) {
+	for _, elt := range elts {
+		if keyVal {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				p.panicf("mixture of field:value and value elements in literal")
+			}
+			p.expr(kv.Key, nil)
+			p.expr(kv.Value, elem)
+		} else {
+			p.expr(elt, elem)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+func (p *quoter) typ(expr ast.Expr) types.Type {
+	switch v := expr.(type) {
+	case *ast.Ident:
+		if arg, ok := p.arg(v.Name); ok {
+			if t, ok := arg.(types.Type); ok {
+				return t
+			}
+			p.panicf("placeholder $%s is not a type", v.Name[len(quotePrefix):])
+		}
+		if o, ok := p.lookup(v.Name).(*types.TypeName); ok {
+			return o.Type()
+		}
+	case *ast.SelectorExpr:
+		if pkg := p.lookupPkg(v.X); pkg != nil {
+			if o, ok := p.pkgRef(pkg, v.Sel.Name).(*types.TypeName); ok {
+				return o.Type()
+			}
+		}
+	case *ast.ParenExpr:
+		return p.typ(v.X)
+	case *ast.StarExpr:
+		return types.NewPointer(p.typ(v.X))
+	case *ast.ArrayType:
+		elem := p.typ(v.Elt)
+		if v.Len == nil {
+			return types.NewSlice(elem)
+		}
+		if _, ok := v.Len.(*ast.Ellipsis); ok {
+			return types.NewArray(elem, -1)
+		}
+		p.expr(v.Len, nil)
+		n := p.cb.stk.Pop()
+		if n.CVal == nil || n.CVal.Kind() != constant.Int {
+			p.panicf("array length %v must be constant", types.ExprString(v.Len))
+		}
+		size, _ := constant.Int64Val(n.CVal)
+		return types.NewArray(elem, size)
+	case *ast.MapType:
+		return types.NewMap(p.typ(v.Key), p.typ(v.Value))
+	case *ast.ChanType:
+		dir := types.SendRecv
+		switch v.Dir {
+		case ast.SEND:
+			dir = types.SendOnly
+		case ast.RECV:
+			dir = types.RecvOnly
+		}
+		return types.NewChan(dir, p.typ(v.Value))
+	case *ast.FuncType:
+		params, variadic := p.fields(v.Params)
+		results, _ := p.fields(v.Results)
+		return types.NewSignatureType(nil, nil, nil, params, results, variadic)
+	case *ast.StructType:
+		pkg := p.cb.pkg.Types
+		var fields []*types.Var
+		var tags []string
+		for _, fld := range v.Fields.List {
+			typ := p.typ(fld.Type)
+			var tag string
+			if fld.Tag != nil {
+				tag, _ = strconv.Unquote(fld.Tag.Value)
+			}
+			if fld.Names == nil {
+				fields = append(fields, types.NewField(token.NoPos, pkg, embeddedName(typ), typ, true))
+				tags = append(tags, tag)
+			}
+			for _, name := range fld.Names {
+				fields = append(fields, types.NewField(token.NoPos, pkg, name.Name, typ, false))
+				tags = append(tags, tag)
+			}
+		}
+		return types.NewStruct(fields, tags)
+	case *ast.InterfaceType:
+		pkg := p.cb.pkg.Types
+		var methods []*types.Func
+		var embeddeds []types.Type
+		for _, fld := range v.Methods.List {
+			typ := p.typ(fld.Type)
+			if fld.Names == nil {
+				embeddeds = append(embeddeds, typ)
+				continue
+			}
+			for _, name := range fld.Names {
+				methods = append(methods, types.NewFunc(token.NoPos, pkg, name.Name, typ.(*types.Signature)))
+			}
+		}
+		return types.NewInterfaceType(methods, embeddeds).Complete()
+	default:
+		p.panicf("unsupported type in quoted code: %T", expr)
+	}
+	p.panicf("%v is not a type", types.ExprString(expr))
+	return nil
+}
+
+func embeddedName(typ types.Type) string {
+	if t, ok := typ.(*types.Pointer); ok {
+		typ = t.Elem()
+	}
+	if t, ok := typ.(*types.Named); ok {
+		return t.Obj().Name()
+	}
+	return types.TypeString(typ, nil)
+}
+
+func (p *quoter) fields(list *ast.FieldList) (*types.Tuple, bool) {
+	if list == nil {
+		return nil, false
+	}
+	pkg := p.cb.pkg
+	var vars []*types.Var
+	var variadic bool
+	for _, fld := range list.List {
+		typExpr := fld.Type
+		if t, ok := typExpr.(*ast.Ellipsis); ok {
+			typExpr, variadic = &ast.ArrayType{Elt: t.Elt}, true
+		}
+		typ := p.typ(typExpr)
+		if fld.Names == nil {
+			vars = append(vars, pkg.NewParam(token.NoPos, "", typ))
+		}
+		for _, name := range fld.Names {
+			vars = append(vars, pkg.NewParam(token.NoPos, name.Name, typ))
+		}
+	}
+	return types.NewTuple(vars...), variadic
+}
+
+// ----------------------------------------------------------------------------
+
+func (p *quoter) stmts(stmts []ast.Stmt) {
+	for _, stmt := range stmts {
+		p.stmt(stmt)
+	}
+}
+
+func (p *quoter) stmt(stmt ast.Stmt) {
+	cb, src := p.cb, p.src
+	switch v := stmt.(type) {
+	case *ast.ExprStmt:
+		p.expr(v.X, nil)
+		cb.EndStmt()
+	case *ast.AssignStmt:
+		p.assignStmt(v)
+	case *ast.IncDecStmt:
+		p.ref(v.X)
+		cb.IncDec(v.Tok, src...)
+	case *ast.DeclStmt:
+		p.declStmt(v)
+	case *ast.ReturnStmt:
+		p.exprs(v.Results)
+		cb.Return(len(v.Results), src...)
+	case *ast.BlockStmt:
+		cb.Block(src...)
+		p.stmts(v.List)
+		cb.End()
+	case *ast.IfStmt:
+		p.ifStmt(v)
+	case *ast.ForStmt:
+		cb.For(src...)
+		if v.Init != nil {
+			p.stmt(v.Init)
+		}
+		p.optExpr(v.Cond)
+		cb.Then(src...)
+		p.stmts(v.Body.List)
+		if v.Post != nil {
+			cb.Post()
+			p.stmt(v.Post)
+		}
+		cb.End()
+	case *ast.RangeStmt:
+		p.rangeStmt(v)
+	case *ast.SwitchStmt:
+		cb.Switch(src...)
+		if v.Init != nil {
+			p.stmt(v.Init)
+		}
+		p.optExpr(v.Tag)
+		cb.Then(src...)
+		for _, c := range v.Body.List {
+			clause := c.(*ast.CaseClause)
+			p.exprs(clause.List)
+			cb.Case(len(clause.List), src...)
+			p.stmts(clause.Body)
+			cb.End()
+		}
+		cb.End()
+	case *ast.BranchStmt:
+		var l *Label
+		if v.Label != nil {
+			var ok bool
+			if l, ok = cb.LookupLabel(v.Label.Name); !ok {
+				p.panicf("label %s not defined", v.Label.Name)
+			}
+		}
+		switch v.Tok {
+		case token.BREAK:
+			cb.Break(l)
+		case token.CONTINUE:
+			cb.Continue(l)
+		case token.GOTO:
+			cb.Goto(l)
+		case token.FALLTHROUGH:
+			cb.Fallthrough(src...)
+		}
+	case *ast.LabeledStmt:
+		l, ok := cb.LookupLabel(v.Label.Name)
+		if !ok {
+			l = cb.NewLabel(getPos(src), v.Label.Name)
+		}
+		cb.Label(l)
+		p.stmt(v.Stmt)
+	case *ast.DeferStmt:
+		p.expr(v.Call, nil)
+		cb.Defer()
+	case *ast.GoStmt:
+		p.expr(v.Call, nil)
+		cb.Go()
+	case *ast.SendStmt:
+		p.expr(v.Chan, nil)
+		p.expr(v.Value, nil)
+		cb.Send()
+	case *ast.EmptyStmt:
+	default:
+		p.panicf("unsupported statement in quoted code: %T", stmt)
+	}
+}
+
+// ref pushes an expression as the left hand side of an assignment.
+func (p *quoter) ref(expr ast.Expr) {
+	cb, src := p.cb, p.src
+	switch v := expr.(type) {
+	case *ast.Ident:
+		if v.Name == "_" {
+			cb.VarRef(nil, src...)
+		} else if arg, ok := p.arg(v.Name); ok {
+			cb.VarRef(arg, src...)
+		} else {
+			cb.VarRef(p.lookup(v.Name), src...)
+		}
+	case *ast.ParenExpr:
+		p.ref(v.X)
+	case *ast.SelectorExpr:
+		if pkg := p.lookupPkg(v.X); pkg != nil {
+			cb.VarRef(p.pkgRef(pkg, v.Sel.Name), src...)
+			return
+		}
+		p.expr(v.X, nil)
+		cb.MemberRef(v.Sel.Name, src...)
+	case *ast.IndexExpr:
+		p.expr(v.X, nil)
+		p.expr(v.Index, nil)
+		cb.IndexRef(1, src...)
+	case *ast.StarExpr:
+		p.expr(v.X, nil)
+		cb.ElemRef(src...)
+	default:
+		p.panicf("cannot assign to %v", types.ExprString(expr))
+	}
+}
+
+func (p *quoter) assignStmt(v *ast.AssignStmt) {
+	cb, src := p.cb, p.src
+	switch v.Tok {
+	case token.DEFINE:
+		names := make([]string, len(v.Lhs))
+		for i, lhs := range v.Lhs {
+			name, ok := lhs.(*ast.Ident)
+			if !ok {
+				p.panicf("non-name %v on left side of :=", types.ExprString(lhs))
+			}
+			names[i] = name.Name
+		}
+		cb.DefineVarStart(getPos(src), names...)
+		p.exprs(v.Rhs)
+		cb.EndInit(len(v.Rhs))
+	case token.ASSIGN:
+		for _, lhs := range v.Lhs {
+			p.ref(lhs)
+		}
+		p.exprs(v.Rhs)
+		cb.AssignWith(len(v.Lhs), len(v.Rhs), src...)
+	default:
+		p.ref(v.Lhs[0])
+		p.expr(v.Rhs[0], nil)
+		cb.AssignOp(v.Tok, src...)
+	}
+}
+
+func (p *quoter) declStmt(v *ast.DeclStmt) {
+	cb := p.cb
+	decl := v.Decl.(*ast.GenDecl)
+	if decl.Tok != token.VAR {
+		p.panicf("unsupported declaration in quoted code: %v", decl.Tok)
+	}
+	for _, spec := range decl.Specs {
+		vs := spec.(*ast.ValueSpec)
+		names := make([]string, len(vs.Names))
+		for i, name := range vs.Names {
+			names[i] = name.Name
+		}
+		var typ types.Type
+		if vs.Type != nil {
+			typ = p.typ(vs.Type)
+		}
+		if vs.Values == nil {
+			cb.NewVar(typ, names...)
+			continue
+		}
+		cb.NewVarStart(typ, names...)
+		p.exprs(vs.Values)
+		cb.EndInit(len(vs.Values))
+	}
+}
+
+func (p *quoter) ifStmt(v *ast.IfStmt) {
+	cb, src := p.cb, p.src
+	cb.If(src...)
+	if v.Init != nil {
+		p.stmt(v.Init)
+	}
+	p.expr(v.Cond, nil)
+	cb.Then(src...)
+	p.stmts(v.Body.List)
+	if v.Else != nil {
+		cb.Else(src...)
+		if e, ok := v.Else.(*ast.BlockStmt); ok {
+			p.stmts(e.List)
+		} else {
+			p.stmt(v.Else)
+		}
+	}
+	cb.End()
+}
+
+func (p *quoter) rangeStmt(v *ast.RangeStmt) {
+	cb, src := p.cb, p.src
+	if v.Tok == token.DEFINE {
+		names := make([]string, 0, 2)
+		for _, e := range []ast.Expr{v.Key, v.Value} {
+			if e != nil {
+				names = append(names, e.(*ast.Ident).Name)
+			}
+		}
+		cb.ForRangeEx(names, src...)
+	} else {
+		cb.ForRangeEx(nil, src...)
+		if v.Key != nil {
+			p.ref(v.Key)
+			if v.Value != nil {
+				p.ref(v.Value)
+			}
+		}
+	}
+	p.expr(v.X, nil)
+	cb.RangeAssignThen(getPos(src))
+	p.stmts(v.Body.List)
+	cb.End()
+}
+
+// ----------------------------------------------------------------------------
@@ -0,0 +1,286 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"log"
+)
+
+// ----------------------------------------------------------------------------
+
+// ParamChange describes a parameter of the new signature of a function.
+type ParamChange struct {
+	// Param is the new parameter.
+	Param *Param
+
+	// From is index of the old parameter whose arguments are passed to Param
+	// at existing call sites. -1 means Param is a new parameter.
+	From int
+
+	// Default is the argument passed to a new parameter at existing call sites.
+	Default ast.Expr
+}
+
+// ChangeParams changes parameters of the function `p` (which can be called
+// before BodyStart or after End), and rewrites its call sites emitted in all
+// files of the package. Parameters can be added, removed and reordered:
+//
+//	// func f(a int, b string) => func f(b string, c bool, a int)
+//	fn.ChangeParams(pkg,
+//		gox.ParamChange{Param: b, From: 1},
+//		gox.ParamChange{Param: c, From: -1, Default: ast.NewIdent("false")},
+//		gox.ParamChange{Param: a, From: 0})
+//
+// Call sites are references of `p` recorded when they are emitted, so `p`
+// must be a function (not a method). Variadic functions, calls like `f(g())`
+// where g returns multiple values, and references to `p` other than calls
+// aren't supported, and calls in open blocks are only found in the innermost
+// one of each open function: an error is returned for any of them before
+// anything is changed. The function body isn't rewritten, so it shouldn't use
+// removed parameters.
+func (p *Func) ChangeParams(pkg *Package, changes ...ParamChange) error {
+	if debugInstr {
+		log.Println("ChangeParams", p.Name(), len(changes))
+	}
+	return p.changeParams(pkg, changes, func(site callSite, c ParamChange) ast.Expr {
+		return c.Default
+	})
+}
+
+// callSite represents a call expression and the function declaration it's in.
+type callSite struct {
+	call *ast.CallExpr
+	in   *ast.FuncDecl
+}
+
+// findCalls finds calls of the package-level function `fn` by its
+// references, in ended functions and in the innermost open block of each open
+// function. Calls in other open blocks aren't found.
+func (p *Package) findCalls(fn *types.Func) []callSite {
+	refs := make(map[*ast.Ident]bool)
+	for _, x := range p.funcRefs[fn] {
+		refs[x] = true
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	var sites []callSite
+	find := func(node ast.Node, in *ast.FuncDecl) {
+		ast.Inspect(node, func(node ast.Node) bool {
+			if call, ok := node.(*ast.CallExpr); ok {
+				if id, ok := call.Fun.(*ast.Ident); ok && refs[id] {
+					sites = append(sites, callSite{call, in})
+				}
+			}
+			return true
+		})
+	}
+	for _, f := range p.files {
+		for _, decl := range f.decls {
+			in, _ := decl.(*ast.FuncDecl)
+			if in != nil && in.Type == nil { // function body hasn't ended
+				continue
+			}
+			find(decl, in)
+		}
+	}
+	var opens []*funcBodyCtx
+	for ctx := &p.cb.current; ctx.fn != nil; ctx = &ctx.fn.old {
+		opens = append(opens, ctx)
+	}
+	var in *ast.FuncDecl
+	for i := len(opens) - 1; i >= 0; i-- {
+		ctx := opens[i]
+		if ctx.fn.decl != nil {
+			in = ctx.fn.decl
+		}
+		for _, stmt := range ctx.stmts {
+			find(stmt, in)
+		}
+	}
+	return sites
+}
+
+func (p *Func) changeParams(
+	pkg *Package, changes []ParamChange, argOf func(site callSite, c ParamChange) ast.Expr) error {
+	sig := p.Type().(*types.Signature)
+	if IsMethodRecv(sig.Recv()) {
+		return fmt.Errorf("ChangeParams: %s is a method", p.Name())
+	}
+	if sig.Variadic() {
+		return fmt.Errorf("ChangeParams: %s is variadic", p.Name())
+	}
+	if sig.TypeParams() != nil {
+		return fmt.Errorf("ChangeParams: %s is generic", p.Name())
+	}
+	n := sig.Params().Len()
+	params := make([]*types.Var, len(changes))
+	used := make([]bool, n)
+	for i, c := range changes {
+		if c.From >= n || (c.From < 0 && c.Default == nil) {
+			return fmt.Errorf("ChangeParams: invalid change of parameter %s", c.Param.Name())
+		}
+		if c.From >= 0 {
+			if used[c.From] {
+				return fmt.Errorf("ChangeParams: parameter %d is passed to more than one parameter", c.From)
+			}
+			used[c.From] = true
+		}
+		params[i] = c.Param
+	}
+
+	name := p.Name()
+	sites := pkg.findCalls(p.Func)
+	if len(sites) != len(pkg.funcRefs[p.Func]) {
+		return fmt.Errorf("ChangeParams: %s is referenced other than by calls, or in blocks not ended", name)
+	}
+	for _, site := range sites {
+		if call := site.call; len(call.Args) != n || call.Ellipsis.IsValid() {
+			return fmt.Errorf("ChangeParams: can't rewrite call of %s with %d arguments", name, len(call.Args))
+		}
+	}
+	for _, site := range sites {
+		args := make([]ast.Expr, len(changes))
+		for i, c := range changes {
+			if c.From < 0 {
+				args[i] = argOf(site, c)
+			} else {
+				args[i] = site.call.Args[c.From]
+			}
+		}
+		for i, arg := range site.call.Args {
+			if !used[i] { // argument of a removed parameter
+				pkg.unrefPkgs(arg)
+			}
+		}
+		site.call.Args = args
+	}
+
+	// types.Func can't change its type, so the new signature replaces the old
+	// one in place. It's safe since the old one is only owned by p (see
+	// NewFuncWith).
+	newSig := types.NewSignatureType(nil, nil, nil, types.NewTuple(params...), sig.Results(), false)
+	*sig = *newSig
+	if p.decl != nil && p.decl.Type != nil { // function body has ended
+		pkg.unrefPkgs(p.decl.Type)
+		p.decl.Type = toFuncType(pkg, sig)
+	}
+	return nil
+}
+
+// ThreadContext adds a parameter `ctx context.Context` to the front of
+// parameters of `fns`, and rewrites their call sites: `ctx` is passed if the
+// caller is one of `fns`, otherwise `context.TODO()` is passed. It returns an
+// error if `ctx` is declared in signatures or bodies of `fns` already. See
+// Func.ChangeParams for limitations.
+func (p *Package) ThreadContext(fns ...*Func) error {
+	if debugInstr {
+		log.Println("ThreadContext", len(fns))
+	}
+	inSet := make(map[*ast.FuncDecl]bool, len(fns))
+	for _, fn := range fns {
+		if fn == nil {
+			return fmt.Errorf("ThreadContext: nil function")
+		}
+		if fn.decl == nil { // closures
+			return fmt.Errorf("ThreadContext: closures aren't supported")
+		}
+		if p.declaresCtx(fn) {
+			return fmt.Errorf("ThreadContext: ctx is declared in %s already", fn.Name())
+		}
+		inSet[fn.decl] = true
+	}
+	tyCtx := p.Import("context").Ref("Context").Type()
+	for _, fn := range fns {
+		params := fn.Type().(*types.Signature).Params()
+		n := params.Len()
+		changes := make([]ParamChange, n+1)
+		ctx := p.NewParam(token.NoPos, "ctx", tyCtx)
+		changes[0] = ParamChange{Param: ctx, From: -1, Default: ident("ctx")}
+		for i := 0; i < n; i++ {
+			changes[i+1] = ParamChange{Param: params.At(i), From: i}
+		}
+		err := fn.changeParams(p, changes, func(site callSite, c ParamChange) ast.Expr {
+			if inSet[site.in] {
+				return ident("ctx")
+			}
+			return &ast.CallExpr{Fun: toObjectExpr(p, p.Import("context").Ref("TODO"))}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// declaresCtx checks if the name `ctx` is declared in the signature of `fn`,
+// or in its body, where it would shadow the parameter added by ThreadContext.
+func (p *Package) declaresCtx(fn *Func) bool {
+	sig := fn.Type().(*types.Signature)
+	for _, vars := range []*types.Tuple{sig.Params(), sig.Results()} {
+		for i, n := 0, vars.Len(); i < n; i++ {
+			if vars.At(i).Name() == "ctx" {
+				return true
+			}
+		}
+	}
+	if fn.decl.Type == nil { // function body hasn't ended
+		for ctx := &p.cb.current; ctx.fn != nil; ctx = &ctx.fn.old {
+			if ctx.fn == fn {
+				_, o := p.cb.current.scope.LookupParent("ctx", token.NoPos)
+				return o != nil && o.Parent() != p.Types.Scope() && o.Parent() != types.Universe
+			}
+		}
+		return false
+	}
+	found := false
+	ast.Inspect(fn.decl.Body, func(node ast.Node) bool {
+		switch v := node.(type) {
+		case *ast.AssignStmt:
+			if v.Tok == token.DEFINE {
+				for _, lhs := range v.Lhs {
+					if x, ok := lhs.(*ast.Ident); ok && x.Name == "ctx" {
+						found = true
+					}
+				}
+			}
+		case *ast.RangeStmt:
+			if v.Tok == token.DEFINE {
+				for _, e := range []ast.Expr{v.Key, v.Value} {
+					if x, ok := e.(*ast.Ident); ok && x.Name == "ctx" {
+						found = true
+					}
+				}
+			}
+		case *ast.ValueSpec:
+			for _, x := range v.Names {
+				found = found || x.Name == "ctx"
+			}
+		case *ast.TypeSpec:
+			found = found || v.Name.Name == "ctx"
+		case *ast.Field:
+			for _, x := range v.Names {
+				found = found || x.Name == "ctx"
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// ----------------------------------------------------------------------------
@@ -0,0 +1,532 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"log"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goplus/gox/internal"
+)
+
+// ----------------------------------------------------------------------------
+
+var basicKinds = [...]types.BasicKind{
+	reflect.Bool:       types.Bool,
+	reflect.Int:        types.Int,
+	reflect.Int8:       types.Int8,
+	reflect.Int16:      types.Int16,
+	reflect.Int32:      types.Int32,
+	reflect.Int64:      types.Int64,
+	reflect.Uint:       types.Uint,
+	reflect.Uint8:      types.Uint8,
+	reflect.Uint16:     types.Uint16,
+	reflect.Uint32:     types.Uint32,
+	reflect.Uint64:     types.Uint64,
+	reflect.Uintptr:    types.Uintptr,
+	reflect.Float32:    types.Float32,
+	reflect.Float64:    types.Float64,
+	reflect.Complex64:  types.Complex64,
+	reflect.Complex128: types.Complex128,
+	reflect.String:     types.String,
+}
+
+var untypedKinds = [...]types.BasicKind{
+	reflect.Bool:    types.UntypedBool,
+	reflect.Int:     types.UntypedInt,
+	reflect.Int8:    types.UntypedInt,
+	reflect.Int16:   types.UntypedInt,
+	reflect.Int32:   types.UntypedInt,
+	reflect.Int64:   types.UntypedInt,
+	reflect.Uint:    types.UntypedInt,
+	reflect.Uint8:   types.UntypedInt,
+	reflect.Uint16:  types.UntypedInt,
+	reflect.Uint32:  types.UntypedInt,
+	reflect.Uint64:  types.UntypedInt,
+	reflect.Uintptr: types.UntypedInt,
+	reflect.Float32: types.UntypedFloat,
+	reflect.Float64: types.UntypedFloat,
+	reflect.String:  types.UntypedString,
+}
+
+var chanDirsOf = [...]types.ChanDir{
+	reflect.RecvDir: types.RecvOnly,
+	reflect.SendDir: types.SendOnly,
+	reflect.BothDir: types.SendRecv,
+}
+
+// TypeOf converts the runtime type `t` to a type of the package. A named
+// type is imported from its package (or looked up in the package itself if
+// they have the same path, or both are main packages), and other types are
+// built from their elements, so generators driven by reflection can
+// reference types directly:
+//
+//	pkg.TypeOf(reflect.TypeOf(User{})) // => the type `User` of package `models`
+//
+// Instances of generic types aren't supported.
+func (p *Package) TypeOf(t reflect.Type) types.Type {
+	if name := t.Name(); name != "" {
+		if pkgPath := t.PkgPath(); pkgPath != "" {
+			if strings.ContainsRune(name, '[') {
+				log.Panicln("TypeOf: instance of generic type isn't supported -", t)
+			}
+			return p.typeObjectOf(pkgPath, name).Type()
+		}
+		if o, ok := types.Universe.Lookup(name).(*types.TypeName); ok { // error, etc.
+			return o.Type()
+		}
+	}
+	switch kind := t.Kind(); kind {
+	case reflect.Ptr:
+		return types.NewPointer(p.TypeOf(t.Elem()))
+	case reflect.Slice:
+		return types.NewSlice(p.TypeOf(t.Elem()))
+	case reflect.Array:
+		return types.NewArray(p.TypeOf(t.Elem()), int64(t.Len()))
+	case reflect.Map:
+		return types.NewMap(p.TypeOf(t.Key()), p.TypeOf(t.Elem()))
+	case reflect.Chan:
+		return types.NewChan(chanDirsOf[t.ChanDir()], p.TypeOf(t.Elem()))
+	case reflect.Func:
+		return p.sigOf(t)
+	case reflect.Struct:
+		return p.structOf(t)
+	case reflect.Interface:
+		return p.interfaceOf(t)
+	case reflect.UnsafePointer:
+		return types.Typ[types.UnsafePointer]
+	default:
+		if kind < reflect.Kind(len(basicKinds)) && basicKinds[kind] != types.Invalid {
+			return types.Typ[basicKinds[kind]]
+		}
+	}
+	log.Panicln("TypeOf: unsupported type -", t)
+	return nil
+}
+
+// typeObjectOf returns the type `name` of the package `pkgPath`. Types of
+// package main (which can't be imported) are looked up in the package itself
+// if it's a main package.
+func (p *Package) typeObjectOf(pkgPath, name string) types.Object {
+	if pkgPath == p.Types.Path() || (pkgPath == "main" && p.Types.Name() == "main") {
+		if o := p.Types.Scope().Lookup(name); o != nil {
+			return o
+		}
+		log.Panicln("TypeOf: type not found -", name)
+	}
+	if pkgPath == "main" {
+		log.Panicln("TypeOf: can't import type of package main -", name)
+	}
+	return p.Import(pkgPath).Ref(name)
+}
+
+// pkgOf returns the package of an unexported field or method declared in the
+// package `pkgPath` (empty for exported ones).
+func (p *Package) pkgOf(pkgPath string) *types.Package {
+	if pkgPath == "" || pkgPath == p.Types.Path() {
+		return p.Types
+	}
+	return p.Import(pkgPath).Types
+}
+
+func (p *Package) sigOf(t reflect.Type) *types.Signature {
+	params := make([]*types.Var, t.NumIn())
+	for i := range params {
+		params[i] = types.NewParam(token.NoPos, p.Types, "", p.TypeOf(t.In(i)))
+	}
+	results := make([]*types.Var, t.NumOut())
+	for i := range results {
+		results[i] = types.NewParam(token.NoPos, p.Types, "", p.TypeOf(t.Out(i)))
+	}
+	return types.NewSignatureType(nil, nil, nil, types.NewTuple(params...), types.NewTuple(results...), t.IsVariadic())
+}
+
+func (p *Package) structOf(t reflect.Type) *types.Struct {
+	n := t.NumField()
+	fields := make([]*types.Var, n)
+	var tags []string
+	for i := 0; i < n; i++ {
+		fld := t.Field(i)
+		fields[i] = types.NewField(token.NoPos, p.pkgOf(fld.PkgPath), fld.Name, p.TypeOf(fld.Type), fld.Anonymous)
+		if fld.Tag != "" {
+			if tags == nil {
+				tags = make([]string, n)
+			}
+			tags[i] = string(fld.Tag)
+		}
+	}
+	return types.NewStruct(fields, tags)
+}
+
+func (p *Package) interfaceOf(t reflect.Type) *types.Interface {
+	n := t.NumMethod()
+	methods := make([]*types.Func, n)
+	for i := 0; i < n; i++ {
+		m := t.Method(i)
+		methods[i] = types.NewFunc(token.NoPos, p.pkgOf(m.PkgPath), m.Name, p.sigOf(m.Type))
+	}
+	return types.NewInterfaceType(methods, nil).Complete()
+}
+
+// ----------------------------------------------------------------------------
+
+// reflectVal converts a runtime value of a basic kind (like `time.Second` or
+// `int64(1)`) to an expression `T(lit)`, or a runtime type to a type
+// expression (see Package.TypeOf).
+func reflectVal(pkg *Package, val interface{}, src ast.Node) *internal.Elem {
+	if t, ok := val.(reflect.Type); ok {
+		typ := pkg.TypeOf(t)
+		return newElem(pkg, toType(pkg, typ), NewTypeType(typ), nil, src)
+	}
+	v := reflect.ValueOf(val)
+	if fn, ok := pkg.literalizers[v.Type()]; ok {
+		cb := &pkg.cb
+		fn(cb, v)
+		ret := cb.stk.Pop()
+		ret.Src = src
+		return ret
+	}
+	if ret := basicVal(pkg, v, false, src); ret != nil {
+		return ret
+	}
+	log.Panicln("unexpected: unsupport value type -", v.Type())
+	return nil
+}
+
+// basicVal converts `v` of a basic kind to an expression `T(lit)`, or just
+// `lit` (an untyped constant) if `untyped` is true or T is the default type
+// of the constant. It returns nil if `v` isn't of a basic kind.
+func basicVal(pkg *Package, v reflect.Value, untyped bool, src ast.Node) *internal.Elem {
+	lit, cval := basicLitOf(v)
+	if lit == nil {
+		return nil
+	}
+	t := v.Type()
+	untypedTy := types.Typ[untypedKinds[t.Kind()]]
+	if untyped || (t.PkgPath() == "" && Default(pkg, untypedTy) == types.Typ[basicKinds[t.Kind()]]) {
+		return newElem(pkg, lit, untypedTy, cval, src)
+	}
+	typ := pkg.TypeOf(t)
+	ret := &ast.CallExpr{Fun: toType(pkg, typ), Args: []ast.Expr{lit}}
+	return newElem(pkg, ret, typ, cval, src)
+}
+
+// basicLitOf returns the literal and constant value of `v` if it's of a basic
+// kind, otherwise it returns nil. A negative number is a literal negated by
+// an unary expression, like `-5`.
+func basicLitOf(v reflect.Value) (ast.Expr, constant.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		return boolean(v.Bool()), constant.MakeBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x := v.Int()
+		if x < 0 {
+			lit := &ast.BasicLit{Kind: token.INT, Value: strconv.FormatUint(uint64(-x), 10)}
+			return &ast.UnaryExpr{Op: token.SUB, X: lit}, constant.MakeInt64(x)
+		}
+		return &ast.BasicLit{Kind: token.INT, Value: strconv.FormatInt(x, 10)}, constant.MakeInt64(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x := v.Uint()
+		return &ast.BasicLit{Kind: token.INT, Value: strconv.FormatUint(x, 10)}, constant.MakeUint64(x)
+	case reflect.Float32, reflect.Float64:
+		x := v.Float()
+		if math.IsInf(x, 0) || math.IsNaN(x) {
+			break
+		}
+		val := strconv.FormatFloat(math.Abs(x), 'g', -1, v.Type().Bits())
+		if !strings.ContainsAny(val, ".e") {
+			val += ".0"
+		}
+		lit := &ast.BasicLit{Kind: token.FLOAT, Value: val}
+		if x < 0 {
+			return &ast.UnaryExpr{Op: token.SUB, X: lit}, constant.MakeFromLiteral("-"+val, token.FLOAT, 0)
+		}
+		return lit, constant.MakeFromLiteral(val, token.FLOAT, 0)
+	case reflect.String:
+		x := v.String()
+		return &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(x)}, constant.MakeString(x)
+	}
+	return nil, nil
+}
+
+// ----------------------------------------------------------------------------
+
+// Literalizer pushes a literal of the runtime value `v` (see SetLiteralizer).
+type Literalizer = func(cb *CodeBuilder, v reflect.Value)
+
+// SetLiteralizer sets the literalizer of values of the runtime type `t`, which
+// is used by ValLit and Val (for values of types it doesn't handle itself)
+// instead of the default conversion, so literals of well-known types can stay
+// idiomatic:
+//
+//	pkg.SetLiteralizer(reflect.TypeOf(time.Duration(0)), gox.LitDuration)
+//	pkg.SetLiteralizer(reflect.TypeOf((*regexp.Regexp)(nil)), gox.LitRegexp)
+//
+// A nil `fn` removes the literalizer of `t`. Nil values of `t` are handled by
+// ValLit, so `fn` is only called with non-nil ones.
+func (p *Package) SetLiteralizer(t reflect.Type, fn Literalizer) {
+	if fn == nil {
+		delete(p.literalizers, t)
+		return
+	}
+	if p.literalizers == nil {
+		p.literalizers = make(map[reflect.Type]Literalizer)
+	}
+	p.literalizers[t] = fn
+}
+
+var durationUnits = [...]struct {
+	unit time.Duration
+	name string
+}{
+	{time.Hour, "Hour"},
+	{time.Minute, "Minute"},
+	{time.Second, "Second"},
+	{time.Millisecond, "Millisecond"},
+	{time.Microsecond, "Microsecond"},
+	{time.Nanosecond, "Nanosecond"},
+}
+
+// LitDuration is a literalizer of time.Duration, which converts a duration to
+// a multiple of the largest unit dividing it, like `3 * time.Second`.
+func LitDuration(cb *CodeBuilder, v reflect.Value) {
+	d := time.Duration(v.Int())
+	if d == 0 {
+		cb.stk.Push(basicVal(cb.pkg, v, false, nil))
+		return
+	}
+	for _, u := range durationUnits {
+		if d%u.unit == 0 {
+			ref := cb.pkg.Import("time").Ref(u.name)
+			if n := int64(d / u.unit); n != 1 {
+				cb.Val(int(n)).Val(ref).BinaryOp(token.MUL)
+			} else {
+				cb.Val(ref)
+			}
+			return
+		}
+	}
+}
+
+// LitRegexp is a literalizer of *regexp.Regexp, which converts a regexp to
+// `regexp.MustCompile(expr)`.
+func LitRegexp(cb *CodeBuilder, v reflect.Value) {
+	re := v.Interface().(*regexp.Regexp)
+	cb.Val(cb.pkg.Import("regexp").Ref("MustCompile")).Val(re.String()).Call(1)
+}
+
+// ValLit pushes a literal of the runtime value `v`. Values of basic kinds are
+// converted like Val does, and slices, arrays, maps, structs and pointers to
+// them are converted to composite literals recursively:
+//
+//	cb.ValLit(map[string][]int{"b": {2}, "a": {1}}) // => map[string][]int{"a": {1}, "b": {2}}
+//
+// Keys of a map are sorted, so the literal is deterministic. Zero fields of a
+// struct are omitted. Types of elements are elided if they are the same as
+// the element type of the composite literal. Values of types having a
+// literalizer (see Package.SetLiteralizer) are converted by it. A pointer to
+// a zero value of other kinds is converted to `new(T)`.
+//
+// It panics with a *CodeError if `v` can't be converted to a literal, such as
+// a value referring to itself (see ValLitEx).
+func (p *CodeBuilder) ValLit(v interface{}, src ...ast.Node) *CodeBuilder {
+	if debugInstr {
+		log.Println("ValLit", reflect.TypeOf(v)) // v may refer to itself
+	}
+	lit := &litBuilder{CodeBuilder: p}
+	lit.valLit(reflect.ValueOf(v), nil, getSrc(src))
+	return p
+}
+
+// ValLitEx is like ValLit, but returns the error instead of panicking if `v`
+// can't be converted to a literal, in which case the stack isn't changed.
+func (p *CodeBuilder) ValLitEx(v interface{}, src ...ast.Node) error {
+	return p.tryInstr(0, func() {
+		p.ValLit(v, src...)
+	})
+}
+
+// litRef is a reference to a value which may refer to itself, see litBuilder.
+type litRef struct {
+	t   reflect.Type
+	ptr uintptr
+}
+
+// litBuilder converts a runtime value to a literal, tracking pointers, slices
+// and maps being converted, so a value referring to itself is an error.
+type litBuilder struct {
+	*CodeBuilder
+	visiting map[litRef]bool
+}
+
+// enter marks `v` as being converted, and reports a cycle if it already is.
+func (p *litBuilder) enter(v reflect.Value, src ast.Node) litRef {
+	ref := litRef{v.Type(), v.Pointer()}
+	if p.visiting[ref] {
+		p.panicCodeErrorf(getSrcPos(src), "ValLit: value of type %v refers to itself", ref.t)
+	}
+	if p.visiting == nil {
+		p.visiting = make(map[litRef]bool)
+	}
+	p.visiting[ref] = true
+	return ref
+}
+
+func (p *litBuilder) leave(ref litRef) {
+	delete(p.visiting, ref)
+}
+
+// valLit pushes a literal of `v`. `static` is type of the element (or field)
+// holding `v`, or nil if there isn't one.
+func (p *litBuilder) valLit(v reflect.Value, static reflect.Type, src ast.Node) {
+	if !v.IsValid() { // nil interface
+		p.Val(nil, src)
+		return
+	}
+	t := v.Type()
+	switch t.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			p.Val(nil, src)
+		} else {
+			p.valLit(v.Elem(), nil, src)
+		}
+		return
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		if v.IsNil() {
+			if t == static {
+				p.Val(nil, src)
+			} else {
+				p.Typ(p.pkg.TypeOf(t)).Val(nil).Call(1)
+				p.stk.Get(-1).Src = src
+			}
+			return
+		}
+	}
+	pkg := p.pkg
+	if fn, ok := pkg.literalizers[t]; ok {
+		fn(p.CodeBuilder, v)
+		p.stk.Get(-1).Src = src
+		return
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		switch t.Elem().Kind() {
+		case reflect.Struct, reflect.Array, reflect.Slice, reflect.Map:
+			ref := p.enter(v, src)
+			p.valLit(v.Elem(), nil, nil)
+			p.UnaryOp(token.AND, false, src)
+			p.leave(ref)
+			return
+		}
+		if v.Elem().IsZero() {
+			p.Val(pkg.builtin.Scope().Lookup("new"), src).Typ(pkg.TypeOf(t.Elem())).Call(1)
+			p.stk.Get(-1).Src = src
+			return
+		}
+		p.panicCodeErrorf(getSrcPos(src), "ValLit: can't take address of non-zero value of type %v", t.Elem())
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice {
+			defer p.leave(p.enter(v, src))
+		}
+		n, elem := v.Len(), t.Elem()
+		for i := 0; i < n; i++ {
+			p.valLit(v.Index(i), elem, nil)
+		}
+		if t.Kind() == reflect.Slice {
+			p.SliceLitEx(pkg.TypeOf(t), n, false, src)
+		} else {
+			p.ArrayLitEx(pkg.TypeOf(t), n, false, src)
+		}
+		p.elideLitType(t == static)
+		return
+	case reflect.Map:
+		defer p.leave(p.enter(v, src))
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return lessValue(keys[i], keys[j])
+		})
+		for _, key := range keys {
+			p.valLit(key, t.Key(), nil)
+			p.valLit(v.MapIndex(key), t.Elem(), nil)
+		}
+		p.MapLit(pkg.TypeOf(t), len(keys)<<1, src)
+		p.elideLitType(t == static)
+		return
+	case reflect.Struct:
+		arity := 0
+		for i, n := 0, t.NumField(); i < n; i++ {
+			fv := v.Field(i)
+			if fv.IsZero() {
+				continue
+			}
+			if fld := t.Field(i); fld.PkgPath != "" && fld.PkgPath != pkg.Types.Path() {
+				p.panicCodeErrorf(getSrcPos(src), "ValLit: can't set unexported field %s of %v", fld.Name, t)
+			}
+			p.Val(i)
+			p.valLit(fv, t.Field(i).Type, nil)
+			arity += 2
+		}
+		p.StructLit(pkg.TypeOf(t), arity, true, src)
+		p.elideLitType(t == static)
+		return
+	default:
+		if ret := basicVal(pkg, v, t == static, src); ret != nil {
+			p.stk.Push(ret)
+			return
+		}
+	}
+	p.panicCodeErrorf(getSrcPos(src), "ValLit: unsupported value of type %v", t)
+}
+
+// elideLitType elides type of the composite literal on the top of the stack
+// if it's an element of a composite literal of the same type.
+func (p *CodeBuilder) elideLitType(elide bool) {
+	if elide {
+		lit := *p.stk.Get(-1).Val.(*ast.CompositeLit)
+		lit.Type = nil
+		p.stk.Get(-1).Val = &lit
+	}
+}
+
+// lessValue reports whether the map key `a` sorts before `b`. Keys of basic
+// kinds are compared by value, and others by their text.
+func lessValue(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	case reflect.String:
+		return a.String() < b.String()
+	case reflect.Bool:
+		return !a.Bool() && b.Bool()
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
+
+// ----------------------------------------------------------------------------
@@ -0,0 +1,86 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"go/token"
+	"go/types"
+	"sync"
+
+	"github.com/goplus/gox/packages"
+)
+
+// ----------------------------------------------------------------------------
+
+// A Session holds a FileSet, an importer and a Context shared by packages
+// created by it, so that position tables and imported packages aren't
+// duplicated when building many packages in a process. Packages created by a
+// session can import each other.
+type Session struct {
+	Fset *token.FileSet
+
+	imp  types.Importer
+	ctx  *Context
+	pkgs map[string]*Package
+	mu   sync.Mutex
+}
+
+// NewSession creates a new session. If fset is nil, a new FileSet is used. If
+// imp is nil, packages.NewImporter(fset) is used.
+func NewSession(fset *token.FileSet, imp types.Importer) *Session {
+	if fset == nil {
+		fset = token.NewFileSet()
+	}
+	if imp == nil {
+		imp = packages.NewImporter(fset)
+	}
+	return &Session{Fset: fset, imp: imp, ctx: NewContext(), pkgs: make(map[string]*Package)}
+}
+
+// NewPackage creates a new package attached to this session. Fset, Importer
+// and Context of `conf` (which can be nil) are replaced by those of the
+// session.
+func (p *Session) NewPackage(pkgPath, name string, conf *Config) *Package {
+	var c Config
+	if conf != nil {
+		c = *conf
+	}
+	c.Fset, c.Importer, c.Context = p.Fset, p, p.ctx
+	pkg := NewPackage(pkgPath, name, &c)
+	p.mu.Lock()
+	p.pkgs[pkgPath] = pkg
+	p.mu.Unlock()
+	return pkg
+}
+
+// Package returns the package `pkgPath` created by this session.
+func (p *Session) Package(pkgPath string) (pkg *Package, ok bool) {
+	p.mu.Lock()
+	pkg, ok = p.pkgs[pkgPath]
+	p.mu.Unlock()
+	return
+}
+
+// Import imports a package by pkgPath. Packages created by this session are
+// returned directly, others are imported by the importer of the session.
+func (p *Session) Import(pkgPath string) (*types.Package, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pkg, ok := p.pkgs[pkgPath]; ok {
+		return pkg.Types, nil
+	}
+	return p.imp.Import(pkgPath)
+}
+
+// ----------------------------------------------------------------------------
@@ -43,6 +43,32 @@ func (p *blockStmt) End(cb *CodeBuilder, src ast.Node) {
 	cb.emitStmt(&ast.BlockStmt{List: stmts})
 }
 
+// ----------------------------------------------------------------------------
+//
+// assert
+//
+//	...
+//
+// end
+type assertStmt struct {
+	old codeBlockCtx
+}
+
+func (p *assertStmt) End(cb *CodeBuilder, src ast.Node) {
+	stmts, flows := cb.endBlockStmt(&p.old)
+	switch cb.assertMode {
+	case AssertNever:
+		cb.pkg.unrefPkgs(&ast.BlockStmt{List: stmts})
+		return
+	case AssertDebug:
+		cond := ident(cb.pkg.assertsGuard().Name())
+		cb.emitStmt(&ast.IfStmt{Cond: cond, Body: &ast.BlockStmt{List: stmts}})
+	default:
+		cb.emitStmt(&ast.BlockStmt{List: stmts})
+	}
+	cb.current.flows |= flows
+}
+
 // ----------------------------------------------------------------------------
 //
 // vblock
@@ -142,18 +168,33 @@ type switchStmt struct {
 	init ast.Stmt
 	tag  *internal.Elem
 	old  codeBlockCtx
+	fall *caseStmt // the last case if it ends with fallthrough
 }
 
 func (p *switchStmt) Then(cb *CodeBuilder, src ...ast.Node) {
 	p.tag = cb.stk.Pop()
-	switch stmts := cb.clearBlockStmt(); len(stmts) {
+	p.init = switchInit(cb, getPos(src))
+}
+
+// switchInit returns the init statement of a switch statement (nil if there
+// is none), which must be a simple statement.
+func switchInit(cb *CodeBuilder, pos token.Pos) ast.Stmt {
+	stmts := cb.clearBlockStmt()
+	switch len(stmts) {
 	case 0:
-		// nothing to do
+		return nil
 	case 1:
-		p.init = stmts[0]
 	default:
-		panic("TODO: switch statement has too many init statements")
+		cb.panicCodeError(pos, "switch statement has too many init statements")
 	}
+	switch stmt := stmts[0].(type) {
+	case *ast.ExprStmt, *ast.SendStmt, *ast.IncDecStmt, *ast.AssignStmt, *ast.EmptyStmt:
+		return stmt
+	case *ast.DeclStmt:
+		cb.panicCodeError(pos, "var declaration not allowed in switch initializer")
+	}
+	cb.panicCodeError(pos, "switch initializer must be a simple statement")
+	return nil
 }
 
 func (p *switchStmt) Case(cb *CodeBuilder, n int, src ...ast.Node) {
@@ -177,7 +218,7 @@ func (p *switchStmt) Case(cb *CodeBuilder, n int, src ...ast.Node) {
 		}
 		cb.stk.PopN(n)
 	}
-	stmt := &caseStmt{list: list}
+	stmt := &caseStmt{list: list, sw: p}
 	cb.startBlockStmt(stmt, src, "case statement", &stmt.old)
 }
 
@@ -187,23 +228,40 @@ func (p *switchStmt) End(cb *CodeBuilder, src ast.Node) {
 	}
 	stmts, flows := cb.endBlockStmt(&p.old)
 	cb.current.flows |= (flows &^ flowFlagBreak)
+	if p.fall != nil {
+		cb.panicCodeError(p.fall.fallPos, "cannot fallthrough final case in switch")
+	}
 
 	body := &ast.BlockStmt{List: stmts}
 	cb.emitStmt(&ast.SwitchStmt{Init: p.init, Tag: checkParenExpr(p.tag.Val), Body: body})
 }
 
 type caseStmt struct {
-	list []ast.Expr
-	old  codeBlockCtx
+	list    []ast.Expr
+	old     codeBlockCtx
+	sw      *switchStmt
+	fall    ast.Stmt // the fallthrough statement
+	fallPos token.Pos
 }
 
-func (p *caseStmt) Fallthrough(cb *CodeBuilder) {
-	cb.emitStmt(&ast.BranchStmt{Tok: token.FALLTHROUGH})
+func (p *caseStmt) Fallthrough(cb *CodeBuilder, pos token.Pos) {
+	if p.fall != nil {
+		cb.panicCodeError(pos, "fallthrough statement out of place")
+	}
+	p.fall, p.fallPos = &ast.BranchStmt{Tok: token.FALLTHROUGH}, pos
+	cb.emitStmt(p.fall)
 }
 
 func (p *caseStmt) End(cb *CodeBuilder, src ast.Node) {
 	body, flows := cb.endBlockStmt(&p.old)
 	cb.current.flows |= flows
+	p.sw.fall = nil
+	if p.fall != nil {
+		if body[len(body)-1] != p.fall { // must be the last statement
+			cb.panicCodeError(p.fallPos, "fallthrough statement out of place")
+		}
+		p.sw.fall = p
+	}
 	cb.emitStmt(&ast.CaseClause{List: p.list, Body: body})
 }
 
@@ -222,18 +280,58 @@ func (p *caseStmt) End(cb *CodeBuilder, src ast.Node) {
 //
 // end
 type selectStmt struct {
-	old codeBlockCtx
+	old        codeBlockCtx
+	hasDefault bool
 }
 
 func (p *selectStmt) CommCase(cb *CodeBuilder, n int, src ...ast.Node) {
 	var comm ast.Stmt
-	if n == 1 {
+	switch n {
+	case 0:
+		if p.hasDefault {
+			cb.panicCodeError(getPos(src), "multiple defaults in select")
+		}
+		p.hasDefault = true
+	case 1:
 		comm = cb.popStmt()
+		if !isCommStmt(comm) {
+			cb.panicCodeError(getPos(src), "select case must be receive, send or assign recv")
+		}
+	default:
+		cb.panicCodeError(getPos(src), "select case must be receive, send or assign recv")
 	}
 	stmt := &commCase{comm: comm}
 	cb.startBlockStmt(stmt, src, "comm case statement", &stmt.old)
 }
 
+// isCommStmt checks if `stmt` is a send statement, or a receive operation
+// which may be assigned to at most two variables.
+func isCommStmt(stmt ast.Stmt) bool {
+	var x ast.Expr
+	switch v := stmt.(type) {
+	case *ast.SendStmt:
+		return true
+	case *ast.ExprStmt:
+		x = v.X
+	case *ast.AssignStmt:
+		if len(v.Lhs) > 2 || len(v.Rhs) != 1 {
+			return false
+		}
+		x = v.Rhs[0]
+	default:
+		return false
+	}
+	for {
+		paren, ok := x.(*ast.ParenExpr)
+		if !ok {
+			break
+		}
+		x = paren.X
+	}
+	recv, ok := x.(*ast.UnaryExpr)
+	return ok && recv.Op == token.ARROW
+}
+
 func (p *selectStmt) End(cb *CodeBuilder, src ast.Node) {
 	stmts, flows := cb.endBlockStmt(&p.old)
 	cb.current.flows |= (flows &^ flowFlagBreak)
@@ -249,6 +347,12 @@ func (p *commCase) End(cb *CodeBuilder, src ast.Node) {
 	body, flows := cb.endBlockStmt(&p.old)
 	cb.current.flows |= flows
 	cb.emitStmt(&ast.CommClause{Comm: p.comm, Body: body})
+
+	// Variables defined by the comm statement are in the scope of the select
+	// statement (as it's built before CommCase), so a new scope is used for
+	// the next case to define them again.
+	scope := cb.current.scope
+	cb.current.scope = types.NewScope(scope.Parent(), scope.Pos(), scope.End(), "select statement")
 }
 
 // ----------------------------------------------------------------------------
@@ -275,14 +379,7 @@ type typeSwitchStmt struct {
 }
 
 func (p *typeSwitchStmt) TypeAssertThen(cb *CodeBuilder) {
-	switch stmts := cb.clearBlockStmt(); len(stmts) {
-	case 0:
-		// nothing to do
-	case 1:
-		p.init = stmts[0]
-	default:
-		panic("TODO: type switch statement has too many init statements")
-	}
+	p.init = switchInit(cb, token.NoPos)
 	x := cb.stk.Pop()
 	xType, ok := cb.checkInterface(x.Type)
 	if !ok {
@@ -463,7 +560,9 @@ type forRangeStmt struct {
 	x     *internal.Elem
 	old   codeBlockCtx
 	kvt   []types.Type
-	udt   int // 0: non-udt, 2: (elem,ok), 3: (key,elem,ok)
+	udt   int              // 0: non-udt, 2: (elem,ok), 3: (key,elem,ok)
+	yield *types.Signature // yield func of a range-over-func iterator
+	isInt bool             // range over an integer
 	loopBodyHandler
 }
 
@@ -484,12 +583,20 @@ func (p *forRangeStmt) RangeAssignThen(cb *CodeBuilder, pos token.Pos) {
 			src, _ := cb.loadExpr(x.Src)
 			cb.panicCodeErrorf(pos, "cannot range over %v (type %v)", src, x.Type)
 		}
-		if typs[1] == nil { // chan
-			if names[0] == "_" && len(names) > 1 {
+		if typs[1] == nil { // chan, integer or func(yield func(K) bool)
+			if p.isInt { // an integer has no value: only `for i, _ := range n` is the same as `for i := range n`
+				if len(names) > 1 && names[1] == "_" {
+					names, val = names[:1], nil
+				}
+			} else if names[0] == "_" && len(names) > 1 {
 				names[0], val = names[1], nil
 				names = names[:1]
 			}
 		}
+		p.checkIterVars(cb, pos, x, len(names))
+		if p.isInt { // untyped constant n: for i := range n, i is int
+			typs[0] = types.Default(typs[0])
+		}
 		for i, name := range names {
 			if name == "_" {
 				continue
@@ -527,6 +634,7 @@ func (p *forRangeStmt) RangeAssignThen(cb *CodeBuilder, pos token.Pos) {
 			src, _ := cb.loadExpr(x.Src)
 			cb.panicCodeErrorf(pos, "cannot range over %v (type %v)", src, x.Type)
 		}
+		p.checkIterVars(cb, pos, &x, n-1)
 		if p.udt != 0 {
 			p.x = &x
 		}
@@ -547,6 +655,7 @@ func (p *forRangeStmt) RangeAssignThen(cb *CodeBuilder, pos token.Pos) {
 }
 
 func (p *forRangeStmt) getKeyValTypes(cb *CodeBuilder, typ types.Type) []types.Type {
+	orig := typ
 retry:
 	switch t := typ.(type) {
 	case *types.Slice:
@@ -566,10 +675,23 @@ retry:
 		}
 	case *types.Chan:
 		return []types.Type{t.Elem(), nil}
+	case *types.Signature:
+		if yield := rangeFuncYield(t); yield != nil {
+			p.yield = yield
+			typs := make([]types.Type, 2)
+			for i, n := 0, yield.Params().Len(); i < n; i++ {
+				typs[i] = yield.Params().At(i).Type()
+			}
+			return typs
+		}
 	case *types.Basic:
 		if (t.Info() & types.IsString) != 0 {
 			return []types.Type{types.Typ[types.Int], types.Typ[types.Rune]}
 		}
+		if (t.Info() & types.IsInteger) != 0 {
+			p.isInt = true
+			return []types.Type{orig, nil}
+		}
 	case *types.Named:
 		if kv, ok := p.checkUdt(cb, t); ok {
 			return kv
@@ -580,6 +702,45 @@ retry:
 	return nil
 }
 
+// rangeFuncYield returns the yield func if `sig` is a range-over-func
+// iterator: func(yield func() bool), func(yield func(K) bool) or
+// func(yield func(K, V) bool).
+func rangeFuncYield(sig *types.Signature) *types.Signature {
+	if sig.Params().Len() != 1 || sig.Results().Len() != 0 || sig.Variadic() {
+		return nil
+	}
+	yield, ok := sig.Params().At(0).Type().Underlying().(*types.Signature)
+	if !ok || yield.Params().Len() > 2 || yield.Results().Len() != 1 || yield.Variadic() {
+		return nil
+	}
+	if t, ok := yield.Results().At(0).Type().Underlying().(*types.Basic); !ok || t.Info()&types.IsBoolean == 0 {
+		return nil
+	}
+	return yield
+}
+
+// checkIterVars checks count of iteration variables of a loop ranging over
+// an integer or an iterator func, which can't be more than count of
+// parameters of its yield func.
+func (p *forRangeStmt) checkIterVars(cb *CodeBuilder, pos token.Pos, x *internal.Elem, nvars int) {
+	var n int
+	switch {
+	case p.yield != nil:
+		n = p.yield.Params().Len()
+	case p.isInt:
+		n = 1
+	default:
+		return
+	}
+	if nvars > n {
+		src, _ := cb.loadExpr(x.Src)
+		if n == 0 {
+			cb.panicCodeErrorf(pos, "range over %v (type %v) permits no iteration variables", src, x.Type)
+		}
+		cb.panicCodeErrorf(pos, "range over %v (type %v) permits only one iteration variable", src, x.Type)
+	}
+}
+
 func (p *forRangeStmt) checkUdt(cb *CodeBuilder, o *types.Named) ([]types.Type, bool) {
 	if sig := findMethodType(cb, o, nameGopEnum); sig != nil {
 		enumRet := sig.Results()
@@ -0,0 +1,971 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ----------------------------------------------------------------------------
+
+func structOf(typ *types.Named) *types.Struct {
+	t, ok := typ.Underlying().(*types.Struct)
+	if !ok {
+		log.Panicln(typ, "is not a struct type")
+	}
+	return t
+}
+
+// selectFields returns fields of a struct type by their names. It returns
+// all named fields if names is empty.
+func selectFields(typ *types.Named, names []string) []*types.Var {
+	t := structOf(typ)
+	if len(names) == 0 {
+		ret := make([]*types.Var, 0, t.NumFields())
+		for i, n := 0, t.NumFields(); i < n; i++ {
+			if fld := t.Field(i); !fld.Embedded() && fld.Name() != "_" {
+				ret = append(ret, fld)
+			}
+		}
+		return ret
+	}
+	ret := make([]*types.Var, len(names))
+	for i, name := range names {
+		ret[i] = lookupField(t, name)
+		if ret[i] == nil {
+			log.Panicln(typ, "has no field", name)
+		}
+	}
+	return ret
+}
+
+func lookupField(t *types.Struct, name string) *types.Var {
+	if i := fieldIndex(t, name); i >= 0 {
+		return t.Field(i)
+	}
+	return nil
+}
+
+func fieldIndex(t *types.Struct, name string) int {
+	for i, n := 0, t.NumFields(); i < n; i++ {
+		if t.Field(i).Name() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func exportName(name string) string {
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[n:]
+}
+
+// paramName returns a parameter name for a field, eg. `Type` => `type_`.
+func paramName(name string) string {
+	r, n := utf8.DecodeRuneInString(name)
+	name = string(unicode.ToLower(r)) + name[n:]
+	if token.IsKeyword(name) {
+		name += "_"
+	}
+	return name
+}
+
+// uniqueName returns `name`, or `name` with a number suffix if it's used, and
+// marks the result as used.
+func uniqueName(name string, used map[string]bool) string {
+	ret := name
+	for i := 2; used[ret]; i++ {
+		ret = name + strconv.Itoa(i)
+	}
+	used[ret] = true
+	return ret
+}
+
+// ----------------------------------------------------------------------------
+
+// AccessorFlags controls what NewAccessors generates.
+type AccessorFlags int
+
+const (
+	// AccessorGetter generates getters.
+	AccessorGetter AccessorFlags = 1 << iota
+	// AccessorSetter generates setters.
+	AccessorSetter
+	// AccessorNilCheck makes getters return the zero value on a nil receiver.
+	AccessorNilCheck
+
+	// AccessorDefault generates both getters and setters.
+	AccessorDefault = AccessorGetter | AccessorSetter
+)
+
+// NewAccessors generates getter and setter methods with pointer receivers
+// for `fields` of the struct type `typ` (all named fields if `fields` is empty):
+//
+//	func (p *T) Name() string    // or GetName for an exported field
+//	func (p *T) SetName(v string)
+//
+// GetName is also used if Name is a field or method of T already. If the name
+// of an accessor still conflicts with a field or method of T, a CodeError is
+// raised.
+//
+// With AccessorNilCheck, a getter is generated as:
+//
+//	func (p *T) Name() (ret string) {
+//		if p != nil {
+//			ret = p.name
+//		}
+//		return
+//	}
+func (p *Package) NewAccessors(typ *types.Named, flags AccessorFlags, fields ...string) {
+	if debugInstr {
+		log.Println("NewAccessors", typ, flags, fields)
+	}
+	for _, fld := range selectFields(typ, fields) {
+		name := fld.Name()
+		exported := exportName(name)
+		if flags&AccessorGetter != 0 {
+			getter := exported
+			if getter == name || hasMember(p, typ, getter) {
+				getter = "Get" + exported
+			}
+			p.checkAccessor(typ, getter)
+			p.newGetter(typ, fld, getter, flags&AccessorNilCheck != 0)
+		}
+		if flags&AccessorSetter != 0 {
+			setter := "Set" + exported
+			p.checkAccessor(typ, setter)
+			p.newSetter(typ, fld, setter)
+		}
+	}
+}
+
+// hasMember checks if `name` is a field or method of `typ` (not promoted from
+// embedded fields).
+func hasMember(pkg *Package, typ *types.Named, name string) bool {
+	obj, index, _ := types.LookupFieldOrMethod(typ, true, pkg.Types, name)
+	return obj != nil && len(index) == 1
+}
+
+func (p *Package) checkAccessor(typ *types.Named, name string) {
+	if hasMember(p, typ, name) {
+		p.cb.panicCodeErrorf(token.NoPos, "%v already has a field or method named %s", typ, name)
+	}
+}
+
+func (p *Package) newGetter(typ *types.Named, fld *types.Var, getter string, nilCheck bool) {
+	recv := p.NewParam(token.NoPos, "p", types.NewPointer(typ))
+	if !nilCheck {
+		ret := NewTuple(p.NewParam(token.NoPos, "", fld.Type()))
+		p.NewFunc(recv, getter, nil, ret, false).BodyStart(p).
+			VarVal("p").MemberVal(fld.Name()).Return(1).
+			End()
+		return
+	}
+	ret := NewTuple(p.NewParam(token.NoPos, "ret", fld.Type()))
+	p.NewFunc(recv, getter, nil, ret, false).BodyStart(p).
+		If().VarVal("p").Val(nil).BinaryOp(token.NEQ).Then().
+		/**/ VarRef(ret.At(0)).VarVal("p").MemberVal(fld.Name()).Assign(1).
+		End().
+		Return(0).
+		End()
+}
+
+func (p *Package) newSetter(typ *types.Named, fld *types.Var, setter string) {
+	recv := p.NewParam(token.NoPos, "p", types.NewPointer(typ))
+	params := NewTuple(p.NewParam(token.NoPos, "v", fld.Type()))
+	p.NewFunc(recv, setter, params, nil, false).BodyStart(p).
+		VarVal("p").MemberRef(fld.Name()).VarVal("v").Assign(1).
+		End()
+}
+
+// ----------------------------------------------------------------------------
+
+// ConstructorOpts represents options of NewConstructor.
+type ConstructorOpts struct {
+	// Name is name of the constructor. Defaults to "New" + T.
+	Name string
+
+	// Fields are fields initialized by parameters of the constructor.
+	// Defaults to all named fields.
+	Fields []string
+
+	// Validate is name of a method of *T. If it isn't empty, the constructor
+	// calls it to validate the result, and returns (*T, error).
+	Validate string
+
+	// Options generates `type TOption func(*T)`, and the constructor
+	// accepts `opts ...TOption` to apply after fields are initialized.
+	Options bool
+}
+
+// NewConstructor generates a constructor of the struct type `typ`:
+//
+//	func NewT(field1 T1, field2 T2, ...) *T {
+//		return &T{field1: field1, field2: field2, ...}
+//	}
+//
+// With Options and Validate specified, it generates:
+//
+//	type TOption func(*T)
+//
+//	func NewT(field1 T1, ..., opts ...TOption) (*T, error) {
+//		ret := &T{field1: field1, ...}
+//		for _, opt := range opts {
+//			opt(ret)
+//		}
+//		if err := ret.Validate(); err != nil {
+//			return nil, err
+//		}
+//		return ret, nil
+//	}
+func (p *Package) NewConstructor(typ *types.Named, opts *ConstructorOpts) *Func {
+	if opts == nil {
+		opts = &ConstructorOpts{}
+	}
+	tname := typ.Obj().Name()
+	name := opts.Name
+	if name == "" {
+		name = "New" + tname
+	}
+	if debugInstr {
+		log.Println("NewConstructor", typ, name)
+	}
+	t := structOf(typ)
+	fields := selectFields(typ, opts.Fields)
+	simple := !opts.Options && opts.Validate == ""
+	used := make(map[string]bool) // names of parameters and local variables
+	if !simple {
+		used["ret"] = true
+	}
+	if opts.Options {
+		used["opts"], used["opt"] = true, true
+	}
+	if opts.Validate != "" {
+		used["err"] = true
+	}
+	params := make([]*types.Var, len(fields), len(fields)+1)
+	for i, fld := range fields {
+		params[i] = p.NewParam(token.NoPos, uniqueName(paramName(fld.Name()), used), fld.Type())
+	}
+	if opts.Options {
+		tyOpt := p.NewTypeDefs().NewType(tname+"Option").
+			InitType(p, types.NewSignatureType(nil, nil, nil, NewTuple(p.NewParam(token.NoPos, "", types.NewPointer(typ))), nil, false))
+		params = append(params, p.NewParam(token.NoPos, "opts", types.NewSlice(tyOpt)))
+	}
+	tyRet := types.NewPointer(typ)
+	results := []*types.Var{p.NewParam(token.NoPos, "", tyRet)}
+	if opts.Validate != "" {
+		results = append(results, p.NewParam(token.NoPos, "", types.Universe.Lookup("error").Type()))
+	}
+	fn := p.NewFunc(nil, name, NewTuple(params...), NewTuple(results...), opts.Options)
+	cb := fn.BodyStart(p)
+	if !simple {
+		cb.DefineVarStart(token.NoPos, "ret")
+	}
+	for i, fld := range fields {
+		cb.Val(fieldIndex(t, fld.Name())).Val(params[i])
+	}
+	cb.StructLit(typ, len(fields)<<1, true).UnaryOp(token.AND)
+	if simple {
+		cb.Return(1).End()
+		return fn
+	}
+	cb.EndInit(1)
+	if opts.Options {
+		cb.ForRange("_", "opt").VarVal("opts").RangeAssignThen(token.NoPos).
+			/**/ VarVal("opt").VarVal("ret").Call(1).EndStmt().
+			End()
+	}
+	if opts.Validate != "" {
+		cb.If().DefineVarStart(token.NoPos, "err").VarVal("ret").MemberVal(opts.Validate).Call(0).EndInit(1).
+			/**/ VarVal("err").Val(nil).BinaryOp(token.NEQ).Then().
+			/**/ Val(nil).VarVal("err").Return(2).
+			End()
+		cb.VarVal("ret").Val(nil).Return(2)
+	} else {
+		cb.VarVal("ret").Return(1)
+	}
+	cb.End()
+	return fn
+}
+
+// ----------------------------------------------------------------------------
+
+// NewBuilderType generates a builder type of the struct type `typ`, with
+// fields initialized by `defaults` (others are zero values):
+//
+//	type TBuilder struct {
+//		v T
+//	}
+//
+//	func NewTBuilder() *TBuilder {
+//		return &TBuilder{v: T{field1: default1, ...}}
+//	}
+//
+//	func (p *TBuilder) WithField1(v T1) *TBuilder {
+//		p.v.field1 = v
+//		return p
+//	}
+//	...
+//
+//	func (p *TBuilder) Build() *T {
+//		ret := p.v
+//		return &ret
+//	}
+func (p *Package) NewBuilderType(typ *types.Named, defaults map[string]F) *types.Named {
+	tname := typ.Obj().Name()
+	if debugInstr {
+		log.Println("NewBuilderType", typ)
+	}
+	t := structOf(typ)
+	fields := selectFields(typ, nil)
+	for name := range defaults {
+		if lookupField(t, name) == nil {
+			log.Panicln(typ, "has no field", name)
+		}
+	}
+	bfields := []*types.Var{types.NewField(token.NoPos, p.Types, "v", typ, false)}
+	builder := p.NewTypeDefs().NewType(tname+"Builder").InitType(p, types.NewStruct(bfields, nil))
+	tyRet := types.NewPointer(builder)
+
+	cb := p.NewFunc(nil, "New"+tname+"Builder", nil, NewTuple(p.NewParam(token.NoPos, "", tyRet)), false).
+		BodyStart(p)
+	if len(defaults) > 0 {
+		cb.Val(0)
+		n := 0
+		for _, fld := range fields { // keep order of fields
+			if fn, ok := defaults[fld.Name()]; ok {
+				cb.Val(fieldIndex(t, fld.Name()))
+				if fn(cb) != 1 {
+					log.Panicln("default value of", fld.Name(), "isn't a single value")
+				}
+				n++
+			}
+		}
+		cb.StructLit(typ, n<<1, true).StructLit(builder, 2, true)
+	} else {
+		cb.StructLit(builder, 0, true)
+	}
+	cb.UnaryOp(token.AND).Return(1).End()
+
+	for _, fld := range fields {
+		recv := p.NewParam(token.NoPos, "p", tyRet)
+		params := NewTuple(p.NewParam(token.NoPos, "v", fld.Type()))
+		p.NewFunc(recv, "With"+exportName(fld.Name()), params, NewTuple(p.NewParam(token.NoPos, "", tyRet)), false).
+			BodyStart(p).
+			VarVal("p").MemberVal("v").MemberRef(fld.Name()).VarVal("v").Assign(1).
+			VarVal("p").Return(1).
+			End()
+	}
+
+	recv := p.NewParam(token.NoPos, "p", tyRet)
+	p.NewFunc(recv, "Build", nil, NewTuple(p.NewParam(token.NoPos, "", types.NewPointer(typ))), false).
+		BodyStart(p).
+		DefineVarStart(token.NoPos, "ret").VarVal("p").MemberVal("v").EndInit(1).
+		VarVal("ret").UnaryOp(token.AND).Return(1).
+		End()
+	return builder
+}
+
+// ----------------------------------------------------------------------------
+
+// NewClone generates a Clone method of the struct type `typ`, which copies
+// slices, maps and pointers held by fields, and clones values having a Clone
+// method recursively:
+//
+//	func (p *T) Clone() *T {
+//		if p == nil {
+//			return nil
+//		}
+//		ret := new(T)
+//		*ret = *p
+//		if p.slice != nil {
+//			ret.slice = make([]E, len(p.slice))
+//			copy(ret.slice, p.slice)
+//		}
+//		if p.ptr != nil {
+//			ret.ptr = p.ptr.Clone()
+//		}
+//		...
+//		return ret
+//	}
+//
+// If cycleSafe is true, Clone calls an unexported method `cloneWith` which
+// tracks cloned objects of *T in a map, so that cyclic references (eg.
+// `next *T` of a ring) are preserved instead of leading to infinite recursion.
+func (p *Package) NewClone(typ *types.Named, cycleSafe bool) *Func {
+	if debugInstr {
+		log.Println("NewClone", typ, cycleSafe)
+	}
+	structOf(typ)
+	tyPtr := types.NewPointer(typ)
+	ret := NewTuple(p.NewParam(token.NoPos, "", tyPtr))
+	recv := p.NewParam(token.NoPos, "p", tyPtr)
+	fn := p.NewFunc(recv, "Clone", nil, ret, false)
+	if !cycleSafe {
+		p.cloneBody(fn.BodyStart(p), typ, nil)
+		return fn
+	}
+	tySeen := types.NewMap(tyPtr, tyPtr)
+	seen := p.NewParam(token.NoPos, "seen", tySeen)
+	recv = p.NewParam(token.NoPos, "p", tyPtr)
+	fnWith := p.NewFunc(recv, "cloneWith", NewTuple(seen), ret, false)
+	fn.BodyStart(p).
+		VarVal("p").MemberVal("cloneWith").
+		Val(p.Builtin().Ref("make")).Typ(tySeen).Call(1).
+		Call(1).Return(1).
+		End()
+	p.cloneBody(fnWith.BodyStart(p), typ, seen)
+	return fn
+}
+
+func (p *Package) cloneBody(cb *CodeBuilder, typ *types.Named, seen *types.Var) {
+	tyPtr := types.NewPointer(typ)
+	builtin := p.Builtin()
+	cb.If().VarVal("p").Val(nil).BinaryOp(token.EQL).Then().
+		/**/ Val(nil).Return(1).
+		End()
+	if seen != nil {
+		cb.If().DefineVarStart(token.NoPos, "v", "ok").Val(seen).VarVal("p").Index(1, true).EndInit(1).
+			/**/ VarVal("ok").Then().
+			/**/ VarVal("v").Return(1).
+			End()
+	}
+	cb.DefineVarStart(token.NoPos, "ret").Val(builtin.Ref("new")).Typ(typ).Call(1).EndInit(1).
+		VarVal("ret").ElemRef().VarVal("p").Elem().Assign(1)
+	if seen != nil {
+		cb.Val(seen).VarVal("p").IndexRef(1).VarVal("ret").Assign(1)
+	}
+	// cloneOf clones the value on the top of the stack if necessary.
+	cloneOf := func(t types.Type) {
+		if seen != nil && types.Identical(t, tyPtr) {
+			cb.MemberVal("cloneWith").Val(seen).Call(1)
+		} else if hasCloneMethod(t) {
+			cb.MemberVal("Clone").Call(0)
+		}
+	}
+	t := structOf(typ)
+	for i, n := 0, t.NumFields(); i < n; i++ {
+		fld := t.Field(i)
+		name := fld.Name()
+		if name == "_" {
+			continue
+		}
+		switch ft := fld.Type().Underlying().(type) {
+		case *types.Slice:
+			cb.If().VarVal("p").MemberVal(name).Val(nil).BinaryOp(token.NEQ).Then().
+				/**/ VarVal("ret").MemberRef(name).
+				/**/ Val(builtin.Ref("make")).Typ(fld.Type()).Val(builtin.Ref("len")).VarVal("p").MemberVal(name).Call(1).Call(2).
+				/**/ Assign(1)
+			if needClone(ft.Elem(), tyPtr, seen) {
+				cb.ForRange("i", "v").VarVal("p").MemberVal(name).RangeAssignThen(token.NoPos).
+					/**/ VarVal("ret").MemberVal(name).VarVal("i").IndexRef(1).VarVal("v")
+				cloneOf(ft.Elem())
+				cb.Assign(1).
+					End()
+			} else {
+				cb.Val(builtin.Ref("copy")).VarVal("ret").MemberVal(name).VarVal("p").MemberVal(name).Call(2).EndStmt()
+			}
+			cb.End()
+		case *types.Map:
+			cb.If().VarVal("p").MemberVal(name).Val(nil).BinaryOp(token.NEQ).Then().
+				/**/ VarVal("ret").MemberRef(name).
+				/**/ Val(builtin.Ref("make")).Typ(fld.Type()).Val(builtin.Ref("len")).VarVal("p").MemberVal(name).Call(1).Call(2).
+				/**/ Assign(1).
+				/**/ ForRange("k", "v").VarVal("p").MemberVal(name).RangeAssignThen(token.NoPos).
+				/******/ VarVal("ret").MemberVal(name).VarVal("k").IndexRef(1).VarVal("v")
+			cloneOf(ft.Elem())
+			cb.Assign(1).
+				/**/ End().
+				End()
+		case *types.Pointer:
+			cb.If().VarVal("p").MemberVal(name).Val(nil).BinaryOp(token.NEQ).Then()
+			if needClone(fld.Type(), tyPtr, seen) {
+				cb.VarVal("ret").MemberRef(name).VarVal("p").MemberVal(name)
+				cloneOf(fld.Type())
+				cb.Assign(1)
+			} else {
+				cb.DefineVarStart(token.NoPos, "v").VarVal("p").MemberVal(name).Elem().EndInit(1).
+					VarVal("ret").MemberRef(name).VarVal("v").UnaryOp(token.AND).Assign(1)
+			}
+			cb.End()
+		default:
+			if hasCloneMethod(fld.Type()) {
+				cb.VarVal("ret").MemberRef(name).VarVal("p").MemberVal(name)
+				cloneOf(fld.Type())
+				cb.Assign(1)
+			}
+		}
+	}
+	cb.VarVal("ret").Return(1).
+		End()
+}
+
+func needClone(t types.Type, tyPtr types.Type, seen *types.Var) bool {
+	return (seen != nil && types.Identical(t, tyPtr)) || hasCloneMethod(t)
+}
+
+// hasCloneMethod checks if `t` has a method `Clone() t`.
+func hasCloneMethod(t types.Type) bool {
+	obj, _, _ := types.LookupFieldOrMethod(t, false, nil, "Clone")
+	if fn, ok := obj.(*types.Func); ok {
+		sig := fn.Type().(*types.Signature)
+		return sig.Params().Len() == 0 && sig.Results().Len() == 1 &&
+			types.Identical(sig.Results().At(0).Type(), t)
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------
+
+// EqualMode specifies how NewEqual compares a field.
+type EqualMode int
+
+const (
+	// EqualAuto compares a field by Go equality semantics. Values having
+	// a method `Equal(T) bool` (eg. time.Time) are compared by it, and
+	// slices and maps are compared element by element.
+	EqualAuto EqualMode = iota
+	// EqualIgnore doesn't compare a field.
+	EqualIgnore
+	// EqualDeep compares a field by reflect.DeepEqual.
+	EqualDeep
+)
+
+// NewEqual generates an Equal method of the struct type `typ`, which compares
+// fields according to `modes` (EqualAuto by default):
+//
+//	func (p T) Equal(other T) bool {
+//		if p.name != other.name {
+//			return false
+//		}
+//		if !p.time.Equal(other.time) {
+//			return false
+//		}
+//		if len(p.slice) != len(other.slice) {
+//			return false
+//		}
+//		for i, v := range p.slice {
+//			if v != other.slice[i] {
+//				return false
+//			}
+//		}
+//		...
+//		return true
+//	}
+//
+// Fields which are neither comparable nor slices/maps of comparable elements
+// are compared by reflect.DeepEqual. Embedded fields are compared as other
+// fields.
+func (p *Package) NewEqual(typ *types.Named, modes map[string]EqualMode) *Func {
+	if debugInstr {
+		log.Println("NewEqual", typ)
+	}
+	t := structOf(typ)
+	for name := range modes {
+		if lookupField(t, name) == nil {
+			log.Panicln(typ, "has no field", name)
+		}
+	}
+	recv := p.NewParam(token.NoPos, "p", typ)
+	params := NewTuple(p.NewParam(token.NoPos, "other", typ))
+	ret := NewTuple(p.NewParam(token.NoPos, "", types.Typ[types.Bool]))
+	fn := p.NewFunc(recv, "Equal", params, ret, false)
+	cb := fn.BodyStart(p)
+	retFalse := func() {
+		cb.Then().Val(false).Return(1).End()
+	}
+	deepEqual := func(name string) {
+		cb.If().
+			Val(p.Import("reflect").Ref("DeepEqual")).
+			VarVal("p").MemberVal(name).VarVal("other").MemberVal(name).Call(2).
+			UnaryOp(token.NOT)
+		retFalse()
+	}
+	for i, n := 0, t.NumFields(); i < n; i++ {
+		fld := t.Field(i)
+		name := fld.Name()
+		if name == "_" {
+			continue
+		}
+		ft := fld.Type()
+		switch modes[name] {
+		case EqualIgnore:
+			continue
+		case EqualDeep:
+			deepEqual(name)
+			continue
+		}
+		if canCompare(ft) {
+			cb.If().VarVal("p").MemberVal(name)
+			notEqual(cb, ft, func() { cb.VarVal("other").MemberVal(name) })
+			retFalse()
+			continue
+		}
+		switch u := ft.Underlying().(type) {
+		case *types.Slice:
+			if canCompare(u.Elem()) {
+				p.lenNotEqual(cb, name)
+				retFalse()
+				cb.ForRange("i", "v").VarVal("p").MemberVal(name).RangeAssignThen(token.NoPos).
+					/**/ If().VarVal("v")
+				notEqual(cb, u.Elem(), func() { cb.VarVal("other").MemberVal(name).VarVal("i").Index(1, false) })
+				retFalse()
+				cb.End()
+				continue
+			}
+		case *types.Map:
+			if canCompare(u.Elem()) {
+				p.lenNotEqual(cb, name)
+				retFalse()
+				cb.ForRange("k", "v").VarVal("p").MemberVal(name).RangeAssignThen(token.NoPos).
+					/**/ If().DefineVarStart(token.NoPos, "v2", "ok").
+					/**/ VarVal("other").MemberVal(name).VarVal("k").Index(1, true).EndInit(1).
+					/**/ VarVal("ok").UnaryOp(token.NOT).VarVal("v2")
+				notEqual(cb, u.Elem(), func() { cb.VarVal("v") })
+				cb.BinaryOp(token.LOR)
+				retFalse()
+				cb.End()
+				continue
+			}
+		}
+		deepEqual(name)
+	}
+	cb.Val(true).Return(1).
+		End()
+	return fn
+}
+
+func (p *Package) lenNotEqual(cb *CodeBuilder, name string) {
+	lenf := p.Builtin().Ref("len")
+	cb.If().
+		Val(lenf).VarVal("p").MemberVal(name).Call(1).
+		Val(lenf).VarVal("other").MemberVal(name).Call(1).
+		BinaryOp(token.NEQ)
+}
+
+// notEqual compares the value on the top of the stack with the value pushed
+// by `y`, by a method `Equal(T) bool` if `t` has, otherwise by `!=`.
+func notEqual(cb *CodeBuilder, t types.Type, y func()) {
+	if hasEqualMethod(t) {
+		cb.MemberVal("Equal")
+		y()
+		cb.Call(1).UnaryOp(token.NOT)
+	} else {
+		y()
+		cb.BinaryOp(token.NEQ)
+	}
+}
+
+// canCompare checks if values of type `t` can be compared by notEqual.
+func canCompare(t types.Type) bool {
+	return hasEqualMethod(t) || types.Comparable(t)
+}
+
+// hasEqualMethod checks if `t` has a method `Equal(t) bool`.
+func hasEqualMethod(t types.Type) bool {
+	obj, _, _ := types.LookupFieldOrMethod(t, false, nil, "Equal")
+	if fn, ok := obj.(*types.Func); ok {
+		sig := fn.Type().(*types.Signature)
+		return sig.Params().Len() == 1 && sig.Results().Len() == 1 &&
+			types.Identical(sig.Params().At(0).Type(), t) &&
+			types.Identical(sig.Results().At(0).Type(), types.Typ[types.Bool])
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------
+
+type jsonField struct {
+	*types.Var
+	key       string
+	omitEmpty bool
+	asString  bool
+	marshaler bool // encoded by its MarshalJSON or MarshalText method
+}
+
+func (p *Package) jsonFields(typ *types.Named) []*jsonField {
+	t := structOf(typ)
+	ret := make([]*jsonField, 0, t.NumFields())
+	for i, n := 0, t.NumFields(); i < n; i++ {
+		fld := t.Field(i)
+		if fld.Embedded() {
+			log.Panicln("NewJSONMethods:", typ, "has an embedded field", fld.Name())
+		}
+		if !fld.Exported() {
+			continue
+		}
+		tag := reflect.StructTag(t.Tag(i)).Get("json")
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		jf := &jsonField{Var: fld, key: opts[0], marshaler: p.isMarshaler(fld.Type())}
+		if jf.key == "" {
+			jf.key = fld.Name()
+		}
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "omitempty":
+				jf.omitEmpty = true
+			case "string":
+				if jf.marshaler { // encoding/json ignores it
+					continue
+				}
+				if t, ok := fld.Type().Underlying().(*types.Basic); !ok || t.Info()&(types.IsInteger|types.IsBoolean) == 0 {
+					log.Panicln("NewJSONMethods: unsupported option `string` of field", fld.Name())
+				}
+				jf.asString = true
+			}
+		}
+		ret = append(ret, jf)
+	}
+	return ret
+}
+
+// isMarshaler checks if values of type `t` are encoded by encoding/json with
+// their own methods, ie. `t` or `*t` implements json.Marshaler or
+// encoding.TextMarshaler.
+func (p *Package) isMarshaler(t types.Type) bool {
+	ifaces := [...][2]string{{"encoding/json", "Marshaler"}, {"encoding", "TextMarshaler"}}
+	for _, iface := range ifaces {
+		it := p.Import(iface[0]).Ref(iface[1]).Type().Underlying().(*types.Interface)
+		if types.Implements(t, it) || types.Implements(types.NewPointer(t), it) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewJSONMethods generates MarshalJSON and UnmarshalJSON methods of the
+// struct type `typ`, honoring `json` tags of its fields (name, omitempty,
+// string and "-"). MarshalJSON appends fields to a preallocated buffer, and
+// formats integers and booleans by strconv directly:
+//
+//	func (p T) MarshalJSON() ([]byte, error) {
+//		buf := make([]byte, 0, N)
+//		buf = append(buf, '{')
+//		buf = append(buf, "\"id\":"...)
+//		buf = strconv.AppendInt(buf, int64(p.ID), 10)
+//		buf = append(buf, ',')
+//		if len(p.Tags) != 0 { // omitempty
+//			buf = append(buf, "\"tags\":"...)
+//			if b, err := json.Marshal(p.Tags); err != nil {
+//				return nil, err
+//			} else {
+//				buf = append(buf, b...)
+//			}
+//			buf = append(buf, ',')
+//		}
+//		if buf[len(buf)-1] == ',' {
+//			buf[len(buf)-1] = '}'
+//		} else {
+//			buf = append(buf, '}')
+//		}
+//		return buf, nil
+//	}
+//
+//	func (p *T) UnmarshalJSON(data []byte) error {
+//		type plain T
+//		return json.Unmarshal(data, (*plain)(p))
+//	}
+//
+// Fields implementing json.Marshaler or encoding.TextMarshaler are always
+// encoded by json.Marshal. Embedded fields are unsupported.
+func (p *Package) NewJSONMethods(typ *types.Named) {
+	if debugInstr {
+		log.Println("NewJSONMethods", typ)
+	}
+	fields := p.jsonFields(typ)
+	builtin := p.Builtin()
+	json := p.Import("encoding/json")
+	tyBytes := types.NewSlice(TyByte)
+	tyError := types.Universe.Lookup("error").Type()
+
+	recv := p.NewParam(token.NoPos, "p", typ)
+	ret := NewTuple(p.NewParam(token.NoPos, "", tyBytes), p.NewParam(token.NoPos, "", tyError))
+	cb := p.NewFunc(recv, "MarshalJSON", nil, ret, false).BodyStart(p)
+	size := 2
+	for _, fld := range fields {
+		size += len(fld.key) + 20
+	}
+	cb.DefineVarStart(token.NoPos, "buf").
+		Val(builtin.Ref("make")).Typ(tyBytes).Val(0).Val(size).Call(3).EndInit(1)
+	buf := cb.Scope().Lookup("buf")
+	// bufAppend generates `buf = append(buf, v)` or `buf = append(buf, v...)`.
+	bufAppend := func(v interface{}, ellipsis bool) {
+		cb.VarRef(buf).Val(builtin.Ref("append")).Val(buf).Val(v).Call(2, ellipsis).Assign(1)
+	}
+	// bufCall generates `buf = strconv.fn(buf, T(p.name), args...)`.
+	bufCall := func(fn string, t types.Type, fld *types.Var, args ...interface{}) {
+		cb.VarRef(buf).Val(p.Import("strconv").Ref(fn)).Val(buf)
+		if types.Identical(fld.Type(), t) {
+			cb.VarVal("p").MemberVal(fld.Name())
+		} else {
+			cb.Typ(t).VarVal("p").MemberVal(fld.Name()).Call(1)
+		}
+		for _, arg := range args {
+			cb.Val(arg)
+		}
+		cb.Call(2 + len(args)).Assign(1)
+	}
+	bufAppend('{', false)
+	for _, fld := range fields {
+		name := fld.Name()
+		omit := fld.omitEmpty && p.notEmptyIf(cb, fld.Var)
+		if omit {
+			cb.Then()
+		}
+		bufAppend(strconv.Quote(fld.key)+":", true)
+		if fld.asString {
+			bufAppend('"', false)
+		}
+		var t *types.Basic
+		if !fld.marshaler {
+			t, _ = fld.Type().Underlying().(*types.Basic)
+		}
+		switch {
+		case t != nil && t.Info()&types.IsBoolean != 0:
+			bufCall("AppendBool", types.Typ[types.Bool], fld.Var)
+		case t != nil && t.Info()&types.IsUnsigned != 0:
+			bufCall("AppendUint", types.Typ[types.Uint64], fld.Var, 10)
+		case t != nil && t.Info()&types.IsInteger != 0:
+			bufCall("AppendInt", types.Typ[types.Int64], fld.Var, 10)
+		default:
+			cb.If().DefineVarStart(token.NoPos, "b", "err").
+				/**/ Val(json.Ref("Marshal")).VarVal("p").MemberVal(name).Call(1).EndInit(1).
+				/**/ VarVal("err").Val(nil).BinaryOp(token.NEQ).Then().
+				/**/ Val(nil).VarVal("err").Return(2).
+				Else()
+			_, b := cb.Scope().LookupParent("b", token.NoPos)
+			bufAppend(b, true)
+			cb.End()
+		}
+		if fld.asString {
+			bufAppend('"', false)
+		}
+		bufAppend(',', false)
+		if omit {
+			cb.End()
+		}
+	}
+	last := func() *CodeBuilder {
+		return cb.Val(buf).Val(builtin.Ref("len")).Val(buf).Call(1).Val(1).BinaryOp(token.SUB)
+	}
+	cb.If()
+	last().Index(1, false).Val(',').BinaryOp(token.EQL).Then()
+	last().IndexRef(1).Val('}').Assign(1)
+	cb.Else()
+	bufAppend('}', false)
+	cb.End().
+		Val(buf).Val(nil).Return(2).
+		End()
+
+	recv = p.NewParam(token.NoPos, "p", types.NewPointer(typ))
+	params := NewTuple(p.NewParam(token.NoPos, "data", tyBytes))
+	cb = p.NewFunc(recv, "UnmarshalJSON", params, NewTuple(p.NewParam(token.NoPos, "", tyError)), false).
+		BodyStart(p)
+	plain := cb.NewTypeDefs().NewType("plain").InitType(p, typ)
+	cb.Val(json.Ref("Unmarshal")).
+		VarVal("data").Typ(types.NewPointer(plain)).VarVal("p").Call(1).
+		Call(2).Return(1).
+		End()
+}
+
+// notEmptyIf starts `if p.name is not empty` for the `omitempty` option of
+// the field `fld`. It returns false (without starting if) if values of the
+// field are never empty, eg. structs.
+func (p *Package) notEmptyIf(cb *CodeBuilder, fld *types.Var) bool {
+	name := fld.Name()
+	switch t := fld.Type().Underlying().(type) {
+	case *types.Basic:
+		cb.If().VarVal("p").MemberVal(name)
+		switch {
+		case t.Info()&types.IsBoolean != 0:
+		case t.Info()&types.IsString != 0:
+			cb.Val("").BinaryOp(token.NEQ)
+		default:
+			cb.Val(0).BinaryOp(token.NEQ)
+		}
+	case *types.Slice, *types.Map, *types.Array:
+		cb.If().Val(p.Builtin().Ref("len")).VarVal("p").MemberVal(name).Call(1).Val(0).BinaryOp(token.NEQ)
+	case *types.Pointer, *types.Interface:
+		cb.If().VarVal("p").MemberVal(name).Val(nil).BinaryOp(token.NEQ)
+	default:
+		return false
+	}
+	return true
+}
+
+// ----------------------------------------------------------------------------
+
+// StructBuilder builds a struct type field by field (see NewStructType).
+type StructBuilder struct {
+	pkg    *Package
+	fields []*types.Var
+	tags   []string
+}
+
+// NewStructType starts to build a struct type:
+//
+//	pkg.NewStructType().
+//		Field("", typBase, "", true).
+//		Field("Name", types.Typ[types.String], `json:"name"`, false).
+//		Type()
+func (p *Package) NewStructType() *StructBuilder {
+	return &StructBuilder{pkg: p}
+}
+
+// Field adds a field `name` of type `typ` with the struct tag `tag` (can be
+// empty). If `embedded` is true, it adds an embedded field, whose name can be
+// empty to take the name of `typ` (or its element type if `typ` is a pointer).
+func (p *StructBuilder) Field(name string, typ types.Type, tag string, embedded bool) *StructBuilder {
+	if debugInstr {
+		log.Println("StructField", name, typ, tag, embedded)
+	}
+	if embedded && name == "" {
+		name = embeddedName(typ)
+	}
+	if name != "_" {
+		for _, fld := range p.fields {
+			if fld.Name() == name {
+				log.Panicln("duplicate field", name)
+			}
+		}
+	}
+	p.fields = append(p.fields, types.NewField(token.NoPos, p.pkg.Types, name, typ, embedded))
+	p.tags = append(p.tags, tag)
+	return p
+}
+
+// Type returns the struct type built.
+func (p *StructBuilder) Type() *types.Struct {
+	return types.NewStruct(p.fields, p.tags)
+}
+
+// AST returns the AST of the struct type built, with struct tags and
+// embedded fields.
+func (p *StructBuilder) AST() *ast.StructType {
+	return toStructType(p.pkg, p.Type()).(*ast.StructType)
+}
+
+// ----------------------------------------------------------------------------
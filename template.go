@@ -123,6 +123,8 @@ func boundType(pkg *Package, arg, param types.Type, parg *internal.Elem) error {
 				return fmt.Errorf("TODO: contract.Match %v => %v failed", arg, p.typ.contract)
 			}
 			p.boundTo(pkg, arg, parg)
+		} else if isUntypedNumericOf(arg, p.tBound) { // untyped int + untyped rune => untyped rune
+			p.tBound, p.parg = arg, parg
 		} else if !AssignableConv(pkg, getElemTypeIf(arg, parg), p.tBound, parg) {
 			if !(isUntyped(pkg, p.tBound) && AssignableConv(pkg, p.tBound, arg, p.parg)) {
 				return &boundTypeError{a: arg, b: p.tBound}
@@ -190,6 +192,27 @@ func Default(pkg *Package, t types.Type) types.Type {
 	return DefaultConv(pkg, t, nil)
 }
 
+// DefaultOf returns the default type of a value combining values of types
+// `typs` (like elements of `[a, b, c]` or operands of `cond ? a : b`), or
+// nil if they have no common type. For example, DefaultOf(untyped int,
+// untyped rune) is rune, and DefaultOf(untyped int, untyped bigint) is bigint.
+func DefaultOf(pkg *Package, typs ...types.Type) types.Type {
+	var t types.Type
+	for _, typ := range typs {
+		if t == nil {
+			t = typ
+		} else if t = commonType(pkg, t, typ); t == nil {
+			return nil
+		}
+	}
+	if t == nil {
+		return nil
+	}
+	return Default(pkg, t)
+}
+
+// DefaultConv is like Default, but it also converts the value `pv` (can be
+// nil) to the default type, which is required by custom untyped types.
 func DefaultConv(pkg *Package, t types.Type, pv *Element) types.Type {
 	switch typ := t.(type) {
 	case *types.Named:
@@ -405,22 +428,93 @@ func assignable(pkg *Package, v types.Type, t *types.Named, pv *internal.Elem) b
 	return false
 }
 
+// ComparableTo reports whether values `varg` and `targ` can be compared by
+// `==` and `!=`. See CheckComparable for the reason if they can't.
 func ComparableTo(pkg *Package, varg, targ *Element) bool {
+	return CheckComparable(pkg, varg, targ) == nil
+}
+
+// CheckComparable checks whether values `varg` and `targ` can be compared by
+// `==` and `!=`. If they can't, it returns an error explaining why, like
+// "mismatched types int and string" or "slice can only be compared to nil".
+func CheckComparable(pkg *Package, varg, targ *Element) error {
 	V, T := varg.Type, targ.Type
 	if v, ok := V.(*types.Basic); ok {
 		if (v.Info() & types.IsUntyped) != 0 {
-			return untypedComparable(pkg, v, varg, T)
+			if untypedComparable(pkg, v, varg, T) {
+				return nil
+			}
+			return mismatchedTypes(pkg, V, T)
 		}
 	}
 	if t, ok := T.(*types.Basic); ok {
 		if (t.Info() & types.IsUntyped) != 0 {
-			return untypedComparable(pkg, t, targ, V)
+			if untypedComparable(pkg, t, targ, V) {
+				return nil
+			}
+			return mismatchedTypes(pkg, V, T)
 		}
 	}
-	if getUnderlying(pkg, V) == getUnderlying(pkg, T) {
-		return true
+	if getUnderlying(pkg, V) != getUnderlying(pkg, T) &&
+		!AssignableConv(pkg, V, T, varg) && !AssignableConv(pkg, T, V, targ) {
+		return mismatchedTypes(pkg, V, T)
+	}
+	if reason := incomparableReason(pkg, V); reason != "" {
+		return &comparableError{reason}
+	}
+	if reason := incomparableReason(pkg, T); reason != "" {
+		return &comparableError{reason}
+	}
+	return nil
+}
+
+type comparableError struct {
+	reason string
+}
+
+func (p *comparableError) Error() string {
+	return p.reason
+}
+
+// mismatchedTypes explains why V and T don't match: if one of them is an
+// interface which the other doesn't implement, the missing method is given.
+func mismatchedTypes(pkg *Package, V, T types.Type) error {
+	iface, typ := V, T
+	if _, ok := getUnderlying(pkg, iface).(*types.Interface); !ok {
+		iface, typ = T, V
+	}
+	if _, ok := getUnderlying(pkg, iface).(*types.Interface); ok {
+		if _, ok := getUnderlying(pkg, typ).(*types.Interface); !ok && !isUntyped(pkg, typ) {
+			if m := CheckImplements(pkg, typ, iface); m != nil {
+				return &comparableError{m.Error()}
+			}
+		}
+	}
+	return &comparableError{fmt.Sprintf("mismatched types %v and %v", V, T)}
+}
+
+// incomparableReason returns why values of type `t` can't be compared, or ""
+// if they can.
+func incomparableReason(pkg *Package, t types.Type) string {
+	switch u := getUnderlying(pkg, t).(type) {
+	case *types.Slice:
+		return "slice can only be compared to nil"
+	case *types.Map:
+		return "map can only be compared to nil"
+	case *types.Signature:
+		return "func can only be compared to nil"
+	case *types.Struct:
+		for i, n := 0, u.NumFields(); i < n; i++ {
+			if ft := u.Field(i).Type(); !types.Comparable(ft) {
+				return fmt.Sprintf("struct containing %v cannot be compared", ft)
+			}
+		}
+	case *types.Array:
+		if !types.Comparable(u.Elem()) {
+			return fmt.Sprintf("%v cannot be compared", t)
+		}
 	}
-	return AssignableConv(pkg, V, T, varg) || AssignableConv(pkg, T, V, targ)
+	return ""
 }
 
 func untypedComparable(pkg *Package, v *types.Basic, varg *Element, t types.Type) bool {
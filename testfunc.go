@@ -0,0 +1,145 @@
+/*
+ Copyright 2022 The GoPlus Authors (goplus.org)
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package gox
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"log"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+
+// TestGoFile returns name of the testing file of a file named `fname`, that
+// is, `fname` itself if it ends with `_test.go`, otherwise `fname` with its
+// `.go` suffix replaced by `_test.go` (`gox_test.go` if `fname` is empty).
+func TestGoFile(fname string) string {
+	if strings.HasSuffix(fname, "_test.go") {
+		return fname
+	}
+	if fname == "" {
+		return "gox_test.go"
+	}
+	return strings.TrimSuffix(fname, ".go") + "_test.go"
+}
+
+// newTestingFunc declares `func <prefix>Name(<param> *testing.<typ>)` in the
+// testing file of the current file, and generates its body by `body`.
+func (p *Package) newTestingFunc(
+	prefix, name, param, typ string, body func(cb *CodeBuilder, x *Param)) *Func {
+	if !strings.HasPrefix(name, prefix) {
+		name = prefix + name
+	}
+	old, _ := p.SetCurFile(TestGoFile(p.file.fname), true)
+	defer p.RestoreCurFile(old)
+	t := p.Import("testing").Ref(typ).Type()
+	x := p.NewParam(token.NoPos, param, types.NewPointer(t))
+	fn := p.NewFunc(nil, name, NewTuple(x), nil, false)
+	cb := fn.BodyStart(p)
+	if body != nil {
+		body(cb, x)
+	}
+	cb.End()
+	return fn
+}
+
+// NewTestFunc declares a test function `func TestName(t *testing.T)` in the
+// testing file of the current file (see TestGoFile), and generates its body by
+// `body`. The `Test` prefix is added to `name` if it doesn't have one.
+func (p *Package) NewTestFunc(name string, body func(cb *CodeBuilder, t *Param)) *Func {
+	if debugInstr {
+		log.Println("NewTestFunc", name)
+	}
+	return p.newTestingFunc("Test", name, "t", "T", body)
+}
+
+// NewBenchmarkFunc declares a benchmark function
+// `func BenchmarkName(b *testing.B)` in the testing file of the current file.
+func (p *Package) NewBenchmarkFunc(name string, body func(cb *CodeBuilder, b *Param)) *Func {
+	if debugInstr {
+		log.Println("NewBenchmarkFunc", name)
+	}
+	return p.newTestingFunc("Benchmark", name, "b", "B", body)
+}
+
+// NewFuzzFunc declares a fuzz test function `func FuzzName(f *testing.F)` in
+// the testing file of the current file.
+func (p *Package) NewFuzzFunc(name string, body func(cb *CodeBuilder, f *Param)) *Func {
+	if debugInstr {
+		log.Println("NewFuzzFunc", name)
+	}
+	return p.newTestingFunc("Fuzz", name, "f", "F", body)
+}
+
+// NewTableTest declares a table-driven test function in the testing file of
+// the current file:
+//
+//	func TestName(t *testing.T) {
+//		tests := []struct {
+//			name string
+//			fields...
+//		}{
+//			{cases[0]...},
+//			...
+//		}
+//		for _, tt := range tests {
+//			t.Run(tt.name, func(t *testing.T) {
+//				body(cb, t, tt)
+//			})
+//		}
+//	}
+//
+// Each case lists values (accepted by CodeBuilder.Val) of the name and fields.
+func (p *Package) NewTableTest(
+	name string, fields []*types.Var, cases [][]interface{},
+	body func(cb *CodeBuilder, t *Param, tt types.Object)) *Func {
+	if debugInstr {
+		log.Println("NewTableTest", name, len(fields), len(cases))
+	}
+	flds := make([]*types.Var, 0, len(fields)+1)
+	flds = append(flds, types.NewField(token.NoPos, p.Types, "name", types.Typ[types.String], false))
+	flds = append(flds, fields...)
+	tyCase := types.NewStruct(flds, nil)
+	return p.NewTestFunc(name, func(cb *CodeBuilder, t *Param) {
+		cb.DefineVarStart(token.NoPos, "tests")
+		for _, c := range cases {
+			if len(c) != len(flds) {
+				log.Panicln("NewTableTest: case", c, "doesn't match fields")
+			}
+			for _, v := range c {
+				cb.Val(v)
+			}
+			cb.StructLit(tyCase, len(c), false)
+		}
+		cb.SliceLit(types.NewSlice(tyCase), len(cases))
+		for _, elt := range cb.Get(-1).Val.(*ast.CompositeLit).Elts {
+			elt.(*ast.CompositeLit).Type = nil // elide types of cases
+		}
+		cb.EndInit(1).
+			ForRange("_", "tt").VarVal("tests").RangeAssignThen(token.NoPos)
+		tt := cb.Scope().Lookup("tt")
+		inner := p.NewParam(token.NoPos, "t", t.Type())
+		cb.Val(t).MemberVal("Run").Val(tt).MemberVal("name").
+			NewClosure(NewTuple(inner), nil, false).BodyStart(p)
+		if body != nil {
+			body(cb, inner, tt)
+		}
+		cb.End().Call(2).EndStmt().
+			End()
+	})
+}
+
+// ----------------------------------------------------------------------------
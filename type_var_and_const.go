@@ -91,7 +91,26 @@ func (p *TypeDecl) Inited() bool {
 	return p.spec.Type != nil
 }
 
-// InitType initializes a uncompleted type.
+// SetTypeParams makes an uncompleted type generic, like `type List[T any]`.
+// Unlike passing `tparams` to InitType, the type can be instantiated by its
+// own type parameters before InitType is called, so it can refer to itself:
+//
+//	decl := pkg.NewType("List").SetTypeParams(pkg, tp) // tp is type parameter T
+//	self, _ := types.Instantiate(nil, decl.Type(), []types.Type{tp}, false)
+//	decl.InitType(pkg, types.NewStruct(...)) // fields `next *List[T]` and `val T`
+func (p *TypeDecl) SetTypeParams(pkg *Package, tparams ...*TypeParam) *TypeDecl {
+	if debugInstr {
+		log.Println("SetTypeParams", p.typ.Obj().Name(), tparams)
+	}
+	if p.spec.Type != nil || p.spec.TypeParams != nil {
+		log.Panicln("SetTypeParams: type already defined -", p.typ)
+	}
+	setTypeParams(pkg, p.typ, p.spec, tparams)
+	return p
+}
+
+// InitType initializes a uncompleted type. If `tparams` is specified, the
+// type is generic (see also SetTypeParams).
 func (p *TypeDecl) InitType(pkg *Package, typ types.Type, tparams ...*TypeParam) *types.Named {
 	if debugInstr {
 		log.Println("InitType", p.typ.Obj().Name(), typ)
@@ -105,11 +124,36 @@ func (p *TypeDecl) InitType(pkg *Package, typ types.Type, tparams ...*TypeParam)
 	} else {
 		p.typ.SetUnderlying(typ)
 	}
-	setTypeParams(pkg, p.typ, spec, tparams)
+	if spec.TypeParams == nil {
+		setTypeParams(pkg, p.typ, spec, tparams)
+	} else if len(tparams) > 0 {
+		log.Panicln("InitType: type params already set -", p.typ)
+	}
 	spec.Type = toType(pkg, typ)
 	return p.typ
 }
 
+// NewMethod declares a method `name` of this type with the signature `sig`
+// (whose receiver is ignored), and starts its body. The receiver is named `p`,
+// and its type is *T if `ptrRecv` is true, or T otherwise. The method is added
+// to the method set of this type. Use CodeBuilder.Func to get the method.
+func (p *TypeDecl) NewMethod(pkg *Package, name string, sig *types.Signature, ptrRecv bool, src ...ast.Node) *CodeBuilder {
+	if debugInstr {
+		log.Println("NewMethod", p.typ.Obj().Name(), name, ptrRecv)
+	}
+	var typ types.Type = p.typ
+	if ptrRecv {
+		typ = types.NewPointer(typ)
+	}
+	recv := pkg.NewParam(token.NoPos, "p", typ)
+	sig = types.NewSignatureType(recv, nil, nil, sig.Params(), sig.Results(), sig.Variadic())
+	fn, err := pkg.NewFuncWith(getPos(src), name, sig, nil)
+	if err != nil {
+		panic(err)
+	}
+	return fn.BodyStart(pkg, src...)
+}
+
 // ----------------------------------------------------------------------------
 
 // TypeDefs represents a type declaration block.
@@ -246,7 +290,8 @@ type ValueDecl struct {
 	vals  *[]ast.Expr
 	tok   token.Token
 	pos   token.Pos
-	at    int // commitStmt(at)
+	at    int            // commitStmt(at)
+	spec  *ast.ValueSpec // nil for `a, b := expr`
 }
 
 // Inited checkes if `InitStart` is called or not.
@@ -261,6 +306,51 @@ func (p *ValueDecl) InitStart(pkg *Package) *CodeBuilder {
 	return &pkg.cb
 }
 
+// SetComments sets associated documentation of the spec (like `// doc` in
+// `var (\n// doc\na int\n)`).
+func (p *ValueDecl) SetComments(pkg *Package, doc *ast.CommentGroup) *ValueDecl {
+	if p.spec != nil {
+		p.spec.Doc = doc
+		for _, name := range p.names {
+			if o := p.scope.Lookup(name); o != nil && name != "_" {
+				pkg.setDoc(o, doc)
+			}
+		}
+	}
+	return p
+}
+
+// SetLineComment sets the comment at the end of the spec (like `// comment`
+// in `a int // comment`). Like a doc comment starting with "\n", it usually
+// starts with a blank, as the comment is printed as is.
+func (p *ValueDecl) SetLineComment(comment *ast.CommentGroup) *ValueDecl {
+	if p.spec != nil {
+		p.spec.Comment = comment
+	}
+	return p
+}
+
+// Names returns names of the variables or constants declared by the spec.
+func (p *ValueDecl) Names() []string {
+	return p.names
+}
+
+// AddNames adds variables with `names` to the spec, so that `var a int`
+// becomes `var a, b, c int`. The spec must declare uninitialized variables
+// of an explicit type. See ConstDefs.AddNames for constants.
+func (p *ValueDecl) AddNames(pkg *Package, names ...string) *ValueDecl {
+	if debugInstr {
+		log.Println("AddNames", names)
+	}
+	if p.spec == nil || p.tok != token.VAR || p.typ == nil || p.spec.Values != nil {
+		log.Panicln("AddNames: can't add variables to", p.names)
+	}
+	idents := pkg.newValueNames(p.scope, p.pos, p.tok, p.typ, names)
+	p.spec.Names = append(p.spec.Names, idents...)
+	p.names = append(p.names[:len(p.names):len(p.names)], names...)
+	return p
+}
+
 func (p *ValueDecl) Ref(name string) Ref {
 	return p.scope.Lookup(name)
 }
@@ -355,6 +445,16 @@ func (p *ValueDecl) endInit(cb *CodeBuilder, arity int) *ValueDecl {
 			}
 		} else if typ == nil {
 			var retType = rets[i].Type
+			if retType == types.Typ[types.UntypedNil] {
+				pos, at := getSrcPos(rets[i].Src), "variable declaration"
+				if pos == token.NoPos {
+					pos = p.pos
+				}
+				if p.tok == token.DEFINE {
+					at = "assignment"
+				}
+				cb.panicCodeErrorf(pos, "use of untyped nil in %s", at)
+			}
 			var parg *Element
 			if values != nil {
 				parg = &Element{Type: retType, Val: values[i]}
@@ -402,7 +502,28 @@ func (p *Package) newValueDecl(
 	}
 	// var a, b = expr
 	// const a, b = expr
-	nameIdents := make([]*ast.Ident, n)
+	spec.Names = p.newValueNames(scope, pos, tok, typ, names)
+	if typ != nil {
+		if ut, ok := typ.(*unboundType); ok && ut.tBound == nil {
+			ut.ptypes = append(ut.ptypes, &spec.Type)
+		} else {
+			spec.Type = toType(p, typ)
+		}
+	}
+	decl := &ValueDecl{
+		typ: typ, names: names, tok: tok, pos: pos, scope: scope, vals: &spec.Values, at: spec.at,
+		spec: spec.ValueSpec}
+	if tok == token.VAR && scope == p.Types.Scope() {
+		p.varDecls = append(p.varDecls, decl)
+	}
+	return decl
+}
+
+// newValueNames creates idents of `names`. Variables with an explicit `typ`
+// are declared here, others are declared at EndInit.
+func (p *Package) newValueNames(
+	scope *types.Scope, pos token.Pos, tok token.Token, typ types.Type, names []string) []*ast.Ident {
+	nameIdents := make([]*ast.Ident, len(names))
 	for i, name := range names {
 		nameIdents[i] = ident(name)
 		if name == "_" { // skip underscore
@@ -419,16 +540,7 @@ func (p *Package) newValueDecl(
 			}
 		}
 	}
-	spec.Names = nameIdents
-	if typ != nil {
-		if ut, ok := typ.(*unboundType); ok && ut.tBound == nil {
-			ut.ptypes = append(ut.ptypes, &spec.Type)
-		} else {
-			spec.Type = toType(p, typ)
-		}
-	}
-	return &ValueDecl{
-		typ: typ, names: names, tok: tok, pos: pos, scope: scope, vals: &spec.Values, at: spec.at}
+	return nameIdents
 }
 
 func (p *Package) newValueDefs(scope *types.Scope, tok token.Token) *valueDefs {
@@ -543,6 +655,21 @@ func (p *valueDefs) NewPos() ValueAt {
 	return ValueAt{spec, p.at}
 }
 
+// InsertPos is like NewPos, but the spec is inserted before the i-th spec of
+// the declaration block (or appended if i is out of range), so that specs
+// can be ordered explicitly.
+func (p *valueDefs) InsertPos(i int) ValueAt {
+	decl := p.decl
+	if i < 0 || i >= len(decl.Specs) {
+		return p.NewPos()
+	}
+	spec := &ast.ValueSpec{}
+	decl.Specs = append(decl.Specs, nil)
+	copy(decl.Specs[i+1:], decl.Specs[i:])
+	decl.Specs[i] = spec
+	return ValueAt{spec, p.at}
+}
+
 // VarDefs represents a var declaration block.
 type VarDefs struct {
 	valueDefs
@@ -594,6 +721,8 @@ func (p *VarDefs) Delete(name string) error {
 				}
 				if len(vspec.Names) == 1 {
 					p.decl.Specs = append(p.decl.Specs[:i], p.decl.Specs[i+1:]...)
+					p.pkg.unrefPkgs(vspec.Type)
+					vspec.Names = nil // see InitOrder
 					return nil
 				}
 				vspec.Names = append(vspec.Names[:j], vspec.Names[j+1:]...)
@@ -612,8 +741,10 @@ type F = func(cb *CodeBuilder) int
 // ConstDefs represents a const declaration block.
 type ConstDefs struct {
 	valueDefs
-	typ types.Type
-	F   F
+	typ  types.Type
+	F    F
+	last *ast.ValueSpec // spec created by the last call to New, see AddNames
+	iota int            // iota of last
 }
 
 func constInitFn(cb *CodeBuilder, iotav int, fn F) int {
@@ -648,9 +779,97 @@ func (p *ConstDefs) NewAt(at ValueAt, fn F, iotav int, pos token.Pos, typ types.
 	n := constInitFn(cb, iotav, fn)
 	cb.EndInit(n)
 	p.F, p.typ = fn, typ
+	p.last, p.iota = at.ValueSpec, iotav
 	return p
 }
 
+// AddNames adds constants with `names` to the spec created by the last call
+// to New (or Add with `fn`), so that `const a = 1` becomes `const a, b = 1, 2`.
+// The values of the constants are given by the callback `fn`, which is called
+// with iota of the spec. It fails if Next is called after New, as specs
+// repeating values of the spec must have the same number of names.
+func (p *ConstDefs) AddNames(fn F, pos token.Pos, names ...string) *ConstDefs {
+	if debugInstr {
+		log.Println("AddNames", names)
+	}
+	spec := p.last
+	if spec == nil {
+		log.Panicln("AddNames: no const spec to add constants to")
+	}
+	pkg := p.pkg
+	cb := pkg.CB()
+	n := constInitFn(cb, p.iota, fn)
+	if len(names) != n {
+		if len(names) < n {
+			cb.panicCodeError(pos, "extra expression in const declaration")
+		}
+		cb.panicCodeError(pos, "missing value in const declaration")
+	}
+
+	ret := cb.stk.GetArgs(n)
+	defer cb.stk.PopN(n)
+
+	for i, name := range names {
+		typ := p.typ
+		if typ != nil {
+			if err := matchType(pkg, ret[i], typ, "assignment"); err != nil {
+				panic(err)
+			}
+		} else {
+			typ = ret[i].Type
+		}
+		if ret[i].CVal == nil {
+			src, _ := cb.loadExpr(ret[i].Src)
+			cb.panicCodeErrorf(pos, "const initializer %s is not a constant", src)
+		}
+		if name != "_" {
+			if old := p.scope.Insert(types.NewConst(pos, pkg.Types, name, typ, ret[i].CVal)); old != nil {
+				oldpos := cb.fset.Position(old.Pos())
+				cb.panicCodeErrorf(
+					pos, "%s redeclared in this block\n\tprevious declaration at %v", name, oldpos)
+			}
+		}
+		spec.Names = append(spec.Names, ident(name))
+		spec.Values = append(spec.Values, ret[i].Val)
+	}
+	if last := p.F; last != nil { // Next repeats all values of the spec
+		p.F = func(cb *CodeBuilder) int {
+			return last(cb) + fn(cb)
+		}
+	}
+	return p
+}
+
+// Iota returns the value of iota of the next spec created by New, Next or
+// Add, which is the number of specs in the declaration block.
+func (p *ConstDefs) Iota() int {
+	return len(p.decl.Specs)
+}
+
+// Add creates constants with specified `typ` (can be nil) and `names`, and
+// manages iota for them like:
+//
+//	const (
+//		a = iota // Add(fn, pos, nil, "a")
+//		b        // Add(nil, pos, nil, "b")
+//		c        // Add(nil, pos, nil, "c")
+//	)
+//
+// If `fn` is nil, the initializer is omitted and the last one is repeated,
+// and `typ` must be nil.
+func (p *ConstDefs) Add(fn F, pos token.Pos, typ types.Type, names ...string) *ConstDefs {
+	if fn != nil {
+		return p.New(fn, p.Iota(), pos, typ, names...)
+	}
+	if typ != nil {
+		p.pkg.cb.panicCodeError(pos, "const declaration cannot have type without expression")
+	}
+	if p.F == nil {
+		p.pkg.cb.panicCodeError(pos, "missing init expr for const declaration")
+	}
+	return p.Next(p.Iota(), pos, names...)
+}
+
 // Next creates constants with specified `names`.
 // The values of the constants are given by the callback `fn` which is
 // specified by the last call to `New`.
@@ -690,6 +909,7 @@ func (p *ConstDefs) NextAt(at ValueAt, fn F, iotav int, pos token.Pos, names ...
 		idents[i] = ident(name)
 	}
 	at.Names = idents
+	p.last = nil // specs repeating its values have the same number of names
 	return p
 }
 
@@ -16,12 +16,10 @@ package gox
 import (
 	"fmt"
 	"go/ast"
-	"go/constant"
 	"go/token"
 	"go/types"
 	"log"
 	"strings"
-	_ "unsafe"
 
 	"github.com/goplus/gox/internal"
 )
@@ -87,6 +85,16 @@ func isGenericType(typ types.Type) bool {
 	return false
 }
 
+// isGeneric checks if `typ` is a generic function or (the type of) a generic
+// type, which can be instantiated by Index.
+func (p *CodeBuilder) isGeneric(typ types.Type) bool {
+	if t, ok := typ.(*TypeType); ok {
+		typ = t.Type()
+	}
+	p.ensureLoaded(typ)
+	return isGenericType(typ)
+}
+
 func (p *CodeBuilder) inferType(nidx int, args []*internal.Elem, src ...ast.Node) *CodeBuilder {
 	typ := args[0].Type
 	var tt bool
@@ -107,9 +115,28 @@ func (p *CodeBuilder) inferType(nidx int, args []*internal.Elem, src ...ast.Node
 	targs := make([]types.Type, nidx)
 	indices := make([]ast.Expr, nidx)
 	for i := 0; i < nidx; i++ {
-		targs[i] = args[i+1].Type.(*TypeType).Type()
+		arg := args[i+1]
+		t, ok := arg.Type.(*TypeType)
+		if !ok {
+			src, pos := p.loadExpr(arg.Src)
+			if arg.Src == nil {
+				src, pos = types.ExprString(arg.Val), getSrcPos(srcExpr)
+			}
+			p.panicCodeErrorf(pos, "%s is not a type", src)
+		}
+		targs[i] = t.Type()
 		p.ensureLoaded(targs[i])
-		indices[i] = args[i+1].Val
+		indices[i] = arg.Val
+	}
+	var tparams *types.TypeParamList
+	if tt {
+		tparams = typ.(*types.Named).TypeParams()
+	} else {
+		tparams = typ.(*types.Signature).TypeParams()
+	}
+	if n := tparams.Len(); nidx > n || (tt && nidx < n) {
+		pos := getSrcPos(srcExpr)
+		p.panicCodeErrorf(pos, "got %d type arguments but %v has %d type parameters", nidx, typ, n)
 	}
 	var tyRet types.Type
 	var err error
@@ -209,53 +236,6 @@ func toNamedType(pkg *Package, t *types.Named) ast.Expr {
 	return expr
 }
 
-type operandMode byte
-
-//type builtinId int
-
-type operand struct {
-	mode operandMode
-	expr ast.Expr
-	typ  types.Type
-	val  constant.Value
-	//id   builtinId
-}
-
-const (
-	invalid   operandMode = iota // operand is invalid
-	novalue                      // operand represents no value (result of a function call w/o result)
-	builtin                      // operand is a built-in function
-	typexpr                      // operand is a type
-	constant_                    // operand is a constant; the operand's typ is a Basic type
-	variable                     // operand is an addressable variable
-	mapindex                     // operand is a map index expression (acts like a variable on lhs, commaok on rhs of an assignment)
-	value                        // operand is a computed value
-	commaok                      // like value, but operand may be used in a comma,ok expression
-	commaerr                     // like commaok, but second value is error, not boolean
-	cgofunc                      // operand is a cgo function
-)
-
-type positioner interface {
-	Pos() token.Pos
-}
-
-//go:linkname checker_infer go/types.(*Checker).infer
-func checker_infer(check *types.Checker, posn positioner, tparams []*types.TypeParam, targs []types.Type, params *types.Tuple, args []*operand) (result []types.Type)
-
-func infer(pkg *Package, posn positioner, tparams []*types.TypeParam, targs []types.Type, params *types.Tuple, args []*operand) (result []types.Type, err error) {
-	conf := &types.Config{
-		Error: func(e error) {
-			err = e
-			if terr, ok := e.(types.Error); ok {
-				err = fmt.Errorf("%s", terr.Msg)
-			}
-		},
-	}
-	checker := types.NewChecker(conf, pkg.Fset, pkg.Types, nil)
-	result = checker_infer(checker, posn, tparams, targs, params, args)
-	return
-}
-
 func getParamsTypes(pkg *Package, tuple *types.Tuple, variadic bool) string {
 	n := tuple.Len()
 	if n == 0 {
@@ -283,22 +263,13 @@ func checkInferArgs(pkg *Package, fn *internal.Elem, sig *types.Signature, args
 		if flags&InstrFlagEllipsis != 0 {
 			return args, nil
 		}
-		var typ types.Type
 		if nargs < nreq {
-			typ = sig.Params().At(nreq - 1).Type()
-			elem := typ.(*types.Slice).Elem()
+			elem := sig.Params().At(nreq - 1).Type().(*types.Slice).Elem()
 			if t, ok := elem.(*types.TypeParam); ok {
 				return nil, fmt.Errorf("cannot infer %v (%v)", elem, pkg.cb.fset.Position(t.Obj().Pos()))
 			}
-		} else {
-			typ = types.NewSlice(types.Default(args[nreq-1].Type))
-		}
-		res := make([]*internal.Elem, nreq)
-		for i := 0; i < nreq-1; i++ {
-			res[i] = args[i]
 		}
-		res[nreq-1] = &internal.Elem{Type: typ}
-		return res, nil
+		return args, nil // arguments of the variadic parameter are inferred one by one
 	} else if nreq != nargs {
 		fewOrMany := "not enough"
 		if nargs > nreq {
@@ -316,22 +287,8 @@ func inferFunc(pkg *Package, fn *internal.Elem, sig *types.Signature, targs []ty
 	if err != nil {
 		return nil, err
 	}
-	xlist := make([]*operand, len(args))
-	for i, arg := range args {
-		xlist[i] = &operand{
-			mode: value,
-			expr: arg.Val,
-			typ:  arg.Type,
-			val:  arg.CVal,
-		}
-	}
-	tp := sig.TypeParams()
-	n := tp.Len()
-	tparams := make([]*types.TypeParam, n)
-	for i := 0; i < n; i++ {
-		tparams[i] = tp.At(i)
-	}
-	targs, err = infer(pkg, fn.Val, tparams, targs, sig.Params(), xlist)
+	variadic := sig.Variadic() && flags&InstrFlagEllipsis == 0
+	targs, err = infer(pkg, typeParamsOf(sig), targs, sig.Params(), args, variadic)
 	if err != nil {
 		return nil, err
 	}
@@ -339,17 +296,21 @@ func inferFunc(pkg *Package, fn *internal.Elem, sig *types.Signature, targs []ty
 }
 
 func inferFuncTargs(pkg *Package, fn *internal.Elem, sig *types.Signature, targs []types.Type) (types.Type, error) {
+	targs, err := infer(pkg, typeParamsOf(sig), targs, nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return types.Instantiate(pkg.cb.ctxt, sig, targs, true)
+}
+
+func typeParamsOf(sig *types.Signature) []*types.TypeParam {
 	tp := sig.TypeParams()
 	n := tp.Len()
 	tparams := make([]*types.TypeParam, n)
 	for i := 0; i < n; i++ {
 		tparams[i] = tp.At(i)
 	}
-	targs, err := infer(pkg, fn.Val, tparams, targs, nil, nil)
-	if err != nil {
-		return nil, err
-	}
-	return types.Instantiate(pkg.cb.ctxt, sig, targs, true)
+	return tparams
 }
 
 func funcHasTypeParams(t *types.Signature) bool {
@@ -737,3 +737,337 @@ func main() {
 }
 `)
 }
+
+func TestGenTypeParamsSelfRef(t *testing.T) {
+	pkg := newMainPackage()
+	tp := types.NewTypeParam(types.NewTypeName(token.NoPos, pkg.Types, "T", nil), types.NewInterfaceType(nil, nil))
+	decl := pkg.NewType("List").SetTypeParams(pkg, tp)
+	self, err := types.Instantiate(nil, decl.Type(), []types.Type{tp}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decl.InitType(pkg, types.NewStruct([]*types.Var{
+		types.NewField(token.NoPos, pkg.Types, "next", types.NewPointer(self), false),
+		types.NewField(token.NoPos, pkg.Types, "val", tp, false),
+	}, nil))
+	inst, err := types.Instantiate(nil, decl.Type(), []types.Type{types.Typ[types.Int]}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		DefineVarStart(token.NoPos, "l").Val(1).Val(100).StructLit(inst, 2, true).EndInit(1).
+		Val(pkg.Builtin().Ref("println")).Val(ctxRef(pkg, "l")).MemberVal("next").MemberVal("val").Call(1).EndStmt().
+		End()
+	domTest(t, pkg, `package main
+
+type List[T interface {
+}] struct {
+	next *List[T]
+	val  T
+}
+
+func main() {
+	l := List[int]{val: 100}
+	println(l.next.val)
+}
+`)
+}
+
+func TestGenTypeParamsMultiIndex(t *testing.T) {
+	pkg := newMainPackage()
+	comparable := types.Universe.Lookup("comparable").Type()
+	any := types.Universe.Lookup("any").Type()
+	kp := types.NewTypeParam(types.NewTypeName(token.NoPos, pkg.Types, "K", nil), comparable)
+	vp := types.NewTypeParam(types.NewTypeName(token.NoPos, pkg.Types, "V", nil), any)
+	pair := pkg.NewType("Pair").InitType(pkg, types.NewStruct([]*types.Var{
+		types.NewField(token.NoPos, pkg.Types, "k", kp, false),
+		types.NewField(token.NoPos, pkg.Types, "v", vp, false),
+	}, nil), kp, vp)
+	tp1 := types.NewTypeParam(types.NewTypeName(token.NoPos, pkg.Types, "K", nil), comparable)
+	tp2 := types.NewTypeParam(types.NewTypeName(token.NoPos, pkg.Types, "V", nil), any)
+	params := types.NewTuple(types.NewParam(token.NoPos, pkg.Types, "k", tp1), types.NewParam(token.NoPos, pkg.Types, "v", tp2))
+	sig := types.NewSignatureType(nil, nil, []*types.TypeParam{tp1, tp2}, params, nil, false)
+	fn := pkg.NewFuncDecl(token.NoPos, "F", sig)
+	fn.BodyStart(pkg).End()
+	tyInt := types.Typ[types.Int]
+	tyString := types.Typ[types.String]
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		Val(fn).Typ(tyInt).Typ(tyString).Index(2, false).Val(1).Val("a").Call(2).EndStmt().
+		DefineVarStart(token.NoPos, "p").Typ(pair).Typ(tyInt).Typ(tyString).Index(2, false).Star().Val(nil).Call(1).EndInit(1).
+		End()
+	domTest(t, pkg, `package main
+
+type Pair[K comparable, V any] struct {
+	k K
+	v V
+}
+
+func F[K comparable, V any](k K, v V) {
+}
+func main() {
+	F[int, string](1, "a")
+	p := (*Pair[int, string])(nil)
+}
+`)
+}
+
+func TestTypeParamErrMultiIndex(t *testing.T) {
+	tyInt := types.Typ[types.Int]
+	tySlice := types.NewSlice(tyInt)
+	newPkg := func() (pkg *gox.Package, pair *types.Named, fn *gox.Func) {
+		pkg = newMainPackage()
+		comparable := types.Universe.Lookup("comparable").Type()
+		any := types.Universe.Lookup("any").Type()
+		kp := types.NewTypeParam(types.NewTypeName(token.NoPos, pkg.Types, "K", nil), comparable)
+		vp := types.NewTypeParam(types.NewTypeName(token.NoPos, pkg.Types, "V", nil), any)
+		pair = pkg.NewType("Pair").InitType(pkg, types.NewStruct(nil, nil), kp, vp)
+		tp1 := types.NewTypeParam(types.NewTypeName(token.NoPos, pkg.Types, "K", nil), comparable)
+		tp2 := types.NewTypeParam(types.NewTypeName(token.NoPos, pkg.Types, "V", nil), any)
+		sig := types.NewSignatureType(nil, nil, []*types.TypeParam{tp1, tp2}, nil, nil, false)
+		fn = pkg.NewFuncDecl(token.NoPos, "F", sig)
+		fn.BodyStart(pkg).End()
+		return
+	}
+
+	pkg, pair, _ := newPkg()
+	codeErrorTestEx(t, pkg, `./foo.gop:5:40: got 1 type arguments but Pair[K comparable, V any] has 2 type parameters`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				DefineVarStart(0, "v1").Typ(pair).Typ(tyInt).Index(1, false, source(`Pair[int]`, 5, 40)).Star().Val(nil).Call(1).EndInit(1).
+				End()
+		})
+	pkg, _, fn := newPkg()
+	codeErrorTestEx(t, pkg, `./foo.gop:5:40: got 3 type arguments but func[K comparable, V any]() has 2 type parameters`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				Val(fn).Typ(tyInt).Typ(tyInt).Typ(tyInt).Index(3, false, source(`F[int, int, int]`, 5, 40)).Call(0).EndStmt().
+				End()
+		})
+	pkg, _, fn = newPkg()
+	codeErrorTestEx(t, pkg, `./foo.gop:5:40: 1 is not a type`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				Val(fn).Typ(tyInt).Val(1).Index(2, false, source(`F[int, 1]`, 5, 40)).Call(0).EndStmt().
+				End()
+		})
+	pkg, _, fn = newPkg()
+	codeErrorTestEx(t, pkg, `./foo.gop:5:40: []int does not satisfy comparable`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				Val(fn).Typ(tySlice).Typ(tyInt).Index(2, false, source(`F[[]int, int]`, 5, 40)).Call(0).EndStmt().
+				End()
+		})
+	pkg = newMainPackage()
+	codeErrorTestEx(t, pkg, `./foo.gop:5:40: invalid operation: more than one index`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(tySlice, "a").
+				VarVal("a").Val(1).Val(2).Index(2, false, source(`a[1, 2]`, 5, 40)).EndStmt().
+				End()
+		})
+}
+
+func TestTypeParamsInferCall(t *testing.T) {
+	const src = `package foo
+
+func At[T interface{ ~[]E }, E any](x T, i int) E {
+	return x[i]
+}
+
+func Max[T ~int | float64](a, b T) T {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func Keys[K comparable, V any](m map[K]V) []K {
+	return nil
+}
+
+func Apply[T any, R any](v T, fn func(T) R) R {
+	return fn(v)
+}
+
+type Int []int
+var MyInts = Int{1,2,3,4}
+`
+	gt := newGoxTest()
+	_, err := gt.LoadGoPackage("foo", "foo.go", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := gt.NewPackage("", "main")
+	pkgRef := pkg.Import("foo")
+	fnAt := pkgRef.Ref("At")
+	fnMax := pkgRef.Ref("Max")
+	fnKeys := pkgRef.Ref("Keys")
+	fnApply := pkgRef.Ref("Apply")
+	myInts := pkgRef.Ref("MyInts")
+	tyInt := types.Typ[types.Int]
+	tyString := types.Typ[types.String]
+	tyMap := types.NewMap(tyString, tyInt)
+	tyFn := types.NewSignatureType(nil, nil, nil,
+		types.NewTuple(types.NewParam(token.NoPos, pkg.Types, "v", tyInt)),
+		types.NewTuple(types.NewParam(token.NoPos, pkg.Types, "", tyString)), false)
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVar(tyFn, "fn").
+		NewVarStart(tyInt, "a").Val(fnAt).Val(myInts).Val(0).Call(2).EndInit(1).
+		NewVarStart(types.Typ[types.Float64], "b").Val(fnMax).Val(1).Val(2.5).Call(2).EndInit(1).
+		NewVarStart(types.NewSlice(tyString), "c").Val(fnKeys).Typ(tyMap).Val(nil).Call(1).Call(1).EndInit(1).
+		NewVarStart(tyString, "d").Val(fnApply).Val(1).VarVal("fn").Call(2).EndInit(1).
+		End()
+	domTest(t, pkg, `package main
+
+import "foo"
+
+func main() {
+	var fn func(v int) string
+	var a int = foo.At(foo.MyInts, 0)
+	var b float64 = foo.Max(1, 2.5)
+	var c []string = foo.Keys(map[string]int(nil))
+	var d string = foo.Apply(1, fn)
+}
+`)
+}
+
+func TestTypeParamsErrorInferMismatch(t *testing.T) {
+	const src = `package foo
+
+func Max[T ~int | float64](a, b T) T {
+	if a > b {
+		return a
+	}
+	return b
+}
+`
+	gt := newGoxTest()
+	_, err := gt.LoadGoPackage("foo", "foo.go", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := gt.NewPackage("", "main")
+	pkgRef := pkg.Import("foo")
+	fnMax := pkgRef.Ref("Max")
+	tyInt := types.Typ[types.Int]
+	tyFloat := types.Typ[types.Float64]
+	codeErrorTestEx(t, pkg, `./foo.gop:5:40: type float64 of y does not match inferred type int for T`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(tyInt, "x").NewVar(tyFloat, "y").
+				Val(fnMax, source("foo.Max", 5, 40)).VarVal("x").VarVal("y").CallWith(2, 0, source("foo.Max(x, y)", 5, 40)).EndStmt().
+				End()
+		})
+}
+
+func TestTypeParamsInferVariadic(t *testing.T) {
+	const src = `package foo
+
+func List[T any](xs ...T) []T {
+	return xs
+}
+`
+	gt := newGoxTest()
+	_, err := gt.LoadGoPackage("foo", "foo.go", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := gt.NewPackage("", "main")
+	fnList := pkg.Import("foo").Ref("List")
+	tyStrings := types.NewSlice(types.Typ[types.String])
+	pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+		NewVar(tyStrings, "s").
+		NewVarStart(types.NewSlice(types.Typ[types.Float64]), "a").Val(fnList).Val(1).Val(2.5).Call(2).EndInit(1).
+		NewVarStart(types.NewSlice(gox.TyRune), "b").Val(fnList).Val(1).Val('x').Call(2).EndInit(1).
+		NewVarStart(tyStrings, "c").Val(fnList).VarVal("s").CallWith(1, gox.InstrFlagEllipsis).EndInit(1).
+		End()
+	domTest(t, pkg, `package main
+
+import "foo"
+
+func main() {
+	var s []string
+	var a []float64 = foo.List(1, 2.5)
+	var b []rune = foo.List(1, 'x')
+	var c []string = foo.List(s...)
+}
+`)
+}
+
+func TestTypeParamsErrorInferVariadic(t *testing.T) {
+	const src = `package foo
+
+func List[T any](xs ...T) []T {
+	return xs
+}
+`
+	gt := newGoxTest()
+	_, err := gt.LoadGoPackage("foo", "foo.go", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := gt.NewPackage("", "main")
+	fnList := pkg.Import("foo").Ref("List")
+	tyInt := types.Typ[types.Int]
+	tyFloat := types.Typ[types.Float64]
+	codeErrorTestEx(t, pkg, `./foo.gop:5:40: type float64 of y does not match inferred type int for T`,
+		func(pkg *gox.Package) {
+			pkg.NewFunc(nil, "main", nil, nil, false).BodyStart(pkg).
+				NewVar(tyInt, "x").NewVar(tyFloat, "y").
+				Val(fnList, source("foo.List", 5, 40)).VarVal("x").Val(1).VarVal("y").CallWith(3, 0, source("foo.List(x, 1, y)", 5, 40)).EndStmt().
+				End()
+		})
+}
+
+func TestInterfaceBuilder(t *testing.T) {
+	pkg := newMainPackage()
+	tyInt := types.Typ[types.Int]
+	tyString := types.Typ[types.String]
+	sigString := types.NewSignatureType(nil, nil, nil, nil, types.NewTuple(pkg.NewParam(token.NoPos, "", tyString)), false)
+	stringer := pkg.NewType("Stringer").InitType(pkg, pkg.NewInterfaceBuilder().Method("String", sigString).Type())
+	number := pkg.NewType("Number").InitType(pkg, pkg.NewInterfaceBuilder().
+		Union(types.NewTerm(true, tyInt), types.NewTerm(true, types.Typ[types.Float64])).Type())
+	iface := pkg.NewInterfaceBuilder().
+		Embed(number).
+		Embed(stringer).
+		Method("Get", types.NewSignatureType(nil, nil, nil, nil, types.NewTuple(pkg.NewParam(token.NoPos, "", tyInt)), false)).
+		Type()
+	tp := types.NewTypeParam(types.NewTypeName(token.NoPos, pkg.Types, "T", nil), iface)
+	sig := types.NewSignatureType(nil, nil, []*types.TypeParam{tp}, types.NewTuple(pkg.NewParam(token.NoPos, "v", tp)), nil, false)
+	pkg.NewFuncDecl(token.NoPos, "Print", sig).BodyStart(pkg).End()
+	tp2 := types.NewTypeParam(types.NewTypeName(token.NoPos, pkg.Types, "T", nil), pkg.NewInterfaceBuilder().Union(types.NewTerm(false, tyString)).Type())
+	sig2 := types.NewSignatureType(nil, nil, []*types.TypeParam{tp2}, types.NewTuple(pkg.NewParam(token.NoPos, "v", tp2)), nil, false)
+	pkg.NewFuncDecl(token.NoPos, "Str", sig2).BodyStart(pkg).End()
+	domTest(t, pkg, `package main
+
+type Stringer interface {
+	String() string
+}
+type Number interface {
+	~int | ~float64
+}
+
+func Print[T interface {
+	Number
+	Stringer
+	Get() int
+}](v T) {
+}
+func Str[T interface {
+	string
+}](v T) {
+}
+`)
+}
+
+func TestInterfaceBuilderErr(t *testing.T) {
+	pkg := newMainPackage()
+	tyInt := types.Typ[types.Int]
+	sig := types.NewSignatureType(nil, nil, nil, nil, nil, false)
+	named := pkg.NewType("MyInt").InitType(pkg, tyInt)
+	stringer := pkg.NewInterfaceBuilder().Method("String", sig).Type()
+	safeRun(t, func() { pkg.NewInterfaceBuilder().Method("Get", sig).Method("Get", sig) })
+	safeRun(t, func() { pkg.NewInterfaceBuilder().Union() })
+	safeRun(t, func() { pkg.NewInterfaceBuilder().Union(types.NewTerm(true, named)) })
+	safeRun(t, func() { pkg.NewInterfaceBuilder().Union(types.NewTerm(false, tyInt), types.NewTerm(false, stringer)) })
+}